@@ -0,0 +1,53 @@
+// Package archive packs a store into a single, deduplicated backup file.
+//
+// An archive holds each unique block of the store once, followed by a table
+// of contents describing the tree and where each block may be found:
+//
+//	MAGIC
+//	block data...
+//	table of contents (JSON)
+//	trailer: table of contents offset and length (big-endian int64), MAGIC
+//
+// An opened Archive is itself an fs.BlockStore, so it may serve as the
+// source of a patch plan, or be published by a remote.Server.
+//
+// The manifest in the table of contents, a list of Entry built with
+// NewManifest and rebuilt into a tree with NewRepo, describes a tree
+// without its data. It is not particular to archives: remote servers send
+// it as their tree, a spool stages it for a push, and sync.Check compares
+// destinations against it.
+package archive
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+// Marks the start and end of an archive file.
+const MAGIC string = "RPLARC01"
+
+const trailerSize int64 = 8 + 8 + int64(len(MAGIC))
+
+// Locate the data for a block in the archive.
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+// The table of contents for an archive.
+type Toc struct {
+	Manifest []*Entry
+	Index    map[string]*Extent
+}
+
+type trailer struct {
+	TocOffset int64
+	TocLength int64
+	Magic     [8]byte
+}
+
+func badArchive(msg string) os.Error {
+	return os.NewError("Not a valid archive: " + msg)
+}
+
+var byteOrder = binary.BigEndian
@@ -0,0 +1,269 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func mkArchive(t *testing.T) (string, fs.LocalStore, string) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.D("baz",
+			tg.F("dup", tg.B(42, 65537)),
+			tg.F("small", tg.B(7, 100))))
+
+	path := treegen.TestTree(t, treeSpec)
+	store, err := fs.NewLocalStore(path, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	archiveF, err := ioutil.TempFile("", "archive")
+	assert.T(t, err == nil)
+	archiveF.Close()
+
+	err = Create(archiveF.Name(), store)
+	assert.Tf(t, err == nil, "%v", err)
+
+	return path, store, archiveF.Name()
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	path, store, archivePath := mkArchive(t)
+	defer os.RemoveAll(path)
+	defer os.Remove(archivePath)
+
+	archive, err := Open(archivePath)
+	assert.Tf(t, err == nil, "%v", err)
+	defer archive.Close()
+
+	assert.Equal(t,
+		store.Repo().Root().(fs.Dir).Info().Strong,
+		archive.Root().(fs.Dir).Info().Strong)
+
+	// Duplicate file content is only stored once
+	bar, has := fs.Lookup(store.Repo().Root().(fs.Dir), filepath.Join("foo", "bar"))
+	assert.T(t, has)
+	assert.Equal(t, len(bar.(fs.File).Blocks())+1, len(archive.Toc().Index))
+
+	node, has := fs.Lookup(archive.Root().(fs.Dir), filepath.Join("foo", "baz", "dup"))
+	assert.T(t, has)
+	file := node.(fs.File)
+
+	for _, block := range file.Blocks() {
+		buf, err := archive.ReadBlock(block.Info().Strong)
+		assert.Tf(t, err == nil, "%v", err)
+		assert.Equal(t, block.Info().Strong, fs.StrongChecksum(buf))
+	}
+
+	buf := &bytes.Buffer{}
+	n, err := archive.ReadInto(file.Info().Strong, 0, file.Info().Size, buf)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, file.Info().Size, n)
+	assert.Equal(t, file.Info().Strong, fs.StrongChecksum(buf.Bytes()))
+
+	// Ranges spanning block boundaries
+	expect := &bytes.Buffer{}
+	_, err = store.ReadInto(file.Info().Strong, 8000, 10000, expect)
+	assert.T(t, err == nil)
+	buf.Reset()
+	n, err = archive.ReadInto(file.Info().Strong, 8000, 10000, buf)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(10000), n)
+	assert.Equal(t, expect.Bytes(), buf.Bytes())
+}
+
+func TestArchiveInvalid(t *testing.T) {
+	f, err := ioutil.TempFile("", "archive")
+	assert.T(t, err == nil)
+	defer os.Remove(f.Name())
+	f.WriteString("not an archive at all, no sir")
+	f.Close()
+
+	_, err = Open(f.Name())
+	assert.T(t, err != nil)
+}
+
+func TestArchiveVolumes(t *testing.T) {
+	path, store, archivePath := mkArchive(t)
+	defer os.RemoveAll(path)
+	defer os.Remove(archivePath)
+
+	volumes, err := CreateVolumes(archivePath, store, 10000)
+	assert.Tf(t, err == nil, "%v", err)
+	for _, volume := range volumes {
+		defer os.Remove(volume)
+	}
+	assert.T(t, len(volumes) > 1)
+
+	archive, err := OpenVolumes(archivePath)
+	assert.Tf(t, err == nil, "%v", err)
+	defer archive.Close()
+
+	assert.Equal(t,
+		store.Repo().Root().(fs.Dir).Info().Strong,
+		archive.Root().(fs.Dir).Info().Strong)
+
+	node, has := fs.Lookup(archive.Root().(fs.Dir), filepath.Join("foo", "bar"))
+	assert.T(t, has)
+	file := node.(fs.File)
+
+	// Blocks straddle volume boundaries
+	buf := &bytes.Buffer{}
+	n, err := archive.ReadInto(file.Info().Strong, 0, file.Info().Size, buf)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, file.Info().Size, n)
+	assert.Equal(t, file.Info().Strong, fs.StrongChecksum(buf.Bytes()))
+}
+
+func damage(t *testing.T, path string, offset int64) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	assert.T(t, err == nil)
+	defer f.Close()
+	_, err = f.WriteAt([]byte("damage"), offset)
+	assert.T(t, err == nil)
+}
+
+func TestArchiveRepair(t *testing.T) {
+	path, store, archivePath := mkArchive(t)
+	defer os.RemoveAll(path)
+	defer os.Remove(archivePath)
+
+	parityPath, err := CreateParity(archivePath, 4096, 4)
+	assert.Tf(t, err == nil, "%v", err)
+	defer os.Remove(parityPath)
+
+	// Nothing to repair
+	repaired, err := Repair(archivePath)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, 0, len(repaired))
+
+	// One damaged shard in each of two groups
+	damage(t, archivePath, 5000)
+	damage(t, archivePath, 4*4096+100)
+
+	repaired, err = Repair(archivePath)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, []int{1, 4}, repaired)
+
+	archive, err := Open(archivePath)
+	assert.Tf(t, err == nil, "%v", err)
+	defer archive.Close()
+
+	node, has := fs.Lookup(archive.Root().(fs.Dir), filepath.Join("foo", "bar"))
+	assert.T(t, has)
+	file := node.(fs.File)
+
+	buf := &bytes.Buffer{}
+	_, err = archive.ReadInto(file.Info().Strong, 0, file.Info().Size, buf)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, file.Info().Strong, fs.StrongChecksum(buf.Bytes()))
+
+	// Two damaged shards in the same group are beyond repair
+	damage(t, archivePath, 100)
+	damage(t, archivePath, 3*4096+100)
+
+	_, err = Repair(archivePath)
+	assert.T(t, err != nil)
+	assert.Equal(t, store.Repo().Root().(fs.Dir).Info().Strong, archive.Root().(fs.Dir).Info().Strong)
+}
+
+// Write a parity file describing the parity given, which need not be
+// consistent.
+func writeParityFile(t *testing.T, path string, parity []byte, info *ParityInfo) {
+	buf := &bytes.Buffer{}
+	buf.WriteString(PARITY_MAGIC)
+	buf.Write(parity)
+
+	infoBytes, err := json.Marshal(info)
+	assert.T(t, err == nil)
+	tr := &trailer{TocOffset: int64(buf.Len()), TocLength: int64(len(infoBytes))}
+	copy(tr.Magic[:], PARITY_MAGIC)
+	buf.Write(infoBytes)
+	buf.WriteString(fs.StrongChecksum(infoBytes))
+	assert.T(t, binary.Write(buf, byteOrder, tr) == nil)
+
+	assert.T(t, ioutil.WriteFile(path, buf.Bytes(), 0644) == nil)
+}
+
+func TestParityRefusesBadInfo(t *testing.T) {
+	path, _, archivePath := mkArchive(t)
+	defer os.RemoveAll(path)
+	defer os.Remove(archivePath)
+
+	parityPath, err := CreateParity(archivePath, 4096, 4)
+	assert.Tf(t, err == nil, "%v", err)
+	defer os.Remove(parityPath)
+
+	parF, err := os.Open(parityPath)
+	assert.T(t, err == nil)
+	info, err := readParityInfo(parF)
+	parF.Close()
+	assert.Tf(t, err == nil, "%v", err)
+
+	// A damaged description fails its checksum
+	fi, err := os.Stat(parityPath)
+	assert.T(t, err == nil)
+	damage(t, parityPath, fi.Size-trailerSize-60)
+	_, err = Repair(archivePath)
+	assert.T(t, err != nil)
+
+	// Descriptions which do not hold together are refused, however
+	// well they are checksummed
+	parity := make([]byte, int64(info.groups())*info.ShardSize)
+	bad := []func(info *ParityInfo){
+		func(info *ParityInfo) { info.GroupSize = 0 },
+		func(info *ParityInfo) { info.ShardSize = 0 },
+		func(info *ParityInfo) { info.ShardSize = MAX_SHARD_SIZE + 1 },
+		func(info *ParityInfo) { info.Size = -1 },
+		func(info *ParityInfo) { info.Shards = info.Shards[1:] },
+		func(info *ParityInfo) { info.Parity = info.Parity[1:] },
+		func(info *ParityInfo) { info.GroupSize = 1 }}
+	for i, breakInfo := range bad {
+		broken := *info
+		breakInfo(&broken)
+		writeParityFile(t, parityPath, parity, &broken)
+		_, err = Repair(archivePath)
+		assert.Tf(t, err != nil, "%d", i)
+	}
+
+	// A consistent one is not
+	writeParityFile(t, parityPath, parity, info)
+	parF, err = os.Open(parityPath)
+	assert.T(t, err == nil)
+	_, err = readParityInfo(parF)
+	parF.Close()
+	assert.Tf(t, err == nil, "%v", err)
+}
+
+func TestManifestTraversal(t *testing.T) {
+	path, store, archivePath := mkArchive(t)
+	defer os.RemoveAll(path)
+	defer os.Remove(archivePath)
+
+	manifest := NewManifest(store.Repo().Root())
+	_, err := NewRepo(manifest)
+	assert.Tf(t, err == nil, "%v", err)
+
+	for _, badPath := range []string{
+		"..",
+		filepath.Join("foo", "..", "..", "etc"),
+		string(filepath.Separator) + "etc",
+		filepath.Join("foo", "."),
+		filepath.Join("foo", "bar\x00"),
+		filepath.Join("foo", `ba\r`)} {
+		bad := append(append([]*Entry{}, manifest...),
+			&Entry{Path: badPath, Strong: manifest[1].Strong})
+		_, err = NewRepo(bad)
+		assert.Tf(t, err != nil, "%q accepted", badPath)
+	}
+}
@@ -0,0 +1,98 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// Describe a directory or file in a tree.
+// Entries are listed parents before children, so a tree can be rebuilt
+// from them in one pass.
+type Entry struct {
+	Path   string
+	IsDir  bool
+	Mode   uint32
+	Size   int64
+	Strong string
+	Blocks []*fs.BlockInfo
+}
+
+// Describe a tree as a list of entries, in the order of fs.Walk.
+// The manifest holds everything needed to plan a patch from the tree,
+// without its data.
+func NewManifest(root fs.FsNode) []*Entry {
+	manifest := []*Entry{}
+
+	fs.Walk(root, func(node fs.Node) bool {
+		switch n := node.(type) {
+		case fs.Dir:
+			manifest = append(manifest, &Entry{
+				Path:   fs.RelPath(n),
+				IsDir:  true,
+				Mode:   n.Mode(),
+				Strong: n.Info().Strong})
+			return true
+
+		case fs.File:
+			entry := &Entry{
+				Path:   fs.RelPath(n),
+				Mode:   n.Mode(),
+				Size:   n.Info().Size,
+				Strong: n.Info().Strong}
+
+			blocks := &fs.Blocks{Contents: append([]fs.Block{}, n.Blocks()...)}
+			sort.Sort(blocks)
+			for _, block := range blocks.Contents {
+				entry.Blocks = append(entry.Blocks, block.Info())
+			}
+
+			manifest = append(manifest, entry)
+		}
+		return false
+	})
+
+	return manifest
+}
+
+// Rebuild a tree model from its manifest.
+// Manifests may come from untrusted peers, so any entry whose path could
+// escape the tree, or cannot be created on this platform, is rejected.
+func NewRepo(manifest []*Entry) (*fs.MemRepo, os.Error) {
+	repo := fs.NewMemRepo()
+	dirs := make(map[string]fs.Dir)
+
+	for _, entry := range manifest {
+		if err := fs.CheckRelPath(entry.Path); err != nil {
+			return nil, os.NewError(fmt.Sprintf("Invalid manifest: %v", err))
+		}
+
+		parentPath, name := filepath.Split(entry.Path)
+		parentPath = strings.TrimRight(parentPath, "/\\")
+
+		parent, hasParent := dirs[parentPath]
+		if entry.Path != "" && !hasParent {
+			return nil, os.NewError(fmt.Sprintf("Invalid manifest: %s has no parent", entry.Path))
+		}
+
+		if entry.IsDir {
+			info := &fs.DirInfo{Name: name, Mode: entry.Mode, Strong: entry.Strong}
+			if hasParent {
+				info.Parent = parent.Info().Strong
+			}
+			dirs[entry.Path] = repo.AddDir(parent, info)
+		} else {
+			info := &fs.FileInfo{Name: name, Mode: entry.Mode, Size: entry.Size, Strong: entry.Strong}
+			if hasParent {
+				info.Parent = parent.Info().Strong
+			}
+			repo.AddFile(parent, info, entry.Blocks)
+		}
+	}
+
+	return repo, nil
+}
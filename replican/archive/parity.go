@@ -0,0 +1,302 @@
+package archive
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"json"
+	"os"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// Marks the start and end of a parity file. A parity file is laid out as
+// the magic, the parity shards of each group in order, the ParityInfo as
+// JSON, the strong checksum of that JSON, and the trailer locating it.
+//
+// Version 1 parity files have no checksum of their ParityInfo; they are
+// still read.
+const PARITY_MAGIC string = "RPLPAR02"
+const PARITY_MAGIC_V1 string = "RPLPAR01"
+
+// Largest shard a parity file may describe, so that a damaged one cannot
+// exhaust memory when it is read.
+const MAX_SHARD_SIZE int64 = 1 << 26
+
+// Describe the parity protecting a file.
+//
+// The file is divided into shards of ShardSize bytes, and the shards into
+// groups of GroupSize. Each group has one parity shard, the XOR of its data
+// shards, so any one damaged shard in a group can be rebuilt from the rest.
+// Redundancy is therefore 1/GroupSize of the file size; smaller groups
+// survive more widespread damage at the cost of a larger parity file.
+//
+// This is simple XOR parity, not an erasure code such as Reed-Solomon or
+// Par2: it recovers at most one lost shard in each group, and a group with
+// two or more damaged shards cannot be repaired, however much parity the
+// other groups have.
+type ParityInfo struct {
+	Size      int64
+	ShardSize int64
+	GroupSize int
+
+	// Strong checksums of each data shard, and of each group's parity shard.
+	Shards []string
+	Parity []string
+}
+
+// Get the path of the parity file protecting path.
+func ParityPath(path string) string {
+	return path + ".par"
+}
+
+func (info *ParityInfo) shardLength(i int) int64 {
+	if remain := info.Size - int64(i)*info.ShardSize; remain < info.ShardSize {
+		return remain
+	}
+	return info.ShardSize
+}
+
+func (info *ParityInfo) groups() int {
+	return (len(info.Shards) + info.GroupSize - 1) / info.GroupSize
+}
+
+// Check that the description is consistent with itself, so that nothing
+// read by it is out of range.
+func (info *ParityInfo) validate() os.Error {
+	switch {
+	case info.Size < 0:
+		return os.NewError(fmt.Sprintf("Not a valid parity file: size %d", info.Size))
+	case info.ShardSize <= 0 || info.ShardSize > MAX_SHARD_SIZE:
+		return os.NewError(fmt.Sprintf("Not a valid parity file: shard size %d", info.ShardSize))
+	case info.GroupSize <= 0:
+		return os.NewError(fmt.Sprintf("Not a valid parity file: group size %d", info.GroupSize))
+	case int64(len(info.Shards)) != (info.Size+info.ShardSize-1)/info.ShardSize:
+		return os.NewError(fmt.Sprintf("Not a valid parity file: %d shards of %d bytes for %d bytes",
+			len(info.Shards), info.ShardSize, info.Size))
+	case len(info.Parity) != info.groups():
+		return os.NewError(fmt.Sprintf("Not a valid parity file: %d parity shards for %d groups",
+			len(info.Parity), info.groups()))
+	}
+	return nil
+}
+
+func xorInto(dst []byte, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
+
+// Generate a parity file for the file at path, usually an archive or
+// archive volume. Returns the path of the parity file written.
+func CreateParity(path string, shardSize int64, groupSize int) (string, os.Error) {
+	if shardSize <= 0 || shardSize > MAX_SHARD_SIZE || groupSize <= 0 {
+		return "", os.NewError(fmt.Sprintf(
+			"Invalid shard size %d or group size %d", shardSize, groupSize))
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	info := &ParityInfo{Size: fi.Size, ShardSize: shardSize, GroupSize: groupSize}
+	for n := (fi.Size + shardSize - 1) / shardSize; n > 0; n-- {
+		info.Shards = append(info.Shards, "")
+	}
+
+	parityPath := ParityPath(path)
+	parF, err := os.Create(parityPath)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeParity(f, parF, info)
+	if closeErr := parF.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(parityPath)
+		return "", err
+	}
+
+	return parityPath, nil
+}
+
+func writeParity(f *os.File, w io.Writer, info *ParityInfo) os.Error {
+	cw := &countingWriter{w: w}
+	if _, err := cw.Write([]byte(PARITY_MAGIC)); err != nil {
+		return err
+	}
+
+	shard := make([]byte, info.ShardSize)
+	for group := 0; group < info.groups(); group++ {
+		parity := make([]byte, info.ShardSize)
+
+		for i := group * info.GroupSize; i < (group+1)*info.GroupSize && i < len(info.Shards); i++ {
+			buf := shard[:info.shardLength(i)]
+			if _, err := f.ReadAt(buf, int64(i)*info.ShardSize); err != nil {
+				return err
+			}
+
+			info.Shards[i] = fs.StrongChecksum(buf)
+			xorInto(parity, buf)
+		}
+
+		info.Parity = append(info.Parity, fs.StrongChecksum(parity))
+		if _, err := cw.Write(parity); err != nil {
+			return err
+		}
+	}
+
+	infoBytes, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	tr := &trailer{TocOffset: cw.offset, TocLength: int64(len(infoBytes))}
+	copy(tr.Magic[:], PARITY_MAGIC)
+
+	if _, err = cw.Write(infoBytes); err != nil {
+		return err
+	}
+	if _, err = cw.Write([]byte(fs.StrongChecksum(infoBytes))); err != nil {
+		return err
+	}
+
+	return binary.Write(cw, byteOrder, tr)
+}
+
+// Read the description of the parity in a parity file, checking it
+// against its checksum and the layout of the file.
+func readParityInfo(parF *os.File) (*ParityInfo, os.Error) {
+	fi, err := parF.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.Size < int64(len(PARITY_MAGIC))+trailerSize {
+		return nil, os.NewError("Not a valid parity file: too short")
+	}
+
+	tr := &trailer{}
+	if err := binary.Read(io.NewSectionReader(parF, fi.Size-trailerSize, trailerSize), byteOrder, tr); err != nil {
+		return nil, err
+	}
+
+	var checksumLength int64
+	switch string(tr.Magic[:]) {
+	case PARITY_MAGIC:
+		checksumLength = int64(len(fs.StrongChecksum(nil)))
+	case PARITY_MAGIC_V1:
+	default:
+		return nil, os.NewError("Not a valid parity file: bad trailer")
+	}
+	if tr.TocOffset < int64(len(PARITY_MAGIC)) || tr.TocOffset > fi.Size ||
+		tr.TocLength < 0 || tr.TocLength > fi.Size ||
+		tr.TocOffset+tr.TocLength+checksumLength != fi.Size-trailerSize {
+		return nil, os.NewError("Not a valid parity file: bad trailer")
+	}
+
+	infoBytes := make([]byte, tr.TocLength+checksumLength)
+	if _, err := parF.ReadAt(infoBytes, tr.TocOffset); err != nil {
+		return nil, err
+	}
+	if checksumLength > 0 {
+		checksum := string(infoBytes[tr.TocLength:])
+		infoBytes = infoBytes[:tr.TocLength]
+		if fs.StrongChecksum(infoBytes) != checksum {
+			return nil, os.NewError("Not a valid parity file: description is damaged")
+		}
+	}
+
+	info := &ParityInfo{}
+	if err := json.Unmarshal(infoBytes, info); err != nil {
+		return nil, err
+	}
+	if err := info.validate(); err != nil {
+		return nil, err
+	}
+	if int64(len(PARITY_MAGIC))+int64(info.groups())*info.ShardSize != tr.TocOffset {
+		return nil, os.NewError("Not a valid parity file: parity shards do not fit")
+	}
+	return info, nil
+}
+
+// Check the file at path against its parity file, rebuilding any damaged
+// shards in place. Returns the indexes of the shards repaired.
+// Repair fails if any group has more than one damaged shard, or if the
+// parity for a damaged group is itself damaged.
+func Repair(path string) (repaired []int, err os.Error) {
+	parF, err := os.Open(ParityPath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer parF.Close()
+
+	info, err := readParityInfo(parF)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	shard := make([]byte, info.ShardSize)
+	for group := 0; group < info.groups(); group++ {
+		parity := make([]byte, info.ShardSize)
+		damaged := -1
+
+		for i := group * info.GroupSize; i < (group+1)*info.GroupSize && i < len(info.Shards); i++ {
+			buf := shard[:info.shardLength(i)]
+
+			// A truncated file reads short; the shard will fail its checksum
+			n, err := f.ReadAt(buf, int64(i)*info.ShardSize)
+			if err != nil && err != os.EOF {
+				return repaired, err
+			}
+			for j := n; j < len(buf); j++ {
+				buf[j] = 0
+			}
+
+			if fs.StrongChecksum(buf) == info.Shards[i] {
+				xorInto(parity, buf)
+			} else if damaged == -1 {
+				damaged = i
+			} else {
+				return repaired, os.NewError(fmt.Sprintf(
+					"Cannot repair %s: shards %d and %d are both damaged", path, damaged, i))
+			}
+		}
+
+		if damaged == -1 {
+			continue
+		}
+
+		parityOffset := int64(len(PARITY_MAGIC)) + int64(group)*info.ShardSize
+		if _, err := parF.ReadAt(shard, parityOffset); err != nil {
+			return repaired, err
+		}
+		if fs.StrongChecksum(shard) != info.Parity[group] {
+			return repaired, os.NewError(fmt.Sprintf(
+				"Cannot repair %s: parity for shard %d is damaged", path, damaged))
+		}
+
+		xorInto(parity, shard)
+		if _, err := f.WriteAt(parity[:info.shardLength(damaged)], int64(damaged)*info.ShardSize); err != nil {
+			return repaired, err
+		}
+		repaired = append(repaired, damaged)
+	}
+
+	return repaired, f.Truncate(info.Size)
+}
@@ -0,0 +1,162 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"json"
+	"os"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// An archive opened for reading, providing the archived tree and its blocks.
+type Archive struct {
+	r      io.ReaderAt
+	closer io.Closer
+	toc    *Toc
+	repo   *fs.MemRepo
+}
+
+// Open an archive file.
+func Open(path string) (*Archive, os.Error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	archive, err := NewArchive(f, fi.Size)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	archive.closer = f
+	return archive, nil
+}
+
+// Read an archive of the given size.
+func NewArchive(r io.ReaderAt, size int64) (*Archive, os.Error) {
+	if size < int64(len(MAGIC))+trailerSize {
+		return nil, badArchive("too short")
+	}
+
+	header := make([]byte, len(MAGIC))
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if string(header) != MAGIC {
+		return nil, badArchive("missing header")
+	}
+
+	tr := &trailer{}
+	if err := binary.Read(io.NewSectionReader(r, size-trailerSize, trailerSize), byteOrder, tr); err != nil {
+		return nil, err
+	}
+	if string(tr.Magic[:]) != MAGIC {
+		return nil, badArchive("missing trailer")
+	}
+	if tr.TocOffset < int64(len(MAGIC)) || tr.TocOffset+tr.TocLength > size-trailerSize {
+		return nil, badArchive("table of contents out of range")
+	}
+
+	tocBytes := make([]byte, tr.TocLength)
+	if _, err := r.ReadAt(tocBytes, tr.TocOffset); err != nil {
+		return nil, err
+	}
+
+	toc := &Toc{}
+	if err := json.Unmarshal(tocBytes, toc); err != nil {
+		return nil, err
+	}
+
+	repo, err := NewRepo(toc.Manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Archive{r: r, toc: toc, repo: repo}, nil
+}
+
+func (archive *Archive) Repo() fs.NodeRepo { return archive.repo }
+
+func (archive *Archive) Root() fs.FsNode { return archive.repo.Root() }
+
+// Get the table of contents of the archive.
+func (archive *Archive) Toc() *Toc { return archive.toc }
+
+func (archive *Archive) Close() os.Error {
+	if archive.closer != nil {
+		return archive.closer.Close()
+	}
+	return nil
+}
+
+func (archive *Archive) ReadBlock(strong string) ([]byte, os.Error) {
+	buf := &bytes.Buffer{}
+	if _, err := archive.ReadBlockInto(strong, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (archive *Archive) ReadBlockInto(strong string, writer io.Writer) (int64, os.Error) {
+	extent, has := archive.toc.Index[strong]
+	if !has {
+		return 0, os.NewError(
+			fmt.Sprintf("Block with strong checksum %s not found", strong))
+	}
+
+	return io.Copy(writer, io.NewSectionReader(archive.r, extent.Offset, extent.Length))
+}
+
+// Read a range of a file by way of the blocks which cover it.
+func (archive *Archive) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	file, has := archive.repo.File(strong)
+	if !has {
+		return 0,
+			os.NewError(fmt.Sprintf("File with strong checksum %s not found", strong))
+	}
+
+	var written int64
+	to := from + length
+	for _, block := range file.Blocks() {
+		extent, has := archive.toc.Index[block.Info().Strong]
+		if !has {
+			return written, os.NewError(
+				fmt.Sprintf("Block with strong checksum %s not found", block.Info().Strong))
+		}
+
+		blockFrom := block.Info().Offset()
+		blockTo := blockFrom + extent.Length
+		if blockTo <= from || blockFrom >= to {
+			continue
+		}
+
+		start, end := int64(0), extent.Length
+		if from > blockFrom {
+			start = from - blockFrom
+		}
+		if to < blockTo {
+			end = to - blockFrom
+		}
+
+		n, err := io.Copy(writer, io.NewSectionReader(archive.r, extent.Offset+start, end-start))
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	if written < length {
+		return written, os.EOF
+	}
+	return written, nil
+}
@@ -0,0 +1,175 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// Get the path of the numbered volume of a multi-volume archive.
+// Volumes are numbered from 1.
+func VolumePath(path string, n int) string {
+	return fmt.Sprintf("%s.%03d", path, n)
+}
+
+// Write to a series of volume files, starting a new one whenever
+// the current volume reaches the volume size.
+type volumeWriter struct {
+	path       string
+	volumeSize int64
+	volumes    []string
+	current    *os.File
+	written    int64
+}
+
+func (vw *volumeWriter) Write(buf []byte) (n int, err os.Error) {
+	for len(buf) > 0 {
+		if vw.current == nil || vw.written == vw.volumeSize {
+			if err = vw.next(); err != nil {
+				return n, err
+			}
+		}
+
+		chunk := buf
+		if remain := vw.volumeSize - vw.written; int64(len(chunk)) > remain {
+			chunk = chunk[:remain]
+		}
+
+		wr, err := vw.current.Write(chunk)
+		n += wr
+		vw.written += int64(wr)
+		if err != nil {
+			return n, err
+		}
+		buf = buf[wr:]
+	}
+	return n, nil
+}
+
+func (vw *volumeWriter) next() os.Error {
+	if err := vw.Close(); err != nil {
+		return err
+	}
+
+	path := VolumePath(vw.path, len(vw.volumes)+1)
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	vw.volumes = append(vw.volumes, path)
+	vw.current = f
+	vw.written = 0
+	return nil
+}
+
+func (vw *volumeWriter) Close() os.Error {
+	if vw.current == nil {
+		return nil
+	}
+	err := vw.current.Close()
+	vw.current = nil
+	return err
+}
+
+// Write an archive of the store's tree as a series of volumes,
+// none larger than volumeSize bytes. Volumes are named by VolumePath,
+// and the paths of the volumes written are returned.
+func CreateVolumes(path string, store fs.BlockStore, volumeSize int64) ([]string, os.Error) {
+	if volumeSize <= 0 {
+		return nil, os.NewError(fmt.Sprintf("Invalid volume size: %d", volumeSize))
+	}
+
+	vw := &volumeWriter{path: path, volumeSize: volumeSize}
+
+	err := Write(vw, store)
+	if closeErr := vw.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		for _, volume := range vw.volumes {
+			os.Remove(volume)
+		}
+		return nil, err
+	}
+
+	return vw.volumes, nil
+}
+
+// Read across a series of volumes as if they were one.
+type volumeReader struct {
+	volumes []*os.File
+	offsets []int64 // offset of the start of each volume
+}
+
+func (vr *volumeReader) ReadAt(buf []byte, off int64) (n int, err os.Error) {
+	// Find the last volume starting at or before off
+	i := sort.Search(len(vr.offsets), func(i int) bool { return vr.offsets[i] > off }) - 1
+	if i < 0 {
+		return 0, os.EINVAL
+	}
+
+	for ; len(buf) > 0 && i < len(vr.volumes); i++ {
+		rd, err := vr.volumes[i].ReadAt(buf, off-vr.offsets[i])
+		n += rd
+		off += int64(rd)
+		buf = buf[rd:]
+		if err != nil && err != os.EOF {
+			return n, err
+		}
+	}
+
+	if len(buf) > 0 {
+		return n, os.EOF
+	}
+	return n, nil
+}
+
+func (vr *volumeReader) Close() (err os.Error) {
+	for _, volume := range vr.volumes {
+		if closeErr := volume.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Open an archive split into volumes by CreateVolumes.
+// Volume boundaries are transparent to the reader.
+func OpenVolumes(path string) (*Archive, os.Error) {
+	vr := &volumeReader{}
+	var size int64
+
+	for n := 1; ; n++ {
+		f, err := os.Open(VolumePath(path, n))
+		if err != nil {
+			break
+		}
+
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			vr.Close()
+			return nil, err
+		}
+
+		vr.volumes = append(vr.volumes, f)
+		vr.offsets = append(vr.offsets, size)
+		size += fi.Size
+	}
+
+	if len(vr.volumes) == 0 {
+		return nil, os.NewError(fmt.Sprintf("No volumes found for archive %s", path))
+	}
+
+	archive, err := NewArchive(vr, size)
+	if err != nil {
+		vr.Close()
+		return nil, err
+	}
+
+	archive.closer = vr
+	return archive, nil
+}
@@ -0,0 +1,89 @@
+package archive
+
+import (
+	"encoding/binary"
+	"io"
+	"json"
+	"os"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// Keep track of the archive offset as data is written.
+type countingWriter struct {
+	w      io.Writer
+	offset int64
+}
+
+func (cw *countingWriter) Write(buf []byte) (int, os.Error) {
+	n, err := cw.w.Write(buf)
+	cw.offset += int64(n)
+	return n, err
+}
+
+// Write an archive of the store's tree to the given path.
+func Create(path string, store fs.BlockStore) os.Error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = Write(f, store)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// Write an archive of the store's tree. Blocks appearing more than once in
+// the tree are only written once.
+func Write(w io.Writer, store fs.BlockStore) os.Error {
+	cw := &countingWriter{w: w}
+	toc := &Toc{Index: make(map[string]*Extent)}
+
+	if _, err := cw.Write([]byte(MAGIC)); err != nil {
+		return err
+	}
+
+	toc.Manifest = NewManifest(store.Repo().Root())
+	for _, entry := range toc.Manifest {
+		for _, blockInfo := range entry.Blocks {
+			if err := writeBlock(cw, store, blockInfo.Strong, toc); err != nil {
+				return err
+			}
+		}
+	}
+
+	tocBytes, err := json.Marshal(toc)
+	if err != nil {
+		return err
+	}
+
+	tr := &trailer{TocOffset: cw.offset, TocLength: int64(len(tocBytes))}
+	copy(tr.Magic[:], MAGIC)
+
+	if _, err = cw.Write(tocBytes); err != nil {
+		return err
+	}
+
+	return binary.Write(cw, byteOrder, tr)
+}
+
+// Write a block's data to the archive, unless it has already been written.
+func writeBlock(cw *countingWriter, store fs.BlockProvider, strong string, toc *Toc) os.Error {
+	if _, has := toc.Index[strong]; has {
+		return nil
+	}
+
+	offset := cw.offset
+	n, err := store.ReadBlockInto(strong, cw)
+	if err != nil {
+		return err
+	}
+
+	toc.Index[strong] = &Extent{Offset: offset, Length: n}
+	return nil
+}
@@ -0,0 +1,168 @@
+package daemon
+
+import (
+	"crypto/subtle"
+	"http"
+	"json"
+	"strconv"
+	"strings"
+)
+
+const API_PREFIX string = "/api/"
+
+// Number of recent runs in which a path must change to be churning,
+// unless a request says otherwise.
+const DEFAULT_CHURN_RUNS int = 3
+
+// Serve a REST API controlling the daemon. Clients authenticate by
+// presenting the configured token in an Authorization header:
+//
+//	Authorization: Bearer <token>
+//
+// Resources are:
+//
+//	GET  /api/profiles                              profiles, their groups and status
+//	POST /api/profiles/<name>/sync                  start a sync
+//	POST /api/profiles/<name>/pause                 stop syncing on the interval
+//	POST /api/profiles/<name>/resume                resume syncing on the interval
+//	GET  /api/profiles/<name>/checkpoints           recent successful syncs
+//	GET  /api/profiles/<name>/report                plan of the last successful sync
+//	GET  /api/profiles/<name>/churn[?runs=<n>]      paths changed by each of the last runs
+//	POST /api/profiles/<name>/resolve?conflict=<path>[&restore=<path>]
+//	                                                discard or restore a conflict
+//
+// The name of a profile with destinations may be given to sync, pause or
+// resume each of the profiles in its group; the other resources are those
+// of a single profile.
+type API struct {
+	Daemon *Daemon
+	Token  string
+}
+
+func NewAPI(daemon *Daemon, token string) *API {
+	return &API{Daemon: daemon, Token: token}
+}
+
+// Test whether a request presents token. No request presents an empty token.
+func authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) == 1
+}
+
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, api.Token) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Trim(r.URL.Path[len(API_PREFIX):], "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "profiles":
+		api.get(w, r, (&Dashboard{Daemon: api.Daemon}).profileStatus())
+		return
+	case len(parts) != 3 || parts[0] != "profiles":
+		http.NotFound(w, r)
+		return
+	}
+
+	name, action := parts[1], parts[2]
+	_, isProfile := api.Daemon.Profile(name)
+	members, isGroup := api.Daemon.Group(name)
+	if !isGroup {
+		members = []string{name}
+	}
+	switch {
+	case !isProfile && !isGroup:
+		http.NotFound(w, r)
+		return
+	case !isProfile && action != "sync" && action != "pause" && action != "resume":
+		http.NotFound(w, r)
+		return
+	}
+
+	switch action {
+	case "sync":
+		if api.post(w, r) {
+			for _, member := range members {
+				if status, _ := api.Daemon.Status(member); status.Running {
+					http.Error(w, "Already syncing", http.StatusConflict)
+					return
+				}
+			}
+			go api.Daemon.Sync(name)
+			w.WriteHeader(http.StatusAccepted)
+		}
+	case "pause", "resume":
+		if api.post(w, r) {
+			for _, member := range members {
+				api.Daemon.SetPaused(member, action == "pause")
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case "checkpoints":
+		api.get(w, r, api.Daemon.Checkpoints(name))
+	case "report":
+		if report, has := api.Daemon.Report(name); has {
+			api.get(w, r, report)
+		} else {
+			http.NotFound(w, r)
+		}
+	case "churn":
+		runs, err := strconv.Atoi(r.FormValue("runs"))
+		if err != nil || runs < 2 {
+			runs = DEFAULT_CHURN_RUNS
+		}
+		if churning, err := api.Daemon.Churning(name, runs); err == nil {
+			api.get(w, r, churning)
+		} else {
+			http.Error(w, err.String(), http.StatusInternalServerError)
+		}
+	case "resolve":
+		if api.post(w, r) {
+			err := api.Daemon.ResolveConflict(name,
+				r.FormValue("conflict"), r.FormValue("restore"))
+			if err != nil {
+				http.Error(w, err.String(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Check that a request changing the daemon's state is a POST.
+func (api *API) post(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// Respond to a GET request with a JSON representation of result.
+func (api *API) get(w http.ResponseWriter, r *http.Request, result interface{}) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	buf, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.String(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
@@ -0,0 +1,168 @@
+package daemon
+
+import (
+	"http"
+	"http/httptest"
+	"io/ioutil"
+	"json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func apiRequest(t *testing.T, method string, url string, token string) (int, []byte) {
+	req, err := http.NewRequest(method, url, nil)
+	assert.T(t, err == nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.Tf(t, err == nil, "%v", err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.T(t, err == nil)
+	return resp.StatusCode, body
+}
+
+func TestAPI(t *testing.T) {
+	tg := treegen.New()
+	srcPath := treegen.TestTree(t, tg.D("foo",
+		tg.D("bar", tg.F("baz", tg.B(42, 100)))))
+	defer os.RemoveAll(srcPath)
+	dstPath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(43, 100))))
+	defer os.RemoveAll(dstPath)
+
+	daemon := New()
+	daemon.AddProfile(&Profile{Name: "test", Src: srcPath, Dst: dstPath, ConflictDir: "conflicts"})
+
+	server := httptest.NewServer(NewAPI(daemon, "sekrit"))
+	defer server.Close()
+	base := server.URL + API_PREFIX + "profiles"
+
+	code, _ := apiRequest(t, "GET", base, "wrong")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = apiRequest(t, "GET", base+"/test/sync", "sekrit")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	code, _ = apiRequest(t, "POST", base+"/test/sync", "sekrit")
+	assert.Equal(t, http.StatusAccepted, code)
+
+	for i := 0; i < 100; i++ {
+		if status, _ := daemon.Status("test"); status.Finished != 0 {
+			break
+		}
+		time.Sleep(1e8)
+	}
+
+	code, body := apiRequest(t, "GET", base+"/test/checkpoints", "sekrit")
+	assert.Equal(t, http.StatusOK, code)
+	checkpoints := []*Checkpoint{}
+	assert.T(t, json.Unmarshal(body, &checkpoints) == nil)
+	assert.Equal(t, 1, len(checkpoints))
+
+	code, body = apiRequest(t, "GET", base+"/test/report", "sekrit")
+	assert.Equal(t, http.StatusOK, code)
+	assert.T(t, len(body) > 0)
+
+	code, _ = apiRequest(t, "POST", base+"/test/pause", "sekrit")
+	assert.Equal(t, http.StatusNoContent, code)
+	status, _ := daemon.Status("test")
+	assert.T(t, status.Paused)
+
+	// The file in the way of the source directory is awaiting triage
+	conflict := filepath.Join("conflicts", "foo", "bar")
+	assert.Equal(t, []string{conflict}, status.Conflicts)
+
+	code, _ = apiRequest(t, "POST", base+"/test/resolve?conflict=nosuch", "sekrit")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Nor can a conflict be restored over the destination, the conflict
+	// directory, or anything holding the conflict
+	for _, restoreTo := range []string{".", "conflicts", filepath.Join("conflicts", "foo"), conflict} {
+		code, _ = apiRequest(t, "POST",
+			base+"/test/resolve?conflict="+conflict+"&restore="+restoreTo, "sekrit")
+		assert.Equalf(t, http.StatusBadRequest, code, "%s", restoreTo)
+		_, err := os.Stat(filepath.Join(dstPath, conflict))
+		assert.Tf(t, err == nil, "%s: %v", restoreTo, err)
+	}
+
+	code, _ = apiRequest(t, "POST", base+"/test/resolve?conflict="+conflict, "sekrit")
+	assert.Equal(t, http.StatusNoContent, code)
+	_, err := os.Stat(filepath.Join(dstPath, conflict))
+	assert.T(t, err != nil)
+
+	status, _ = daemon.Status("test")
+	assert.Equal(t, 0, len(status.Conflicts))
+
+	code, _ = apiRequest(t, "GET", base+"/nosuch/report", "sekrit")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestAPIGroup(t *testing.T) {
+	tg := treegen.New()
+	srcPath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 100))))
+	defer os.RemoveAll(srcPath)
+	dstPath1 := treegen.TestTree(t, tg.D("foo"))
+	defer os.RemoveAll(dstPath1)
+	dstPath2 := treegen.TestTree(t, tg.D("foo"))
+	defer os.RemoveAll(dstPath2)
+
+	daemon := New()
+	err := daemon.AddProfile(&Profile{Name: "fleet", Src: srcPath,
+		Destinations: []*Destination{
+			&Destination{Name: "one", Dst: dstPath1},
+			&Destination{Name: "two", Dst: dstPath2}}})
+	assert.T(t, err == nil)
+
+	server := httptest.NewServer(NewAPI(daemon, "sekrit"))
+	defer server.Close()
+	base := server.URL + API_PREFIX + "profiles"
+
+	code, body := apiRequest(t, "GET", base, "sekrit")
+	assert.Equal(t, http.StatusOK, code)
+	listed := []*profileStatus{}
+	assert.T(t, json.Unmarshal(body, &listed) == nil)
+	assert.Equal(t, 2, len(listed))
+	for _, ps := range listed {
+		assert.Equal(t, "fleet", ps.Group)
+	}
+
+	code, _ = apiRequest(t, "POST", base+"/fleet/sync", "sekrit")
+	assert.Equal(t, http.StatusAccepted, code)
+
+	for _, member := range []string{"fleet:one", "fleet:two"} {
+		for i := 0; i < 100; i++ {
+			if status, _ := daemon.Status(member); status.Finished != 0 {
+				break
+			}
+			time.Sleep(1e8)
+		}
+		status, _ := daemon.Status(member)
+		assert.Equalf(t, "", status.Err, "%s", member)
+		assert.Tf(t, status.Finished != 0, "%s", member)
+	}
+	for _, dstPath := range []string{dstPath1, dstPath2} {
+		_, err = os.Stat(filepath.Join(dstPath, "foo", "bar"))
+		assert.Tf(t, err == nil, "%v", err)
+	}
+
+	code, _ = apiRequest(t, "POST", base+"/fleet/pause", "sekrit")
+	assert.Equal(t, http.StatusNoContent, code)
+	for _, member := range []string{"fleet:one", "fleet:two"} {
+		status, _ := daemon.Status(member)
+		assert.Tf(t, status.Paused, "%s", member)
+	}
+
+	// The group is not itself synced, so has no reports of its own.
+	code, _ = apiRequest(t, "GET", base+"/fleet/report", "sekrit")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = apiRequest(t, "GET", base+"/fleet:one/report", "sekrit")
+	assert.Equal(t, http.StatusOK, code)
+}
@@ -0,0 +1,873 @@
+// Package daemon keeps configured pairs of trees in sync, and reports
+// on the progress and outcome of each sync.
+package daemon
+
+import (
+	"fmt"
+	"json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/stats"
+	"github.com/cmars/replican-sync/replican/sync"
+)
+
+// A named source and destination to be kept in sync.
+type Profile struct {
+	Name string
+	Src  string
+	Dst  string
+
+	// Directory, relative to Dst, keeping conflicting destination entries.
+	// If empty, conflicts are discarded.
+	ConflictDir string
+
+	// Nanoseconds between syncs. If zero, the profile is only synced on demand.
+	Interval int64
+
+	// If not empty, a statistics sample is appended to this series
+	// after each sync.
+	StatsPath string
+
+	// Watch the source for changes where the platform allows, and skip
+	// syncs on the interval while nothing has changed. Changes made to
+	// the destination alone are then not put right until the source changes.
+	Watch bool
+
+	// If not empty, the reports of recent syncs are saved here,
+	// so that churning files can be found across restarts.
+	ReportPath string
+
+	// Damp files which change on every scan of the source, such as logs
+	// and databases: once a file has changed in FlapRuns consecutive
+	// scans, it is left out of syncs until it settles. If FlapEvery is
+	// greater than one, it is still synced on every FlapEvery'th sync.
+	// Files are never damped if FlapRuns is zero.
+	FlapRuns  int
+	FlapEvery int
+
+	// Paths left out of syncs, as filepath.Match patterns matched against
+	// each relative path, and each of the directories above it. Matching
+	// paths are neither copied nor deleted.
+	Exclude []string
+
+	// Further destinations of the same source. Each is synced as a profile
+	// of its own, named Name:Destination.Name, with the settings of this
+	// profile unless it has its own. Syncing this profile syncs them all.
+	// Dst may then be left empty, if the profile has no destination of
+	// its own.
+	Destinations []*Destination
+}
+
+// One of the destinations of a profile. See Profile.Destinations.
+type Destination struct {
+	Name string
+	Dst  string
+
+	// If empty, the conflict directory of the profile.
+	ConflictDir string
+
+	// Nanoseconds between syncs. If zero, the interval of the profile.
+	Interval int64
+
+	// Where the statistics and reports of syncs to this destination are
+	// kept. If empty, and the profile keeps its own, they are kept beside
+	// those of the profile, with the name of the destination appended, so
+	// that destinations do not share them.
+	StatsPath  string
+	ReportPath string
+
+	// Paths left out of syncs to this destination, as well as those
+	// the profile leaves out.
+	Exclude []string
+}
+
+// Get the profile syncing a profile's source to one of its destinations.
+func (profile *Profile) member(dest *Destination) *Profile {
+	member := &Profile{
+		Name:        profile.Name + ":" + dest.Name,
+		Src:         profile.Src,
+		Dst:         dest.Dst,
+		ConflictDir: dest.ConflictDir,
+		Interval:    dest.Interval,
+		StatsPath:   dest.StatsPath,
+		ReportPath:  dest.ReportPath,
+		Watch:       profile.Watch,
+		FlapRuns:    profile.FlapRuns,
+		FlapEvery:   profile.FlapEvery,
+		Exclude:     append(append([]string{}, profile.Exclude...), dest.Exclude...)}
+	if member.ConflictDir == "" {
+		member.ConflictDir = profile.ConflictDir
+	}
+	if member.Interval == 0 {
+		member.Interval = profile.Interval
+	}
+	if member.StatsPath == "" && profile.StatsPath != "" {
+		member.StatsPath = profile.StatsPath + "." + dest.Name
+	}
+	if member.ReportPath == "" && profile.ReportPath != "" {
+		member.ReportPath = profile.ReportPath + "." + dest.Name
+	}
+	return member
+}
+
+// The state of a profile's current or most recent sync.
+type Status struct {
+	Name    string
+	Running bool
+
+	// Paused profiles are not synced on their interval,
+	// only when a sync is asked for.
+	Paused bool
+
+	// Start and finish times in nanoseconds since the epoch.
+	// Finished is zero while a sync is running.
+	Started  int64
+	Finished int64
+
+	// Error which ended the last sync, if any.
+	Err string
+
+	// Commands executed so far, of the total in the plan.
+	Done  int
+	Total int
+
+	// Summary of the plan, by kind of command.
+	Plan string
+
+	// Paths of conflicting entries awaiting triage in the conflict directory.
+	Conflicts []string
+
+	// Paths of flapping files left out of the sync. See Profile.FlapRuns.
+	Damped []string
+}
+
+// Record a successful sync.
+type Checkpoint struct {
+	// Time the sync finished, in nanoseconds since the epoch.
+	Time int64
+
+	// Strong checksum of the source root which was synced.
+	Root string
+}
+
+// Number of checkpoints kept for each profile.
+const MAX_CHECKPOINTS int = 100
+
+// Number of sync reports kept for each profile.
+const MAX_REPORTS int = 20
+
+// Daemon configuration, as read from a JSON file.
+type Config struct {
+	// HTTP address for the dashboard and control API. The dashboard is
+	// served to other hosts only with Token.
+	Listen string
+
+	// Token which clients of the control API must present.
+	// If empty, the control API is disabled.
+	Token string
+
+	Profiles []*Profile
+}
+
+func LoadConfig(path string) (*Config, os.Error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := &Config{}
+	if err = json.NewDecoder(f).Decode(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+type Daemon struct {
+	mutex       gosync.Mutex
+	profiles    []*Profile
+	status      map[string]*Status
+	checkpoints map[string][]*Checkpoint
+	reports     map[string]string
+	history     map[string][]*sync.ExecReport
+	flaps       map[string]*flapTracker
+
+	// Change journals and index caches of watched sources, by path, shared
+	// by the profiles syncing each.
+	journals map[string]*sourceJournal
+	hashes   map[string]*fs.IndexCache
+
+	// Names of the profiles synced by each profile with destinations.
+	groups map[string][]string
+
+	// Syncs in progress, and whether new ones are refused.
+	active   gosync.WaitGroup
+	draining bool
+}
+
+func New() *Daemon {
+	return &Daemon{
+		status:      make(map[string]*Status),
+		checkpoints: make(map[string][]*Checkpoint),
+		reports:     make(map[string]string),
+		history:     make(map[string][]*sync.ExecReport),
+		flaps:       make(map[string]*flapTracker),
+		journals:    make(map[string]*sourceJournal),
+		hashes:      make(map[string]*fs.IndexCache),
+		groups:      make(map[string][]string)}
+}
+
+// Add a profile, and a profile for each of its destinations.
+func (daemon *Daemon) AddProfile(profile *Profile) os.Error {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+
+	profiles := []*Profile{}
+	if profile.Dst != "" || len(profile.Destinations) == 0 {
+		profiles = append(profiles, profile)
+	}
+	for _, dest := range profile.Destinations {
+		profiles = append(profiles, profile.member(dest))
+	}
+
+	names := []string{profile.Name}
+	for _, dest := range profile.Destinations {
+		names = append(names, profile.member(dest).Name)
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		_, isProfile := daemon.status[name]
+		_, isGroup := daemon.groups[name]
+		if isProfile || isGroup || seen[name] {
+			return os.NewError(fmt.Sprintf("Profile %s already exists", name))
+		}
+		seen[name] = true
+	}
+
+	group := []string{}
+	for _, added := range profiles {
+		daemon.profiles = append(daemon.profiles, added)
+		daemon.status[added.Name] = &Status{Name: added.Name}
+		group = append(group, added.Name)
+	}
+	if len(profile.Destinations) > 0 {
+		daemon.groups[profile.Name] = group
+	}
+	return nil
+}
+
+// Get the configured profiles, in the order they were added.
+func (daemon *Daemon) Profiles() []*Profile {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+
+	return append([]*Profile{}, daemon.profiles...)
+}
+
+func (daemon *Daemon) Profile(name string) (*Profile, bool) {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+
+	for _, profile := range daemon.profiles {
+		if profile.Name == name {
+			return profile, true
+		}
+	}
+	return nil, false
+}
+
+// Get the names of the profiles synced by a profile with destinations.
+func (daemon *Daemon) Group(name string) ([]string, bool) {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+
+	group, has := daemon.groups[name]
+	return append([]string{}, group...), has
+}
+
+// Get the name of the group each profile synced as part of one is in.
+func (daemon *Daemon) GroupOf() map[string]string {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+
+	groupOf := make(map[string]string)
+	for name, group := range daemon.groups {
+		for _, member := range group {
+			groupOf[member] = name
+		}
+	}
+	return groupOf
+}
+
+// Get a snapshot of a profile's status.
+func (daemon *Daemon) Status(name string) (*Status, bool) {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+
+	status, has := daemon.status[name]
+	if !has {
+		return nil, false
+	}
+
+	snapshot := *status
+	snapshot.Conflicts = append([]string{}, status.Conflicts...)
+	snapshot.Damped = append([]string{}, status.Damped...)
+	return &snapshot, true
+}
+
+// Update a profile's status under lock.
+func (daemon *Daemon) update(name string, f func(status *Status)) {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+
+	f(daemon.status[name])
+}
+
+// Sync a profile now, returning when the sync is complete. A profile
+// with destinations is synced to each of them in turn, indexing the
+// source once for them all; the first error is returned.
+func (daemon *Daemon) Sync(name string) os.Error {
+	daemon.mutex.Lock()
+	group, isGroup := daemon.groups[name]
+	daemon.mutex.Unlock()
+	if !isGroup {
+		group = []string{name}
+	}
+
+	var err os.Error
+	sources := make(map[string]fs.LocalStore)
+	for _, member := range group {
+		if memberErr := daemon.sync(member, sources); err == nil {
+			err = memberErr
+		}
+	}
+	return err
+}
+
+// Sync a profile, taking its source from sources if it has been
+// indexed already, and adding it if not.
+func (daemon *Daemon) sync(name string, sources map[string]fs.LocalStore) (err os.Error) {
+	profile, has := daemon.Profile(name)
+	if !has {
+		return os.NewError(fmt.Sprintf("No such profile: %s", name))
+	}
+
+	daemon.mutex.Lock()
+	status := daemon.status[name]
+	if daemon.draining {
+		daemon.mutex.Unlock()
+		return os.NewError(fmt.Sprintf("Cannot sync %s: shutting down", name))
+	}
+	if status.Running {
+		daemon.mutex.Unlock()
+		return os.NewError(fmt.Sprintf("Profile %s is already syncing", name))
+	}
+	*status = Status{Name: name, Running: true, Started: time.Nanoseconds(),
+		Paused: status.Paused, Conflicts: status.Conflicts}
+	daemon.active.Add(1)
+	daemon.mutex.Unlock()
+	defer daemon.active.Done()
+
+	var dstStore fs.LocalStore
+	defer func() {
+		daemon.update(name, func(status *Status) {
+			status.Running = false
+			status.Finished = time.Nanoseconds()
+			if err != nil {
+				status.Err = err.String()
+			}
+			if dstStore != nil {
+				status.Conflicts = pendingConflicts(dstStore)
+			}
+		})
+	}()
+
+	srcStore, has := sources[profile.Src]
+	if !has {
+		if srcStore, err = fs.NewStoreWithCache(profile.Src, fs.NewMemRepo(), daemon.sourceHashes(profile.Src)); err != nil {
+			return err
+		}
+		sources[profile.Src] = srcStore
+	}
+
+	dstStore, err = fs.NewLocalStore(profile.Dst, fs.NewMemRepo())
+	if err != nil {
+		return err
+	}
+	if err = dstStore.SetConflictDir(profile.ConflictDir); err != nil {
+		return err
+	}
+
+	damped := daemon.damp(profile, srcStore.Repo().Root())
+	skip := make(map[string]bool)
+	for _, path := range damped {
+		skip[path] = true
+	}
+	for _, root := range []fs.FsNode{srcStore.Repo().Root(), dstStore.Repo().Root()} {
+		for _, path := range excluded(root, profile.Exclude) {
+			skip[path] = true
+		}
+	}
+
+	plan := sync.NewPatchPlanOpts(srcStore, dstStore, &sync.PlanOptions{Skip: skip})
+	daemon.update(name, func(status *Status) {
+		status.Total = len(plan.Cmds)
+		status.Plan = Summarize(plan)
+		status.Damped = damped
+	})
+
+	failedCmd, err := plan.ExecWith(&sync.ExecContext{
+		Src:     srcStore,
+		Dst:     dstStore,
+		Confine: true,
+		Progress: func(cmd sync.PatchCmd) {
+			daemon.update(name, func(status *Status) { status.Done++ })
+		}})
+	if recordErr := daemon.record(profile, sync.NewExecReport(plan, err)); err == nil {
+		err = recordErr
+	}
+	if err != nil {
+		return os.NewError(fmt.Sprintf("%v: %v", failedCmd, err))
+	}
+
+	plan.Clean(nil)
+
+	daemon.mutex.Lock()
+	checkpoints := append(daemon.checkpoints[name],
+		&Checkpoint{Time: time.Nanoseconds(), Root: rootStrong(srcStore.Repo().Root())})
+	if len(checkpoints) > MAX_CHECKPOINTS {
+		checkpoints = checkpoints[len(checkpoints)-MAX_CHECKPOINTS:]
+	}
+	daemon.checkpoints[name] = checkpoints
+	daemon.reports[name] = plan.String()
+	daemon.mutex.Unlock()
+
+	if profile.StatsPath != "" {
+		series, err := stats.OpenSeries(profile.StatsPath)
+		if err != nil {
+			return err
+		}
+		defer series.Close()
+
+		if err = series.Append(stats.NewSample(srcStore.Repo().Root(), plan)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get the relative paths of the files under root left out by patterns.
+// See Profile.Exclude.
+func excluded(root fs.FsNode, patterns []string) []string {
+	paths := []string{}
+	if len(patterns) == 0 {
+		return paths
+	}
+
+	fs.Walk(root, func(node fs.Node) bool {
+		if file, is := node.(fs.File); is {
+			if path := fs.RelPath(file); excludes(patterns, path) {
+				paths = append(paths, path)
+			}
+			return false
+		}
+		_, is := node.(fs.Dir)
+		return is
+	})
+	return paths
+}
+
+// Test whether a relative path, or any directory above it, matches
+// any of patterns, whole or by name.
+func excludes(patterns []string, path string) bool {
+	for ; path != "." && path != ""; path = filepath.Dir(path) {
+		_, name := filepath.Split(path)
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, path); matched {
+				return true
+			} else if matched, _ = filepath.Match(pattern, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func rootStrong(root fs.FsNode) string {
+	switch node := root.(type) {
+	case fs.Dir:
+		return node.Info().Strong
+	case fs.File:
+		return node.Info().Strong
+	}
+	return ""
+}
+
+// Add a sync report to a profile's history, saving it if configured.
+func (daemon *Daemon) record(profile *Profile, report *sync.ExecReport) os.Error {
+	history, err := daemon.History(profile.Name)
+	if err != nil {
+		return err
+	}
+
+	history = append(history, report)
+	if len(history) > MAX_REPORTS {
+		history = history[len(history)-MAX_REPORTS:]
+	}
+
+	daemon.mutex.Lock()
+	daemon.history[profile.Name] = history
+	daemon.mutex.Unlock()
+
+	if profile.ReportPath != "" {
+		return sync.SaveReports(profile.ReportPath, history)
+	}
+	return nil
+}
+
+// Get the reports of a profile's recent syncs, oldest first. The history
+// is loaded from the profile's ReportPath when first asked for.
+func (daemon *Daemon) History(name string) ([]*sync.ExecReport, os.Error) {
+	profile, has := daemon.Profile(name)
+	if !has {
+		return nil, os.NewError(fmt.Sprintf("No such profile: %s", name))
+	}
+
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+
+	history, has := daemon.history[name]
+	if !has && profile.ReportPath != "" {
+		var err os.Error
+		if history, err = sync.LoadReports(profile.ReportPath); err != nil {
+			return nil, err
+		}
+		daemon.history[name] = history
+	}
+	return append([]*sync.ExecReport{}, history...), nil
+}
+
+// Get the paths changed by each of a profile's most recent syncs, up to
+// the given number. Files which churn like this usually have unstable
+// modification times or content, and make syncs flap.
+func (daemon *Daemon) Churning(name string, runs int) ([]string, os.Error) {
+	history, err := daemon.History(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(history) > runs {
+		history = history[len(history)-runs:]
+	}
+	return sync.Churning(history), nil
+}
+
+// Pause or resume syncing a profile on its interval.
+func (daemon *Daemon) SetPaused(name string, paused bool) os.Error {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+
+	status, has := daemon.status[name]
+	if !has {
+		return os.NewError(fmt.Sprintf("No such profile: %s", name))
+	}
+	status.Paused = paused
+	return nil
+}
+
+// Get the checkpoints of a profile's recent successful syncs, oldest first.
+func (daemon *Daemon) Checkpoints(name string) []*Checkpoint {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+
+	return append([]*Checkpoint{}, daemon.checkpoints[name]...)
+}
+
+// Get the plan executed by a profile's last successful sync.
+func (daemon *Daemon) Report(name string) (string, bool) {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+
+	report, has := daemon.reports[name]
+	return report, has
+}
+
+// Resolve a conflict awaiting triage, given its path as listed in the
+// profile's status. If restoreTo is not empty, the conflicting entry is moved
+// back into the destination at that relative path, replacing whatever was
+// synced there. Otherwise, it is discarded.
+func (daemon *Daemon) ResolveConflict(name string, conflict string, restoreTo string) os.Error {
+	profile, has := daemon.Profile(name)
+	if !has {
+		return os.NewError(fmt.Sprintf("No such profile: %s", name))
+	}
+
+	status, _ := daemon.Status(name)
+	if status.Running {
+		return os.NewError(fmt.Sprintf("Profile %s is syncing", name))
+	}
+
+	pending := false
+	for _, path := range status.Conflicts {
+		pending = pending || path == conflict
+	}
+	if !pending {
+		return os.NewError(fmt.Sprintf("No such conflict in %s: %s", name, conflict))
+	}
+
+	conflictPath := filepath.Join(profile.Dst, conflict)
+	if restoreTo != "" {
+		restoreTo = filepath.Clean(restoreTo)
+		if err := fs.CheckRelPath(restoreTo); err != nil {
+			return os.NewError(fmt.Sprintf("Cannot restore outside of %s: %v", profile.Dst, err))
+		}
+		if overlaps(restoreTo, conflict) ||
+			(profile.ConflictDir != "" && overlaps(restoreTo, filepath.Clean(profile.ConflictDir))) {
+			return os.NewError(fmt.Sprintf("Cannot restore over conflicts awaiting triage: %s", restoreTo))
+		}
+
+		if err := restoreConflict(conflictPath, filepath.Join(profile.Dst, restoreTo)); err != nil {
+			return err
+		}
+	} else if err := os.RemoveAll(conflictPath); err != nil {
+		return err
+	}
+
+	daemon.update(name, func(status *Status) {
+		for i, path := range status.Conflicts {
+			if path == conflict {
+				status.Conflicts = append(status.Conflicts[:i], status.Conflicts[i+1:]...)
+				break
+			}
+		}
+	})
+	return nil
+}
+
+// Test whether one relative path is the other, or lies within it.
+func overlaps(path string, other string) bool {
+	sep := string(os.PathSeparator)
+	return path == other || strings.HasPrefix(path, other+sep) || strings.HasPrefix(other, path+sep)
+}
+
+// Move a conflict to restorePath. Whatever was there is moved aside, and
+// only removed once the conflict is in its place, so that a failed move
+// loses nothing.
+func restoreConflict(conflictPath string, restorePath string) os.Error {
+	asidePath := ""
+	if _, err := os.Lstat(restorePath); err == nil {
+		for i := 0; ; i++ {
+			asidePath = fmt.Sprintf("%s.replaced.%d", restorePath, i)
+			if _, err = os.Lstat(asidePath); err != nil {
+				break
+			}
+		}
+		if err = os.Rename(restorePath, asidePath); err != nil {
+			return err
+		}
+	}
+
+	if err := fs.Move(conflictPath, restorePath); err != nil {
+		if asidePath != "" {
+			if restoreErr := os.Rename(asidePath, restorePath); restoreErr != nil {
+				return os.NewError(fmt.Sprintf(
+					"%v; replaced entry left at %s, failed to restore it: %v", err, asidePath, restoreErr))
+			}
+		}
+		return err
+	}
+
+	if asidePath != "" {
+		return os.RemoveAll(asidePath)
+	}
+	return nil
+}
+
+// Summarize a plan as the number of each kind of command in it.
+func Summarize(plan *sync.PatchPlan) string {
+	counts := make(map[string]int)
+	for _, cmd := range plan.Cmds {
+		kind := fmt.Sprintf("%T", cmd)
+		kind = kind[strings.LastIndex(kind, ".")+1:]
+		counts[kind]++
+	}
+
+	kinds := []string{}
+	for kind, _ := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	parts := []string{}
+	for _, kind := range kinds {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[kind], kind))
+	}
+	if len(parts) == 0 {
+		return "Nothing to do"
+	}
+	return strings.Join(parts, ", ")
+}
+
+type conflictVisitor struct {
+	store     fs.LocalStore
+	conflicts []string
+}
+
+func (cv *conflictVisitor) VisitDir(path string, f *os.FileInfo) bool { return true }
+
+func (cv *conflictVisitor) VisitFile(path string, f *os.FileInfo) {
+	cv.conflicts = append(cv.conflicts, cv.store.RelPath(path))
+}
+
+// List the entries in a store's conflict directory.
+func pendingConflicts(store fs.LocalStore) []string {
+	if store.ConflictDir() == "" {
+		return nil
+	}
+
+	cv := &conflictVisitor{store: store}
+	conflictPath := filepath.Join(store.RootPath(), store.ConflictDir())
+	if _, err := os.Stat(conflictPath); err == nil {
+		filepath.Walk(conflictPath, cv, nil)
+	}
+
+	sort.Strings(cv.conflicts)
+	return cv.conflicts
+}
+
+// Get the index cache of a source, kept between syncs so that each
+// reindex of it only reads the files changed since the last.
+func (daemon *Daemon) sourceHashes(src string) *fs.IndexCache {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+
+	src = filepath.Clean(src)
+	hashes, has := daemon.hashes[src]
+	if !has {
+		hashes = fs.NewIndexCache()
+		daemon.hashes[src] = hashes
+	}
+	return hashes
+}
+
+// A change journal of a source, shared by the profiles watching it, so
+// that the source is watched once however many destinations it has.
+type sourceJournal struct {
+	journal fs.ChangeJournal
+
+	// Paths changed, and whether changes were lost, since each profile
+	// last took them.
+	changed map[string]map[string]bool
+	lost    map[string]bool
+}
+
+// Take the paths changed since a profile last took them. If the profile
+// has not taken them before, it has no record of the source to compare
+// with, so the changes are lost to it.
+func (sj *sourceJournal) changes(name string) (paths []string, lost bool) {
+	journalPaths, journalLost := sj.journal.Changes()
+	for profile, changed := range sj.changed {
+		for _, path := range journalPaths {
+			changed[path] = true
+		}
+		sj.lost[profile] = sj.lost[profile] || journalLost
+	}
+
+	changed, has := sj.changed[name]
+	for path, _ := range changed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	lost = !has || sj.lost[name]
+
+	sj.changed[name] = make(map[string]bool)
+	sj.lost[name] = false
+	return paths, lost
+}
+
+// Test whether a watched profile's source is unchanged since its last
+// successful sync. Starts watching the source on first use.
+//
+// The source is still walked when it has changed, but the files the
+// journal reports changed are forgotten by its index cache, so that only
+// they are read again, however their stat looks.
+func (daemon *Daemon) unchanged(profile *Profile, status *Status) bool {
+	src := filepath.Clean(profile.Src)
+	sj, has := daemon.journals[src]
+	if !has {
+		journal, err := fs.NewChangeJournal(src)
+		if err != nil {
+			return false
+		}
+		sj = &sourceJournal{
+			journal: journal,
+			changed: make(map[string]map[string]bool),
+			lost:    make(map[string]bool)}
+		daemon.journals[src] = sj
+	}
+
+	// Changes are taken from the journal whether or not the profile is
+	// synced now; any made during the sync will be seen next time.
+	paths, lost := sj.changes(profile.Name)
+	hashes := daemon.sourceHashes(src)
+	if lost {
+		hashes.Clear()
+	} else {
+		forget := make([]string, len(paths))
+		for i, path := range paths {
+			forget[i] = filepath.Join(src, path)
+		}
+		hashes.Forget(forget)
+	}
+	return !lost && len(paths) == 0 && status.Finished != 0 && status.Err == ""
+}
+
+// Refuse to start any more syncs, and wait for those in progress to finish.
+func (daemon *Daemon) Drain() {
+	daemon.mutex.Lock()
+	daemon.draining = true
+	daemon.mutex.Unlock()
+
+	daemon.active.Wait()
+}
+
+// Sync each profile having an interval, whenever it is due,
+// until signalled to stop. Profiles with the same source which are
+// due at once share one index of it.
+func (daemon *Daemon) Run(stop <-chan bool, errors chan<- os.Error) {
+	due := make(map[string]int64)
+	ticker := time.NewTicker(1e9)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			sources := make(map[string]fs.LocalStore)
+			for _, profile := range daemon.Profiles() {
+				status, _ := daemon.Status(profile.Name)
+				if profile.Interval <= 0 || status.Paused || due[profile.Name] > now {
+					continue
+				}
+
+				if profile.Watch && daemon.unchanged(profile, status) {
+					due[profile.Name] = now + profile.Interval
+					continue
+				}
+
+				due[profile.Name] = now + profile.Interval
+				if err := daemon.sync(profile.Name, sources); err != nil && errors != nil {
+					errors <- err
+				}
+			}
+		}
+	}
+}
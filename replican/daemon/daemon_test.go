@@ -0,0 +1,359 @@
+package daemon
+
+import (
+	"http"
+	"http/httptest"
+	"io/ioutil"
+	"json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/events"
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/stats"
+	"github.com/cmars/replican-sync/replican/sync"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func mkProfile(t *testing.T) *Profile {
+	tg := treegen.New()
+	srcPath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.F("baz", tg.B(7, 100))))
+	dstPath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(43, 65537))))
+
+	statsF, err := ioutil.TempFile("", "stats")
+	assert.T(t, err == nil)
+	statsF.Close()
+
+	return &Profile{Name: "test", Src: srcPath, Dst: dstPath,
+		ConflictDir: "conflicts",
+		StatsPath:   statsF.Name()}
+}
+
+func cleanProfile(profile *Profile) {
+	os.RemoveAll(profile.Src)
+	os.RemoveAll(profile.Dst)
+	os.Remove(profile.StatsPath)
+}
+
+func TestSync(t *testing.T) {
+	profile := mkProfile(t)
+	defer cleanProfile(profile)
+
+	daemon := New()
+	assert.T(t, daemon.AddProfile(profile) == nil)
+	assert.T(t, daemon.AddProfile(profile) != nil)
+
+	status, has := daemon.Status("test")
+	assert.T(t, has)
+	assert.Equal(t, int64(0), status.Finished)
+
+	err := daemon.Sync("test")
+	assert.Tf(t, err == nil, "%v", err)
+
+	status, _ = daemon.Status("test")
+	assert.T(t, !status.Running)
+	assert.T(t, status.Finished >= status.Started)
+	assert.Equal(t, "", status.Err)
+	assert.T(t, status.Total > 0)
+	assert.Equal(t, status.Total, status.Done)
+	assert.T(t, status.Plan != "Nothing to do")
+
+	srcDir, errors := fs.IndexDir(filepath.Join(profile.Src, "foo"), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	dstDir, errors := fs.IndexDir(filepath.Join(profile.Dst, "foo"), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, srcDir.Info().Strong, dstDir.Info().Strong)
+
+	series, err := stats.OpenSeries(profile.StatsPath)
+	assert.T(t, err == nil)
+	defer series.Close()
+	assert.Equal(t, int64(1), series.Len())
+
+	assert.T(t, daemon.Sync("nosuchprofile") != nil)
+}
+
+func TestDestinationInherits(t *testing.T) {
+	profile := &Profile{
+		Name:        "test",
+		Src:         "src",
+		ConflictDir: ".conflicts",
+		Interval:    60e9,
+		StatsPath:   "stats",
+		ReportPath:  "report",
+		Destinations: []*Destination{
+			&Destination{Name: "plain", Dst: "a"},
+			&Destination{Name: "own", Dst: "b", ConflictDir: ".mine", Interval: 30e9,
+				StatsPath: "own.stats", ReportPath: "own.report"}}}
+
+	plain := profile.member(profile.Destinations[0])
+	assert.Equal(t, ".conflicts", plain.ConflictDir)
+	assert.Equal(t, int64(60e9), plain.Interval)
+	assert.Equal(t, "stats.plain", plain.StatsPath)
+	assert.Equal(t, "report.plain", plain.ReportPath)
+
+	own := profile.member(profile.Destinations[1])
+	assert.Equal(t, ".mine", own.ConflictDir)
+	assert.Equal(t, int64(30e9), own.Interval)
+	assert.Equal(t, "own.stats", own.StatsPath)
+	assert.Equal(t, "own.report", own.ReportPath)
+
+	// Without paths of the profile's own, none are kept
+	profile.StatsPath, profile.ReportPath = "", ""
+	plain = profile.member(profile.Destinations[0])
+	assert.Equal(t, "", plain.StatsPath)
+	assert.Equal(t, "", plain.ReportPath)
+}
+
+func TestSyncDestinations(t *testing.T) {
+	profile := mkProfile(t)
+	defer cleanProfile(profile)
+
+	tg := treegen.New()
+	allPath := treegen.TestTree(t, tg.D("foo"))
+	defer os.RemoveAll(allPath)
+	somePath := treegen.TestTree(t, tg.D("foo", tg.F("baz", tg.B(8, 100))))
+	defer os.RemoveAll(somePath)
+	profile.Destinations = []*Destination{
+		&Destination{Name: "all", Dst: allPath},
+		&Destination{Name: "some", Dst: somePath, Exclude: []string{"baz"}}}
+
+	daemon := New()
+	assert.T(t, daemon.AddProfile(profile) == nil)
+	assert.Equal(t, 3, len(daemon.Profiles()))
+	_, has := daemon.Profile("test:some")
+	assert.T(t, has)
+
+	srcIndexed := 0
+	id := events.Subscribe(func(event events.Event) {
+		if started, is := event.(*events.IndexStarted); is && started.Path == filepath.Clean(profile.Src) {
+			srcIndexed++
+		}
+	})
+	defer events.Unsubscribe(id)
+
+	err := daemon.Sync("test")
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, 1, srcIndexed)
+
+	srcDir, errors := fs.IndexDir(filepath.Join(profile.Src, "foo"), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	for _, dstPath := range []string{profile.Dst, allPath} {
+		dstDir, errors := fs.IndexDir(filepath.Join(dstPath, "foo"), fs.NewMemRepo())
+		assert.Equalf(t, 0, len(errors), "%v", errors)
+		assert.Equal(t, srcDir.Info().Strong, dstDir.Info().Strong)
+	}
+
+	// Excluded paths are left alone.
+	_, err = os.Stat(filepath.Join(somePath, "foo", "bar"))
+	assert.T(t, err == nil)
+	content, err := ioutil.ReadFile(filepath.Join(somePath, "foo", "baz"))
+	assert.T(t, err == nil)
+	assert.Equal(t, 100, len(content))
+	srcContent, err := ioutil.ReadFile(filepath.Join(profile.Src, "foo", "baz"))
+	assert.T(t, err == nil)
+	assert.T(t, string(content) != string(srcContent))
+
+	status, _ := daemon.Status("test:some")
+	assert.T(t, status.Finished > 0)
+	assert.Equal(t, "", status.Err)
+}
+
+func TestDashboard(t *testing.T) {
+	profile := mkProfile(t)
+	defer cleanProfile(profile)
+
+	daemon := New()
+	daemon.AddProfile(profile)
+	daemon.Sync("test")
+
+	server := httptest.NewServer(NewDashboard(daemon, "sekrit"))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/")
+	assert.T(t, err == nil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.T(t, err == nil)
+	assert.T(t, strings.Contains(string(body), profile.Src))
+
+	resp, err = http.Get(server.URL + "/status")
+	assert.T(t, err == nil)
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.T(t, err == nil)
+
+	result := []*profileStatus{}
+	assert.T(t, json.Unmarshal(body, &result) == nil)
+	assert.Equal(t, 1, len(result))
+	assert.Equal(t, "test", result[0].Status.Name)
+	assert.Equal(t, result[0].Status.Total, result[0].Status.Done)
+}
+
+// Test that the dashboard serves other hosts only with the API token.
+func TestDashboardRemote(t *testing.T) {
+	dashboard := NewDashboard(New(), "sekrit")
+	get := func(remoteAddr string, token string) int {
+		req, err := http.NewRequest("GET", "http://replican/status", nil)
+		assert.T(t, err == nil)
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		dashboard.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, get("127.0.0.1:4242", ""))
+	assert.Equal(t, http.StatusOK, get("[::1]:4242", ""))
+	assert.Equal(t, http.StatusUnauthorized, get("192.0.2.1:4242", ""))
+	assert.Equal(t, http.StatusUnauthorized, get("192.0.2.1:4242", "wrong"))
+	assert.Equal(t, http.StatusOK, get("192.0.2.1:4242", "sekrit"))
+
+	// Without a token, only the local host is served
+	dashboard.Token = ""
+	assert.Equal(t, http.StatusUnauthorized, get("192.0.2.1:4242", ""))
+}
+
+func TestDrain(t *testing.T) {
+	profile := mkProfile(t)
+	defer cleanProfile(profile)
+
+	daemon := New()
+	daemon.AddProfile(profile)
+
+	daemon.Drain()
+	assert.T(t, daemon.Sync("test") != nil)
+
+	status, _ := daemon.Status("test")
+	assert.Equal(t, int64(0), status.Finished)
+}
+
+func TestChurning(t *testing.T) {
+	profile := mkProfile(t)
+	defer cleanProfile(profile)
+
+	reportF, err := ioutil.TempFile("", "reports")
+	assert.T(t, err == nil)
+	reportF.Close()
+	os.Remove(reportF.Name())
+	defer os.Remove(reportF.Name())
+	profile.ReportPath = reportF.Name()
+
+	daemon := New()
+	daemon.AddProfile(profile)
+
+	// bar changes before every sync, baz only before the first.
+	barPath := filepath.Join(profile.Src, "foo", "bar")
+	for i := 0; i < 3; i++ {
+		err = ioutil.WriteFile(barPath, []byte(strings.Repeat("churn", i+1)), 0644)
+		assert.T(t, err == nil)
+		assert.T(t, daemon.Sync("test") == nil)
+	}
+
+	churning, err := daemon.Churning("test", 3)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, []string{filepath.Join("foo", "bar")}, churning)
+
+	// The history survives a restart.
+	daemon = New()
+	daemon.AddProfile(profile)
+	history, err := daemon.History("test")
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, 3, len(history))
+
+	diff := sync.CompareReports(history[0], history[1])
+	assert.T(t, len(diff.Removed) > 0)
+	assert.Equal(t, []string{filepath.Join("foo", "bar")}, diff.Repeated)
+}
+
+func TestDamping(t *testing.T) {
+	profile := mkProfile(t)
+	defer cleanProfile(profile)
+	profile.FlapRuns = 2
+	profile.FlapEvery = 4
+
+	daemon := New()
+	daemon.AddProfile(profile)
+
+	barPath := filepath.Join(profile.Src, "foo", "bar")
+	dstBarPath := filepath.Join(profile.Dst, "foo", "bar")
+	for i := 1; i <= 4; i++ {
+		content := strings.Repeat("flap", i)
+		err := ioutil.WriteFile(barPath, []byte(content), 0644)
+		assert.T(t, err == nil)
+		assert.T(t, daemon.Sync("test") == nil)
+
+		// bar has changed in two consecutive scans by the third sync,
+		// and is synced again on the fourth.
+		status, _ := daemon.Status("test")
+		dstContent, err := ioutil.ReadFile(dstBarPath)
+		assert.T(t, err == nil)
+		if i == 3 {
+			assert.Equal(t, []string{filepath.Join("foo", "bar")}, status.Damped)
+			assert.T(t, string(dstContent) != content)
+		} else {
+			assert.Equal(t, 0, len(status.Damped))
+			assert.Equal(t, content, string(dstContent))
+		}
+	}
+}
+
+// A journal reporting the changes it is given.
+type fakeJournal struct {
+	paths []string
+	lost  bool
+}
+
+func (journal *fakeJournal) Changes() ([]string, bool) {
+	paths, lost := journal.paths, journal.lost
+	journal.paths, journal.lost = nil, false
+	return paths, lost
+}
+
+func (journal *fakeJournal) Close() os.Error { return nil }
+
+func TestSourceJournalShared(t *testing.T) {
+	journal := &fakeJournal{}
+	sj := &sourceJournal{
+		journal: journal,
+		changed: make(map[string]map[string]bool),
+		lost:    make(map[string]bool)}
+
+	// Profiles which have not looked before have nothing to compare with.
+	_, lost := sj.changes("a")
+	assert.T(t, lost)
+	_, lost = sj.changes("b")
+	assert.T(t, lost)
+
+	// Each profile sees every change, however many take them.
+	journal.paths = []string{"foo"}
+	paths, lost := sj.changes("a")
+	assert.T(t, !lost)
+	assert.Equal(t, []string{"foo"}, paths)
+
+	journal.paths = []string{"bar"}
+	paths, lost = sj.changes("b")
+	assert.T(t, !lost)
+	assert.Equal(t, []string{"bar", "foo"}, paths)
+
+	paths, lost = sj.changes("a")
+	assert.T(t, !lost)
+	assert.Equal(t, []string{"bar"}, paths)
+
+	journal.lost = true
+	_, lost = sj.changes("a")
+	assert.T(t, lost)
+	_, lost = sj.changes("b")
+	assert.T(t, lost)
+	paths, lost = sj.changes("b")
+	assert.T(t, !lost)
+	assert.Equal(t, 0, len(paths))
+}
@@ -0,0 +1,156 @@
+package daemon
+
+import (
+	"fmt"
+	"html"
+	"http"
+	"json"
+	"net"
+	"time"
+)
+
+// Serve an HTML dashboard of the daemon's profiles and their status at /,
+// and the same status as JSON at /status. Profiles name the paths synced,
+// so only clients on the local host are served, unless a request presents
+// the API token as the API requires. Behind a proxy on the local host,
+// every client is local, and the proxy must authenticate them.
+type Dashboard struct {
+	Daemon *Daemon
+	Token  string
+}
+
+func NewDashboard(daemon *Daemon, token string) *Dashboard {
+	return &Dashboard{Daemon: daemon, Token: token}
+}
+
+// Test whether a request comes from the local host.
+func isLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 127
+	}
+	return ip.Equal(net.IPv6loopback)
+}
+
+// Pair a profile with its status, for rendering. Group is the name of the
+// profile with destinations the profile is synced as part of, if any.
+type profileStatus struct {
+	Profile *Profile
+	Status  *Status
+	Group   string
+}
+
+func (dashboard *Dashboard) profileStatus() []*profileStatus {
+	groupOf := dashboard.Daemon.GroupOf()
+	result := []*profileStatus{}
+	for _, profile := range dashboard.Daemon.Profiles() {
+		status, _ := dashboard.Daemon.Status(profile.Name)
+		result = append(result, &profileStatus{Profile: profile, Status: status,
+			Group: groupOf[profile.Name]})
+	}
+	return result
+}
+
+func (dashboard *Dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isLoopback(r) && !authorized(r, dashboard.Token) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/":
+		dashboard.serveHtml(w)
+	case "/status":
+		dashboard.serveJson(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (dashboard *Dashboard) serveJson(w http.ResponseWriter) {
+	buf, err := json.Marshal(dashboard.profileStatus())
+	if err != nil {
+		http.Error(w, err.String(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+const dashboardHead = `<!DOCTYPE html>
+<html>
+<head>
+<title>replican</title>
+<meta http-equiv="refresh" content="2">
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+.bar { width: 200px; background: #eee; }
+.bar div { background: #4a4; height: 1em; }
+.err { color: #c00; }
+</style>
+</head>
+<body>
+<h1>replican</h1>
+<table>
+<tr><th>Profile</th><th>Group</th><th>Source</th><th>Destination</th><th>Status</th><th>Progress</th><th>Plan</th><th>Conflicts</th></tr>
+`
+
+const dashboardFoot = `</table>
+</body>
+</html>
+`
+
+func (dashboard *Dashboard) serveHtml(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, dashboardHead)
+
+	for _, ps := range dashboard.profileStatus() {
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>",
+			html.EscapeString(ps.Profile.Name),
+			html.EscapeString(ps.Group),
+			html.EscapeString(ps.Profile.Src),
+			html.EscapeString(ps.Profile.Dst),
+			statusHtml(ps.Status),
+			progressHtml(ps.Status),
+			html.EscapeString(ps.Status.Plan))
+		for _, conflict := range ps.Status.Conflicts {
+			fmt.Fprintf(w, "%s<br>", html.EscapeString(conflict))
+		}
+		fmt.Fprint(w, "</td></tr>\n")
+	}
+
+	fmt.Fprint(w, dashboardFoot)
+}
+
+func statusHtml(status *Status) string {
+	switch {
+	case status.Running:
+		return "Syncing since " + html.EscapeString(time.SecondsToLocalTime(status.Started/1e9).String())
+	case status.Finished == 0:
+		return "Not yet synced"
+	case status.Err != "":
+		return fmt.Sprintf(`<span class="err">Failed at %s: %s</span>`,
+			html.EscapeString(time.SecondsToLocalTime(status.Finished/1e9).String()),
+			html.EscapeString(status.Err))
+	}
+	return "Synced at " + html.EscapeString(time.SecondsToLocalTime(status.Finished/1e9).String())
+}
+
+func progressHtml(status *Status) string {
+	percent := 100
+	if status.Total > 0 {
+		percent = status.Done * 100 / status.Total
+	}
+	return fmt.Sprintf(`<div class="bar"><div style="width: %d%%"></div></div>%d / %d`,
+		percent, status.Done, status.Total)
+}
@@ -0,0 +1,83 @@
+package daemon
+
+import (
+	"sort"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// Track how many consecutive scans of a source each file has changed in,
+// to find files which change on every scan, such as logs and databases.
+type flapTracker struct {
+	// Strong checksum of each file when last scanned, by relative path.
+	strong map[string]string
+
+	// Number of consecutive scans in which each file has changed.
+	changes map[string]int
+
+	// Number of scans made.
+	scans int
+}
+
+func newFlapTracker() *flapTracker {
+	return &flapTracker{strong: make(map[string]string), changes: make(map[string]int)}
+}
+
+// Record a scan of the source.
+func (tracker *flapTracker) scan(root fs.FsNode) {
+	strong := make(map[string]string)
+	fs.Walk(root, func(node fs.Node) bool {
+		if file, isFile := node.(fs.File); isFile {
+			strong[fs.RelPath(file)] = file.Info().Strong
+			return false
+		}
+		_, isDir := node.(fs.Dir)
+		return isDir
+	})
+
+	changes := make(map[string]int)
+	for path, fileStrong := range strong {
+		if last, has := tracker.strong[path]; has && last != fileStrong {
+			changes[path] = tracker.changes[path] + 1
+		}
+	}
+
+	tracker.strong = strong
+	tracker.changes = changes
+	tracker.scans++
+}
+
+// Get the files which have changed in at least runs consecutive scans.
+func (tracker *flapTracker) flapping(runs int) []string {
+	paths := []string{}
+	for path, changes := range tracker.changes {
+		if changes >= runs {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Get the flapping files to leave out of a profile's sync now, according
+// to its damping policy, having recorded a scan of its source.
+func (daemon *Daemon) damp(profile *Profile, root fs.FsNode) []string {
+	if profile.FlapRuns <= 0 {
+		return nil
+	}
+
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+
+	tracker, has := daemon.flaps[profile.Name]
+	if !has {
+		tracker = newFlapTracker()
+		daemon.flaps[profile.Name] = tracker
+	}
+	tracker.scan(root)
+
+	if profile.FlapEvery > 1 && tracker.scans%profile.FlapEvery == 0 {
+		return nil
+	}
+	return tracker.flapping(profile.FlapRuns)
+}
@@ -0,0 +1,74 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"xml"
+)
+
+// Get the path of a per-user launchd job definition on macOS.
+func LaunchdPath(label string) string {
+	return filepath.Join(os.Getenv("HOME"), "Library", "LaunchAgents", label+".plist")
+}
+
+// Render a launchd job definition which runs the daemon with a configuration
+// file, starting it at login and restarting it should it exit.
+func LaunchdPlist(label string, exe string, configPath string) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprint(buf, `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>`)
+	xml.Escape(buf, []byte(label))
+	fmt.Fprint(buf, `</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>`)
+	xml.Escape(buf, []byte(exe))
+	fmt.Fprint(buf, `</string>
+		<string>`)
+	xml.Escape(buf, []byte(configPath))
+	fmt.Fprint(buf, `</string>
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+</dict>
+</plist>
+`)
+	return buf.Bytes()
+}
+
+// Write a launchd job definition for the daemon, returning its path.
+// The job is loaded with launchctl load <path>.
+func InstallLaunchd(label string, exe string, configPath string) (string, os.Error) {
+	path := LaunchdPath(label)
+
+	dir, _ := filepath.Split(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = f.Write(LaunchdPlist(label, exe, configPath))
+	return path, err
+}
+
+// Get the sc.exe arguments which register the daemon as a Windows service,
+// started automatically at boot. The service runs the daemon with the
+// service command, so that it answers the service control manager.
+func WindowsServiceArgs(name string, exe string, configPath string) []string {
+	return []string{"create", name,
+		"binPath=", fmt.Sprintf(`"%s" service "%s"`, exe, configPath),
+		"start=", "auto"}
+}
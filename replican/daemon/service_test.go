@@ -0,0 +1,24 @@
+package daemon
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestLaunchdPlist(t *testing.T) {
+	plist := string(LaunchdPlist("com.example.replican", "/opt/replican & co/replicand", "/etc/replican.json"))
+
+	assert.T(t, strings.Contains(plist, "<string>com.example.replican</string>"))
+	assert.T(t, strings.Contains(plist, "<string>/opt/replican &amp; co/replicand</string>"))
+	assert.T(t, strings.Contains(plist, "<string>/etc/replican.json</string>"))
+	assert.T(t, strings.Contains(plist, "<key>KeepAlive</key>"))
+}
+
+func TestWindowsServiceArgs(t *testing.T) {
+	args := WindowsServiceArgs("replican", `C:\Program Files\replicand.exe`, `C:\replican.json`)
+	assert.Equal(t, []string{"create", "replican",
+		"binPath=", `"C:\Program Files\replicand.exe" service "C:\replican.json"`,
+		"start=", "auto"}, args)
+}
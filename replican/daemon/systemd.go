@@ -0,0 +1,101 @@
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// File descriptor of the first socket passed by systemd socket activation.
+const LISTEN_FDS_START int = 3
+
+// Get the sockets passed to the process by systemd socket activation,
+// in the order they are configured in the socket unit.
+// Returns no listeners if the process was not socket activated.
+func Listeners() ([]net.Listener, os.Error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, os.NewError(fmt.Sprintf("Invalid LISTEN_FDS: %v", err))
+	}
+
+	// Don't pass the sockets on to any children.
+	os.Setenv("LISTEN_PID", "")
+	os.Setenv("LISTEN_FDS", "")
+
+	listeners := []net.Listener{}
+	for fd := LISTEN_FDS_START; fd < LISTEN_FDS_START+nfds; fd++ {
+		f := os.NewFile(fd, fmt.Sprintf("LISTEN_FD_%d", fd))
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// Send a state notification to the service manager, such as "READY=1"
+// or "STOPPING=1". Does nothing if not run by a service manager
+// expecting notifications.
+func Notify(state string) os.Error {
+	socketName := os.Getenv("NOTIFY_SOCKET")
+	if socketName == "" {
+		return nil
+	}
+
+	// Names starting with @ are in the abstract namespace.
+	if socketName[0] == '@' {
+		socketName = "\x00" + socketName[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketName, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Get the interval, in nanoseconds, at which the service manager expects
+// liveness notifications. Returns zero if none are expected.
+func WatchdogInterval() int64 {
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return 0
+	}
+
+	usec, err := strconv.Atoi64(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return usec * 1e3
+}
+
+// Notify the service manager that the daemon is alive, at half the
+// watchdog interval, until signalled to stop.
+func Watchdog(stop <-chan bool) {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			Notify("WATCHDOG=1")
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package daemon
+
+import (
+	"os"
+)
+
+// Hand the process to the Windows service control manager. There is none
+// on this platform.
+func ServeWindowsService(name string, run func(stop <-chan bool)) os.Error {
+	return os.NewError("Windows services are only supported on windows")
+}
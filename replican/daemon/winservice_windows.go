@@ -0,0 +1,180 @@
+package daemon
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	_SERVICE_WIN32_OWN_PROCESS = 0x10
+
+	_SERVICE_STOPPED       = 1
+	_SERVICE_START_PENDING = 2
+	_SERVICE_STOP_PENDING  = 3
+	_SERVICE_RUNNING       = 4
+
+	_SERVICE_ACCEPT_STOP     = 0x1
+	_SERVICE_ACCEPT_SHUTDOWN = 0x4
+
+	_SERVICE_CONTROL_STOP        = 1
+	_SERVICE_CONTROL_INTERROGATE = 4
+	_SERVICE_CONTROL_SHUTDOWN    = 5
+
+	_NO_ERROR                   = 0
+	_ERROR_CALL_NOT_IMPLEMENTED = 120
+)
+
+// Milliseconds the service control manager is told to wait between
+// reports while the service starts or stops.
+const SERVICE_WAIT_HINT = 10000
+
+// SERVICE_STATUS, as taken by SetServiceStatus.
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+// SERVICE_TABLE_ENTRYW, as taken by StartServiceCtrlDispatcherW.
+type serviceTableEntry struct {
+	serviceName *uint16
+	serviceProc uintptr
+}
+
+// The service run by the process. The callbacks of the service control
+// manager carry no context, so there can only be one.
+type windowsService struct {
+	name []uint16
+	run  func(stop <-chan bool)
+
+	// Closed, once, when the manager asks the service to stop.
+	stop     chan bool
+	stopOnce sync.Once
+
+	registerHandler  uintptr
+	setServiceStatus uintptr
+	handle           uintptr
+	err              os.Error
+}
+
+var service *windowsService
+
+// Hand the process to the Windows service control manager, which starts
+// the service named name by calling run. run is given a channel which is
+// closed when the manager asks the service to stop, or the system shuts
+// down, and the service is reported stopped once run returns. Blocks
+// until then. Fails if the process was not started by the manager.
+//
+// The manager is told the service is still stopping every so often while
+// run drains, so that syncs in progress may finish.
+func ServeWindowsService(name string, run func(stop <-chan bool)) os.Error {
+	advapi32, errno := syscall.LoadLibrary("advapi32.dll")
+	if errno != 0 {
+		return os.NewSyscallError("LoadLibrary", errno)
+	}
+	defer syscall.FreeLibrary(advapi32)
+
+	procs := make(map[string]uintptr)
+	for _, name := range []string{"StartServiceCtrlDispatcherW",
+		"RegisterServiceCtrlHandlerExW", "SetServiceStatus"} {
+		proc, errno := syscall.GetProcAddress(advapi32, name)
+		if errno != 0 {
+			return os.NewSyscallError("GetProcAddress", errno)
+		}
+		procs[name] = uintptr(proc)
+	}
+
+	service = &windowsService{
+		name:             syscall.StringToUTF16(name),
+		run:              run,
+		stop:             make(chan bool),
+		registerHandler:  procs["RegisterServiceCtrlHandlerExW"],
+		setServiceStatus: procs["SetServiceStatus"]}
+
+	// The dispatcher runs on this thread until the service stops.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	table := []serviceTableEntry{
+		{serviceName: &service.name[0], serviceProc: syscall.NewCallback(serviceMain)},
+		{}}
+	r1, _, e1 := syscall.Syscall(procs["StartServiceCtrlDispatcherW"], 1,
+		uintptr(unsafe.Pointer(&table[0])), 0, 0)
+	if r1 == 0 {
+		return os.NewSyscallError("StartServiceCtrlDispatcher", int(e1))
+	}
+	return service.err
+}
+
+// ServiceMain, called by the dispatcher to start the service.
+func serviceMain(argc uintptr, argv uintptr) uintptr {
+	r1, _, e1 := syscall.Syscall(service.registerHandler, 3,
+		uintptr(unsafe.Pointer(&service.name[0])), syscall.NewCallback(serviceHandler), 0)
+	if r1 == 0 {
+		service.err = os.NewSyscallError("RegisterServiceCtrlHandlerEx", int(e1))
+		return 0
+	}
+	service.handle = r1
+	service.report(_SERVICE_START_PENDING, 0, SERVICE_WAIT_HINT)
+
+	done := make(chan bool)
+	go func() {
+		service.run(service.stop)
+		close(done)
+	}()
+	service.report(_SERVICE_RUNNING, 0, 0)
+
+	stopping := service.stop
+	var pending <-chan int64
+	checkPoint := uint32(0)
+	for {
+		select {
+		case <-done:
+			service.report(_SERVICE_STOPPED, 0, 0)
+			return 0
+		case <-stopping:
+			stopping = nil
+			pending = time.After(0)
+		case <-pending:
+			checkPoint++
+			service.report(_SERVICE_STOP_PENDING, checkPoint, SERVICE_WAIT_HINT)
+			pending = time.After(SERVICE_WAIT_HINT * 1e6 / 2)
+		}
+	}
+
+	panic("Impossible")
+}
+
+// HandlerEx, called by the dispatcher with each control sent to the
+// service.
+func serviceHandler(control uintptr, eventType uintptr, eventData uintptr, context uintptr) uintptr {
+	switch control {
+	case _SERVICE_CONTROL_STOP, _SERVICE_CONTROL_SHUTDOWN:
+		service.stopOnce.Do(func() { close(service.stop) })
+		return _NO_ERROR
+	case _SERVICE_CONTROL_INTERROGATE:
+		return _NO_ERROR
+	}
+	return _ERROR_CALL_NOT_IMPLEMENTED
+}
+
+// Tell the service control manager the state of the service.
+func (svc *windowsService) report(state uint32, checkPoint uint32, waitHint uint32) {
+	status := &serviceStatus{
+		serviceType:  _SERVICE_WIN32_OWN_PROCESS,
+		currentState: state,
+		checkPoint:   checkPoint,
+		waitHint:     waitHint}
+	if state == _SERVICE_RUNNING {
+		status.controlsAccepted = _SERVICE_ACCEPT_STOP | _SERVICE_ACCEPT_SHUTDOWN
+	}
+	syscall.Syscall(svc.setServiceStatus, 2, svc.handle, uintptr(unsafe.Pointer(status)), 0)
+}
@@ -0,0 +1,144 @@
+// Package events carries notifications from every stage of the sync
+// pipeline -- indexing, planning, executing -- to any interested subscriber.
+//
+// Progress displays, logging and metrics can all be built as subscribers,
+// rather than each stage taking its own callbacks. Events are delivered
+// synchronously, in the goroutine which published them, so handlers
+// should return quickly.
+package events
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// An event published by the pipeline. Subscribers switch on the
+// concrete type to pick out the events they are interested in.
+type Event interface{}
+
+// Indexing of a local directory has started.
+type IndexStarted struct {
+	Path string
+}
+
+// A file has been read and its blocks checksummed during indexing.
+type FileHashed struct {
+	Path   string
+	Size   int64
+	Strong string
+}
+
+// A patch plan has been constructed.
+type PlanReady struct {
+	Dst  string
+	Cmds int
+}
+
+// A patch command has been executed. Err is set if it failed.
+type CmdExecuted struct {
+	Cmd fmt.Stringer
+	Err os.Error
+}
+
+// A conflicting destination path has been moved aside.
+type ConflictFound struct {
+	Path      string
+	RelocPath string
+}
+
+// Execution of a patch plan has finished. Err is set if it failed.
+type SyncFinished struct {
+	Dst string
+	Err os.Error
+}
+
+// Receives published events.
+type Handler func(event Event)
+
+// Delivers published events to its subscribers.
+type Bus struct {
+	mutex    sync.RWMutex
+	handlers map[int]Handler
+	next     int
+}
+
+func NewBus() *Bus {
+	return &Bus{handlers: make(map[int]Handler)}
+}
+
+// Add a subscriber to the bus. Returns an id with which it
+// may later be unsubscribed.
+func (bus *Bus) Subscribe(handler Handler) int {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	bus.next++
+	bus.handlers[bus.next] = handler
+	return bus.next
+}
+
+// Remove a subscriber from the bus.
+func (bus *Bus) Unsubscribe(id int) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	bus.handlers[id] = nil, false
+}
+
+// Deliver an event to all current subscribers.
+func (bus *Bus) Publish(event Event) {
+	bus.mutex.RLock()
+	handlers := make([]Handler, 0, len(bus.handlers))
+	for _, handler := range bus.handlers {
+		handlers = append(handlers, handler)
+	}
+	bus.mutex.RUnlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+// The bus to which the pipeline publishes.
+var Default = NewBus()
+
+// Subscribe to the default bus.
+func Subscribe(handler Handler) int { return Default.Subscribe(handler) }
+
+// Unsubscribe from the default bus.
+func Unsubscribe(id int) { Default.Unsubscribe(id) }
+
+// Publish to the default bus.
+func Publish(event Event) { Default.Publish(event) }
+
+// Get a handler which logs each event it receives.
+func Log(logger *log.Logger) Handler {
+	return func(event Event) {
+		switch e := event.(type) {
+		case *IndexStarted:
+			logger.Printf("Indexing %s", e.Path)
+		case *FileHashed:
+			logger.Printf("Indexed %s (%d bytes)", e.Path, e.Size)
+		case *PlanReady:
+			logger.Printf("Planned %d commands for %s", e.Cmds, e.Dst)
+		case *CmdExecuted:
+			if e.Err != nil {
+				logger.Printf("%v: %v", e.Cmd, e.Err)
+			} else {
+				logger.Printf("%v", e.Cmd)
+			}
+		case *ConflictFound:
+			logger.Printf("Conflict at %s moved to %s", e.Path, e.RelocPath)
+		case *SyncFinished:
+			if e.Err != nil {
+				logger.Printf("Sync to %s failed: %v", e.Dst, e.Err)
+			} else {
+				logger.Printf("Sync to %s finished", e.Dst)
+			}
+		default:
+			logger.Printf("%v", event)
+		}
+	}
+}
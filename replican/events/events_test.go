@@ -0,0 +1,26 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+
+	var first, second []Event
+	id := bus.Subscribe(func(event Event) { first = append(first, event) })
+	bus.Subscribe(func(event Event) { second = append(second, event) })
+
+	bus.Publish(&IndexStarted{Path: "foo"})
+	assert.Equal(t, 1, len(first))
+	assert.Equal(t, 1, len(second))
+	assert.Equal(t, "foo", first[0].(*IndexStarted).Path)
+
+	bus.Unsubscribe(id)
+	bus.Publish(&SyncFinished{Dst: "bar"})
+	assert.Equal(t, 1, len(first))
+	assert.Equal(t, 2, len(second))
+	assert.Equal(t, "bar", second[1].(*SyncFinished).Dst)
+}
@@ -0,0 +1,95 @@
+package fs
+
+import (
+	"bytes"
+	"os"
+)
+
+// Names of the extended attributes in which Linux keeps POSIX ACLs:
+// the access ACL of a file or directory, and the default ACL which a
+// directory gives to entries created in it.
+const (
+	ACL_ACCESS_XATTR  = "system.posix_acl_access"
+	ACL_DEFAULT_XATTR = "system.posix_acl_default"
+)
+
+// The POSIX ACLs of a file or directory, beyond its mode bits, in the
+// encoding of their extended attributes, which every Linux host shares.
+// Either may be nil, if there is no such ACL.
+type Acls struct {
+	Access  []byte
+	Default []byte
+}
+
+// Test whether two sets of ACLs are the same. Nil is the same as no ACLs.
+func (acls *Acls) Equal(other *Acls) bool {
+	if acls == nil {
+		acls = &Acls{}
+	}
+	if other == nil {
+		other = &Acls{}
+	}
+	return bytes.Equal(acls.Access, other.Access) && bytes.Equal(acls.Default, other.Default)
+}
+
+// Read the POSIX ACLs of path, without following links.
+// Nil if it has none, or the platform or file system has none to read.
+func ReadAcls(path string) (*Acls, os.Error) {
+	names, err := listXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var acls *Acls
+	for _, name := range names {
+		if name != ACL_ACCESS_XATTR && name != ACL_DEFAULT_XATTR {
+			continue
+		}
+		value, err := getXattr(path, name)
+		if err != nil {
+			return nil, err
+		}
+		if acls == nil {
+			acls = &Acls{}
+		}
+		if name == ACL_ACCESS_XATTR {
+			acls.Access = value
+		} else {
+			acls.Default = value
+		}
+	}
+	return acls, nil
+}
+
+// Set the POSIX ACLs of path to acls, removing those it lacks.
+func WriteAcls(path string, acls *Acls) os.Error {
+	current, err := ReadAcls(path)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		current = &Acls{}
+	}
+	if acls == nil {
+		acls = &Acls{}
+	}
+
+	for _, acl := range []struct {
+		name   string
+		value  []byte
+		exists bool
+	}{
+		{ACL_ACCESS_XATTR, acls.Access, current.Access != nil},
+		{ACL_DEFAULT_XATTR, acls.Default, current.Default != nil}} {
+		switch {
+		case acl.value != nil:
+			err = setXattr(path, acl.name, acl.value)
+		case acl.exists:
+			err = removeXattr(path, acl.name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Check that relpath stays beneath root: that it does not climb out of
+// it, and that no directory along it is a symbolic link. With followLast,
+// its last name is checked too, for operations which would follow a link
+// there rather than act on the link itself.
+//
+// This stops a link planted in the tree from redirecting IO outside of
+// root, but not one swapped in between the check and the IO.
+func CheckBeneath(root string, relpath string, followLast bool) os.Error {
+	names := SplitNames(filepath.Clean(relpath))
+	path := root
+	for i, name := range names {
+		switch name {
+		case ".":
+			continue
+		case "..":
+			return os.NewError(fmt.Sprintf("%s escapes %s", relpath, root))
+		}
+
+		path = filepath.Join(path, name)
+		if i == len(names)-1 && !followLast {
+			break
+		}
+		if fi, err := os.Lstat(path); err == nil && fi.IsSymlink() {
+			return os.NewError(fmt.Sprintf(
+				"Refusing to follow symbolic link %s beneath %s", path, root))
+		}
+	}
+	return nil
+}
+
+// Check that a link to target, created at linkPath beneath root, points
+// beneath root too: that the target is relative, and does not climb out
+// of root from the link's directory. Links the target passes through are
+// not followed; those in the tree are refused by CheckBeneath wherever IO
+// would go through them.
+func CheckLinkBeneath(root string, linkPath string, target string) os.Error {
+	if filepath.IsAbs(target) {
+		return os.NewError(fmt.Sprintf(
+			"Refusing to link %s to absolute path %s", linkPath, target))
+	}
+	if !InRoot(root, filepath.Join(filepath.Dir(linkPath), target)) {
+		return os.NewError(fmt.Sprintf(
+			"Refusing to link %s to %s, outside of %s", linkPath, target, root))
+	}
+	return nil
+}
+
+// Open relpath beneath root, refusing to follow any symbolic link on the
+// way. This is the fallback for platforms where the kernel cannot confine
+// path resolution itself.
+func openChecked(root string, relpath string, flag int, perm uint32) (*os.File, os.Error) {
+	if err := CheckBeneath(root, relpath, true); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(filepath.Join(root, relpath), flag, perm)
+}
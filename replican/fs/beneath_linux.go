@@ -0,0 +1,56 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	_SYS_OPENAT2 = 437
+
+	_RESOLVE_NO_MAGICLINKS = 0x02
+	_RESOLVE_BENEATH       = 0x08
+)
+
+// struct open_how, from linux/openat2.h
+type openHow struct {
+	Flags   uint64
+	Mode    uint64
+	Resolve uint64
+}
+
+// Open relpath beneath the directory root. Resolution of the path,
+// including any symbolic links along it, may not leave root.
+//
+// The kernel enforces this with openat2 and RESOLVE_BENEATH, so even a
+// link swapped in while the path is resolved cannot escape. Kernels before
+// 5.6 lack openat2, and links along the path are refused instead.
+func OpenBeneath(root string, relpath string, flag int, perm uint32) (*os.File, os.Error) {
+	dir, err := os.Open(root)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	path := filepath.Join(root, relpath)
+	how := &openHow{
+		Flags:   uint64(flag | syscall.O_CLOEXEC),
+		Mode:    uint64(perm),
+		Resolve: _RESOLVE_BENEATH | _RESOLVE_NO_MAGICLINKS}
+
+	fd, _, errno := syscall.Syscall6(_SYS_OPENAT2,
+		uintptr(dir.Fd()),
+		uintptr(unsafe.Pointer(syscall.StringBytePtr(relpath))),
+		uintptr(unsafe.Pointer(how)),
+		unsafe.Sizeof(*how), 0, 0)
+	switch {
+	case int(errno) == syscall.ENOSYS:
+		return openChecked(root, relpath, flag, perm)
+	case errno != 0:
+		return nil, &os.PathError{Op: "openat2", Path: path, Error: os.Errno(errno)}
+	}
+
+	return os.NewFile(int(fd), path), nil
+}
@@ -0,0 +1,11 @@
+package fs
+
+import (
+	"os"
+)
+
+// Open relpath beneath the directory root. The kernel cannot confine path
+// resolution on this platform, so symbolic links along the path are refused.
+func OpenBeneath(root string, relpath string, flag int, perm uint32) (*os.File, os.Error) {
+	return openChecked(root, relpath, flag, perm)
+}
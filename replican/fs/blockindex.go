@@ -0,0 +1,326 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Marks the start of a block index file.
+const BLOCK_INDEX_MAGIC string = "RPLIDX01"
+
+// A compact, read-only index of the blocks in a tree, laid out on disk so
+// that it can be memory-mapped and searched in place. Opening a block index
+// costs the same whatever its size; nothing is read until it is searched.
+//
+// All integers are big-endian. The layout is:
+//
+//	header:  magic [8]byte, blocks uint32, files uint32, strings uint64
+//	blocks:  strong [20]byte, weak uint32, position uint32, file uint32,
+//	         sorted by strong
+//	weaks:   block record number uint32, sorted by the block's weak checksum;
+//	         padded to a multiple of 8 bytes
+//	files:   strong [20]byte, path offset uint32, path length uint32,
+//	         size uint64, block size uint32 or zero for BLOCKSIZE;
+//	         in order of fs.Walk
+//	strings: file paths relative to the root
+type BlockIndex struct {
+	data    []byte
+	nBlocks int
+	nFiles  int
+
+	blocksOff  int
+	weaksOff   int
+	filesOff   int
+	stringsOff int
+}
+
+const (
+	blockIndexHeaderSize = 24
+	blockRecordSize      = 32
+	fileRecordSize       = 40
+)
+
+// A block found in a BlockIndex.
+type IndexedBlock struct {
+	Strong   string
+	Weak     int
+	Position int
+
+	// Path of the containing file relative to the root, and its checksum and size.
+	Path       string
+	FileStrong string
+	FileSize   int64
+
+	// Block size of the file, or zero for BLOCKSIZE.
+	BlockSize int
+}
+
+// Get the byte offset of the block in its file.
+func (block *IndexedBlock) Offset() int64 {
+	if block.BlockSize == 0 {
+		return int64(block.Position) * int64(BLOCKSIZE)
+	}
+	return int64(block.Position) * int64(block.BlockSize)
+}
+
+type blockRecord struct {
+	strong []byte
+	weak   uint32
+	pos    uint32
+	file   uint32
+}
+
+type blockRecords []*blockRecord
+
+func (br blockRecords) Len() int { return len(br) }
+
+func (br blockRecords) Less(i, j int) bool {
+	if c := bytes.Compare(br[i].strong, br[j].strong); c != 0 {
+		return c < 0
+	}
+	if br[i].file != br[j].file {
+		return br[i].file < br[j].file
+	}
+	return br[i].pos < br[j].pos
+}
+
+func (br blockRecords) Swap(i, j int) { br[i], br[j] = br[j], br[i] }
+
+type weakOrder struct {
+	records blockRecords
+	order   []uint32
+}
+
+func (wo *weakOrder) Len() int { return len(wo.order) }
+
+func (wo *weakOrder) Less(i, j int) bool {
+	wi, wj := wo.records[wo.order[i]].weak, wo.records[wo.order[j]].weak
+	if wi != wj {
+		return wi < wj
+	}
+	return wo.order[i] < wo.order[j]
+}
+
+func (wo *weakOrder) Swap(i, j int) { wo.order[i], wo.order[j] = wo.order[j], wo.order[i] }
+
+func decodeStrong(strong string) ([]byte, os.Error) {
+	raw, err := hex.DecodeString(strong)
+	if err != nil || len(raw) != 20 {
+		return nil, os.NewError(fmt.Sprintf("Invalid strong checksum: %s", strong))
+	}
+	return raw, nil
+}
+
+// Write a block index of the tree under root.
+func WriteBlockIndex(w io.Writer, root FsNode) os.Error {
+	var files []File
+	Walk(root, func(node Node) bool {
+		if file, is := node.(File); is {
+			files = append(files, file)
+			return false
+		}
+		_, is := node.(Dir)
+		return is
+	})
+
+	records := blockRecords{}
+	paths := &bytes.Buffer{}
+	fileRecords := &bytes.Buffer{}
+
+	for i, file := range files {
+		// Records have a position, but no room for an offset
+		if IsChunked(file) {
+			return os.NewError(fmt.Sprintf(
+				"%s: a block index cannot hold files divided by content", RelPath(file)))
+		}
+
+		fileStrong, err := decodeStrong(file.Info().Strong)
+		if err != nil {
+			return err
+		}
+
+		path := RelPath(file)
+		fileRecords.Write(fileStrong)
+		binary.Write(fileRecords, binary.BigEndian, uint32(paths.Len()))
+		binary.Write(fileRecords, binary.BigEndian, uint32(len(path)))
+		binary.Write(fileRecords, binary.BigEndian, uint64(file.Info().Size))
+		if blockSize := FileBlockSize(file); blockSize == int64(BLOCKSIZE) {
+			binary.Write(fileRecords, binary.BigEndian, uint32(0))
+		} else {
+			binary.Write(fileRecords, binary.BigEndian, uint32(blockSize))
+		}
+		paths.WriteString(path)
+
+		for _, block := range file.Blocks() {
+			strong, err := decodeStrong(block.Info().Strong)
+			if err != nil {
+				return err
+			}
+			records = append(records, &blockRecord{
+				strong: strong,
+				weak:   uint32(block.Info().Weak),
+				pos:    uint32(block.Info().Position),
+				file:   uint32(i)})
+		}
+	}
+
+	sort.Sort(records)
+
+	weaks := &weakOrder{records: records, order: make([]uint32, len(records))}
+	for i := range weaks.order {
+		weaks.order[i] = uint32(i)
+	}
+	sort.Sort(weaks)
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(BLOCK_INDEX_MAGIC)
+	binary.Write(buf, binary.BigEndian, uint32(len(records)))
+	binary.Write(buf, binary.BigEndian, uint32(len(files)))
+	binary.Write(buf, binary.BigEndian, uint64(paths.Len()))
+
+	for _, record := range records {
+		buf.Write(record.strong)
+		binary.Write(buf, binary.BigEndian, record.weak)
+		binary.Write(buf, binary.BigEndian, record.pos)
+		binary.Write(buf, binary.BigEndian, record.file)
+	}
+
+	for _, i := range weaks.order {
+		binary.Write(buf, binary.BigEndian, i)
+	}
+	if len(weaks.order)%2 == 1 {
+		binary.Write(buf, binary.BigEndian, uint32(0))
+	}
+
+	fileRecords.WriteTo(buf)
+	paths.WriteTo(buf)
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// Open a block index file, mapping it into memory.
+func OpenBlockIndex(path string) (*BlockIndex, os.Error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size < blockIndexHeaderSize {
+		return nil, os.NewError(fmt.Sprintf("%s: not a block index", path))
+	}
+
+	data, err := mapFile(f, int(fi.Size))
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := newBlockIndex(data)
+	if err != nil {
+		unmapFile(data)
+		return nil, os.NewError(fmt.Sprintf("%s: %v", path, err))
+	}
+	return index, nil
+}
+
+func newBlockIndex(data []byte) (*BlockIndex, os.Error) {
+	if string(data[:len(BLOCK_INDEX_MAGIC)]) != BLOCK_INDEX_MAGIC {
+		return nil, os.NewError("not a block index")
+	}
+
+	index := &BlockIndex{
+		data:    data,
+		nBlocks: int(binary.BigEndian.Uint32(data[8:])),
+		nFiles:  int(binary.BigEndian.Uint32(data[12:]))}
+	stringsLen := int(binary.BigEndian.Uint64(data[16:]))
+
+	index.blocksOff = blockIndexHeaderSize
+	index.weaksOff = index.blocksOff + index.nBlocks*blockRecordSize
+	index.filesOff = index.weaksOff + (index.nBlocks+index.nBlocks%2)*4
+	index.stringsOff = index.filesOff + index.nFiles*fileRecordSize
+
+	if index.stringsOff+stringsLen != len(data) {
+		return nil, os.NewError("block index is truncated or corrupt")
+	}
+	return index, nil
+}
+
+// Unmap the index. It must not be used afterwards.
+func (index *BlockIndex) Close() os.Error {
+	data := index.data
+	index.data = nil
+	return unmapFile(data)
+}
+
+// Get the number of blocks in the index.
+func (index *BlockIndex) Len() int { return index.nBlocks }
+
+func (index *BlockIndex) blockRecord(i int) []byte {
+	off := index.blocksOff + i*blockRecordSize
+	return index.data[off : off+blockRecordSize]
+}
+
+func (index *BlockIndex) indexedBlock(i int) *IndexedBlock {
+	record := index.blockRecord(i)
+	file := int(binary.BigEndian.Uint32(record[28:]))
+
+	fileOff := index.filesOff + file*fileRecordSize
+	fileRecord := index.data[fileOff : fileOff+fileRecordSize]
+	pathOff := index.stringsOff + int(binary.BigEndian.Uint32(fileRecord[20:]))
+	pathLen := int(binary.BigEndian.Uint32(fileRecord[24:]))
+
+	return &IndexedBlock{
+		Strong:     hex.EncodeToString(record[:20]),
+		Weak:       int(binary.BigEndian.Uint32(record[20:])),
+		Position:   int(binary.BigEndian.Uint32(record[24:])),
+		Path:       string(index.data[pathOff : pathOff+pathLen]),
+		FileStrong: hex.EncodeToString(fileRecord[:20]),
+		FileSize:   int64(binary.BigEndian.Uint64(fileRecord[28:])),
+		BlockSize:  int(binary.BigEndian.Uint32(fileRecord[36:]))}
+}
+
+// Find a block by strong checksum. Where the same block appears in several
+// files, the first in walk order is found.
+func (index *BlockIndex) Block(strong string) (*IndexedBlock, bool) {
+	key, err := decodeStrong(strong)
+	if err != nil {
+		return nil, false
+	}
+
+	i := sort.Search(index.nBlocks, func(i int) bool {
+		return bytes.Compare(index.blockRecord(i)[:20], key) >= 0
+	})
+	if i < index.nBlocks && bytes.Equal(index.blockRecord(i)[:20], key) {
+		return index.indexedBlock(i), true
+	}
+	return nil, false
+}
+
+func (index *BlockIndex) weakRecord(i int) int {
+	return int(binary.BigEndian.Uint32(index.data[index.weaksOff+i*4:]))
+}
+
+// Find all the blocks having a weak checksum.
+func (index *BlockIndex) WeakBlocks(weak int) []*IndexedBlock {
+	blockWeak := func(i int) uint32 {
+		return binary.BigEndian.Uint32(index.blockRecord(index.weakRecord(i))[20:])
+	}
+
+	blocks := []*IndexedBlock{}
+	for i := sort.Search(index.nBlocks, func(i int) bool {
+		return blockWeak(i) >= uint32(weak)
+	}); i < index.nBlocks && blockWeak(i) == uint32(weak); i++ {
+		blocks = append(blocks, index.indexedBlock(index.weakRecord(i)))
+	}
+	return blocks
+}
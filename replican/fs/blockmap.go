@@ -0,0 +1,212 @@
+package fs
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"json"
+	"os"
+	"path/filepath"
+)
+
+// Cache the block maps of large files, such as virtual machine images,
+// so that repeated syncs need not rehash them in full.
+//
+// Block maps are keyed by file identity (device and inode). A file whose
+// size and modification time are unchanged is not read at all. Otherwise,
+// if TrustExtents is set and the platform can report the file's extents
+// (FIEMAP on Linux), blocks lying entirely within extents unchanged since
+// the last scan keep their cached checksums, and only the rest are rehashed.
+// Extents are only a sound guide to change on copy-on-write filesystems,
+// where rewritten data is always given new extents; elsewhere, leave
+// TrustExtents unset.
+//
+// Since a cached file is not read in full, its strong checksum is not the
+// SHA-1 of its content as from IndexFile, but the SHA-1 of its block strong
+// checksums in order. Cached block maps are therefore comparable with each
+// other, but not with block maps from IndexFile.
+type BlockMapCache struct {
+	Dir string
+
+	TrustExtents bool
+
+	// Number of blocks hashed by the last call to IndexFile.
+	Rehashed int
+}
+
+// A contiguous region of a file's data on its device.
+type Extent struct {
+	Logical  int64
+	Physical int64
+	Length   int64
+}
+
+func (extent *Extent) String() string {
+	return fmt.Sprintf("%d+%d@%d", extent.Logical, extent.Length, extent.Physical)
+}
+
+type blockMapEntry struct {
+	Size    int64
+	Mtime   int64
+	Info    *FileInfo
+	Blocks  []*BlockInfo
+	Extents []*Extent
+}
+
+func NewBlockMapCache(dir string) *BlockMapCache {
+	return &BlockMapCache{Dir: dir}
+}
+
+func (cache *BlockMapCache) entryPath(fi *os.FileInfo) string {
+	return filepath.Join(cache.Dir, fmt.Sprintf("%x-%x", fi.Dev, fi.Ino))
+}
+
+func (cache *BlockMapCache) load(path string) *blockMapEntry {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	entry := &blockMapEntry{}
+	if err = json.Unmarshal(buf, entry); err != nil {
+		return nil
+	}
+	return entry
+}
+
+func (cache *BlockMapCache) save(path string, entry *blockMapEntry) os.Error {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(cache.Dir, 0755); err != nil {
+		return err
+	}
+
+	tempF, err := ioutil.TempFile(cache.Dir, "blockmap")
+	if err != nil {
+		return err
+	}
+
+	_, err = tempF.Write(buf)
+	tempF.Close()
+	if err != nil {
+		os.Remove(tempF.Name())
+		return err
+	}
+
+	return os.Rename(tempF.Name(), path)
+}
+
+// Build the block map of a file, reusing what the cache knows of it.
+func (cache *BlockMapCache) IndexFile(path string) (*FileInfo, []*BlockInfo, os.Error) {
+	cache.Rehashed = 0
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !fi.IsRegular() {
+		return nil, nil, os.NewError(fmt.Sprintf("%s: not a regular file", path))
+	}
+
+	entryPath := cache.entryPath(fi)
+	prev := cache.load(entryPath)
+	if prev != nil && prev.Size == fi.Size && prev.Mtime == fi.Mtime_ns {
+		return prev.Info, prev.Blocks, nil
+	}
+
+	var extents []*Extent
+	var trusted func(from int64, to int64) bool
+	if cache.TrustExtents {
+		if extents, err = FileExtents(f); err == nil && prev != nil {
+			trusted = unchangedExtents(prev.Extents, extents)
+		}
+	}
+
+	_, name := filepath.Split(path)
+	info := &FileInfo{Name: name, Mode: fi.Mode, Size: fi.Size}
+	blocks := []*BlockInfo{}
+	fileHash := sha1.New()
+
+	buf := make([]byte, BLOCKSIZE)
+	for pos := 0; int64(pos)*int64(BLOCKSIZE) < fi.Size; pos++ {
+		from := int64(pos) * int64(BLOCKSIZE)
+		to := from + int64(BLOCKSIZE)
+		if to > fi.Size {
+			to = fi.Size
+		}
+
+		var block *BlockInfo
+		if trusted != nil && pos < len(prev.Blocks) &&
+			prev.Size >= to && (to-from == int64(BLOCKSIZE) || prev.Size == fi.Size) &&
+			trusted(from, to) {
+			block = prev.Blocks[pos]
+		} else {
+			rd, err := f.ReadAt(buf[:to-from], from)
+			if int64(rd) != to-from {
+				if err == nil {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, nil, err
+			}
+
+			block = IndexBlock(buf[:rd])
+			block.Position = pos
+			cache.Rehashed++
+		}
+
+		blocks = append(blocks, block)
+		fileHash.Write([]byte(block.Strong))
+	}
+
+	info.Strong = toHexString(fileHash)
+	for _, block := range blocks {
+		block.Parent = info.Strong
+	}
+
+	err = cache.save(entryPath, &blockMapEntry{
+		Size: fi.Size, Mtime: fi.Mtime_ns, Info: info, Blocks: blocks, Extents: extents})
+	return info, blocks, err
+}
+
+// Get a test of whether a range of a file lies entirely within extents
+// which are the same now as before.
+func unchangedExtents(before []*Extent, after []*Extent) func(from int64, to int64) bool {
+	same := make(map[string]bool)
+	for _, extent := range before {
+		same[extent.String()] = true
+	}
+
+	kept := []*Extent{}
+	for _, extent := range after {
+		if same[extent.String()] {
+			kept = append(kept, extent)
+		}
+	}
+
+	return func(from int64, to int64) bool {
+		for from < to {
+			covered := false
+			for _, extent := range kept {
+				if extent.Logical <= from && from < extent.Logical+extent.Length {
+					from = extent.Logical + extent.Length
+					covered = true
+					break
+				}
+			}
+			if !covered {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,130 @@
+package fs
+
+import (
+	"io"
+	"os"
+)
+
+// How files are divided into blocks.
+type Chunking int
+
+const (
+	// Blocks of the block size. Inserting or deleting bytes shifts the
+	// content of every block after the change, so none of them match.
+	CHUNK_FIXED Chunking = iota
+
+	// Blocks which end where a rolling hash of the content before them
+	// meets a condition, so that their boundaries move with the content
+	// around an insertion or deletion, and only the blocks it touches
+	// differ. Blocks are around the block size, from a quarter of it to
+	// eight times it.
+	CHUNK_CONTENT
+)
+
+// Bytes the rolling hash of CHUNK_CONTENT is calculated over.
+const CHUNK_WINDOW = 48
+
+// Table of the buzhash rolling hash. Any table of random values will do,
+// but every host must use the same one to choose the same boundaries, so
+// it is generated here rather than with math/rand.
+var buzTable [256]uint32
+
+func init() {
+	x := uint32(0x9e3779b9)
+	for i := range buzTable {
+		// xorshift32
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		buzTable[i] = x
+	}
+}
+
+func rotl(x uint32, n uint) uint32 {
+	n %= 32
+	return x<<n | x>>(32-n)
+}
+
+// Divides a stream into blocks by their content. See CHUNK_CONTENT.
+type Chunker struct {
+	r    io.Reader
+	min  int
+	max  int
+	mask uint32
+
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+}
+
+// Divide the content read from r into blocks around blockSize.
+// If zero, BLOCKSIZE.
+func NewChunker(r io.Reader, blockSize int) *Chunker {
+	if blockSize == 0 {
+		blockSize = BLOCKSIZE
+	}
+	chunker := &Chunker{r: r, min: blockSize / 4, max: blockSize * 8}
+	if chunker.min < CHUNK_WINDOW {
+		chunker.min = CHUNK_WINDOW
+	}
+	if chunker.max < chunker.min {
+		chunker.max = chunker.min
+	}
+
+	// Past the minimum, a boundary is found on average every
+	// mask+1 bytes.
+	bits := uint(0)
+	for 1<<(bits+1) <= blockSize-chunker.min {
+		bits++
+	}
+	chunker.mask = 1<<bits - 1
+
+	chunker.buf = make([]byte, chunker.max)
+	return chunker
+}
+
+// Get the next block, which is only valid until the next call.
+// At the end of the stream, returns os.EOF.
+func (chunker *Chunker) Next() ([]byte, os.Error) {
+	if chunker.end-chunker.start < chunker.max && !chunker.eof {
+		copy(chunker.buf, chunker.buf[chunker.start:chunker.end])
+		chunker.end -= chunker.start
+		chunker.start = 0
+
+		n, err := io.ReadFull(chunker.r, chunker.buf[chunker.end:])
+		chunker.end += n
+		if err == os.EOF || err == io.ErrUnexpectedEOF {
+			chunker.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	data := chunker.buf[chunker.start:chunker.end]
+	if len(data) == 0 {
+		return nil, os.EOF
+	}
+	n := chunker.cut(data)
+	chunker.start += n
+	return data[:n], nil
+}
+
+// Get the length of the block at the start of data.
+func (chunker *Chunker) cut(data []byte) int {
+	if len(data) <= chunker.min {
+		return len(data)
+	}
+
+	var h uint32
+	for i := chunker.min - CHUNK_WINDOW; i < chunker.min; i++ {
+		h = rotl(h, 1) ^ buzTable[data[i]]
+	}
+	for i := chunker.min; i < len(data); i++ {
+		if h&chunker.mask == 0 {
+			return i
+		}
+		h = rotl(h, 1) ^ rotl(buzTable[data[i-CHUNK_WINDOW]], CHUNK_WINDOW) ^ buzTable[data[i]]
+	}
+	return len(data)
+}
@@ -0,0 +1,60 @@
+package fs
+
+import (
+	"compress/gzip"
+	"os"
+	"strings"
+)
+
+// Suffix of files stored compressed in a destination.
+const GZIP_SUFFIX = ".gz"
+
+type gunzipFS struct {
+	vfs VirtualFS
+}
+
+// Get a VirtualFS in which each file stored as name.gz reads as name,
+// decompressed. Other files read as they are.
+func GunzipFS(vfs VirtualFS) VirtualFS {
+	return &gunzipFS{vfs: vfs}
+}
+
+type gunzipDir struct {
+	VirtualFile
+}
+
+func (dir *gunzipDir) Readdir(count int) ([]os.FileInfo, os.Error) {
+	entries, err := dir.VirtualFile.Readdir(count)
+	for i := range entries {
+		name := entries[i].Name
+		if entries[i].IsRegular() && strings.HasSuffix(name, GZIP_SUFFIX) {
+			entries[i].Name = name[:len(name)-len(GZIP_SUFFIX)]
+		}
+	}
+	return entries, err
+}
+
+func (gfs *gunzipFS) Open(name string) (VirtualFile, os.Error) {
+	if f, err := gfs.vfs.Open(name + GZIP_SUFFIX); err == nil {
+		r, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &transformedFile{VirtualFile: f, r: r}, nil
+	}
+
+	f, err := gfs.vfs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &gunzipDir{VirtualFile: f}, nil
+}
+
+// Open a tree whose files are stored gzip-compressed, as written by a
+// compressed sync. The tree is indexed by its uncompressed content, and
+// reads from the store are decompressed, so it can be the source of a sync
+// which restores it.
+func NewCompressedStore(rootPath string, repo NodeRepo) (*VirtualStore, os.Error) {
+	return NewVirtualStore(GunzipFS(DirFS(rootPath)), repo)
+}
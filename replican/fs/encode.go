@@ -0,0 +1,218 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Node info structs have a canonical encoding, so that manifests, network
+// peers and persistent repos built on it agree byte for byte whatever
+// platform or release wrote them.
+//
+// All integers are big-endian. Strong checksums are a length uint8
+// followed by the raw checksum, so that an empty checksum, such as the
+// parent of a root, is a single zero byte. Names are a length uint32
+// followed by their UTF-8 bytes. Each record starts with a tag byte
+// naming its type. The layouts are:
+//
+//	block: 'B', position uint32, weak uint32, strong, parent
+//	file:  'F', mode uint32, size uint64, strong, parent, name
+//	dir:   'D', mode uint32, strong, parent, name
+const (
+	BLOCK_INFO_TAG byte = 'B'
+	FILE_INFO_TAG  byte = 'F'
+	DIR_INFO_TAG   byte = 'D'
+)
+
+// Longest name a decoder will accept, well beyond any platform's limit,
+// so that a corrupt length cannot exhaust memory.
+const maxEncodedName = 1 << 16
+
+// Encode a block's info in the canonical encoding.
+func EncodeBlockInfo(w io.Writer, info *BlockInfo) os.Error {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(BLOCK_INFO_TAG)
+	binary.Write(buf, binary.BigEndian, uint32(info.Position))
+	binary.Write(buf, binary.BigEndian, uint32(info.Weak))
+	if err := encodeStrongs(buf, info.Strong, info.Parent); err != nil {
+		return err
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// Encode a file's info in the canonical encoding.
+func EncodeFileInfo(w io.Writer, info *FileInfo) os.Error {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(FILE_INFO_TAG)
+	binary.Write(buf, binary.BigEndian, info.Mode)
+	binary.Write(buf, binary.BigEndian, uint64(info.Size))
+	if err := encodeStrongs(buf, info.Strong, info.Parent); err != nil {
+		return err
+	}
+	encodeName(buf, info.Name)
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// Encode a directory's info in the canonical encoding.
+// Temporary checksums, given to directories before their contents
+// are indexed, cannot be encoded.
+func EncodeDirInfo(w io.Writer, info *DirInfo) os.Error {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(DIR_INFO_TAG)
+	binary.Write(buf, binary.BigEndian, info.Mode)
+	if err := encodeStrongs(buf, info.Strong, info.Parent); err != nil {
+		return err
+	}
+	encodeName(buf, info.Name)
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// Decode a block's info written by EncodeBlockInfo.
+func DecodeBlockInfo(r io.Reader) (*BlockInfo, os.Error) {
+	if err := decodeTag(r, BLOCK_INFO_TAG); err != nil {
+		return nil, err
+	}
+
+	var position, weak uint32
+	if err := binary.Read(r, binary.BigEndian, &position); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &weak); err != nil {
+		return nil, err
+	}
+
+	info := &BlockInfo{Position: int(position), Weak: int(weak)}
+	var err os.Error
+	if info.Strong, err = decodeChecksum(r); err != nil {
+		return nil, err
+	}
+	if info.Parent, err = decodeChecksum(r); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Decode a file's info written by EncodeFileInfo.
+func DecodeFileInfo(r io.Reader) (*FileInfo, os.Error) {
+	if err := decodeTag(r, FILE_INFO_TAG); err != nil {
+		return nil, err
+	}
+
+	var size uint64
+	info := &FileInfo{}
+	if err := binary.Read(r, binary.BigEndian, &info.Mode); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	info.Size = int64(size)
+
+	var err os.Error
+	if info.Strong, err = decodeChecksum(r); err != nil {
+		return nil, err
+	}
+	if info.Parent, err = decodeChecksum(r); err != nil {
+		return nil, err
+	}
+	if info.Name, err = decodeName(r); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Decode a directory's info written by EncodeDirInfo.
+func DecodeDirInfo(r io.Reader) (*DirInfo, os.Error) {
+	if err := decodeTag(r, DIR_INFO_TAG); err != nil {
+		return nil, err
+	}
+
+	info := &DirInfo{}
+	if err := binary.Read(r, binary.BigEndian, &info.Mode); err != nil {
+		return nil, err
+	}
+
+	var err os.Error
+	if info.Strong, err = decodeChecksum(r); err != nil {
+		return nil, err
+	}
+	if info.Parent, err = decodeChecksum(r); err != nil {
+		return nil, err
+	}
+	if info.Name, err = decodeName(r); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func encodeStrongs(buf *bytes.Buffer, strongs ...string) os.Error {
+	for _, strong := range strongs {
+		if strong == "" {
+			buf.WriteByte(0)
+			continue
+		}
+
+		raw, err := decodeStrong(strong)
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(byte(len(raw)))
+		buf.Write(raw)
+	}
+	return nil
+}
+
+func encodeName(buf *bytes.Buffer, name string) {
+	binary.Write(buf, binary.BigEndian, uint32(len(name)))
+	buf.WriteString(name)
+}
+
+func decodeTag(r io.Reader, tag byte) os.Error {
+	var got [1]byte
+	if _, err := io.ReadFull(r, got[:]); err != nil {
+		return err
+	}
+	if got[0] != tag {
+		return os.NewError(fmt.Sprintf("Expected record tag %q, found %q", tag, got[0]))
+	}
+	return nil
+}
+
+func decodeChecksum(r io.Reader) (string, os.Error) {
+	var length [1]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return "", err
+	}
+
+	raw := make([]byte, length[0])
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+func decodeName(r io.Reader) (string, os.Error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	if length > maxEncodedName {
+		return "", os.NewError(fmt.Sprintf("Encoded name too long: %d bytes", length))
+	}
+
+	raw := make([]byte, length)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
@@ -0,0 +1,78 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+// The canonical encoding must never change: these were written by hand
+// from the documented layouts.
+const (
+	goldenBlock = "42000000031234abcd" +
+		"140214b4b355d11ca8f2ce45a968c264651bdfbf83" +
+		"14971c419dd609331343dee105fffd0f4608dc0bf2"
+	goldenFile = "46000081a40000000000010001" +
+		"14971c419dd609331343dee105fffd0f4608dc0bf2" +
+		"147ee737c83ee689c96ef37d3a029068c390ebc8f8" +
+		"0000000462c3a472"
+	goldenDir = "44000041ed" +
+		"147ee737c83ee689c96ef37d3a029068c390ebc8f8" +
+		"00" +
+		"00000000"
+)
+
+func TestEncodeGolden(t *testing.T) {
+	blockInfo := &BlockInfo{
+		Position: 3,
+		Weak:     0x1234abcd,
+		Strong:   StrongChecksum([]byte("block")),
+		Parent:   StrongChecksum([]byte("file"))}
+	fileInfo := &FileInfo{
+		Name:   "bär",
+		Mode:   0100644,
+		Size:   65537,
+		Strong: StrongChecksum([]byte("file")),
+		Parent: StrongChecksum([]byte("dir"))}
+	dirInfo := &DirInfo{
+		Mode:   040755,
+		Strong: StrongChecksum([]byte("dir"))}
+
+	buf := &bytes.Buffer{}
+	assert.T(t, EncodeBlockInfo(buf, blockInfo) == nil)
+	assert.Equal(t, goldenBlock, hex.EncodeToString(buf.Bytes()))
+	decodedBlock, err := DecodeBlockInfo(buf)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, blockInfo, decodedBlock)
+
+	buf = &bytes.Buffer{}
+	assert.T(t, EncodeFileInfo(buf, fileInfo) == nil)
+	assert.Equal(t, goldenFile, hex.EncodeToString(buf.Bytes()))
+	decodedFile, err := DecodeFileInfo(buf)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, fileInfo, decodedFile)
+
+	buf = &bytes.Buffer{}
+	assert.T(t, EncodeDirInfo(buf, dirInfo) == nil)
+	assert.Equal(t, goldenDir, hex.EncodeToString(buf.Bytes()))
+	decodedDir, err := DecodeDirInfo(buf)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, dirInfo, decodedDir)
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	// Records of one type are not decoded as another.
+	raw, _ := hex.DecodeString(goldenFile)
+	_, err := DecodeDirInfo(bytes.NewBuffer(raw))
+	assert.T(t, err != nil)
+
+	// Nor are truncated records.
+	_, err = DecodeFileInfo(bytes.NewBuffer(raw[:len(raw)-1]))
+	assert.T(t, err != nil)
+
+	// Temporary checksums have no encoding.
+	err = EncodeDirInfo(&bytes.Buffer{}, &DirInfo{Strong: "tmp0"})
+	assert.T(t, err != nil)
+}
@@ -0,0 +1,11 @@
+package fs
+
+import (
+	"os"
+)
+
+// Swap the files or directories at path1 and path2 in one step. The kernel
+// cannot exchange paths on this platform, so both are left as they were.
+func Exchange(path1 string, path2 string) (bool, os.Error) {
+	return false, nil
+}
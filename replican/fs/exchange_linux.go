@@ -0,0 +1,33 @@
+package fs
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	_AT_FDCWD        = -100
+	_RENAME_EXCHANGE = 1 << 1
+)
+
+// Swap the files or directories at path1 and path2 in one step, so that
+// neither path is ever missing. Returns false, leaving both as they were,
+// where paths cannot be exchanged.
+//
+// Linux 3.15 and later exchange them with renameat2 and RENAME_EXCHANGE,
+// on filesystems which support it.
+func Exchange(path1 string, path2 string) (bool, os.Error) {
+	cwd := _AT_FDCWD
+	_, _, errno := syscall.Syscall6(_SYS_RENAMEAT2,
+		uintptr(cwd), uintptr(unsafe.Pointer(syscall.StringBytePtr(path1))),
+		uintptr(cwd), uintptr(unsafe.Pointer(syscall.StringBytePtr(path2))),
+		_RENAME_EXCHANGE, 0)
+	switch {
+	case int(errno) == syscall.ENOSYS || int(errno) == syscall.EINVAL:
+		return false, nil
+	case errno != 0:
+		return false, &os.LinkError{Op: "renameat2", Old: path1, New: path2, Error: os.Errno(errno)}
+	}
+	return true, nil
+}
@@ -0,0 +1,3 @@
+package fs
+
+const _SYS_RENAMEAT2 = 382
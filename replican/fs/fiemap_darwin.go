@@ -0,0 +1,10 @@
+package fs
+
+import (
+	"os"
+)
+
+// Get the extents of a file's data. Not supported on this platform.
+func FileExtents(f *os.File) ([]*Extent, os.Error) {
+	return nil, os.NewError("File extents are not available on this platform")
+}
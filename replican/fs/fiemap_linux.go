@@ -0,0 +1,75 @@
+package fs
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	FS_IOC_FIEMAP      = 0xC020660B
+	FIEMAP_FLAG_SYNC   = 0x1
+	FIEMAP_EXTENT_LAST = 0x1
+
+	// Flags of extents whose location is not yet, or not simply, known.
+	FIEMAP_EXTENT_UNKNOWN  = 0x2
+	FIEMAP_EXTENT_DELALLOC = 0x4
+	FIEMAP_EXTENT_ENCODED  = 0x8
+
+	fiemapBatch = 32
+)
+
+type fiemapExtent struct {
+	Logical    uint64
+	Physical   uint64
+	Length     uint64
+	reserved64 [2]uint64
+	Flags      uint32
+	reserved   [3]uint32
+}
+
+type fiemap struct {
+	Start         uint64
+	Length        uint64
+	Flags         uint32
+	MappedExtents uint32
+	ExtentCount   uint32
+	reserved      uint32
+	Extents       [fiemapBatch]fiemapExtent
+}
+
+// Get the extents of a file's data, by way of the FIEMAP ioctl.
+func FileExtents(f *os.File) ([]*Extent, os.Error) {
+	extents := []*Extent{}
+	var start uint64
+
+	for {
+		fm := &fiemap{Start: start, Length: ^uint64(0), Flags: FIEMAP_FLAG_SYNC, ExtentCount: fiemapBatch}
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL,
+			uintptr(f.Fd()), FS_IOC_FIEMAP, uintptr(unsafe.Pointer(fm)))
+		if errno != 0 {
+			return nil, os.NewSyscallError("ioctl FS_IOC_FIEMAP", int(errno))
+		}
+
+		if fm.MappedExtents == 0 {
+			return extents, nil
+		}
+
+		for i := uint32(0); i < fm.MappedExtents; i++ {
+			fe := &fm.Extents[i]
+			if fe.Flags&(FIEMAP_EXTENT_UNKNOWN|FIEMAP_EXTENT_DELALLOC|FIEMAP_EXTENT_ENCODED) == 0 {
+				extents = append(extents, &Extent{
+					Logical:  int64(fe.Logical),
+					Physical: int64(fe.Physical),
+					Length:   int64(fe.Length)})
+			}
+
+			if fe.Flags&FIEMAP_EXTENT_LAST != 0 {
+				return extents, nil
+			}
+			start = fe.Logical + fe.Length
+		}
+	}
+
+	panic("Impossible")
+}
@@ -4,21 +4,28 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"hash"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/cmars/replican-sync/replican/events"
 )
 
 // Represent a weak checksum as described in the rsync algorithm paper
 type WeakChecksum struct {
 	a int
 	b int
+
+	// Length of the window rolled over
+	n int
 }
 
 // Reset the state of the checksum
 func (weak *WeakChecksum) Reset() {
 	weak.a = 0
 	weak.b = 0
+	weak.n = 0
 }
 
 // Write a block of data into the checksum
@@ -28,6 +35,7 @@ func (weak *WeakChecksum) Write(buf []byte) {
 		weak.a += b
 		weak.b += (len(buf) - i) * b
 	}
+	weak.n += len(buf)
 }
 
 // Get the current weak checksum value
@@ -38,7 +46,7 @@ func (weak *WeakChecksum) Get() int {
 // Roll the checksum forward by one byte
 func (weak *WeakChecksum) Roll(removedByte byte, newByte byte) {
 	weak.a -= int(removedByte) - int(newByte)
-	weak.b -= int(removedByte)*BLOCKSIZE - weak.a
+	weak.b -= int(removedByte)*weak.n - weak.a
 }
 
 type IndexFilter func(path string, f *os.FileInfo) bool
@@ -67,14 +75,119 @@ func AnyMatch(filters ...IndexFilter) IndexFilter {
 	}
 }
 
+// How the Indexer treats symbolic links.
+type SymlinkPolicy int
+
+const (
+	// Index the files links point to. Links to directories are
+	// reported as errors.
+	SYMLINKS_FILES SymlinkPolicy = iota
+
+	// Leave links out of the index.
+	SYMLINKS_SKIP
+
+	// Index each link as a file whose content is the link target,
+	// to be recreated as a link when patched. There is no node type of
+	// its own for a link: it is a File whose mode has the link bit, as
+	// tested with IsSymlinkMode, so that every repo, and every encoding
+	// of files, carries links unchanged. Directory checksums tell links
+	// from files.
+	SYMLINKS_STORE
+
+	// Index whatever links point to, descending into linked directories.
+	// Links back to a directory already being indexed are reported as
+	// errors, as are links nested more than MaxLinkDepth deep.
+	SYMLINKS_FOLLOW
+)
+
+// How the Indexer treats version control repositories, which are easily
+// corrupted by copying them while a commit or checkout is under way.
+type VcsPolicy int
+
+const (
+	// Index repositories like any other directory.
+	VCS_ASIS VcsPolicy = iota
+
+	// Leave out every directory which is a repository, with its
+	// working tree.
+	VCS_EXCLUDE
+
+	// Index the working tree of each repository, leaving out the
+	// repository metadata, such as .git.
+	VCS_WORKTREE
+)
+
+// Names of the metadata kept by the recognized version control systems.
+var VCS_NAMES []string = []string{".git", ".hg", ".svn"}
+
+// Test whether a name is the metadata of a version control system.
+func IsVcsName(name string) bool {
+	for _, vcsName := range VCS_NAMES {
+		if name == vcsName {
+			return true
+		}
+	}
+	return false
+}
+
+// Test whether a directory is the working tree of a repository.
+func IsVcsWorkTree(path string) bool {
+	for _, vcsName := range VCS_NAMES {
+		if _, err := os.Lstat(filepath.Join(path, vcsName)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Default limit on links followed within links.
+const DEFAULT_MAX_LINK_DEPTH = 8
+
 type Indexer struct {
 	Path   string
 	Repo   NodeRepo
 	Filter IndexFilter
 	Errors chan<- os.Error
 
-	root   Dir
-	dirMap map[string]Dir
+	Symlinks SymlinkPolicy
+
+	Vcs VcsPolicy
+
+	// Index extended attributes in XATTR_NAMESPACES. Not every NodeRepo
+	// keeps them.
+	Xattrs bool
+
+	// Index POSIX ACLs. Not every NodeRepo keeps them.
+	Acls bool
+
+	// Limit on links followed within links, with SYMLINKS_FOLLOW.
+	// If zero, DEFAULT_MAX_LINK_DEPTH.
+	MaxLinkDepth int
+
+	// Stay on the device of the root, like rsync -x. Directories which
+	// are mount points of other file systems are indexed, but left empty.
+	OneFileSystem bool
+
+	// Size of the blocks files are divided into. If zero, BLOCKSIZE.
+	BlockSize int
+
+	// How files are divided into blocks.
+	Chunking Chunking
+
+	// Reuse the checksums of files unchanged since they were last indexed
+	// through the cache. If nil, every file is hashed.
+	Cache *IndexCache
+
+	// Calculate only the strong checksums of files, leaving their blocks
+	// to be hashed when they are first asked for. Only a LazyRepo defers
+	// them.
+	LazyBlocks bool
+
+	root      Dir
+	dirMap    map[string]Dir
+	listed    map[string]bool
+	linkDepth int
+	rootDev   uint64
 }
 
 // Initialize the Indexer for filepath.Walk visit
@@ -90,6 +203,7 @@ func (indexer *Indexer) initWalk() {
 	indexer.dirMap = make(map[string]Dir)
 
 	if rootInfo, err := os.Stat(indexer.Path); err == nil {
+		indexer.rootDev = rootInfo.Dev
 		indexer.VisitDir(indexer.Path, rootInfo)
 		indexer.root = indexer.dirMap[indexer.Path]
 	}
@@ -102,6 +216,10 @@ func (indexer *Indexer) VisitDir(path string, f *os.FileInfo) bool {
 	}
 
 	path = filepath.Clean(path)
+	if path != indexer.Path && indexer.skipVcs(path) {
+		return false
+	}
+
 	dir, hasDir := indexer.dirMap[path]
 	if !hasDir {
 		dirname, basename := filepath.Split(path)
@@ -109,8 +227,12 @@ func (indexer *Indexer) VisitDir(path string, f *os.FileInfo) bool {
 
 		parentDir, hasParent := indexer.dirMap[dirname]
 		info := &DirInfo{
-			Name: basename,
-			Mode: f.Mode}
+			Name:   basename,
+			Mode:   f.Mode,
+			Mtime:  f.Mtime_ns,
+			Owner:  StatOwner(f),
+			Xattrs: indexer.readXattrs(path),
+			Acls:   indexer.readAcls(path)}
 		if hasParent {
 			info.Parent = parentDir.Info().Strong
 			dir = indexer.Repo.AddDir(parentDir, info)
@@ -121,6 +243,12 @@ func (indexer *Indexer) VisitDir(path string, f *os.FileInfo) bool {
 		indexer.dirMap[path] = dir
 	}
 
+	// Mount points belong to both file systems; keep the directory,
+	// but not what is mounted on it.
+	if indexer.OneFileSystem && f.Dev != indexer.rootDev {
+		return false
+	}
+
 	return true
 }
 
@@ -130,7 +258,102 @@ func (indexer *Indexer) VisitFile(path string, f *os.FileInfo) {
 		return
 	}
 
-	fileInfo, blocksInfo, err := IndexFile(path)
+	// Submodules and linked worktrees keep a .git file naming their metadata
+	if _, name := filepath.Split(path); indexer.Vcs != VCS_ASIS && IsVcsName(name) {
+		return
+	}
+
+	if f.IsSymlink() && indexer.Symlinks != SYMLINKS_FILES {
+		indexer.visitSymlink(path)
+		return
+	}
+
+	fileInfo, blocksInfo, load, err := indexer.indexFile(path)
+	if err == nil {
+		fileInfo.Xattrs = indexer.readXattrs(path)
+		fileInfo.Acls = indexer.readAcls(path)
+	}
+	indexer.addFile(path, fileInfo, blocksInfo, load, err)
+}
+
+// Index a regular file, through the cache if there is one. Files whose
+// blocks are deferred are returned without them, but with a loader.
+func (indexer *Indexer) indexFile(path string) (*FileInfo, []*BlockInfo, BlockLoader, os.Error) {
+	cache, blockSize, chunking := indexer.Cache, indexer.BlockSize, indexer.Chunking
+	indexBlocks := func() (*FileInfo, []*BlockInfo, os.Error) {
+		if cache != nil {
+			return cache.IndexFile(path, blockSize, chunking)
+		}
+		return IndexFileChunking(path, blockSize, chunking)
+	}
+
+	if _, is := indexer.Repo.(LazyRepo); !is || !indexer.LazyBlocks {
+		fileInfo, blocksInfo, err := indexBlocks()
+		return fileInfo, blocksInfo, nil, err
+	}
+
+	// Blocks already in the cache cost nothing to keep
+	if cache != nil {
+		if fileInfo, blocksInfo, has := cache.Lookup(path, blockSize, chunking); has {
+			return fileInfo, blocksInfo, nil, nil
+		}
+	}
+
+	fileInfo, err := IndexFileStrong(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	load := func() ([]*BlockInfo, os.Error) {
+		loaded, blocksInfo, err := indexBlocks()
+		if err != nil {
+			return nil, err
+		} else if loaded.Strong != fileInfo.Strong {
+			return nil, os.NewError(fmt.Sprintf("%s: changed since it was indexed", path))
+		}
+		return blocksInfo, nil
+	}
+	return fileInfo, nil, load, nil
+}
+
+// Read the extended attributes of path, if the indexer is to index them.
+func (indexer *Indexer) readXattrs(path string) map[string][]byte {
+	if !indexer.Xattrs {
+		return nil
+	}
+	xattrs, err := ReadXattrs(path)
+	if err != nil && indexer.Errors != nil {
+		indexer.Errors <- err
+	}
+	return xattrs
+}
+
+// Read the POSIX ACLs of path, if the indexer is to index them.
+func (indexer *Indexer) readAcls(path string) *Acls {
+	if !indexer.Acls {
+		return nil
+	}
+	acls, err := ReadAcls(path)
+	if err != nil && indexer.Errors != nil {
+		indexer.Errors <- err
+	}
+	return acls
+}
+
+// Test whether a directory below the root is left out by the VCS policy.
+func (indexer *Indexer) skipVcs(path string) bool {
+	_, name := filepath.Split(path)
+	switch indexer.Vcs {
+	case VCS_EXCLUDE:
+		return IsVcsName(name) || IsVcsWorkTree(path)
+	case VCS_WORKTREE:
+		return IsVcsName(name)
+	}
+	return false
+}
+
+// Add an indexed file to its parent directory, or report why it could not be indexed.
+// If load is not nil, the file's blocks are loaded by it.
+func (indexer *Indexer) addFile(path string, fileInfo *FileInfo, blocksInfo []*BlockInfo, load BlockLoader, err os.Error) {
 	if err == nil {
 		dirpath, _ := filepath.Split(path)
 		dirpath = filepath.Clean(dirpath)
@@ -138,7 +361,13 @@ func (indexer *Indexer) VisitFile(path string, f *os.FileInfo) {
 			indexer.VisitDir(dirpath, dirinfo)
 
 			if fileParent, hasParent := indexer.dirMap[dirpath]; hasParent {
-				indexer.Repo.AddFile(fileParent, fileInfo, blocksInfo)
+				if load != nil {
+					indexer.Repo.(LazyRepo).AddLazyFile(fileParent, fileInfo, load)
+				} else {
+					indexer.Repo.AddFile(fileParent, fileInfo, blocksInfo)
+				}
+				events.Publish(&events.FileHashed{
+					Path: path, Size: fileInfo.Size, Strong: fileInfo.Strong})
 				return
 			} else if indexer.Errors != nil {
 				indexer.Errors <- os.NewError("cannot locate parent directory")
@@ -149,11 +378,69 @@ func (indexer *Indexer) VisitFile(path string, f *os.FileInfo) {
 	}
 }
 
+// Index a symbolic link according to the symlink policy.
+func (indexer *Indexer) visitSymlink(path string) {
+	switch indexer.Symlinks {
+	case SYMLINKS_STORE:
+		fileInfo, blocksInfo, err := IndexSymlink(path)
+		indexer.addFile(path, fileInfo, blocksInfo, nil, err)
+
+	case SYMLINKS_FOLLOW:
+		target, err := os.Stat(path)
+		if err != nil {
+			indexer.addFile(path, nil, nil, nil, err)
+		} else if indexer.OneFileSystem && target.Dev != indexer.rootDev {
+			return
+		} else if target.IsDirectory() {
+			indexer.followDir(path, target)
+		} else {
+			fileInfo, blocksInfo, load, err := indexer.indexFile(path)
+			indexer.addFile(path, fileInfo, blocksInfo, load, err)
+		}
+	}
+}
+
+// Index the directory a link points to as if it were at the link's path.
+func (indexer *Indexer) followDir(path string, target *os.FileInfo) {
+	maxDepth := indexer.MaxLinkDepth
+	if maxDepth == 0 {
+		maxDepth = DEFAULT_MAX_LINK_DEPTH
+	}
+	if indexer.linkDepth >= maxDepth {
+		indexer.addFile(path, nil, nil, nil, os.NewError(fmt.Sprintf(
+			"%s: more than %d levels of links", path, maxDepth)))
+		return
+	}
+
+	// Following a link to any directory above it would never end
+	for dir := filepath.Dir(path); len(dir) >= len(indexer.Path); dir = filepath.Dir(dir) {
+		if fi, err := os.Stat(dir); err == nil && fi.Dev == target.Dev && fi.Ino == target.Ino {
+			indexer.addFile(path, nil, nil, nil, os.NewError(fmt.Sprintf(
+				"%s: link to %s forms a cycle", path, dir)))
+			return
+		}
+		if dir == indexer.Path {
+			break
+		}
+	}
+
+	// Walking from the path with a trailing separator descends the link.
+	indexer.linkDepth++
+	filepath.Walk(path+string(filepath.Separator), indexer, indexer.Errors)
+	indexer.linkDepth--
+}
+
 func IndexDir(path string, repo NodeRepo) (Dir, []os.Error) {
 	errors := []os.Error{}
 	dirChan := make(chan Dir, 1)
 	errorChan := make(chan os.Error, 1)
 	indexer := &Indexer{Path: path, Repo: repo, Errors: errorChan}
+	if sizeRepo, is := repo.(BlockSizeRepo); is {
+		indexer.BlockSize = sizeRepo.BlockSize()
+	}
+	if chunkingRepo, is := repo.(ChunkingRepo); is {
+		indexer.Chunking = chunkingRepo.Chunking()
+	}
 	go func() {
 		dirChan <- indexer.Index()
 		close(errorChan)
@@ -168,6 +455,7 @@ func IndexDir(path string, repo NodeRepo) (Dir, []os.Error) {
 func (indexer *Indexer) Index() Dir {
 	control := make(chan bool)
 	indexer.initWalk()
+	events.Publish(&events.IndexStarted{Path: indexer.Path})
 
 	go func() {
 		filepath.Walk(indexer.Path, indexer, indexer.Errors)
@@ -182,10 +470,110 @@ func (indexer *Indexer) Index() Dir {
 	return indexer.root
 }
 
+// Start an index of the root alone, to be filled in on demand with
+// IndexEntries rather than by walking the whole tree.
+func (indexer *Indexer) Begin() Dir {
+	indexer.initWalk()
+	indexer.listed = make(map[string]bool)
+	events.Publish(&events.IndexStarted{Path: indexer.Path})
+	return indexer.root
+}
+
+// Index the entries of the directory at path, beneath the root of an index
+// started with Begin, and the directories above it. Subdirectories are
+// indexed without their entries. Directories already listed are not
+// listed again.
+func (indexer *Indexer) IndexEntries(path string) os.Error {
+	path = filepath.Clean(path)
+	if indexer.listed[path] {
+		return nil
+	}
+
+	// Visit the directories down from the root
+	dirs := []string{}
+	for dir := path; len(dir) > len(indexer.Path); dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fi, err := os.Stat(dirs[i])
+		if err != nil {
+			return err
+		} else if !fi.IsDirectory() {
+			return os.NewError(fmt.Sprintf("%s: not a directory", dirs[i]))
+		} else if !indexer.VisitDir(dirs[i], fi) {
+			return nil
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	entries, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	indexer.listed[path] = true
+
+	for i := range entries {
+		entry := &entries[i]
+		entryPath := filepath.Join(path, entry.Name)
+		if entry.IsDirectory() {
+			indexer.VisitDir(entryPath, entry)
+		} else {
+			indexer.VisitFile(entryPath, entry)
+		}
+	}
+	return nil
+}
+
+// Build a tree model of a symbolic link, whose content is its target.
+func IndexSymlink(path string) (fileInfo *FileInfo, blocksInfo []*BlockInfo, err os.Error) {
+	stat, err := os.Lstat(path)
+	if stat == nil {
+		return nil, nil, err
+	} else if !stat.IsSymlink() {
+		return nil, nil, os.NewError(fmt.Sprintf("%s: not a symbolic link", path))
+	}
+
+	target, err := os.Readlink(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, basename := filepath.Split(path)
+	content := []byte(target)
+	fileInfo = &FileInfo{
+		Name:   basename,
+		Mode:   stat.Mode,
+		Size:   int64(len(content)),
+		Mtime:  stat.Mtime_ns,
+		Owner:  StatOwner(stat),
+		Strong: StrongChecksum(content)}
+
+	blocksInfo = []*BlockInfo{}
+	if len(content) > 0 {
+		blocksInfo = append(blocksInfo, IndexBlock(content))
+	}
+	return fileInfo, blocksInfo, nil
+}
+
 // Build a hierarchical tree model representing a file's contents
 func IndexFile(path string) (fileInfo *FileInfo, blocksInfo []*BlockInfo, err os.Error) {
+	return IndexFileWith(path, BLOCKSIZE)
+}
+
+// Build a tree model of a file's contents divided into blocks of blockSize.
+// If zero, BLOCKSIZE.
+func IndexFileWith(path string, blockSize int) (fileInfo *FileInfo, blocksInfo []*BlockInfo, err os.Error) {
+	return IndexFileChunking(path, blockSize, CHUNK_FIXED)
+}
+
+// Build a tree model of a file's contents divided into blocks by chunking,
+// of or around blockSize. If zero, BLOCKSIZE.
+func IndexFileChunking(path string, blockSize int, chunking Chunking) (fileInfo *FileInfo, blocksInfo []*BlockInfo, err os.Error) {
 	var f *os.File
-	var buf [BLOCKSIZE]byte
 
 	stat, err := os.Stat(path)
 	if stat == nil {
@@ -202,30 +590,92 @@ func IndexFile(path string) (fileInfo *FileInfo, blocksInfo []*BlockInfo, err os
 
 	_, basename := filepath.Split(path)
 	fileInfo = &FileInfo{
-		Name: basename,
-		Mode: stat.Mode,
-		Size: stat.Size}
+		Name:  basename,
+		Mode:  stat.Mode,
+		Size:  stat.Size,
+		Mtime: stat.Mtime_ns,
+		Owner: StatOwner(stat)}
+
+	if chunking == CHUNK_CONTENT {
+		blocksInfo, err = indexChunks(f, fileInfo, blockSize)
+	} else {
+		blocksInfo, err = indexContent(f, fileInfo, blockSize)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return fileInfo, blocksInfo, nil
+}
+
+// Build a tree model of a file without its blocks, reading it only for its
+// strong checksum.
+func IndexFileStrong(path string) (fileInfo *FileInfo, err os.Error) {
+	stat, err := os.Stat(path)
+	if stat == nil {
+		return nil, err
+	} else if !stat.IsRegular() {
+		return nil, os.NewError(fmt.Sprintf("%s: not a regular file", path))
+	}
+
+	f, err := os.Open(path)
+	if f == nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sha1 := sha1.New()
+	size, err := io.Copy(sha1, f)
+	if err != nil {
+		return nil, err
+	}
 
+	_, basename := filepath.Split(path)
+	return &FileInfo{
+		Name:   basename,
+		Mode:   stat.Mode,
+		Size:   size,
+		Mtime:  stat.Mtime_ns,
+		Owner:  StatOwner(stat),
+		Strong: toHexString(sha1)}, nil
+}
+
+// Index the blocks of a file's content, setting its size and strong checksum.
+func indexContent(r io.Reader, fileInfo *FileInfo, blockSize int) (blocksInfo []*BlockInfo, err os.Error) {
+	if blockSize == 0 {
+		blockSize = BLOCKSIZE
+	}
+	buf := make([]byte, blockSize)
+	zeroStrong := ZeroStrong(blockSize)
 	var block *BlockInfo
 	sha1 := sha1.New()
 	blockNum := 0
 	blocksInfo = []*BlockInfo{}
+	fileInfo.Size = 0
 
 	for {
-		switch rd, err := f.Read(buf[:]); true {
-		case rd < 0:
-			return nil, nil, err
+		switch rd, err := io.ReadFull(r, buf[:]); true {
+		case rd == 0 && err != os.EOF:
+			return nil, err
 		case rd == 0:
 			fileInfo.Strong = toHexString(sha1)
-			return fileInfo, blocksInfo, nil
+			return blocksInfo, nil
 		case rd > 0:
-			// Update block hashes
-			block = IndexBlock(buf[0:rd])
+			// Update block hashes. Holes in sparse files are common
+			// enough to spare hashing each one.
+			if rd == blockSize && IsZero(buf) {
+				block = &BlockInfo{Strong: zeroStrong}
+			} else {
+				block = IndexBlock(buf[0:rd])
+			}
 			block.Position = blockNum
+			if blockSize != BLOCKSIZE {
+				block.BlockSize = blockSize
+			}
 			blocksInfo = append(blocksInfo, block)
 
 			// update file hash
 			sha1.Write(buf[0:rd])
+			fileInfo.Size += int64(rd)
 
 			// Increment block counter
 			blockNum++
@@ -234,6 +684,38 @@ func IndexFile(path string) (fileInfo *FileInfo, blocksInfo []*BlockInfo, err os
 	panic("Impossible")
 }
 
+// Index the blocks of a file's content divided by content, setting its
+// size and strong checksum.
+func indexChunks(r io.Reader, fileInfo *FileInfo, blockSize int) (blocksInfo []*BlockInfo, err os.Error) {
+	chunker := NewChunker(r, blockSize)
+	sha1 := sha1.New()
+	blocksInfo = []*BlockInfo{}
+	fileInfo.Size = 0
+
+	for {
+		chunk, err := chunker.Next()
+		if err == os.EOF {
+			fileInfo.Strong = toHexString(sha1)
+			return blocksInfo, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		block := IndexBlock(chunk)
+		block.Position = len(blocksInfo)
+		block.ChunkOffset = fileInfo.Size
+		block.ChunkLength = len(chunk)
+		if blockSize != 0 && blockSize != BLOCKSIZE {
+			block.BlockSize = blockSize
+		}
+		blocksInfo = append(blocksInfo, block)
+
+		sha1.Write(chunk)
+		fileInfo.Size += int64(len(chunk))
+	}
+	panic("Impossible")
+}
+
 // Render a Hash as a hexadecimal string.
 func toHexString(hash hash.Hash) string {
 	return fmt.Sprintf("%x", hash.Sum())
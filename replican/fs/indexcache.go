@@ -0,0 +1,232 @@
+package fs
+
+import (
+	"io/ioutil"
+	"json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files modified this many nanoseconds or less before they were hashed
+// are hashed again on the next reindex, however their stat looks, as
+// a change within the same tick of a coarse clock would not show in
+// their modification time.
+const RACY_WINDOW int64 = 2e9
+
+// Remember the checksums of files indexed on local disk, so that
+// reindexing only reads files which have changed. A file whose size,
+// modification time and inode are as they were when it was last hashed,
+// in blocks of the same size and chunking, keeps its checksums; its
+// other metadata is taken fresh from its stat.
+//
+// Unlike BlockMapCache, files are hashed in full when they change, so
+// their checksums are always those IndexFile would calculate.
+type IndexCache struct {
+	mutex   sync.Mutex
+	entries map[string]*indexCacheEntry
+
+	// Paths looked up since the last Sweep.
+	used map[string]bool
+
+	// Number of files hashed, and reused, since the last Sweep.
+	Rehashed int
+	Reused   int
+}
+
+type indexCacheEntry struct {
+	Size  int64
+	Mtime int64
+	Ino   uint64
+
+	BlockSize int
+	Chunking  Chunking
+
+	// When the file was hashed, in nanoseconds since the epoch.
+	Hashed int64
+
+	Strong string
+	Blocks []*BlockInfo
+}
+
+func NewIndexCache() *IndexCache {
+	return &IndexCache{
+		entries: make(map[string]*indexCacheEntry),
+		used:    make(map[string]bool)}
+}
+
+// Index a file as IndexFileChunking does, reusing its checksums if it is
+// unchanged since it was last indexed through the cache.
+func (cache *IndexCache) IndexFile(path string, blockSize int, chunking Chunking) (*FileInfo, []*BlockInfo, os.Error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if fileInfo, blocksInfo, has := cache.lookup(path, stat, blockSize, chunking); has {
+		return fileInfo, blocksInfo, nil
+	}
+
+	hashed := time.Nanoseconds()
+	fileInfo, blocksInfo, err := IndexFileChunking(path, blockSize, chunking)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.Rehashed++
+	if fileInfo.Size == stat.Size && fileInfo.Mtime == stat.Mtime_ns {
+		cache.entries[path] = &indexCacheEntry{
+			Size:      stat.Size,
+			Mtime:     stat.Mtime_ns,
+			Ino:       stat.Ino,
+			BlockSize: blockSize,
+			Chunking:  chunking,
+			Hashed:    hashed,
+			Strong:    fileInfo.Strong,
+			Blocks:    copyBlocks(blocksInfo)}
+	} else {
+		// Changed while it was read
+		cache.entries[path] = nil, false
+	}
+	return fileInfo, blocksInfo, nil
+}
+
+// Get the checksums of a file if it is unchanged since it was last indexed
+// through the cache, without reading it.
+func (cache *IndexCache) Lookup(path string, blockSize int, chunking Chunking) (*FileInfo, []*BlockInfo, bool) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, false
+	}
+	return cache.lookup(path, stat, blockSize, chunking)
+}
+
+func (cache *IndexCache) lookup(path string, stat *os.FileInfo, blockSize int, chunking Chunking) (*FileInfo, []*BlockInfo, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.used[path] = true
+	entry, has := cache.entries[path]
+	if !has || !entry.matches(stat, blockSize, chunking) {
+		return nil, nil, false
+	}
+
+	_, basename := filepath.Split(path)
+	fileInfo := &FileInfo{
+		Name:   basename,
+		Mode:   stat.Mode,
+		Size:   stat.Size,
+		Mtime:  stat.Mtime_ns,
+		Owner:  StatOwner(stat),
+		Strong: entry.Strong}
+	cache.Reused++
+	return fileInfo, copyBlocks(entry.Blocks), true
+}
+
+func (entry *indexCacheEntry) matches(stat *os.FileInfo, blockSize int, chunking Chunking) bool {
+	return stat.IsRegular() && entry.Size == stat.Size && entry.Mtime == stat.Mtime_ns && entry.Ino == stat.Ino &&
+		entry.BlockSize == blockSize && entry.Chunking == chunking &&
+		entry.Mtime+RACY_WINDOW < entry.Hashed
+}
+
+// Write the cache to a file, replacing it whole, so that it is never left
+// half written.
+func (cache *IndexCache) Save(path string) os.Error {
+	cache.mutex.Lock()
+	buf, err := json.Marshal(cache.entries)
+	cache.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	dir, _ := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tempF, err := ioutil.TempFile(dir, "indexcache")
+	if err != nil {
+		return err
+	}
+
+	_, err = tempF.Write(buf)
+	tempF.Close()
+	if err != nil {
+		os.Remove(tempF.Name())
+		return err
+	}
+
+	return os.Rename(tempF.Name(), path)
+}
+
+// Read a cache saved with Save. If there is no such file, the cache is empty.
+func LoadIndexCache(path string) (*IndexCache, os.Error) {
+	cache := NewIndexCache()
+
+	buf, err := ioutil.ReadFile(path)
+	if pathErr, is := err.(*os.PathError); is && pathErr.Error == os.ENOENT {
+		return cache, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(buf, &cache.entries); err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+// Forget files not looked up since the last Sweep, such as those deleted
+// since, and reset the counts.
+func (cache *IndexCache) Sweep() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for path, _ := range cache.entries {
+		if !cache.used[path] {
+			cache.entries[path] = nil, false
+		}
+	}
+	cache.used = make(map[string]bool)
+	cache.Rehashed = 0
+	cache.Reused = 0
+}
+
+// Forget the checksums of files, and of everything beneath directories,
+// so that they are hashed again when next indexed however their stat
+// looks, such as files a ChangeJournal reports changed.
+func (cache *IndexCache) Forget(paths []string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for _, forget := range paths {
+		forget = filepath.Clean(forget)
+		for path, _ := range cache.entries {
+			if path == forget || strings.HasPrefix(path, forget+string(filepath.Separator)) {
+				cache.entries[path] = nil, false
+			}
+		}
+	}
+}
+
+// Forget the checksums of all files.
+func (cache *IndexCache) Clear() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.entries = make(map[string]*indexCacheEntry)
+}
+
+// Copy block models, so that those in the cache are not shared with
+// the repos they are added to.
+func copyBlocks(blocks []*BlockInfo) []*BlockInfo {
+	copied := make([]*BlockInfo, len(blocks))
+	for i, block := range blocks {
+		blockCopy := *block
+		copied[i] = &blockCopy
+	}
+	return copied
+}
@@ -0,0 +1,19 @@
+package fs
+
+import (
+	"os"
+)
+
+// Report the paths changed under a directory tree, so that a tree need not
+// be walked to find out whether, or where, it has changed.
+//
+// Journals are started with NewChangeJournal, where the platform provides
+// a means of watching for changes.
+type ChangeJournal interface {
+	// Get the paths, relative to the root, changed since the journal was
+	// started or Changes was last called. If lost is true, the journal
+	// lost track of changes, and the whole tree should be assumed changed.
+	Changes() (paths []string, lost bool)
+
+	Close() os.Error
+}
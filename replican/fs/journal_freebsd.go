@@ -0,0 +1,10 @@
+package fs
+
+import (
+	"os"
+)
+
+// Start a journal of changes made under root. Not supported on this platform.
+func NewChangeJournal(root string) (ChangeJournal, os.Error) {
+	return nil, os.NewError("Change journals are not available on this platform")
+}
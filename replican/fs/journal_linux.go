@@ -0,0 +1,146 @@
+package fs
+
+import (
+	"os"
+	"os/inotify"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const journalEvents uint32 = inotify.IN_CREATE | inotify.IN_DELETE | inotify.IN_MODIFY |
+	inotify.IN_ATTRIB | inotify.IN_MOVED_FROM | inotify.IN_MOVED_TO | inotify.IN_DELETE_SELF
+
+// A change journal kept in memory from inotify events.
+// Changes made while the journal is not running are not known to it.
+type inotifyJournal struct {
+	root    string
+	watcher *inotify.Watcher
+
+	mutex   sync.Mutex
+	changed map[string]bool
+	lost    bool
+}
+
+// Start a journal of changes made under root from now on.
+func NewChangeJournal(root string) (ChangeJournal, os.Error) {
+	watcher, err := inotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	journal := &inotifyJournal{
+		root:    filepath.Clean(root),
+		watcher: watcher,
+		changed: make(map[string]bool)}
+
+	if err = journal.watchTree(root); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	go journal.run()
+	return journal, nil
+}
+
+type watchVisitor struct {
+	journal *inotifyJournal
+	err     os.Error
+	files   []string
+}
+
+func (wv *watchVisitor) VisitDir(path string, f *os.FileInfo) bool {
+	if err := wv.journal.watcher.AddWatch(path, journalEvents); err != nil && wv.err == nil {
+		wv.err = err
+	}
+	return true
+}
+
+func (wv *watchVisitor) VisitFile(path string, f *os.FileInfo) {
+	wv.files = append(wv.files, path)
+}
+
+// Watch a directory and all its subdirectories.
+func (journal *inotifyJournal) watchTree(path string) os.Error {
+	wv := &watchVisitor{journal: journal}
+	filepath.Walk(path, wv, nil)
+	return wv.err
+}
+
+func (journal *inotifyJournal) run() {
+	for {
+		select {
+		case event, ok := <-journal.watcher.Event:
+			if !ok {
+				return
+			}
+			journal.record(event)
+		case _, ok := <-journal.watcher.Error:
+			if !ok {
+				return
+			}
+			journal.lose()
+		}
+	}
+}
+
+func (journal *inotifyJournal) record(event *inotify.Event) {
+	if event.Mask&inotify.IN_Q_OVERFLOW != 0 {
+		journal.lose()
+		return
+	}
+
+	// Directories created after the journal started must be watched too.
+	// Anything created in them before the watch took effect is found
+	// by walking them.
+	if event.Mask&inotify.IN_ISDIR != 0 && event.Mask&(inotify.IN_CREATE|inotify.IN_MOVED_TO) != 0 {
+		wv := &watchVisitor{journal: journal}
+		filepath.Walk(event.Name, wv, nil)
+		if wv.err != nil {
+			journal.lose()
+		}
+
+		journal.mutex.Lock()
+		for _, path := range wv.files {
+			journal.changed[journal.relPath(path)] = true
+		}
+		journal.mutex.Unlock()
+	}
+
+	journal.mutex.Lock()
+	journal.changed[journal.relPath(event.Name)] = true
+	journal.mutex.Unlock()
+}
+
+func (journal *inotifyJournal) lose() {
+	journal.mutex.Lock()
+	journal.lost = true
+	journal.mutex.Unlock()
+}
+
+func (journal *inotifyJournal) relPath(path string) string {
+	path = filepath.Clean(path)
+	if len(path) > len(journal.root) && path[:len(journal.root)] == journal.root {
+		return path[len(journal.root)+1:]
+	}
+	return ""
+}
+
+func (journal *inotifyJournal) Changes() (paths []string, lost bool) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+
+	for path, _ := range journal.changed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	lost = journal.lost
+	journal.changed = make(map[string]bool)
+	journal.lost = false
+	return paths, lost
+}
+
+func (journal *inotifyJournal) Close() os.Error {
+	return journal.watcher.Close()
+}
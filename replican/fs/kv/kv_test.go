@@ -0,0 +1,127 @@
+package kv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/fs/repotest"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func tempPath(t *testing.T) string {
+	f, err := ioutil.TempFile("", "test.kv")
+	assert.T(t, err == nil)
+	f.Close()
+	os.Remove(f.Name())
+	return f.Name()
+}
+
+func TestKvRepoConformance(t *testing.T) {
+	path := tempPath(t)
+	defer os.Remove(path)
+
+	repotest.TestNodeRepo(t, func() (fs.NodeRepo, os.Error) {
+		return NewKvRepo(path)
+	})
+}
+
+func TestStoreCheckpoint(t *testing.T) {
+	path := tempPath(t)
+	defer os.Remove(path)
+
+	store, err := Open(path)
+	assert.Tf(t, err == nil, "%v", err)
+	store.Put("a", "x", []byte("1"))
+	store.Put("a", "y", []byte("2"))
+	store.Put("b", "x", []byte("3"))
+	assert.Equal(t, 3, store.Pending())
+	assert.Equal(t, []string{"x", "y"}, store.Keys("a"))
+	assert.T(t, store.Checkpoint() == nil)
+
+	store.Delete("a", "y")
+	store.Put("b", "x", []byte("4"))
+	value, has := store.Get("b", "x")
+	assert.T(t, has)
+	assert.Equal(t, "4", string(value))
+
+	// Writes not checkpointed are lost
+	store.Close()
+	store, err = Open(path)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, []string{"x", "y"}, store.Keys("a"))
+	value, has = store.Get("b", "x")
+	assert.T(t, has)
+	assert.Equal(t, "3", string(value))
+
+	store.Delete("a", "y")
+	assert.T(t, store.Checkpoint() == nil)
+	store.Put("c", "x", []byte("5"))
+	assert.T(t, store.Checkpoint() == nil)
+	store.Close()
+
+	// A batch cut short, as by a crash, is discarded whole
+	stat, err := os.Stat(path)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, os.Truncate(path, stat.Size-2) == nil)
+
+	store, err = Open(path)
+	assert.Tf(t, err == nil, "%v", err)
+	defer store.Close()
+	assert.Equal(t, []string{"x"}, store.Keys("a"))
+	_, has = store.Get("c", "x")
+	assert.T(t, !has)
+
+	store.Put("c", "y", []byte("6"))
+	assert.T(t, store.Checkpoint() == nil)
+	value, has = store.Get("c", "y")
+	assert.T(t, has)
+	assert.Equal(t, "6", string(value))
+}
+
+func TestKvRepoReopen(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar",
+			tg.F("a", tg.B(42, 65537)),
+			tg.F("b", tg.B(43, 65537))),
+		tg.D("baz",
+			tg.F("c", tg.B(44, 1000))))
+	treePath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(treePath)
+
+	path := tempPath(t)
+	defer os.Remove(path)
+
+	repo, err := NewKvRepo(path)
+	assert.Tf(t, err == nil, "%v", err)
+	store, err := fs.NewLocalStore(treePath, repo)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, store.SetChunking(fs.CHUNK_CONTENT) == nil)
+	root := store.Repo().Root().(fs.Dir)
+	strong := root.Info().Strong
+	repo.Close()
+
+	repo, err = NewKvRepo(path)
+	assert.Tf(t, err == nil, "%v", err)
+	defer repo.Close()
+
+	reopened, is := repo.Root().(fs.Dir)
+	assert.T(t, is)
+	assert.Equal(t, strong, reopened.Info().Strong)
+	assert.Equal(t, fs.CHUNK_CONTENT, repo.Chunking())
+
+	node, found := fs.Lookup(reopened, filepath.Join("foo", "bar", "a"))
+	assert.T(t, found)
+	file := node.(fs.File)
+	assert.T(t, fs.IsChunked(file))
+	for _, block := range file.Blocks() {
+		found, has := repo.Block(block.Info().Strong)
+		assert.T(t, has)
+		assert.Equal(t, block.Info().ChunkOffset, found.Info().ChunkOffset)
+	}
+}
@@ -0,0 +1,503 @@
+package kv
+
+import (
+	"fmt"
+	"json"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// Keys written between checkpoints while a tree is indexed.
+const KV_BATCH = 10000
+
+// Buckets of a KvRepo.
+const (
+	BUCKET_DIRS        = "dirs"        // dir id: dirRecord
+	BUCKET_FILES       = "files"       // file id: fileRecord
+	BUCKET_BLOCKS      = "blocks"      // block strong checksum: blockRecord
+	BUCKET_WEAK        = "weak"        // block weak checksum: block strong checksum
+	BUCKET_DIR_STRONG  = "dir_strong"  // dir strong checksum: dir id
+	BUCKET_FILE_STRONG = "file_strong" // file strong checksum: file id
+	BUCKET_META        = "meta"
+)
+
+// Keys of the meta bucket.
+const (
+	META_ROOT        = "root"
+	META_NEXT_ID     = "next_id"
+	META_STRONG_MODE = "strong_mode"
+	META_BLOCK_SIZE  = "block_size"
+	META_CHUNKING    = "chunking"
+)
+
+// A NodeRepo kept in a key-value Store, for trees with more blocks than
+// fit in memory, without the cgo dependency of an SQLite database. Nodes
+// are looked up by their checksums in index buckets, and only loaded as
+// they are asked for.
+//
+// Writes are checkpointed every KV_BATCH keys, and whenever the checksum
+// of a root directory is updated, as at the end of an index. The root is
+// only recorded then, so a repo reopened after a crash while indexing
+// still has the last tree indexed whole.
+type KvRepo struct {
+	store *Store
+
+	// Id of the root, which may not yet be recorded in the store.
+	root string
+
+	nextId     int64
+	strongMode fs.StrongMode
+	blockSize  int
+	chunking   fs.Chunking
+
+	// Directories added to since the last checkpoint. Kept decoded, so
+	// that adding to large directories does not encode them each time.
+	dirty map[string]*dirRecord
+}
+
+type dirRecord struct {
+	Info    *fs.DirInfo
+	Parent  string
+	SubDirs []string
+	Files   []string
+}
+
+type fileRecord struct {
+	Info   *fs.FileInfo
+	Parent string
+	Blocks []*fs.BlockInfo
+}
+
+type blockRecord struct {
+	File string
+	Info *fs.BlockInfo
+}
+
+type kvBlock struct {
+	repo *KvRepo
+	file string
+	info *fs.BlockInfo
+}
+
+func (block *kvBlock) Repo() fs.NodeRepo { return block.repo }
+
+func (block *kvBlock) Parent() (fs.FsNode, bool) {
+	if file, has := block.repo.loadFile(block.file); has {
+		return file, true
+	}
+	return nil, false
+}
+
+func (block *kvBlock) Info() *fs.BlockInfo {
+	return block.info
+}
+
+type kvFile struct {
+	repo   *KvRepo
+	id     string
+	parent string
+	info   *fs.FileInfo
+}
+
+func (file *kvFile) Repo() fs.NodeRepo { return file.repo }
+
+func (file *kvFile) Parent() (fs.FsNode, bool) {
+	if file.parent == "" {
+		return nil, false
+	}
+	if dir, has := file.repo.loadDir(file.parent); has {
+		return dir, true
+	}
+	return nil, false
+}
+
+func (file *kvFile) Info() *fs.FileInfo {
+	return file.info
+}
+
+func (file *kvFile) Name() string {
+	return file.info.Name
+}
+
+func (file *kvFile) Mode() uint32 {
+	return file.info.Mode
+}
+
+func (file *kvFile) Blocks() []fs.Block {
+	result := []fs.Block{}
+	record, has := file.repo.fileRecord(file.id)
+	if !has {
+		return result
+	}
+	for _, blockInfo := range record.Blocks {
+		result = append(result, &kvBlock{repo: file.repo, file: file.id, info: blockInfo})
+	}
+	return result
+}
+
+type kvDir struct {
+	repo   *KvRepo
+	id     string
+	parent string
+	info   *fs.DirInfo
+}
+
+func (dir *kvDir) Repo() fs.NodeRepo { return dir.repo }
+
+func (dir *kvDir) Parent() (fs.FsNode, bool) {
+	if dir.parent == "" {
+		return nil, false
+	}
+	if parent, has := dir.repo.loadDir(dir.parent); has {
+		return parent, true
+	}
+	return nil, false
+}
+
+func (dir *kvDir) Info() *fs.DirInfo {
+	return dir.info
+}
+
+func (dir *kvDir) Name() string {
+	return dir.info.Name
+}
+
+func (dir *kvDir) Mode() uint32 {
+	return dir.info.Mode
+}
+
+func (dir *kvDir) SubDirs() []fs.Dir {
+	result := []fs.Dir{}
+	record, has := dir.repo.dirRecord(dir.id)
+	if !has {
+		return result
+	}
+	for _, id := range record.SubDirs {
+		if subdir, has := dir.repo.loadDir(id); has {
+			result = append(result, subdir)
+		}
+	}
+	return result
+}
+
+func (dir *kvDir) Files() []fs.File {
+	result := []fs.File{}
+	record, has := dir.repo.dirRecord(dir.id)
+	if !has {
+		return result
+	}
+	for _, id := range record.Files {
+		if file, has := dir.repo.loadFile(id); has {
+			result = append(result, file)
+		}
+	}
+	return result
+}
+
+func (dir *kvDir) UpdateStrong() string {
+	return dir.repo.UpdateStrong(dir)
+}
+
+// Open the repo kept in the store file at path, creating it if there is none.
+func NewKvRepo(path string) (*KvRepo, os.Error) {
+	store, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := &KvRepo{store: store, dirty: make(map[string]*dirRecord)}
+	if root, has := store.Get(BUCKET_META, META_ROOT); has {
+		repo.root = string(root)
+	}
+	repo.nextId = repo.metaInt(META_NEXT_ID)
+	repo.strongMode = fs.StrongMode(repo.metaInt(META_STRONG_MODE))
+	repo.blockSize = int(repo.metaInt(META_BLOCK_SIZE))
+	repo.chunking = fs.Chunking(repo.metaInt(META_CHUNKING))
+	return repo, nil
+}
+
+func (repo *KvRepo) metaInt(key string) int64 {
+	value, has := repo.store.Get(BUCKET_META, key)
+	if !has {
+		return 0
+	}
+	n, err := strconv.Atoi64(string(value))
+	if err != nil {
+		log.Printf("%s: bad %s: %v", repo.store.Path(), key, err)
+	}
+	return n
+}
+
+func (repo *KvRepo) putMetaInt(key string, value int64) {
+	repo.store.Put(BUCKET_META, key, []byte(strconv.Itoa64(value)))
+}
+
+// Allocate an id for a new node. Dirs and files are told apart by the
+// first letter of their ids.
+func (repo *KvRepo) newId(kind string) string {
+	repo.nextId++
+	repo.putMetaInt(META_NEXT_ID, repo.nextId)
+	return fmt.Sprintf("%s%d", kind, repo.nextId)
+}
+
+func (repo *KvRepo) Root() fs.FsNode {
+	switch {
+	case repo.root == "":
+		return nil
+	case repo.root[0] == 'f':
+		if file, has := repo.loadFile(repo.root); has {
+			return file
+		}
+	default:
+		if dir, has := repo.loadDir(repo.root); has {
+			return dir
+		}
+	}
+	return nil
+}
+
+func (repo *KvRepo) WeakBlock(weak int) (fs.Block, bool) {
+	strong, has := repo.store.Get(BUCKET_WEAK, strconv.Itoa(weak))
+	if !has {
+		return nil, false
+	}
+	return repo.Block(string(strong))
+}
+
+func (repo *KvRepo) Block(strong string) (fs.Block, bool) {
+	record := &blockRecord{}
+	if !repo.get(BUCKET_BLOCKS, strong, record) {
+		return nil, false
+	}
+	return &kvBlock{repo: repo, file: record.File, info: record.Info}, true
+}
+
+func (repo *KvRepo) File(strong string) (fs.File, bool) {
+	id, has := repo.store.Get(BUCKET_FILE_STRONG, strong)
+	if !has {
+		return nil, false
+	}
+	if file, has := repo.loadFile(string(id)); has {
+		return file, true
+	}
+	return nil, false
+}
+
+func (repo *KvRepo) Dir(strong string) (fs.Dir, bool) {
+	id, has := repo.store.Get(BUCKET_DIR_STRONG, strong)
+	if !has {
+		return nil, false
+	}
+	if dir, has := repo.loadDir(string(id)); has {
+		return dir, true
+	}
+	return nil, false
+}
+
+func (repo *KvRepo) AddBlock(file fs.File, blockInfo *fs.BlockInfo) fs.Block {
+	kvfile := file.(*kvFile)
+	record, has := repo.fileRecord(kvfile.id)
+	if !has {
+		record = &fileRecord{Info: kvfile.info, Parent: kvfile.parent}
+	}
+	record.Blocks = append(record.Blocks, blockInfo)
+	repo.put(BUCKET_FILES, kvfile.id, record)
+	repo.indexBlock(kvfile.id, blockInfo)
+	repo.batched()
+	return &kvBlock{repo: repo, file: kvfile.id, info: blockInfo}
+}
+
+func (repo *KvRepo) indexBlock(fileId string, blockInfo *fs.BlockInfo) {
+	repo.put(BUCKET_BLOCKS, blockInfo.Strong, &blockRecord{File: fileId, Info: blockInfo})
+	repo.store.Put(BUCKET_WEAK, strconv.Itoa(blockInfo.Weak), []byte(blockInfo.Strong))
+}
+
+func (repo *KvRepo) AddFile(dir fs.Dir, fileInfo *fs.FileInfo, blocksInfo []*fs.BlockInfo) fs.File {
+	file := &kvFile{repo: repo, id: repo.newId("f"), info: fileInfo}
+	if kvdir, is := dir.(*kvDir); is {
+		file.parent = kvdir.id
+		if record, has := repo.dirRecord(kvdir.id); has {
+			record.Files = append(record.Files, file.id)
+			repo.dirty[kvdir.id] = record
+		}
+	} else {
+		repo.root = file.id
+		repo.store.Put(BUCKET_META, META_ROOT, []byte(file.id))
+	}
+
+	repo.put(BUCKET_FILES, file.id, &fileRecord{
+		Info: fileInfo, Parent: file.parent, Blocks: blocksInfo})
+	repo.store.Put(BUCKET_FILE_STRONG, fileInfo.Strong, []byte(file.id))
+	for _, blockInfo := range blocksInfo {
+		repo.indexBlock(file.id, blockInfo)
+	}
+	repo.batched()
+	return file
+}
+
+func (repo *KvRepo) AddDir(dir fs.Dir, subdirInfo *fs.DirInfo) fs.Dir {
+	subdir := &kvDir{repo: repo, id: repo.newId("d"), info: subdirInfo}
+	if subdirInfo.Strong == "" {
+		subdirInfo.Strong = fmt.Sprintf("tmp%s", subdir.id)
+	}
+	if kvdir, is := dir.(*kvDir); is {
+		subdir.parent = kvdir.id
+		if record, has := repo.dirRecord(kvdir.id); has {
+			record.SubDirs = append(record.SubDirs, subdir.id)
+			repo.dirty[kvdir.id] = record
+		}
+	} else {
+		repo.root = subdir.id
+	}
+
+	repo.dirty[subdir.id] = &dirRecord{Info: subdirInfo, Parent: subdir.parent}
+	repo.store.Put(BUCKET_DIR_STRONG, subdirInfo.Strong, []byte(subdir.id))
+	repo.batched()
+	return subdir
+}
+
+func (repo *KvRepo) UpdateStrong(dir *kvDir) string {
+	newStrong := fs.CalcStrong(dir)
+	if newStrong != dir.info.Strong {
+		if id, has := repo.store.Get(BUCKET_DIR_STRONG, dir.info.Strong); has && string(id) == dir.id {
+			repo.store.Delete(BUCKET_DIR_STRONG, dir.info.Strong)
+		}
+		repo.store.Put(BUCKET_DIR_STRONG, newStrong, []byte(dir.id))
+
+		dir.info.Strong = newStrong
+		if record, has := repo.dirRecord(dir.id); has {
+			record.Info.Strong = newStrong
+			repo.dirty[dir.id] = record
+		}
+	}
+
+	// A root's checksum is updated once its tree is complete
+	if dir.parent == "" {
+		if dir.id == repo.root {
+			repo.store.Put(BUCKET_META, META_ROOT, []byte(dir.id))
+		}
+		if err := repo.Checkpoint(); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+	return newStrong
+}
+
+// Commit the writes made since the last checkpoint.
+func (repo *KvRepo) Checkpoint() os.Error {
+	for id, record := range repo.dirty {
+		repo.put(BUCKET_DIRS, id, record)
+	}
+	if err := repo.store.Checkpoint(); err != nil {
+		return err
+	}
+	repo.dirty = make(map[string]*dirRecord)
+	return nil
+}
+
+// Checkpoint once a batch of writes is full.
+func (repo *KvRepo) batched() {
+	if repo.store.Pending()+len(repo.dirty) < KV_BATCH {
+		return
+	}
+	if err := repo.Checkpoint(); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+func (repo *KvRepo) Close() {
+	if err := repo.Checkpoint(); err != nil {
+		log.Printf("%v", err)
+	}
+	if err := repo.store.Close(); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+func (repo *KvRepo) IndexFilter() fs.IndexFilter {
+	return func(path string, f *os.FileInfo) bool {
+		return filepath.Clean(path) != filepath.Clean(repo.store.Path())
+	}
+}
+
+func (repo *KvRepo) dirRecord(id string) (*dirRecord, bool) {
+	if record, has := repo.dirty[id]; has {
+		return record, true
+	}
+	record := &dirRecord{}
+	return record, repo.get(BUCKET_DIRS, id, record)
+}
+
+func (repo *KvRepo) fileRecord(id string) (*fileRecord, bool) {
+	record := &fileRecord{}
+	return record, repo.get(BUCKET_FILES, id, record)
+}
+
+func (repo *KvRepo) loadDir(id string) (*kvDir, bool) {
+	record, has := repo.dirRecord(id)
+	if !has {
+		return nil, false
+	}
+	return &kvDir{repo: repo, id: id, parent: record.Parent, info: record.Info}, true
+}
+
+func (repo *KvRepo) loadFile(id string) (*kvFile, bool) {
+	record, has := repo.fileRecord(id)
+	if !has {
+		return nil, false
+	}
+	return &kvFile{repo: repo, id: id, parent: record.Parent, info: record.Info}, true
+}
+
+func (repo *KvRepo) get(bucket string, key string, record interface{}) bool {
+	buf, has := repo.store.Get(bucket, key)
+	if !has {
+		return false
+	}
+	if err := json.Unmarshal(buf, record); err != nil {
+		log.Printf("%s: bad %s %s: %v", repo.store.Path(), bucket, key, err)
+		return false
+	}
+	return true
+}
+
+func (repo *KvRepo) put(bucket string, key string, record interface{}) {
+	buf, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	repo.store.Put(bucket, key, buf)
+}
+
+// Get the mode directory checksums are calculated in. It is recorded in
+// the store, so a repo reopened keeps the mode it was given.
+func (repo *KvRepo) StrongMode() fs.StrongMode { return repo.strongMode }
+
+func (repo *KvRepo) SetStrongMode(mode fs.StrongMode) {
+	repo.strongMode = mode
+	repo.putMetaInt(META_STRONG_MODE, int64(mode))
+}
+
+// Get the block size of the files indexed, or zero for BLOCKSIZE. It is
+// recorded in the store, so a repo reopened keeps the size it was given.
+func (repo *KvRepo) BlockSize() int { return repo.blockSize }
+
+func (repo *KvRepo) SetBlockSize(size int) {
+	repo.blockSize = size
+	repo.putMetaInt(META_BLOCK_SIZE, int64(size))
+}
+
+// Get how the files indexed are divided into blocks. Blocks are kept
+// with their offsets, so unlike DbRepo, files divided by content can be
+// held.
+func (repo *KvRepo) Chunking() fs.Chunking { return repo.chunking }
+
+func (repo *KvRepo) SetChunking(chunking fs.Chunking) {
+	repo.chunking = chunking
+	repo.putMetaInt(META_CHUNKING, int64(chunking))
+}
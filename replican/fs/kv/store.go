@@ -0,0 +1,324 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+// Marks the start of a store file.
+const STORE_MAGIC string = "RPLKV001"
+
+// Kinds of record in a store file.
+const (
+	recordPut    byte = 'P'
+	recordDelete byte = 'D'
+	recordCommit byte = 'C'
+)
+
+const (
+	recordHeaderSize = 13
+	commitSize       = 9
+)
+
+// An embedded key-value store, kept in a single file, with its values
+// in named buckets.
+//
+// Writes are held in memory until Checkpoint appends them to the file
+// as one batch, followed by a commit record holding the length and
+// CRC-32 of the batch. When the store is opened, a batch without a valid
+// commit record after it, as a crash while checkpointing would leave,
+// is discarded: each checkpoint is committed whole or not at all.
+//
+// All integers are big-endian. The layout is:
+//
+//	header:  magic [8]byte
+//	records: kind byte, bucket length uint32, key length uint32,
+//	         value length uint32, bucket, key, value
+//	commit:  kind byte, batch length uint32, batch CRC-32 uint32
+//
+// The keys of each bucket are kept in memory, with where their values
+// are in the file; values are read as they are asked for. Values replaced
+// or deleted are left in the file.
+type Store struct {
+	path string
+	file *os.File
+
+	// Where the last batch committed ends.
+	end int64
+
+	buckets map[string]map[string]*location
+
+	// Writes since the last checkpoint, by bucket. A nil value is a delete.
+	pending  map[string]map[string][]byte
+	nPending int
+}
+
+// Where a value is in the file.
+type location struct {
+	offset int64
+	length int
+}
+
+// A write read back from a batch, not applied until its commit is found.
+type loadedWrite struct {
+	bucket string
+	key    string
+	value  *location
+}
+
+// Open the store kept in the file at path, creating it if there is none.
+func Open(path string) (*Store, os.Error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &Store{
+		path:    path,
+		file:    file,
+		buckets: make(map[string]map[string]*location),
+		pending: make(map[string]map[string][]byte)}
+	if err = store.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// Read the keys of the batches committed, and cut off any batch after
+// them which was not.
+func (store *Store) load() os.Error {
+	stat, err := store.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if stat.Size == 0 {
+		if _, err = store.file.WriteAt([]byte(STORE_MAGIC), 0); err != nil {
+			return err
+		}
+		store.end = int64(len(STORE_MAGIC))
+		return store.file.Sync()
+	}
+
+	reader := bufio.NewReader(store.file)
+	magic := make([]byte, len(STORE_MAGIC))
+	if _, err = io.ReadFull(reader, magic); err != nil || string(magic) != STORE_MAGIC {
+		return os.NewError(fmt.Sprintf("%s is not a key-value store", store.path))
+	}
+
+	store.end = int64(len(STORE_MAGIC))
+	offset := store.end
+	crc := crc32.NewIEEE()
+	var batch []*loadedWrite
+
+	for {
+		kind, err := reader.ReadByte()
+		if err != nil {
+			break
+		}
+
+		if kind == recordCommit {
+			var length, sum uint32
+			if binary.Read(reader, binary.BigEndian, &length) != nil ||
+				binary.Read(reader, binary.BigEndian, &sum) != nil {
+				break
+			}
+			if int64(length) != offset-store.end || sum != crc.Sum32() {
+				break
+			}
+			for _, write := range batch {
+				store.apply(write.bucket, write.key, write.value)
+			}
+			offset += commitSize
+			store.end = offset
+			crc.Reset()
+			batch = nil
+			continue
+		} else if kind != recordPut && kind != recordDelete {
+			break
+		}
+
+		header := make([]byte, recordHeaderSize-1)
+		if _, err = io.ReadFull(reader, header); err != nil {
+			break
+		}
+		bucketLen := int(binary.BigEndian.Uint32(header[0:4]))
+		keyLen := int(binary.BigEndian.Uint32(header[4:8]))
+		valueLen := int(binary.BigEndian.Uint32(header[8:12]))
+
+		body := make([]byte, bucketLen+keyLen+valueLen)
+		if _, err = io.ReadFull(reader, body); err != nil {
+			break
+		}
+		crc.Write([]byte{kind})
+		crc.Write(header)
+		crc.Write(body)
+
+		write := &loadedWrite{
+			bucket: string(body[:bucketLen]),
+			key:    string(body[bucketLen : bucketLen+keyLen])}
+		if kind == recordPut {
+			write.value = &location{
+				offset: offset + int64(recordHeaderSize+bucketLen+keyLen),
+				length: valueLen}
+		}
+		batch = append(batch, write)
+		offset += int64(recordHeaderSize + len(body))
+	}
+
+	if store.end < stat.Size {
+		return store.file.Truncate(store.end)
+	}
+	return nil
+}
+
+func (store *Store) apply(bucket string, key string, value *location) {
+	keys, has := store.buckets[bucket]
+	if !has {
+		keys = make(map[string]*location)
+		store.buckets[bucket] = keys
+	}
+	if value == nil {
+		keys[key] = nil, false
+	} else {
+		keys[key] = value
+	}
+}
+
+// Get the value of a key, as last written, whether or not it has been
+// checkpointed.
+func (store *Store) Get(bucket string, key string) ([]byte, bool) {
+	if value, has := store.pending[bucket][key]; has {
+		return value, value != nil
+	}
+
+	value, has := store.buckets[bucket][key]
+	if !has {
+		return nil, false
+	}
+	buf := make([]byte, value.length)
+	if _, err := store.file.ReadAt(buf, value.offset); err != nil {
+		return nil, false
+	}
+	return buf, true
+}
+
+// Set the value of a key, from the next checkpoint.
+func (store *Store) Put(bucket string, key string, value []byte) {
+	store.write(bucket, key, append([]byte{}, value...))
+}
+
+// Delete a key, from the next checkpoint.
+func (store *Store) Delete(bucket string, key string) {
+	store.write(bucket, key, nil)
+}
+
+func (store *Store) write(bucket string, key string, value []byte) {
+	keys, has := store.pending[bucket]
+	if !has {
+		keys = make(map[string][]byte)
+		store.pending[bucket] = keys
+	}
+	if _, has = keys[key]; !has {
+		store.nPending++
+	}
+	keys[key] = value
+}
+
+// Get the keys in a bucket, in bytewise order.
+func (store *Store) Keys(bucket string) []string {
+	keys := []string{}
+	for key, _ := range store.buckets[bucket] {
+		if _, has := store.pending[bucket][key]; !has {
+			keys = append(keys, key)
+		}
+	}
+	for key, value := range store.pending[bucket] {
+		if value != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Get the number of keys written since the last checkpoint.
+func (store *Store) Pending() int { return store.nPending }
+
+// Commit the writes made since the last checkpoint, all together. If they
+// cannot be written, none of them are committed, and they are kept for
+// the next checkpoint.
+func (store *Store) Checkpoint() os.Error {
+	if store.nPending == 0 {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	var batch []*loadedWrite
+	for bucket, keys := range store.pending {
+		for key, value := range keys {
+			kind := recordPut
+			if value == nil {
+				kind = recordDelete
+			}
+			buf.WriteByte(kind)
+			binary.Write(buf, binary.BigEndian, uint32(len(bucket)))
+			binary.Write(buf, binary.BigEndian, uint32(len(key)))
+			binary.Write(buf, binary.BigEndian, uint32(len(value)))
+			buf.WriteString(bucket)
+			buf.WriteString(key)
+
+			write := &loadedWrite{bucket: bucket, key: key}
+			if value != nil {
+				write.value = &location{offset: store.end + int64(buf.Len()), length: len(value)}
+			}
+			buf.Write(value)
+			batch = append(batch, write)
+		}
+	}
+
+	length := buf.Len()
+	sum := crc32.ChecksumIEEE(buf.Bytes())
+	buf.WriteByte(recordCommit)
+	binary.Write(buf, binary.BigEndian, uint32(length))
+	binary.Write(buf, binary.BigEndian, sum)
+
+	_, err := store.file.WriteAt(buf.Bytes(), store.end)
+	if err == nil {
+		err = store.file.Sync()
+	}
+	if err != nil {
+		store.file.Truncate(store.end)
+		return err
+	}
+
+	for _, write := range batch {
+		store.apply(write.bucket, write.key, write.value)
+	}
+	store.end += int64(buf.Len())
+	store.pending = make(map[string]map[string][]byte)
+	store.nPending = 0
+	return nil
+}
+
+// Discard the writes made since the last checkpoint.
+func (store *Store) Rollback() {
+	store.pending = make(map[string]map[string][]byte)
+	store.nPending = 0
+}
+
+// Get the path of the store's file.
+func (store *Store) Path() string { return store.path }
+
+// Close the store. Writes not checkpointed are discarded.
+func (store *Store) Close() os.Error {
+	store.Rollback()
+	return store.file.Close()
+}
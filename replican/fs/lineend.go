@@ -0,0 +1,143 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Line endings which text files are normalized to.
+type LineEnding int
+
+const (
+	// Leave line endings as they are.
+	EOL_KEEP LineEnding = iota
+
+	// Unix line endings, LF.
+	EOL_LF
+
+	// DOS line endings, CRLF.
+	EOL_CRLF
+)
+
+// Normalize the line endings of files whose names match a pattern.
+// Patterns are those of path.Match. A pattern containing a "/" matches
+// the slash-separated path from the root of the tree; any other pattern
+// matches the base name, as "*.txt" does.
+type LineEndingRule struct {
+	Pattern string
+	Ending  LineEnding
+}
+
+func (rule *LineEndingRule) matches(name string) bool {
+	if !strings.Contains(rule.Pattern, "/") {
+		_, name = path.Split(name)
+	}
+	matched, _ := path.Match(rule.Pattern, name)
+	return matched
+}
+
+// Parse line ending rules of the form "pattern=lf" or "pattern=crlf",
+// separated by commas, as in "*.txt=crlf,*.sh=lf".
+func ParseLineEndingRules(spec string) ([]LineEndingRule, os.Error) {
+	rules := []LineEndingRule{}
+	for _, field := range strings.Split(spec, ",") {
+		if field == "" {
+			continue
+		}
+
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, os.NewError(fmt.Sprintf("Invalid line ending rule %q", field))
+		}
+
+		rule := LineEndingRule{Pattern: parts[0]}
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, os.NewError(fmt.Sprintf("Invalid line ending rule %q: %v", field, err))
+		}
+
+		switch strings.ToLower(parts[1]) {
+		case "keep":
+			rule.Ending = EOL_KEEP
+		case "lf":
+			rule.Ending = EOL_LF
+		case "crlf":
+			rule.Ending = EOL_CRLF
+		default:
+			return nil, os.NewError(fmt.Sprintf("Invalid line ending rule %q", field))
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Normalize line endings by the first rule matching each file.
+// Files which match no rule are left as they are.
+//
+// As with any ContentTransform, the source is indexed normalized, so blocks
+// already converted in the destination match the source and are reused.
+func LineEndings(rules ...LineEndingRule) ContentTransform {
+	return TransformFunc(func(name string, r io.Reader) (io.Reader, os.Error) {
+		for i := range rules {
+			if !rules[i].matches(name) {
+				continue
+			}
+
+			switch rules[i].Ending {
+			case EOL_LF:
+				return ToLF.Transform(name, r)
+			case EOL_CRLF:
+				return ToCRLF.Transform(name, r)
+			}
+			break
+		}
+		return r, nil
+	})
+}
+
+// Convert DOS line endings to Unix line endings.
+var ToLF ContentTransform = TransformFunc(func(_ string, r io.Reader) (io.Reader, os.Error) {
+	return &lfReader{r: r}, nil
+})
+
+type lfReader struct {
+	r      io.Reader
+	lastCR bool     // A CR is held back until it is known not to end a line
+	out    []byte   // Converted content not yet returned
+	err    os.Error // Error to return once out is drained
+}
+
+func (lr *lfReader) Read(buf []byte) (int, os.Error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	for len(lr.out) == 0 && lr.err == nil {
+		in := make([]byte, len(buf))
+		rd, err := lr.r.Read(in)
+		for _, b := range in[:rd] {
+			if lr.lastCR && b != '\n' {
+				lr.out = append(lr.out, '\r')
+			}
+			lr.lastCR = b == '\r'
+			if !lr.lastCR {
+				lr.out = append(lr.out, b)
+			}
+		}
+
+		if err != nil && lr.lastCR {
+			lr.out = append(lr.out, '\r')
+			lr.lastCR = false
+		}
+		lr.err = err
+	}
+
+	n := copy(buf, lr.out)
+	lr.out = lr.out[n:]
+	if len(lr.out) > 0 {
+		return n, nil
+	}
+	return n, lr.err
+}
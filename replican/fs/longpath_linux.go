@@ -0,0 +1,6 @@
+package fs
+
+// Paths need no prefix to exceed any length limit on this platform.
+func LongPath(path string) string {
+	return path
+}
@@ -0,0 +1,22 @@
+package fs
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Paths at least this long must be given with the long path prefix.
+const MAX_PATH = 248
+
+// Give a path the long path prefix if Windows needs it to reach the path,
+// lifting the MAX_PATH limit. Only absolute paths can be prefixed.
+func LongPath(path string) string {
+	if len(path) < MAX_PATH || strings.HasPrefix(path, LONG_PATH_PREFIX) || !filepath.IsAbs(path) {
+		return path
+	}
+
+	if strings.HasPrefix(path, `\\`) {
+		return LONG_PATH_PREFIX + `UNC\` + path[2:]
+	}
+	return LONG_PATH_PREFIX + path
+}
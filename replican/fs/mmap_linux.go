@@ -0,0 +1,30 @@
+package fs
+
+import (
+	"os"
+	"syscall"
+)
+
+// Map a file into memory, read-only.
+func mapFile(f *os.File, size int) ([]byte, os.Error) {
+	if size == 0 {
+		return []byte{}, nil
+	}
+
+	data, errno := syscall.Mmap(f.Fd(), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	if errno != 0 {
+		return nil, os.NewSyscallError("mmap", errno)
+	}
+	return data, nil
+}
+
+func unmapFile(data []byte) os.Error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	if errno := syscall.Munmap(data); errno != 0 {
+		return os.NewSyscallError("munmap", errno)
+	}
+	return nil
+}
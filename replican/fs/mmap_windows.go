@@ -0,0 +1,19 @@
+package fs
+
+import (
+	"io"
+	"os"
+)
+
+// Read a file into memory. Files are not mapped on this platform.
+func mapFile(f *os.File, size int) ([]byte, os.Error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func unmapFile(data []byte) os.Error {
+	return nil
+}
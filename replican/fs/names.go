@@ -0,0 +1,163 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"utf8"
+)
+
+var windowsDevices = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true}
+
+// Characters Windows does not allow in names, besides control characters.
+const WINDOWS_RESERVED_CHARS = `<>:"|?*`
+
+// Test for names Windows will not create as given: those with reserved
+// characters, trailing dots or spaces, or naming a device.
+// Windows file systems shared to other platforms, such as over SMB,
+// have the same restrictions.
+func IsWindowsReserved(name string) bool {
+	if strings.IndexAny(name, WINDOWS_RESERVED_CHARS) >= 0 {
+		return true
+	}
+	for _, c := range name {
+		if c < 32 {
+			return true
+		}
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return true
+	}
+	return isWindowsDevice(name)
+}
+
+// Devices are reserved whatever the extension, as in NUL.txt
+func isWindowsDevice(name string) bool {
+	return windowsDevices[strings.ToUpper(strings.SplitN(name, ".", 2)[0])]
+}
+
+// Rename a name reserved on Windows to one which is not: reserved
+// characters and trailing dots or spaces become underscores, and
+// device names are suffixed with an underscore, as in CON_.txt.
+func WindowsSafeName(name string) string {
+	safe := []int{}
+	for _, c := range name {
+		if c < 32 || strings.IndexRune(WINDOWS_RESERVED_CHARS, c) >= 0 {
+			c = '_'
+		}
+		safe = append(safe, c)
+	}
+	for i := len(safe) - 1; i >= 0 && (safe[i] == '.' || safe[i] == ' '); i-- {
+		safe[i] = '_'
+	}
+	name = string(safe)
+
+	if isWindowsDevice(name) {
+		parts := strings.SplitN(name, ".", 2)
+		parts[0] += "_"
+		name = strings.Join(parts, ".")
+	}
+	return name
+}
+
+// Escaped characters are moved into this block of the Unicode private use
+// area, as Cygwin and Services for Macintosh do, so that escaping can be
+// reversed without any record of the original names.
+const ESCAPE_BASE = 0xf000
+
+// Escape a name reserved on Windows so that it can be created there, and
+// later restored with UnescapeName: reserved characters and trailing dots
+// or spaces are escaped, and so is the last character of a device name.
+func EscapeWindowsName(name string) string {
+	escaped := []int{}
+	for _, c := range name {
+		if c < 32 || strings.IndexRune(WINDOWS_RESERVED_CHARS, c) >= 0 {
+			c += ESCAPE_BASE
+		}
+		escaped = append(escaped, c)
+	}
+	for i := len(escaped) - 1; i >= 0 && (escaped[i] == '.' || escaped[i] == ' '); i-- {
+		escaped[i] += ESCAPE_BASE
+	}
+
+	if isWindowsDevice(string(escaped)) {
+		base := strings.SplitN(string(escaped), ".", 2)[0]
+		escaped[len(base)-1] += ESCAPE_BASE
+	}
+	return string(escaped)
+}
+
+// Restore a name escaped by EscapeWindowsName.
+func UnescapeName(name string) string {
+	unescaped := []int{}
+	for _, c := range name {
+		if c >= ESCAPE_BASE && c < ESCAPE_BASE+128 {
+			c -= ESCAPE_BASE
+		}
+		unescaped = append(unescaped, c)
+	}
+	return string(unescaped)
+}
+
+// A path which cannot be created on this platform, because it, or a name
+// along it, is longer than the platform allows.
+type ErrPathTooLong struct {
+	Path string
+
+	// The name along the path which is too long, if any.
+	Name string
+}
+
+func (err *ErrPathTooLong) String() string {
+	if err.Name != "" {
+		return fmt.Sprintf("%s: name %q is longer than %d", err.Path, err.Name, MAX_NAME_LEN)
+	}
+	return fmt.Sprintf("%s: path is longer than %d", err.Path, MAX_PATH_LEN)
+}
+
+// Test for names longer than MAX_NAME_LEN.
+func IsNameTooLong(name string) bool {
+	return pathLen(name) > MAX_NAME_LEN
+}
+
+// Check that a path, and each name along it, is within the length limits
+// of this platform. Returns an ErrPathTooLong if not.
+func CheckPathLength(path string) os.Error {
+	for _, name := range SplitNames(path) {
+		if IsNameTooLong(name) {
+			return &ErrPathTooLong{Path: path, Name: name}
+		}
+	}
+	if pathLen(path) > MAX_PATH_LEN {
+		return &ErrPathTooLong{Path: path}
+	}
+	return nil
+}
+
+// Shorten a name longer than MAX_NAME_LEN, replacing its end with part of
+// its strong checksum, so that distinct long names remain distinct and
+// the same name is always shortened the same way. Its extension is kept.
+func ShortenName(name string) string {
+	if !IsNameTooLong(name) {
+		return name
+	}
+
+	hash := "~" + StrongChecksum([]byte(name))[:12]
+	ext := filepath.Ext(name)
+	if len(ext)+len(hash) > MAX_NAME_LEN/2 {
+		ext = ""
+	}
+
+	// Lengths in bytes are never fewer than those counted by pathLen.
+	keep := MAX_NAME_LEN - len(hash) - len(ext)
+	for keep > 0 && !utf8.RuneStart(name[keep]) {
+		keep--
+	}
+	return name[:keep] + hash + ext
+}
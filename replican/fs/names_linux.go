@@ -0,0 +1,18 @@
+package fs
+
+// Test for names which cannot be created on this platform.
+// Any name without a separator or NUL is allowed here.
+func IsReservedName(name string) bool {
+	return false
+}
+
+// Longest name, and longest path, which can be created on this platform.
+const (
+	MAX_NAME_LEN = 255
+	MAX_PATH_LEN = 4096
+)
+
+// Length of a name or path, as counted against the limits: in bytes.
+func pathLen(path string) int {
+	return len(path)
+}
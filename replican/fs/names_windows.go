@@ -0,0 +1,23 @@
+package fs
+
+import (
+	"utf16"
+)
+
+// Test for names which cannot be created on this platform.
+// Names Windows will not create as given are reserved.
+func IsReservedName(name string) bool {
+	return IsWindowsReserved(name)
+}
+
+// Longest name, and longest path given with the long path prefix,
+// which can be created on this platform.
+const (
+	MAX_NAME_LEN = 255
+	MAX_PATH_LEN = 32767
+)
+
+// Length of a name or path, as counted against the limits: in UTF-16 units.
+func pathLen(path string) int {
+	return len(utf16.Encode([]int(path)))
+}
@@ -4,12 +4,19 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"fmt"
+	"os"
 	"path/filepath"
+	"sort"
 )
 
-// Block size used for checksum, comparison, transmitting deltas.
+// Default block size used for checksum, comparison, transmitting deltas.
+// Stores may be indexed with another; see LocalStore.SetBlockSize.
 const BLOCKSIZE int = 8192
 
+// Strong checksum of a file with no content. Empty files have no blocks,
+// so all of them match each other, and only each other, by this checksum.
+const EMPTY_STRONG = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+
 // Nodes are any member of a hierarchical tree model representing 
 // a part of the filesystem. Nodes include files and directories,
 // and also blocks within the files.
@@ -51,17 +58,57 @@ type Block interface {
 }
 
 // Represent a block in a hierarchical tree model.
-// Blocks are BLOCKSIZE chunks of data which comprise files.
+// Blocks are BLOCKSIZE chunks of data which comprise files, unless
+// the file was indexed with another block size.
 type BlockInfo struct {
 	Position int
 	Weak     int
 	Strong   string
 	Parent   string
+
+	// Block size of the containing file, or zero for BLOCKSIZE.
+	// It is not part of the canonical encoding; see BlockSizeRepo.
+	BlockSize int
+
+	// Offset and length of the block, if the containing file was divided
+	// by content, or zero. Not part of the canonical encoding either;
+	// see ChunkingRepo.
+	ChunkOffset int64
+	ChunkLength int
+}
+
+// Get the size of this block. Fixed-size blocks are the block size of
+// the containing file, though the last block of a file may be shorter.
+func (block *BlockInfo) Size() int64 {
+	if block.ChunkLength > 0 {
+		return int64(block.ChunkLength)
+	} else if block.BlockSize == 0 {
+		return int64(BLOCKSIZE)
+	}
+	return int64(block.BlockSize)
 }
 
 // Get the byte offset of this block in its containing file.
 func (block *BlockInfo) Offset() int64 {
-	return int64(block.Position) * int64(BLOCKSIZE)
+	if block.ChunkLength > 0 {
+		return block.ChunkOffset
+	}
+	return int64(block.Position) * block.Size()
+}
+
+// Get the block size a file was indexed with. For a file divided by
+// content, this is the size its blocks were chosen around.
+func FileBlockSize(file File) int64 {
+	if blocks := file.Blocks(); len(blocks) > 0 && blocks[0].Info().BlockSize > 0 {
+		return int64(blocks[0].Info().BlockSize)
+	}
+	return int64(BLOCKSIZE)
+}
+
+// Test whether a file was divided into blocks by content.
+func IsChunked(file File) bool {
+	blocks := file.Blocks()
+	return len(blocks) > 0 && blocks[0].Info().ChunkLength > 0
 }
 
 type Blocks struct {
@@ -95,8 +142,32 @@ type FileInfo struct {
 	Size   int64
 	Strong string
 	Parent string
+
+	// Modification time in nanoseconds, if indexed from local disk.
+	Mtime int64
+
+	// Owner, if indexed from local disk.
+	Owner *Owner
+
+	// Extended attributes in XATTR_NAMESPACES, if indexed.
+	Xattrs map[string][]byte
+
+	// POSIX ACLs, if indexed.
+	Acls *Acls
+}
+
+// The user and group which own a file or directory.
+type Owner struct {
+	Uid int
+	Gid int
 }
 
+// Get the owner of a file from its stat.
+func StatOwner(fi *os.FileInfo) *Owner {
+	return &Owner{Uid: fi.Uid, Gid: fi.Gid}
+}
+
+// Sort files in bytewise order of their names.
 type Files struct {
 	Contents []File
 }
@@ -131,8 +202,21 @@ type DirInfo struct {
 	Mode   uint32
 	Strong string
 	Parent string
+
+	// Modification time in nanoseconds, if indexed from local disk.
+	Mtime int64
+
+	// Owner, if indexed from local disk.
+	Owner *Owner
+
+	// Extended attributes in XATTR_NAMESPACES, if indexed.
+	Xattrs map[string][]byte
+
+	// POSIX ACLs, if indexed.
+	Acls *Acls
 }
 
+// Sort directories in bytewise order of their names.
 type Dirs struct {
 	Contents []Dir
 }
@@ -149,26 +233,128 @@ func (dirs *Dirs) Swap(i, j int) {
 	dirs.Contents[i], dirs.Contents[j] = dirs.Contents[j], dirs.Contents[i]
 }
 
-// Calculate the strong checksum of a directory.
+// What the strong checksum of a directory is calculated over.
+type StrongMode int
+
+const (
+	// The names and strong checksums of its contents. Trees which differ
+	// only in metadata have the same checksums.
+	STRONG_CONTENT StrongMode = iota
+
+	// As STRONG_CONTENT, and also the modes of its contents and the sizes
+	// of its files, so that trees which differ only in permissions have
+	// different checksums. These checksums can only be compared with
+	// others calculated the same way.
+	STRONG_META
+)
+
+// Implemented by repos which can calculate directory checksums in a mode
+// other than STRONG_CONTENT. The mode should be set before any directories
+// are added, as checksums already calculated are not recalculated.
+type StrongModeRepo interface {
+	NodeRepo
+
+	StrongMode() StrongMode
+
+	SetStrongMode(mode StrongMode)
+}
+
+// Implemented by repos which can be given a block size. LocalStores opened
+// on the repo, and IndexDir, divide files into blocks of that size, so that
+// a store of large blocks is never indexed in small ones first. Persistent
+// repos record the size, and keep it when they are reopened; it is also
+// given to the blocks they load, which are kept without it. Zero means
+// BLOCKSIZE.
+type BlockSizeRepo interface {
+	NodeRepo
+
+	BlockSize() int
+
+	SetBlockSize(size int)
+}
+
+// Implemented by repos which keep the offsets and lengths of blocks, and
+// so can hold files divided by content. LocalStores opened on the repo,
+// and IndexDir, divide files in the repo's way. Zero means CHUNK_FIXED.
+type ChunkingRepo interface {
+	NodeRepo
+
+	Chunking() Chunking
+
+	SetChunking(chunking Chunking)
+}
+
+// Hashes the blocks of a file when they are first asked for.
+type BlockLoader func() ([]*BlockInfo, os.Error)
+
+// Implemented by repos which can add files before their blocks are hashed.
+// The strong checksums of files, and so of directories, do not depend on
+// their blocks, which are only needed to match files that differ; the
+// blocks of a lazy file are loaded the first time its Blocks are asked
+// for. Until then, the repo cannot look them up by their checksums.
+type LazyRepo interface {
+	NodeRepo
+
+	AddLazyFile(dir Dir, fileInfo *FileInfo, load BlockLoader) File
+}
+
+// Calculate the strong checksum of a directory, in the mode of its repo.
 func CalcStrong(dir Dir) string {
+	return CalcStrongMode(dir, RepoStrongMode(dir.Repo()))
+}
+
+// Get the mode a repo calculates directory checksums in.
+func RepoStrongMode(repo NodeRepo) StrongMode {
+	if modeRepo, is := repo.(StrongModeRepo); is {
+		return modeRepo.StrongMode()
+	}
+	return STRONG_CONTENT
+}
+
+// Calculate the strong checksum of a directory in the given mode.
+func CalcStrongMode(dir Dir, mode StrongMode) string {
 	var sha1 = sha1.New()
 	//	s := reprDir(dir)
 	//	fmt.Printf("%s\n", s)
 	//	sha1.Write(s)
-	sha1.Write(reprDir(dir))
+	sha1.Write(reprDir(dir, mode))
 	return toHexString(sha1)
 }
 
 // Represent the directory's distinct deep contents as a byte array.
 // Inspired by git.
-func reprDir(dir Dir) []byte {
+//
+// Subdirectories, then files, are listed in bytewise order of their names,
+// whatever order the repo keeps them in. The order does not depend on locale,
+// and names are not normalized, so hosts indexing identical trees always
+// calculate identical checksums. Links indexed with SYMLINKS_STORE are
+// listed as links, so that a link differs from a file holding its target.
+func reprDir(dir Dir, mode StrongMode) []byte {
 	buf := bytes.NewBufferString("")
 
-	for _, subdir := range dir.SubDirs() {
-		fmt.Fprintf(buf, "%s\td\t%s\n", subdir.UpdateStrong(), subdir.Name())
+	subdirs := &Dirs{Contents: append([]Dir{}, dir.SubDirs()...)}
+	sort.Sort(subdirs)
+	for _, subdir := range subdirs.Contents {
+		if mode == STRONG_META {
+			fmt.Fprintf(buf, "%s\td\t%o\t%s\n", subdir.UpdateStrong(), subdir.Mode(), subdir.Name())
+		} else {
+			fmt.Fprintf(buf, "%s\td\t%s\n", subdir.UpdateStrong(), subdir.Name())
+		}
 	}
-	for _, file := range dir.Files() {
-		fmt.Fprintf(buf, "%s\tf\t%s\n", file.Info().Strong, file.Name())
+
+	files := &Files{Contents: append([]File{}, dir.Files()...)}
+	sort.Sort(files)
+	for _, file := range files.Contents {
+		kind := "f"
+		if IsSymlinkMode(file.Mode()) {
+			kind = "l"
+		}
+		if mode == STRONG_META {
+			fmt.Fprintf(buf, "%s\t%s\t%o\t%d\t%s\n",
+				file.Info().Strong, kind, file.Mode(), file.Info().Size, file.Name())
+		} else {
+			fmt.Fprintf(buf, "%s\t%s\t%s\n", file.Info().Strong, kind, file.Name())
+		}
 	}
 
 	return buf.Bytes()
@@ -207,6 +393,10 @@ func Lookup(dir Dir, relpath string) (fsNode FsNode, hasItem bool) {
 type NodeVisitor func(Node) bool
 
 // Traverse the hierarchical tree model with a user-defined NodeVisitor function.
+// Nodes are visited breadth-first. Within a directory, subdirectories are visited
+// before files, each in order of name; blocks are visited in order of position.
+// The order of traversal is therefore stable for identical trees,
+// whichever NodeRepo holds them.
 func Walk(node Node, visitor NodeVisitor) {
 	nodestack := []Node{}
 	nodestack = append(nodestack, node)
@@ -217,14 +407,21 @@ func Walk(node Node, visitor NodeVisitor) {
 		if visitor(current) {
 
 			if dir, isDir := current.(Dir); isDir {
-				for _, subdir := range dir.SubDirs() {
+				subdirs := &Dirs{Contents: append([]Dir{}, dir.SubDirs()...)}
+				sort.Sort(subdirs)
+				for _, subdir := range subdirs.Contents {
 					nodestack = append(nodestack, subdir)
 				}
-				for _, file := range dir.Files() {
+
+				files := &Files{Contents: append([]File{}, dir.Files()...)}
+				sort.Sort(files)
+				for _, file := range files.Contents {
 					nodestack = append(nodestack, file)
 				}
 			} else if file, isFile := current.(File); isFile {
-				for _, block := range file.Blocks() {
+				blocks := &Blocks{Contents: append([]Block{}, file.Blocks()...)}
+				sort.Sort(blocks)
+				for _, block := range blocks.Contents {
 					nodestack = append(nodestack, block)
 				}
 			}
@@ -0,0 +1,127 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+)
+
+// Strong checksum algorithm of blocks and files. See StrongChecksum.
+const STRONG_HASH = "sha1"
+
+// How the checksums of a tree were calculated. Checksums are only
+// comparable between trees hashed with the same parameters: blocks of
+// different sizes or boundaries never match, and neither do directories
+// in different strong modes.
+type HashParams struct {
+	Hash       string
+	BlockSize  int
+	Chunking   Chunking
+	StrongMode StrongMode
+}
+
+func (params *HashParams) String() string {
+	chunking := "fixed"
+	if params.Chunking == CHUNK_CONTENT {
+		chunking = "content"
+	}
+	mode := "content"
+	if params.StrongMode == STRONG_META {
+		mode = "meta"
+	}
+	return fmt.Sprintf("%s, %s blocks of %d bytes, %s directory checksums",
+		params.Hash, chunking, params.BlockSize, mode)
+}
+
+// Test whether checksums calculated with params are comparable with those
+// calculated with other.
+func (params *HashParams) Equals(other *HashParams) bool {
+	return params.Hash == other.Hash && params.BlockSize == other.BlockSize &&
+		params.Chunking == other.Chunking && params.StrongMode == other.StrongMode
+}
+
+// Get how the checksums of a store were calculated. Local stores know
+// their own settings; otherwise they are taken from the store's repo.
+func StoreParams(store BlockStore) *HashParams {
+	if local, is := store.(LocalStore); is {
+		return &HashParams{
+			Hash:       STRONG_HASH,
+			BlockSize:  local.BlockSize(),
+			Chunking:   local.Chunking(),
+			StrongMode: RepoStrongMode(local.Repo())}
+	}
+	return RepoParams(store.Repo())
+}
+
+// Get how the checksums of a repo were calculated: as the repo records
+// them, or where it does not, as the blocks of its first file show. The
+// blocks of a BlockSizeRepo which is not a ChunkingRepo are fixed, as it
+// cannot hold blocks divided by content.
+func RepoParams(repo NodeRepo) *HashParams {
+	params := &HashParams{Hash: STRONG_HASH, BlockSize: BLOCKSIZE, StrongMode: RepoStrongMode(repo)}
+
+	sizeRepo, hasSize := repo.(BlockSizeRepo)
+	if hasSize && sizeRepo.BlockSize() > 0 {
+		params.BlockSize = sizeRepo.BlockSize()
+	}
+	chunkingRepo, hasChunking := repo.(ChunkingRepo)
+	if hasChunking {
+		params.Chunking = chunkingRepo.Chunking()
+	}
+	if hasSize {
+		return params
+	}
+
+	if file := firstFileWithBlocks(repo.Root()); file != nil {
+		params.BlockSize = int(FileBlockSize(file))
+		if IsChunked(file) {
+			params.Chunking = CHUNK_CONTENT
+		}
+	}
+	return params
+}
+
+func firstFileWithBlocks(root FsNode) (found File) {
+	if root == nil {
+		return nil
+	}
+	Walk(root, func(node Node) bool {
+		if found != nil {
+			return false
+		}
+		if file, is := node.(File); is {
+			if len(file.Blocks()) > 0 {
+				found = file
+			}
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// Reindex a local store, where its parameters differ, to calculate its
+// checksums with params. Directory checksums are recalculated from those
+// of their contents, without reading them again.
+func AdoptParams(store LocalStore, params *HashParams) os.Error {
+	if params.Hash != STRONG_HASH {
+		return os.NewError(fmt.Sprintf("Unsupported hash %s", params.Hash))
+	}
+	if err := store.SetBlockSize(params.BlockSize); err != nil {
+		return err
+	}
+	if err := store.SetChunking(params.Chunking); err != nil {
+		return err
+	}
+
+	if RepoStrongMode(store.Repo()) != params.StrongMode {
+		modeRepo, is := store.Repo().(StrongModeRepo)
+		if !is {
+			return os.NewError(fmt.Sprintf("%T cannot change its strong mode", store.Repo()))
+		}
+		modeRepo.SetStrongMode(params.StrongMode)
+		if root, is := store.Repo().Root().(Dir); is {
+			root.UpdateStrong()
+		}
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package fs
 
 import (
 	"fmt"
+	"sync"
 )
 
 type NodeRepo interface {
@@ -50,6 +51,9 @@ type memFile struct {
 	repo   *MemRepo
 	parent Dir
 	blocks []Block
+
+	// Hashes the blocks of a lazy file which have not yet been asked for.
+	load BlockLoader
 }
 
 func (file *memFile) Parent() (FsNode, bool) {
@@ -73,7 +77,22 @@ func (file *memFile) Repo() NodeRepo {
 	return file.repo
 }
 
+// Get the blocks of the file, loading those of a lazy file. If they
+// cannot be loaded, such as when the file has changed since it was
+// indexed, it has none, and matches nothing.
 func (file *memFile) Blocks() []Block {
+	file.repo.loading.Lock()
+	defer file.repo.loading.Unlock()
+
+	if file.load != nil {
+		load := file.load
+		file.load = nil
+		if blocksInfo, err := load(); err == nil {
+			for _, blockInfo := range blocksInfo {
+				file.repo.AddBlock(file, blockInfo)
+			}
+		}
+	}
 	return file.blocks
 }
 
@@ -130,6 +149,12 @@ type MemRepo struct {
 	dirs       map[string]*memDir
 	weakBlocks map[int]*memBlock
 	root       FsNode
+	strongMode StrongMode
+	blockSize  int
+	chunking   Chunking
+
+	// Held while the blocks of lazy files are loaded.
+	loading sync.Mutex
 }
 
 func NewMemRepo() *MemRepo {
@@ -185,6 +210,12 @@ func (repo *MemRepo) AddFile(dir Dir, fileInfo *FileInfo, blocksInfo []*BlockInf
 	return file
 }
 
+func (repo *MemRepo) AddLazyFile(dir Dir, fileInfo *FileInfo, load BlockLoader) File {
+	file := repo.AddFile(dir, fileInfo, nil).(*memFile)
+	file.load = load
+	return file
+}
+
 func (repo *MemRepo) AddDir(dir Dir, info *DirInfo) Dir {
 	if info.Strong == "" {
 		info.Strong = fmt.Sprintf("tmp%d", len(repo.dirs))
@@ -205,3 +236,15 @@ func (repo *MemRepo) Close() {
 func (repo *MemRepo) IndexFilter() IndexFilter {
 	return AlwaysMatch
 }
+
+func (repo *MemRepo) StrongMode() StrongMode { return repo.strongMode }
+
+func (repo *MemRepo) SetStrongMode(mode StrongMode) { repo.strongMode = mode }
+
+func (repo *MemRepo) BlockSize() int { return repo.blockSize }
+
+func (repo *MemRepo) SetBlockSize(size int) { repo.blockSize = size }
+
+func (repo *MemRepo) Chunking() Chunking { return repo.chunking }
+
+func (repo *MemRepo) SetChunking(chunking Chunking) { repo.chunking = chunking }
@@ -0,0 +1,188 @@
+// Package repotest checks that implementations of fs.NodeRepo behave as
+// MemRepo does: nodes added are found by their checksums and linked to
+// their parents, and directory checksums are recalculated with parents
+// kept linked, as UpdateStrong does when a tree is indexed.
+//
+// Implementations outside this tree can run the checks from their own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		repotest.TestNodeRepo(t, func() (fs.NodeRepo, os.Error) {
+//			return myrepo.Open(...)
+//		})
+//	}
+package repotest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+
+	"github.com/bmizerany/assert"
+)
+
+// Make an empty repository.
+type RepoMaker func() (fs.NodeRepo, os.Error)
+
+// Add a file with the given content to a repo.
+func addFile(repo fs.NodeRepo, dir fs.Dir, name string, content string) fs.File {
+	fileInfo := &fs.FileInfo{
+		Name:   name,
+		Mode:   0644,
+		Size:   int64(len(content)),
+		Strong: fs.StrongChecksum([]byte(content)),
+		Parent: dir.Info().Strong}
+
+	blocksInfo := []*fs.BlockInfo{}
+	for pos := 0; pos*fs.BLOCKSIZE < len(content); pos++ {
+		end := (pos + 1) * fs.BLOCKSIZE
+		if end > len(content) {
+			end = len(content)
+		}
+		blockInfo := fs.IndexBlock([]byte(content[pos*fs.BLOCKSIZE : end]))
+		blockInfo.Position = pos
+		blocksInfo = append(blocksInfo, blockInfo)
+	}
+	return repo.AddFile(dir, fileInfo, blocksInfo)
+}
+
+// Fill a repository with the tree the checks are made over, as an
+// Indexer would: directories are added before their contents, with
+// temporary checksums, and then updated from the root.
+func Build(repo fs.NodeRepo) fs.Dir {
+	root, _ := build(repo)
+	return root
+}
+
+// Build the tree, and get the temporary checksums its directories
+// were added with.
+func build(repo fs.NodeRepo) (fs.Dir, []string) {
+	temps := []string{}
+	addDir := func(parent fs.Dir, name string) fs.Dir {
+		info := &fs.DirInfo{Name: name, Mode: 0755}
+		if parent != nil {
+			info.Parent = parent.Info().Strong
+		}
+		dir := repo.AddDir(parent, info)
+		temps = append(temps, dir.Info().Strong)
+		return dir
+	}
+
+	root := addDir(nil, "")
+	a := addDir(root, "a")
+	addFile(repo, a, "x", fmt.Sprintf("%*d", 2*fs.BLOCKSIZE+10, 1))
+	addFile(repo, a, "y", "why")
+	b := addDir(a, "b")
+	addFile(repo, b, "z", "zed")
+	addDir(a, "empty")
+	addFile(repo, root, "top", "top")
+
+	root.UpdateStrong()
+	return root, temps
+}
+
+// List the paths and checksums of a tree, in walk order.
+func describe(root fs.Dir) []string {
+	result := []string{}
+	fs.Walk(root, func(node fs.Node) bool {
+		switch n := node.(type) {
+		case fs.Dir:
+			result = append(result, fmt.Sprintf("d %s %s", fs.RelPath(n), n.Info().Strong))
+			return true
+		case fs.File:
+			result = append(result, fmt.Sprintf("f %s %s", fs.RelPath(n), n.Info().Strong))
+			return true
+		case fs.Block:
+			result = append(result, fmt.Sprintf("b %d %s", n.Info().Position, n.Info().Strong))
+		}
+		return false
+	})
+	return result
+}
+
+// Check a repository against the behavior of MemRepo.
+func TestNodeRepo(t *testing.T, mk RepoMaker) {
+	repo, err := mk()
+	assert.Tf(t, err == nil, "Failed to make repo: %v", err)
+	defer repo.Close()
+
+	assert.T(t, repo.IndexFilter() != nil)
+
+	ref := Build(fs.NewMemRepo())
+	root, temps := build(repo)
+
+	// The same tree, with the same checksums
+	assert.Equal(t, describe(ref), describe(root))
+	rootNode, isDir := repo.Root().(fs.Dir)
+	assert.T(t, isDir)
+	assert.Equal(t, ref.Info().Strong, rootNode.Info().Strong)
+	_, hasParent := rootNode.Parent()
+	assert.T(t, !hasParent)
+
+	// Temporary checksums are replaced by those calculated.
+	for _, temp := range temps {
+		dir, has := repo.Dir(temp)
+		assert.Tf(t, !has || dir.Info().Strong == temp, "Temporary checksum %s still found", temp)
+	}
+
+	fs.Walk(root, func(node fs.Node) bool {
+		switch n := node.(type) {
+		case fs.Dir:
+			checkDir(t, repo, n)
+			return true
+		case fs.File:
+			checkFile(t, repo, n)
+		}
+		return false
+	})
+
+	for _, relpath := range []string{"top", filepath.Join("a", "x"), filepath.Join("a", "b", "z"), filepath.Join("a", "empty")} {
+		node, found := fs.Lookup(root, relpath)
+		assert.Tf(t, found, "Lookup(%q)", relpath)
+		assert.Equal(t, relpath, fs.RelPath(node))
+	}
+}
+
+func checkDir(t *testing.T, repo fs.NodeRepo, dir fs.Dir) {
+	found, has := repo.Dir(dir.Info().Strong)
+	assert.Tf(t, has, "Dir %q not found by strong checksum", fs.RelPath(dir))
+	if has {
+		assert.Equal(t, fs.RelPath(dir), fs.RelPath(found))
+	}
+	assert.Equal(t, fs.CalcStrong(dir), dir.Info().Strong)
+
+	// Children link back to their parent by its recalculated checksum.
+	for _, subdir := range dir.SubDirs() {
+		parent, hasParent := subdir.Parent()
+		assert.Tf(t, hasParent, "Dir %q has no parent", fs.RelPath(subdir))
+		assert.Equal(t, dir.Info().Strong, parent.(fs.Dir).Info().Strong)
+	}
+	for _, file := range dir.Files() {
+		parent, hasParent := file.Parent()
+		assert.Tf(t, hasParent, "File %q has no parent", fs.RelPath(file))
+		assert.Equal(t, dir.Info().Strong, parent.(fs.Dir).Info().Strong)
+	}
+}
+
+func checkFile(t *testing.T, repo fs.NodeRepo, file fs.File) {
+	found, has := repo.File(file.Info().Strong)
+	assert.Tf(t, has, "File %q not found by strong checksum", fs.RelPath(file))
+	if has {
+		assert.Equal(t, fs.RelPath(file), fs.RelPath(found))
+	}
+
+	for i, block := range file.Blocks() {
+		assert.Equal(t, i, block.Info().Position)
+
+		parent, hasParent := block.Parent()
+		assert.T(t, hasParent)
+		assert.Equal(t, file.Info().Strong, parent.(fs.File).Info().Strong)
+
+		_, has := repo.Block(block.Info().Strong)
+		assert.Tf(t, has, "Block %d of %q not found by strong checksum", i, fs.RelPath(file))
+		_, has = repo.WeakBlock(block.Info().Weak)
+		assert.Tf(t, has, "Block %d of %q not found by weak checksum", i, fs.RelPath(file))
+	}
+}
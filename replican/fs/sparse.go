@@ -0,0 +1,69 @@
+package fs
+
+import (
+	"os"
+	"sync"
+)
+
+// Strong checksum of a whole block of zeros, such as a hole in a sparse file.
+var ZERO_STRONG string = StrongChecksum(make([]byte, BLOCKSIZE))
+
+var zeroStrongs = map[int]string{BLOCKSIZE: ZERO_STRONG}
+var zeroStrongsLock sync.Mutex
+
+// Get the strong checksum of a whole block of zeros of the given size.
+func ZeroStrong(blockSize int) string {
+	zeroStrongsLock.Lock()
+	defer zeroStrongsLock.Unlock()
+
+	strong, has := zeroStrongs[blockSize]
+	if !has {
+		strong = StrongChecksum(make([]byte, blockSize))
+		zeroStrongs[blockSize] = strong
+	}
+	return strong
+}
+
+// Test whether a buffer holds only zeros.
+func IsZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Test whether a block is a whole block of zeros, which need not be
+// transferred or written to a file created sparse.
+func (block *BlockInfo) IsZero() bool {
+	return block.Strong == ZeroStrong(int(block.Size()))
+}
+
+// Writes to a file from an offset, skipping blocks of zeros so that
+// a sparse file, such as a temporary file extended with Truncate, stays
+// sparse. The file must already read as zeros wherever it is written.
+type SparseWriter struct {
+	File   *os.File
+	Offset int64
+}
+
+func (sw *SparseWriter) Write(p []byte) (n int, err os.Error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > BLOCKSIZE {
+			chunk = chunk[:BLOCKSIZE]
+		}
+
+		if !IsZero(chunk) {
+			if _, err = sw.File.WriteAt(chunk, sw.Offset); err != nil {
+				return n, err
+			}
+		}
+
+		sw.Offset += int64(len(chunk))
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
@@ -0,0 +1,44 @@
+package sqlite3
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/kuroneko/gosqlite3"
+)
+
+// Header at the start of every SQLite database file.
+const SQLITE_HEADER = "SQLite format 3\x00"
+
+// Copies live SQLite databases consistently, with VACUUM INTO, which
+// reads the database in a single transaction. Use it as a
+// sync.ConsistentCopier.
+type Copier struct{}
+
+// Test whether a file is an SQLite database, by its header.
+func (copier *Copier) Handles(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	header := make([]byte, len(SQLITE_HEADER))
+	if _, err = io.ReadFull(f, header); err != nil {
+		return false
+	}
+	return string(header) == SQLITE_HEADER
+}
+
+func (copier *Copier) Copy(src string, dst string) os.Error {
+	db, err := sqlite3.Open(src)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Execute(fmt.Sprintf("VACUUM INTO '%s'", strings.Replace(dst, "'", "''", -1)))
+	return err
+}
@@ -78,3 +78,140 @@ func TestRootWorks(t *testing.T) {
 	_, errors := fs.IndexDir(filepath.Join(path, "foo"), dbrepo)
 	assert.Equalf(t, 0, len(errors), "%v", errors)
 }
+
+// Test that the root is that of the tree indexed last, however many trees
+// were indexed before it, and after the repository is reopened.
+func TestRootLatest(t *testing.T) {
+	tg := treegen.New()
+	path := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(path)
+
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.Remove(dbpath)
+
+	first, errors := fs.IndexDir(filepath.Join(path, "foo"), dbrepo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	assert.T(t, treegen.Fab(filepath.Join(path, "foo"), tg.F("baz", tg.B(43, 65537))) == nil)
+	second, errors := fs.IndexDir(filepath.Join(path, "foo"), dbrepo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.T(t, first.Info().Strong != second.Info().Strong)
+	assert.Equal(t, second.Info().Strong, dbrepo.Root().(fs.Dir).Info().Strong)
+
+	// Back to the first tree, which is added again as the latest
+	assert.T(t, os.Remove(filepath.Join(path, "foo", "baz")) == nil)
+	third, errors := fs.IndexDir(filepath.Join(path, "foo"), dbrepo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, first.Info().Strong, third.Info().Strong)
+	assert.Equal(t, third.Info().Strong, dbrepo.Root().(fs.Dir).Info().Strong)
+	dbrepo.Close()
+
+	dbrepo, err := NewDbRepo(dbpath)
+	assert.Tf(t, err == nil, "%v", err)
+	defer dbrepo.Close()
+	assert.Equal(t, third.Info().Strong, dbrepo.Root().(fs.Dir).Info().Strong)
+}
+
+func TestCompact(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar", tg.F("a", tg.B(42, 65537))),
+		tg.F("b", tg.B(43, 65537)))
+	path := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(path)
+
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.Remove(dbpath)
+	defer dbrepo.Close()
+
+	_, errors := fs.IndexDir(filepath.Join(path, "foo"), dbrepo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	single, err := dbrepo.countNodes()
+	assert.T(t, err == nil)
+
+	// Reindex after a change, leaving the first tree orphaned
+	assert.T(t, treegen.Fab(filepath.Join(path, "foo"), tg.F("c", tg.B(44, 65537))) == nil)
+	foo, errors := fs.IndexDir(filepath.Join(path, "foo"), dbrepo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, foo.Info().Strong, dbrepo.Root().Info().Strong)
+
+	var marked, swept int64
+	err = dbrepo.Compact(func(stage string, count int64) {
+		switch stage {
+		case COMPACT_MARK:
+			marked = count
+		case COMPACT_SWEEP:
+			swept = count
+		}
+	})
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(2), marked)
+	assert.Equal(t, single, swept)
+
+	assert.Equal(t, foo.Info().Strong, dbrepo.Root().Info().Strong)
+	assert.Equal(t, foo.Info().Strong, fs.CalcStrong(dbrepo.Root().(fs.Dir)))
+}
+
+func TestDbRepoCommitsTree(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar", tg.F("a", tg.B(42, 65537))),
+		tg.F("b", tg.B(43, 65537)))
+	path := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(path)
+
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.Remove(dbpath)
+	defer dbrepo.Close()
+
+	foo, errors := fs.IndexDir(filepath.Join(path, "foo"), dbrepo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	// Another connection sees the whole tree while the repo is open
+	other, err := NewDbRepo(dbpath)
+	assert.Tf(t, err == nil, "%v", err)
+	defer other.Close()
+	assert.Equal(t, foo.Info().Strong, other.Root().Info().Strong)
+	_, has := other.Block(foo.Files()[0].Blocks()[0].Info().Strong)
+	assert.T(t, has)
+}
+
+func TestDbRepoParams(t *testing.T) {
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.Remove(dbpath)
+
+	dbrepo.SetBlockSize(1 << 16)
+	dbrepo.SetStrongMode(fs.STRONG_META)
+	dbrepo.Close()
+
+	// Reopened, the repo is hashed as it was
+	dbrepo, err := NewDbRepo(dbpath)
+	assert.Tf(t, err == nil, "%v", err)
+	defer dbrepo.Close()
+	assert.Equal(t, 1<<16, dbrepo.BlockSize())
+	assert.Equal(t, fs.STRONG_META, dbrepo.StrongMode())
+
+	// Its parameters are as recorded, and its blocks are fixed
+	params := fs.RepoParams(dbrepo)
+	assert.Equal(t, 1<<16, params.BlockSize)
+	assert.Equal(t, fs.CHUNK_FIXED, params.Chunking)
+}
+
+// Test that statements which fail as they run are reported, not only
+// those which fail to prepare.
+func TestExecErrors(t *testing.T) {
+	dbrepo, err := NewDbRepo(":memory:")
+	assert.T(t, err == nil)
+	defer dbrepo.Close()
+
+	_, err = dbrepo.db.Execute(`CREATE TABLE unique_ids (id INTEGER PRIMARY KEY);`)
+	assert.Tf(t, err == nil, "%v", err)
+	err = dbrepo.exec(`INSERT INTO unique_ids (id) VALUES (?)`, int64(1))
+	assert.Tf(t, err == nil, "%v", err)
+	err = dbrepo.exec(`INSERT INTO unique_ids (id) VALUES (?)`, int64(1))
+	assert.T(t, err != nil)
+
+	count, err := dbrepo.countNodes()
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(0), count)
+}
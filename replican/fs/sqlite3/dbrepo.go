@@ -9,10 +9,30 @@ import (
 	"github.com/kuroneko/gosqlite3"
 )
 
+// Writes made in each transaction while a tree is indexed. Committed one
+// at a time, inserting the blocks of a tree of millions of them takes
+// hours.
+const DB_BATCH = 10000
+
+// A NodeRepo kept in an SQLite database, for trees with more blocks than
+// fit in memory. Nodes are looked up by the indexes on their checksums,
+// and only loaded as they are asked for.
+//
+// Writes are committed in batches of DB_BATCH, and whenever the checksum
+// of a root directory is updated, as at the end of an index, so that
+// other connections to the database see each tree whole.
+//
+// Blocks are kept without their offsets and lengths, so a DbRepo holds
+// only files divided into fixed blocks; stores on it refuse CHUNK_CONTENT.
 type DbRepo struct {
-	RootPath string
-	db       *sqlite3.Database
-	dbpath   string
+	RootPath   string
+	db         *sqlite3.Database
+	dbpath     string
+	strongMode fs.StrongMode
+	blockSize  int
+
+	// Writes made in the open transaction, if any.
+	pending int
 }
 
 type dbBlock struct {
@@ -98,9 +118,15 @@ func (dbd *dbDir) UpdateStrong() string {
 	return dbd.repo.UpdateStrong(dbd)
 }
 
+// Get the root of the tree indexed last. Each index adds a new root, and
+// leaves those before it until the repository is compacted; of several,
+// the last added has the highest rowid. Without the order, SQLite returns
+// whichever it finds first, usually the oldest, so that a reopened or
+// compacted repository would go back to a tree long since replaced.
 func (dbRepo *DbRepo) Root() fs.FsNode {
 	stmt, _ := dbRepo.db.Prepare(
-		"SELECT rowid, strong, name, mode FROM dirs WHERE parent IS NULL")
+		`SELECT rowid, strong, name, mode FROM dirs WHERE parent IS NULL
+			ORDER BY rowid DESC LIMIT 1`)
 	defer stmt.Finalize()
 	stmt.Step()
 	values := stmt.Row()
@@ -109,8 +135,9 @@ func (dbRepo *DbRepo) Root() fs.FsNode {
 		return nil
 	}
 	dir := &dbDir{
-		repo: dbRepo,
-		id:   values[0].(int64),
+		repo:   dbRepo,
+		id:     values[0].(int64),
+		parent: -1,
 		info: &fs.DirInfo{
 			Strong: values[1].(string),
 			Name:   values[2].(string),
@@ -134,10 +161,11 @@ func (dbRepo *DbRepo) WeakBlock(weak int) (fs.Block, bool) {
 		id:     values[0].(int64),
 		parent: values[1].(int64),
 		info: &fs.BlockInfo{
-			Weak:     weak,
-			Position: int(values[2].(int64)),
-			Strong:   values[3].(string),
-			Parent:   values[4].(string)}}
+			Weak:      weak,
+			Position:  int(values[2].(int64)),
+			Strong:    values[3].(string),
+			Parent:    values[4].(string),
+			BlockSize: dbRepo.blockSize}}
 	return block, true
 }
 
@@ -157,10 +185,11 @@ func (dbRepo *DbRepo) Block(strong string) (fs.Block, bool) {
 		id:     values[0].(int64),
 		parent: values[1].(int64),
 		info: &fs.BlockInfo{
-			Weak:     int(values[2].(int64)),
-			Position: int(values[3].(int64)),
-			Strong:   strong,
-			Parent:   values[4].(string)}}
+			Weak:      int(values[2].(int64)),
+			Position:  int(values[3].(int64)),
+			Strong:    strong,
+			Parent:    values[4].(string),
+			BlockSize: dbRepo.blockSize}}
 	return block, true
 }
 
@@ -225,13 +254,11 @@ func (dbRepo *DbRepo) Dir(strong string) (fs.Dir, bool) {
 
 func (dbRepo *DbRepo) AddBlock(file fs.File, blockInfo *fs.BlockInfo) fs.Block {
 	dbfile := file.(*dbFile)
-	stmt, _ := dbRepo.db.Prepare(
+	dbRepo.write(
 		`INSERT INTO blocks (parent, strong, weak, pos) VALUES (?,?,?,?)`,
 		dbfile.id, blockInfo.Strong, int64(blockInfo.Weak), int64(blockInfo.Position))
-	stmt.Step()
-	stmt.Finalize()
 
-	stmt, _ = dbRepo.db.Prepare(`SELECT last_insert_rowid()`)
+	stmt, _ := dbRepo.db.Prepare(`SELECT last_insert_rowid()`)
 	stmt.Step()
 	values := stmt.Row()
 	stmt.Finalize()
@@ -245,13 +272,11 @@ func (dbRepo *DbRepo) AddBlock(file fs.File, blockInfo *fs.BlockInfo) fs.Block {
 
 func (dbRepo *DbRepo) AddFile(dir fs.Dir, fileInfo *fs.FileInfo, blocksInfo []*fs.BlockInfo) fs.File {
 	dbdir := dir.(*dbDir)
-	stmt, _ := dbRepo.db.Prepare(
+	dbRepo.write(
 		`INSERT INTO files (parent, strong, name, mode, size) VALUES (?,?,?,?,?)`,
 		dbdir.id, fileInfo.Strong, fileInfo.Name, int64(fileInfo.Mode), fileInfo.Size)
-	stmt.Step()
-	stmt.Finalize()
 
-	stmt, _ = dbRepo.db.Prepare(`SELECT last_insert_rowid()`)
+	stmt, _ := dbRepo.db.Prepare(`SELECT last_insert_rowid()`)
 	stmt.Step()
 	values := stmt.Row()
 	stmt.Finalize()
@@ -270,25 +295,22 @@ func (dbRepo *DbRepo) AddFile(dir fs.Dir, fileInfo *fs.FileInfo, blocksInfo []*f
 
 func (dbRepo *DbRepo) AddDir(dir fs.Dir, subdirInfo *fs.DirInfo) fs.Dir {
 	var id int64
-	var stmt *sqlite3.Statement
 	var err os.Error
 	sql := `INSERT INTO dirs (parent, strong, name, mode) VALUES (?1,?2,?3,?4)`
 	if dbdir, is := dir.(*dbDir); is {
 		id = dbdir.id
-		stmt, err = dbRepo.db.Prepare(sql,
+		err = dbRepo.write(sql,
 			dbdir.id, subdirInfo.Strong, subdirInfo.Name, int64(subdirInfo.Mode))
 	} else {
 		id = int64(-1)
-		stmt, err = dbRepo.db.Prepare(sql,
+		err = dbRepo.write(sql,
 			nil, subdirInfo.Strong, subdirInfo.Name, int64(subdirInfo.Mode))
 	}
 	if err != nil {
 		log.Printf("%v\n", err)
 	}
-	stmt.Step()
-	stmt.Finalize()
 
-	stmt, _ = dbRepo.db.Prepare(`SELECT last_insert_rowid()`)
+	stmt, _ := dbRepo.db.Prepare(`SELECT last_insert_rowid()`)
 	stmt.Step()
 	values := stmt.Row()
 	stmt.Finalize()
@@ -387,7 +409,7 @@ func (dbRepo *DbRepo) SubdirsOf(dir *dbDir) []fs.Dir {
 	stmt, _ := dbRepo.db.Prepare(
 		`SELECT d.rowid, p.rowid, d.name, d.mode, d.strong, p.strong 
 			FROM dirs AS d LEFT OUTER JOIN dirs AS p ON d.parent = p.rowid
-			WHERE p.rowid = ?`, dir.id)
+			WHERE p.rowid = ? ORDER BY d.name`, dir.id)
 	_, err := stmt.All(func(_ *sqlite3.Statement, values ...interface{}) {
 		result = append(result, &dbDir{
 			repo:   dbRepo,
@@ -410,7 +432,7 @@ func (dbRepo *DbRepo) FilesOf(dir *dbDir) []fs.File {
 	stmt, _ := dbRepo.db.Prepare(
 		`SELECT f.rowid, p.rowid, f.name, f.mode, f.size, f.strong, p.strong 
 			FROM files AS f LEFT OUTER JOIN dirs AS p ON f.parent = p.rowid
-			WHERE p.rowid = ?`, dir.id)
+			WHERE p.rowid = ? ORDER BY f.name`, dir.id)
 	_, err := stmt.All(func(_ *sqlite3.Statement, values ...interface{}) {
 		result = append(result, &dbFile{
 			repo:   dbRepo,
@@ -434,17 +456,18 @@ func (dbRepo *DbRepo) BlocksOf(file *dbFile) []fs.Block {
 	stmt, _ := dbRepo.db.Prepare(
 		`SELECT b.rowid, p.rowid, b.weak, b.pos, b.strong, p.strong 
 			FROM blocks AS b LEFT OUTER JOIN files AS p ON b.parent = p.rowid
-			WHERE p.rowid = ?`, file.id)
+			WHERE p.rowid = ? ORDER BY b.pos`, file.id)
 	stmt.All(func(_ *sqlite3.Statement, values ...interface{}) {
 		result = append(result, &dbBlock{
 			repo:   dbRepo,
 			id:     values[0].(int64),
 			parent: values[1].(int64),
 			info: &fs.BlockInfo{
-				Weak:     int(values[2].(int64)),
-				Position: int(values[3].(int64)),
-				Strong:   values[4].(string),
-				Parent:   values[5].(string)}})
+				Weak:      int(values[2].(int64)),
+				Position:  int(values[3].(int64)),
+				Strong:    values[4].(string),
+				Parent:    values[5].(string),
+				BlockSize: dbRepo.blockSize}})
 	})
 	return result
 }
@@ -453,24 +476,190 @@ func (dbRepo *DbRepo) UpdateStrong(dir *dbDir) string {
 	newStrong := fs.CalcStrong(dir)
 	if newStrong != dir.info.Strong {
 		//		log.Printf("newStrong: %v dir: %v", newStrong, dir)
-		stmt, err := dbRepo.db.Prepare(
+		err := dbRepo.write(
 			`UPDATE dirs SET strong = ? WHERE rowid = ?`, newStrong, dir.id)
 		if err != nil {
 			log.Printf("%v", err)
 		}
-		stmt.Step()
-		stmt.Finalize()
 
 		dir.info.Strong = newStrong
 	}
+
+	// A root's checksum is updated once its tree is complete
+	if dir.parent == -1 {
+		if err := dbRepo.Flush(); err != nil {
+			log.Printf("%v", err)
+		}
+	}
 	return newStrong
 }
 
+// Commit the writes made since the last batch was committed.
+func (dbRepo *DbRepo) Flush() os.Error {
+	if dbRepo.pending == 0 {
+		return nil
+	}
+	dbRepo.pending = 0
+	_, err := dbRepo.db.Execute(`COMMIT;`)
+	return err
+}
+
 func (dbRepo *DbRepo) Close() {
+	if err := dbRepo.Flush(); err != nil {
+		log.Printf("%v", err)
+	}
 	dbRepo.db.Close()
 	dbRepo.db = nil
 }
 
+// Stages of a compaction, as reported to its progress callback.
+const (
+	COMPACT_MARK   = "mark"
+	COMPACT_SWEEP  = "sweep"
+	COMPACT_VACUUM = "vacuum"
+)
+
+// Receives progress while a repository is compacted. While marking, count is
+// the number of live directories found so far; once sweeping, it is the
+// number of orphaned nodes removed.
+type CompactProgress func(stage string, count int64)
+
+// Drop all nodes not reachable from the current root, and rewrite the
+// database to reclaim the space they used.
+//
+// Each reindex into a persistent repository adds a new tree and leaves the
+// previous one behind, so long-lived repositories should be compacted
+// from time to time. The progress callback may be nil.
+func (dbRepo *DbRepo) Compact(progress CompactProgress) os.Error {
+	report := func(stage string, count int64) {
+		if progress != nil {
+			progress(stage, count)
+		}
+	}
+
+	if err := dbRepo.Flush(); err != nil {
+		return err
+	}
+
+	before, err := dbRepo.countNodes()
+	if err != nil {
+		return err
+	}
+
+	if _, err = dbRepo.db.Execute(
+		`CREATE TEMPORARY TABLE IF NOT EXISTS live_dirs (id INTEGER PRIMARY KEY);`); err != nil {
+		return err
+	}
+	if _, err = dbRepo.db.Execute(`DELETE FROM live_dirs;`); err != nil {
+		return err
+	}
+	defer dbRepo.db.Execute(`DROP TABLE IF EXISTS live_dirs;`)
+
+	if root, is := dbRepo.Root().(*dbDir); is {
+		var marked int64
+		pending := []int64{root.id}
+		for len(pending) > 0 {
+			id := pending[len(pending)-1]
+			pending = pending[:len(pending)-1]
+
+			if err = dbRepo.exec(`INSERT INTO live_dirs (id) VALUES (?)`, id); err != nil {
+				return err
+			}
+			marked++
+			report(COMPACT_MARK, marked)
+
+			stmt, err := dbRepo.db.Prepare(`SELECT rowid FROM dirs WHERE parent = ?`, id)
+			if err != nil {
+				return err
+			}
+			_, err = stmt.All(func(_ *sqlite3.Statement, values ...interface{}) {
+				pending = append(pending, values[0].(int64))
+			})
+			stmt.Finalize()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, sql := range []string{
+		`DELETE FROM dirs WHERE rowid NOT IN (SELECT id FROM live_dirs);`,
+		`DELETE FROM files WHERE parent NOT IN (SELECT rowid FROM dirs);`,
+		`DELETE FROM blocks WHERE parent NOT IN (SELECT rowid FROM files);`} {
+		if _, err = dbRepo.db.Execute(sql); err != nil {
+			return err
+		}
+	}
+
+	after, err := dbRepo.countNodes()
+	if err != nil {
+		return err
+	}
+	report(COMPACT_SWEEP, before-after)
+
+	// VACUUM cannot run inside a transaction, and must come last.
+	if _, err = dbRepo.db.Execute(`VACUUM;`); err != nil {
+		return err
+	}
+	report(COMPACT_VACUUM, before-after)
+	return nil
+}
+
+// Make a write in the open batch, starting one if there is none, and
+// committing it once it is full.
+func (dbRepo *DbRepo) write(sql string, values ...interface{}) os.Error {
+	if dbRepo.pending == 0 {
+		if _, err := dbRepo.db.Execute(`BEGIN;`); err != nil {
+			return err
+		}
+	}
+	dbRepo.pending++
+
+	err := dbRepo.exec(sql, values...)
+	if dbRepo.pending >= DB_BATCH {
+		if flushErr := dbRepo.Flush(); err == nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+func (dbRepo *DbRepo) exec(sql string, values ...interface{}) os.Error {
+	stmt, err := dbRepo.db.Prepare(sql, values...)
+	if err != nil {
+		return err
+	}
+	defer stmt.Finalize()
+	return step(stmt)
+}
+
+// Step a statement, returning an error only if it failed, rather than
+// returned a row or finished.
+func step(stmt *sqlite3.Statement) os.Error {
+	switch err := stmt.Step(); err {
+	case nil, sqlite3.ROW, sqlite3.DONE:
+		return nil
+	default:
+		return err
+	}
+	panic("Impossible")
+}
+
+// Count all the nodes stored in the repository.
+func (dbRepo *DbRepo) countNodes() (int64, os.Error) {
+	stmt, err := dbRepo.db.Prepare(
+		`SELECT (SELECT COUNT(*) FROM dirs) + (SELECT COUNT(*) FROM files)
+			+ (SELECT COUNT(*) FROM blocks)`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Finalize()
+	if err = step(stmt); err != nil {
+		return 0, err
+	}
+	return stmt.Row()[0].(int64), nil
+}
+
 func NewDbRepo(dbpath string) (*DbRepo, os.Error) {
 	db, err := sqlite3.Open(dbpath)
 	if err != nil {
@@ -478,7 +667,10 @@ func NewDbRepo(dbpath string) (*DbRepo, os.Error) {
 	}
 
 	dbRepo := &DbRepo{db: db, dbpath: dbpath}
-	err = dbRepo.createTables()
+	if err = dbRepo.createTables(); err != nil {
+		return dbRepo, err
+	}
+	err = dbRepo.loadParams()
 	return dbRepo, err
 }
 
@@ -506,6 +698,9 @@ const cr_dirs = `CREATE TABLE IF NOT EXISTS dirs (
 		mode INTEGER);`
 const cr_di_parent = `CREATE INDEX IF NOT EXISTS di_parent ON dirs (parent);`
 const cr_di_strong = `CREATE INDEX IF NOT EXISTS di_strong ON dirs (strong);`
+const cr_params = `CREATE TABLE IF NOT EXISTS params (
+		name TEXT PRIMARY KEY,
+		value INTEGER);`
 const dangerous = `PRAGMA synchronous = OFF;`
 
 func (dbRepo *DbRepo) createTables() os.Error {
@@ -513,7 +708,7 @@ func (dbRepo *DbRepo) createTables() os.Error {
 		cr_blocks, cr_bl_parent, cr_bl_strong, cr_bl_weak,
 		cr_files, cr_fi_parent, cr_fi_strong,
 		cr_dirs, cr_di_parent, cr_di_strong,
-		dangerous} {
+		cr_params, dangerous} {
 		_, err := dbRepo.db.Execute(sql)
 		if err != nil {
 			return err
@@ -522,6 +717,56 @@ func (dbRepo *DbRepo) createTables() os.Error {
 	return nil
 }
 
+// Names of the hashing parameters recorded in the params table.
+const (
+	PARAM_STRONG_MODE = "strong_mode"
+	PARAM_BLOCK_SIZE  = "block_size"
+)
+
+// Read the hashing parameters recorded in the database, so that a repo
+// reopened is hashed as it was before.
+func (dbRepo *DbRepo) loadParams() os.Error {
+	stmt, err := dbRepo.db.Prepare(`SELECT name, value FROM params`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Finalize()
+	_, err = stmt.All(func(_ *sqlite3.Statement, values ...interface{}) {
+		switch values[0].(string) {
+		case PARAM_STRONG_MODE:
+			dbRepo.strongMode = fs.StrongMode(values[1].(int64))
+		case PARAM_BLOCK_SIZE:
+			dbRepo.blockSize = int(values[1].(int64))
+		}
+	})
+	return err
+}
+
+func (dbRepo *DbRepo) saveParam(name string, value int64) {
+	if err := dbRepo.write(
+		`INSERT OR REPLACE INTO params (name, value) VALUES (?,?)`, name, value); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// Get the mode directory checksums are calculated in. It is recorded in
+// the database, so a repo reopened keeps the mode it was given.
+func (dbRepo *DbRepo) StrongMode() fs.StrongMode { return dbRepo.strongMode }
+
+func (dbRepo *DbRepo) SetStrongMode(mode fs.StrongMode) {
+	dbRepo.strongMode = mode
+	dbRepo.saveParam(PARAM_STRONG_MODE, int64(mode))
+}
+
+// Get the block size of the files indexed, or zero for BLOCKSIZE. It is
+// recorded in the database, so a repo reopened keeps the size it was given.
+func (dbRepo *DbRepo) BlockSize() int { return dbRepo.blockSize }
+
+func (dbRepo *DbRepo) SetBlockSize(size int) {
+	dbRepo.blockSize = size
+	dbRepo.saveParam(PARAM_BLOCK_SIZE, int64(size))
+}
+
 func (dbRepo *DbRepo) IndexFilter() fs.IndexFilter {
 	return func(path string, f *os.FileInfo) bool {
 		return filepath.Clean(path) != dbRepo.dbpath
@@ -10,17 +10,28 @@ import (
 	"strings"
 )
 
-// Provide access to the raw byte storage.
-type BlockStore interface {
-	Repo() NodeRepo
-
+// Provide source data by content, independent of any tree model.
+// Data is addressed either by the strong checksum of a block, or by a range
+// within the file having a given strong checksum. Content-addressed stores,
+// network peers and archives can all provide data this way.
+type BlockProvider interface {
 	// Given a strong checksum of a block, get the bytes for that block.
 	ReadBlock(strong string) ([]byte, os.Error)
 
+	// Given a strong checksum of a block, write the bytes for that block.
+	ReadBlockInto(strong string, writer io.Writer) (int64, os.Error)
+
 	// Given the strong checksum of a file, start and end positions, get those bytes.
 	ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error)
 }
 
+// Provide access to the raw byte storage, along with the tree model indexing it.
+type BlockStore interface {
+	BlockProvider
+
+	Repo() NodeRepo
+}
+
 // A local file implementation of BlockStore
 type LocalStore interface {
 	BlockStore
@@ -29,22 +40,104 @@ type LocalStore interface {
 
 	Relocate(fullpath string) (relocFullpath string, err os.Error)
 
+	// Relocate conflicting entries into the given directory, relative to the
+	// store root, keeping their original relative paths for easy triage.
+	// By default, conflicts are given temporary names in the store root.
+	// Paths which are absolute or climb out of the root are refused.
+	SetConflictDir(relpath string) os.Error
+
+	ConflictDir() string
+
+	// Index symbolic links in the store according to the policy,
+	// reindexing the store. By default, links to files are followed.
+	SetSymlinks(policy SymlinkPolicy) os.Error
+
+	// Index version control repositories in the store according to the
+	// policy, reindexing the store. By default, they are indexed as-is.
+	SetVcs(policy VcsPolicy) os.Error
+
+	// Index extended attributes, reindexing the store. By default
+	// they are not indexed.
+	SetXattrs(index bool) os.Error
+
+	// Index POSIX ACLs, reindexing the store. By default they are
+	// not indexed.
+	SetAcls(index bool) os.Error
+
+	// Divide files into blocks of the given size, reindexing the store.
+	// Larger blocks make smaller indexes of large files, such as media,
+	// at the cost of transferring more around each change. Stores can
+	// only share blocks with stores of the same block size. By default,
+	// BLOCKSIZE.
+	SetBlockSize(size int) os.Error
+
+	BlockSize() int
+
+	// Divide files into blocks by chunking, reindexing the store. Files
+	// divided by content can only be held by a ChunkingRepo. By default,
+	// CHUNK_FIXED.
+	SetChunking(chunking Chunking) os.Error
+
+	Chunking() Chunking
+
+	// Defer hashing the blocks of files in a directory store until they
+	// are asked for, reindexing the store. Only the files which differ
+	// from another store are then hashed in blocks when they are matched.
+	// Blocks can only be deferred in a LazyRepo. By default, they are
+	// hashed as the store is indexed.
+	SetLazyBlocks(lazy bool) os.Error
+
 	Resolve(relpath string) string
 
 	RootPath() string
 
+	// Whether the store was opened with NewReadOnlyStore.
+	ReadOnly() bool
+
+	// Whether the store was opened with NewOnDemandStore.
+	OnDemand() bool
+
+	// Index the entries of the directory at relpath, and the directories
+	// above it, in a store opened with NewOnDemandStore. Other stores are
+	// indexed in full already.
+	IndexEntries(relpath string) os.Error
+
+	// Save the checksums of the store's files to the cache file at path
+	// when it is closed, for NewCachedStore to reuse on startup.
+	WithCache(path string)
+
+	// Release the store, saving its index cache if it has one.
+	Close() os.Error
+
 	reindex() os.Error
 }
 
 type localBase struct {
-	rootPath string
-	repo     NodeRepo
-	relocs   map[string]string
+	rootPath    string
+	repo        NodeRepo
+	relocs      map[string]string
+	conflictDir string
+	symlinks    SymlinkPolicy
+	vcs         VcsPolicy
+	xattrs      bool
+	acls        bool
+	blockSize   int
+	chunking    Chunking
+	lazyBlocks  bool
+	readOnly    bool
+	onDemand    bool
+
+	// Checksums of files as of the last reindex, and where they are saved.
+	hashes    *IndexCache
+	cachePath string
 }
 
 type LocalDirStore struct {
 	*localBase
 	dir Dir
+
+	// Fills in the index of a store opened with NewOnDemandStore.
+	indexer *Indexer
 }
 
 type LocalFileStore struct {
@@ -53,12 +146,70 @@ type LocalFileStore struct {
 }
 
 func NewLocalStore(rootPath string, repo NodeRepo) (local LocalStore, err os.Error) {
+	return newLocalStore(rootPath, repo, &localBase{})
+}
+
+// Open a local directory store in which only the root is indexed at first,
+// and the entries of directories beneath it as they are asked for with
+// IndexEntries, for planning against a huge destination of which only the
+// parts a small source touches need be read. The checksums of directories
+// are unknown, so directories are never matched by them.
+func NewOnDemandStore(rootPath string, repo NodeRepo) (local LocalStore, err os.Error) {
+	if rootInfo, err := os.Stat(rootPath); err != nil {
+		return nil, err
+	} else if !rootInfo.IsDirectory() {
+		return nil, os.NewError(fmt.Sprintf("%s: not a directory", rootPath))
+	}
+	return newLocalStore(rootPath, repo, &localBase{onDemand: true})
+}
+
+// Open a local store which is never written to: nothing is relocated and no
+// temporary files are created in it, so it can safely be used as a source
+// on read-only media such as mounted snapshots. Using it as a destination
+// fails with ErrReadOnly.
+func NewReadOnlyStore(rootPath string, repo NodeRepo) (local LocalStore, err os.Error) {
+	return newLocalStore(rootPath, repo, &localBase{readOnly: true})
+}
+
+// Open a local store with the index cache saved at cachePath, so that only
+// files changed since it was saved are read. The cache is saved again when
+// the store is closed. A cache which cannot be read is rebuilt.
+func NewCachedStore(rootPath string, repo NodeRepo, cachePath string) (local LocalStore, err os.Error) {
+	hashes, err := LoadIndexCache(cachePath)
+	if err != nil {
+		hashes = NewIndexCache()
+	}
+	if local, err = newLocalStore(rootPath, repo, &localBase{hashes: hashes}); err != nil {
+		return nil, err
+	}
+	local.WithCache(cachePath)
+	return local, nil
+}
+
+// Open a local store indexed through hashes, which may be kept between
+// stores of the same tree, so that each reindex only reads the files
+// changed since the last.
+func NewStoreWithCache(rootPath string, repo NodeRepo, hashes *IndexCache) (local LocalStore, err os.Error) {
+	return newLocalStore(rootPath, repo, &localBase{hashes: hashes})
+}
+
+// Open a local store with the settings of localBase, and the rest from
+// the repo.
+func newLocalStore(rootPath string, repo NodeRepo, localBase *localBase) (local LocalStore, err os.Error) {
 	rootInfo, err := os.Stat(rootPath)
 	if err != nil {
 		return nil, err
 	}
 
-	localBase := &localBase{rootPath: rootPath, repo: repo}
+	localBase.rootPath = rootPath
+	localBase.repo = repo
+	localBase.blockSize = BLOCKSIZE
+	if sizeRepo, is := repo.(BlockSizeRepo); is && sizeRepo.BlockSize() > 0 {
+		localBase.blockSize = sizeRepo.BlockSize()
+	}
+	if chunkingRepo, is := repo.(ChunkingRepo); is {
+		localBase.chunking = chunkingRepo.Chunking()
+	}
 	if rootInfo.IsDirectory() {
 		local = &LocalDirStore{localBase: localBase}
 	} else if rootInfo.IsRegular() {
@@ -66,6 +217,9 @@ func NewLocalStore(rootPath string, repo NodeRepo) (local LocalStore, err os.Err
 	}
 
 	localBase.relocs = make(map[string]string)
+	if localBase.hashes == nil {
+		localBase.hashes = NewIndexCache()
+	}
 
 	if err := local.reindex(); err != nil {
 		return nil, err
@@ -76,10 +230,24 @@ func NewLocalStore(rootPath string, repo NodeRepo) (local LocalStore, err os.Err
 
 func (store *LocalDirStore) reindex() (err os.Error) {
 	indexer := &Indexer{
-		Path:   store.RootPath(),
-		Repo:   store.repo,
-		Filter: store.repo.IndexFilter()}
-	store.dir = indexer.Index()
+		Path:       store.RootPath(),
+		Repo:       store.repo,
+		Filter:     store.repo.IndexFilter(),
+		Symlinks:   store.symlinks,
+		Vcs:        store.vcs,
+		Xattrs:     store.xattrs,
+		Acls:       store.acls,
+		BlockSize:  store.blockSize,
+		Chunking:   store.chunking,
+		Cache:      store.hashes,
+		LazyBlocks: store.lazyBlocks}
+	if store.onDemand {
+		store.indexer = indexer
+		store.dir = indexer.Begin()
+	} else {
+		store.dir = indexer.Index()
+		store.hashes.Sweep()
+	}
 	if store.dir == nil {
 		return os.NewError(fmt.Sprintf("Failed to reindex root: %s", store.RootPath()))
 	}
@@ -88,57 +256,269 @@ func (store *LocalDirStore) reindex() (err os.Error) {
 }
 
 func (store *LocalFileStore) reindex() (err os.Error) {
-	if fileInfo, blocksInfo, err := IndexFile(store.RootPath()); err == nil {
+	fileInfo, blocksInfo, err := store.hashes.IndexFile(store.RootPath(), store.blockSize, store.chunking)
+	store.hashes.Sweep()
+	if err == nil {
+		if store.xattrs {
+			if fileInfo.Xattrs, err = ReadXattrs(store.RootPath()); err != nil {
+				return err
+			}
+		}
+		if store.acls {
+			if fileInfo.Acls, err = ReadAcls(store.RootPath()); err != nil {
+				return err
+			}
+		}
 		store.file = store.repo.AddFile(nil, fileInfo, blocksInfo)
 		return nil
 	}
 	return err
 }
 
+func (store *LocalDirStore) SetSymlinks(policy SymlinkPolicy) os.Error {
+	if policy == store.symlinks {
+		return nil
+	}
+	store.symlinks = policy
+	return store.reindex()
+}
+
+// The root of a file store is never a link, so there is nothing to reindex.
+func (store *LocalFileStore) SetSymlinks(policy SymlinkPolicy) os.Error {
+	store.symlinks = policy
+	return nil
+}
+
+func (store *LocalDirStore) SetVcs(policy VcsPolicy) os.Error {
+	if policy == store.vcs {
+		return nil
+	}
+	store.vcs = policy
+	return store.reindex()
+}
+
+// A file store holds no repositories, so there is nothing to reindex.
+func (store *LocalFileStore) SetVcs(policy VcsPolicy) os.Error {
+	store.vcs = policy
+	return nil
+}
+
+func (store *LocalDirStore) SetXattrs(index bool) os.Error {
+	if index == store.xattrs {
+		return nil
+	}
+	store.xattrs = index
+	return store.reindex()
+}
+
+func (store *LocalFileStore) SetXattrs(index bool) os.Error {
+	if index == store.xattrs {
+		return nil
+	}
+	store.xattrs = index
+	return store.reindex()
+}
+
+func (store *LocalDirStore) SetAcls(index bool) os.Error {
+	if index == store.acls {
+		return nil
+	}
+	store.acls = index
+	return store.reindex()
+}
+
+func (store *LocalFileStore) SetAcls(index bool) os.Error {
+	if index == store.acls {
+		return nil
+	}
+	store.acls = index
+	return store.reindex()
+}
+
+func (store *localBase) SetBlockSize(size int) os.Error {
+	if size <= 0 {
+		return os.NewError(fmt.Sprintf("Invalid block size %d", size))
+	} else if size == store.blockSize {
+		return nil
+	}
+	store.blockSize = size
+	if sizeRepo, is := store.repo.(BlockSizeRepo); is {
+		sizeRepo.SetBlockSize(size)
+	}
+	return store.reindex()
+}
+
+func (store *localBase) BlockSize() int {
+	return store.blockSize
+}
+
+func (store *localBase) SetChunking(chunking Chunking) os.Error {
+	if chunking == store.chunking {
+		return nil
+	}
+	chunkingRepo, is := store.repo.(ChunkingRepo)
+	if !is && chunking != CHUNK_FIXED {
+		return os.NewError(fmt.Sprintf("%T cannot hold files divided by content", store.repo))
+	}
+	store.chunking = chunking
+	if is {
+		chunkingRepo.SetChunking(chunking)
+	}
+	return store.reindex()
+}
+
+func (store *localBase) Chunking() Chunking {
+	return store.chunking
+}
+
+func (store *localBase) SetLazyBlocks(lazy bool) os.Error {
+	if lazy == store.lazyBlocks {
+		return nil
+	}
+	if _, is := store.repo.(LazyRepo); !is && lazy {
+		return os.NewError(fmt.Sprintf("%T cannot defer hashing blocks", store.repo))
+	}
+	store.lazyBlocks = lazy
+	return store.reindex()
+}
+
+func (store *localBase) OnDemand() bool {
+	return store.onDemand
+}
+
+func (store *LocalDirStore) IndexEntries(relpath string) os.Error {
+	if !store.onDemand {
+		return nil
+	}
+	return store.indexer.IndexEntries(store.Resolve(relpath))
+}
+
+func (store *LocalFileStore) IndexEntries(relpath string) os.Error {
+	return nil
+}
+
+func (store *localBase) WithCache(path string) {
+	store.cachePath = path
+}
+
+func (store *localBase) Close() os.Error {
+	if store.cachePath == "" {
+		return nil
+	}
+	return store.hashes.Save(store.cachePath)
+}
+
 func (store *localBase) RelPath(fullpath string) (relpath string) {
-	relpath = strings.Replace(fullpath, store.RootPath(), "", 1)
+	relpath = strings.Replace(StripLongPath(fullpath), store.RootPath(), "", 1)
 	relpath = strings.TrimLeft(relpath, "/\\")
 	return relpath
 }
 
+func (store *localBase) ReadOnly() bool {
+	return store.readOnly
+}
+
+// An attempt was made to modify a read-only store.
+type ErrReadOnly struct {
+	Path string
+}
+
+func (err *ErrReadOnly) String() string {
+	return fmt.Sprintf("%s: store is read-only", err.Path)
+}
+
 const RELOC_PREFIX string = "_reloc"
 
 func (store *localBase) Relocate(fullpath string) (relocFullpath string, err os.Error) {
+	if store.readOnly {
+		return "", &ErrReadOnly{Path: fullpath}
+	}
+
+	relpath := store.RelPath(fullpath)
+
+	if store.conflictDir != "" {
+		relocFullpath, err = store.conflictPath(relpath)
+	} else {
+		relocFullpath, err = store.tempPath()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	err = Move(fullpath, relocFullpath)
+	if err != nil {
+		return "", err
+	}
+
+	relocRelpath := store.RelPath(relocFullpath)
+
+	store.relocs[relpath] = relocRelpath
+	return relocFullpath, nil
+}
+
+// Get an unused temporary name in the store root.
+func (store *localBase) tempPath() (string, os.Error) {
 	relocFh, err := ioutil.TempFile(store.RootPath(), RELOC_PREFIX)
 	if err != nil {
 		return "", err
 	}
 
-	relocFullpath = relocFh.Name()
+	tempPath := relocFh.Name()
 
 	err = relocFh.Close()
 	if err != nil {
 		return "", err
 	}
 
-	err = os.Remove(relocFh.Name())
+	err = os.Remove(tempPath)
 	if err != nil {
 		return "", err
 	}
 
-	err = Move(fullpath, relocFullpath)
-	if err != nil {
+	return tempPath, nil
+}
+
+// Get an unused name for relpath in the conflict directory.
+// If an earlier conflict already took the name, a numeric suffix is added.
+func (store *localBase) conflictPath(relpath string) (string, os.Error) {
+	basePath := filepath.Join(store.RootPath(), store.conflictDir, relpath)
+
+	parent, _ := filepath.Split(basePath)
+	if err := os.MkdirAll(parent, 0755); err != nil {
 		return "", err
 	}
 
-	relpath := store.RelPath(fullpath)
-	relocRelpath := store.RelPath(relocFullpath)
+	conflictPath := basePath
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(conflictPath); err != nil {
+			return conflictPath, nil
+		}
+		conflictPath = fmt.Sprintf("%s.%d", basePath, i)
+	}
 
-	store.relocs[relpath] = relocRelpath
-	return relocFullpath, nil
+	panic("Impossible")
 }
 
+func (store *localBase) SetConflictDir(relpath string) os.Error {
+	relpath = filepath.Clean(relpath)
+	if relpath == "." {
+		relpath = ""
+	}
+	if err := CheckRelPath(relpath); err != nil {
+		return err
+	}
+	store.conflictDir = relpath
+	return nil
+}
+
+func (store *localBase) ConflictDir() string { return store.conflictDir }
+
 func (store *localBase) Resolve(relpath string) string {
 	if relocPath, hasReloc := store.relocs[relpath]; hasReloc {
 		relpath = relocPath
 	}
 
-	return filepath.Join(store.RootPath(), relpath)
+	return LongPath(filepath.Join(store.RootPath(), relpath))
 }
 
 func (store *LocalFileStore) Resolve(_ string) string {
@@ -147,26 +527,71 @@ func (store *LocalFileStore) Resolve(_ string) string {
 
 func (store *localBase) RootPath() string { return store.rootPath }
 
+// Test whether path is the root itself or lies beneath it.
+// Both are cleaned first, so ".." elements cannot escape the root.
+// Symbolic links are not followed.
+func InRoot(root string, path string) bool {
+	root = filepath.Clean(StripLongPath(root))
+	path = filepath.Clean(StripLongPath(path))
+	if path == root {
+		return true
+	}
+
+	prefix := strings.TrimRight(root, string(filepath.Separator)) + string(filepath.Separator)
+	return strings.HasPrefix(path, prefix)
+}
+
 func (store *localBase) Repo() NodeRepo { return store.repo }
 
 func (store *LocalDirStore) Root() FsNode { return store.dir }
 
 func (store *LocalFileStore) Root() FsNode { return store.file }
 
-func (store *localBase) ReadBlock(strong string) ([]byte, os.Error) {
+func (store *LocalDirStore) ReadBlock(strong string) ([]byte, os.Error) {
+	return readBlock(store, strong)
+}
+
+func (store *LocalFileStore) ReadBlock(strong string) ([]byte, os.Error) {
+	return readBlock(store, strong)
+}
+
+// Read a whole block into memory by way of its provider's ReadBlockInto.
+func readBlock(provider BlockProvider, strong string) ([]byte, os.Error) {
+	buf := &bytes.Buffer{}
+	if _, err := provider.ReadBlockInto(strong, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (store *LocalDirStore) ReadBlockInto(strong string, writer io.Writer) (int64, os.Error) {
+	return store.readBlockInto(store, strong, writer)
+}
+
+func (store *LocalFileStore) ReadBlockInto(strong string, writer io.Writer) (int64, os.Error) {
+	return store.readBlockInto(store, strong, writer)
+}
+
+func (store *localBase) readBlockInto(local LocalStore, strong string, writer io.Writer) (int64, os.Error) {
 	block, has := store.repo.Block(strong)
 	if !has {
-		return nil, os.NewError(
+		return 0, os.NewError(
 			fmt.Sprintf("Block with strong checksum %s not found", strong))
 	}
 
-	buf := &bytes.Buffer{}
-	_, err := store.ReadInto(block.Info().Strong, block.Info().Offset(), int64(BLOCKSIZE), buf)
-	if err == nil {
-		return nil, err
+	file, has := block.Parent()
+	if !has {
+		return 0, os.NewError(
+			fmt.Sprintf("Block with strong checksum %s has no file", strong))
 	}
 
-	return buf.Bytes(), nil
+	// The last block in a file may be short
+	path := local.Resolve(RelPath(file))
+	n, err := store.readFileInto(file, path, block.Info().Offset(), block.Info().Size(), writer)
+	if err == os.EOF {
+		err = nil
+	}
+	return n, err
 }
 
 func (store *localBase) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
@@ -178,7 +603,7 @@ func (store *localBase) ReadInto(strong string, from int64, length int64, writer
 	}
 
 	path := store.Resolve(RelPath(file))
-	return store.readInto(path, from, length, writer)
+	return store.readFileInto(file, path, from, length, writer)
 }
 
 func (store *LocalFileStore) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
@@ -190,7 +615,67 @@ func (store *LocalFileStore) ReadInto(strong string, from int64, length int64, w
 	}
 
 	path := store.Resolve(RelPath(file))
-	return store.readInto(path, from, length, writer)
+	return store.readFileInto(file, path, from, length, writer)
+}
+
+// Read a range of a file in the store. A file indexed from a symbolic
+// link with SYMLINKS_STORE reads as the link's target.
+func (store *localBase) readFileInto(file FsNode, path string, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	if !IsSymlinkMode(file.Mode()) {
+		n, err := store.readInto(path, from, length, writer)
+		if err != nil {
+			if truncated := checkTruncated(file, path); truncated != nil {
+				return n, truncated
+			}
+		}
+		return n, err
+	}
+
+	target, err := os.Readlink(path)
+	if err != nil {
+		return 0, err
+	}
+
+	to := from + length
+	if from > int64(len(target)) {
+		from = int64(len(target))
+	}
+	if to > int64(len(target)) {
+		to = int64(len(target))
+	}
+
+	n, err := writer.Write([]byte(target[from:to]))
+	if err == nil && int64(n) < length {
+		err = os.EOF
+	}
+	return int64(n), err
+}
+
+// A source file is shorter than when it was indexed, usually because
+// it was changed while being synced.
+type ErrSourceTruncated struct {
+	Path string
+	Size int64 // Size when indexed
+	Now  int64 // Size when read
+}
+
+func (err *ErrSourceTruncated) String() string {
+	return fmt.Sprintf("%s: truncated from %d to %d bytes since it was indexed",
+		err.Path, err.Size, err.Now)
+}
+
+// Check whether a failed read was due to the file shrinking since it was indexed.
+func checkTruncated(node FsNode, path string) *ErrSourceTruncated {
+	file, is := node.(File)
+	if !is {
+		return nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil || fi.Size >= file.Info().Size {
+		return nil
+	}
+	return &ErrSourceTruncated{Path: path, Size: file.Info().Size, Now: fi.Size}
 }
 
 func (store *localBase) readInto(path string, from int64, length int64, writer io.Writer) (int64, os.Error) {
@@ -198,6 +683,7 @@ func (store *localBase) readInto(path string, from int64, length int64, writer i
 	if fh == nil {
 		return 0, err
 	}
+	defer fh.Close()
 
 	_, err = fh.Seek(from, 0)
 	if err != nil {
@@ -0,0 +1,200 @@
+// Package storetest checks that implementations of fs.BlockStore and
+// fs.LocalStore behave as the sync planner relies on: ranges and blocks
+// read as indexed, paths resolve to the files they index, and relocated
+// files stay readable at their new paths.
+//
+// Implementations outside this tree can run the checks from their own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.TestLocalStore(t, func(path string) (fs.LocalStore, os.Error) {
+//			return mystore.Open(path)
+//		})
+//	}
+package storetest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+// Make a store over the tree at path.
+type BlockStoreMaker func(path string) (fs.BlockStore, os.Error)
+
+// Make a local store over the tree at path.
+type LocalStoreMaker func(path string) (fs.LocalStore, os.Error)
+
+// Get the tree stores are checked over. Its files have several blocks,
+// short and aligned last blocks, no content and repeated content.
+func Tree() treegen.Generated {
+	tg := treegen.New()
+	blocksize := int64(fs.BLOCKSIZE)
+	return tg.D("foo",
+		tg.F("multi", tg.B(42, 3*blocksize+100)),
+		tg.F("aligned", tg.B(43, 2*blocksize)),
+		tg.F("empty"),
+		tg.F("repeat", tg.B(44, blocksize), tg.B(44, blocksize)),
+		tg.D("sub", tg.F("small", tg.B(45, 10))))
+}
+
+// Check that a store reads the content of each file it indexes,
+// whole, by range and by block.
+func TestBlockStore(t *testing.T, mk BlockStoreMaker) {
+	path := treegen.TestTree(t, Tree())
+	defer os.RemoveAll(path)
+
+	store, err := mk(path)
+	assert.Tf(t, err == nil, "Failed to make store: %v", err)
+
+	checkFiles(t, store, path)
+	checkMissing(t, store)
+}
+
+// Check a local store as TestBlockStore does, and check that paths resolve
+// to the files indexed and that relocated files can still be read.
+func TestLocalStore(t *testing.T, mk LocalStoreMaker) {
+	TestBlockStore(t, func(path string) (fs.BlockStore, os.Error) {
+		return mk(path)
+	})
+
+	path := treegen.TestTree(t, Tree())
+	defer os.RemoveAll(path)
+
+	store, err := mk(path)
+	assert.Tf(t, err == nil, "Failed to make store: %v", err)
+	assert.Equal(t, filepath.Clean(path), filepath.Clean(store.RootPath()))
+
+	checkResolve(t, store)
+	checkRelocate(t, store, path)
+}
+
+func files(store fs.BlockStore) []fs.File {
+	result := []fs.File{}
+	fs.Walk(store.Repo().Root(), func(node fs.Node) bool {
+		if file, isFile := node.(fs.File); isFile {
+			result = append(result, file)
+			return false
+		}
+		_, isDir := node.(fs.Dir)
+		return isDir
+	})
+	return result
+}
+
+func checkFiles(t *testing.T, store fs.BlockStore, path string) {
+	fileList := files(store)
+	assert.Equal(t, 5, len(fileList))
+
+	for _, file := range fileList {
+		content, err := ioutil.ReadFile(filepath.Join(path, fs.RelPath(file)))
+		assert.Tf(t, err == nil, "%v", err)
+		checkFile(t, store, file, content)
+	}
+}
+
+func checkFile(t *testing.T, store fs.BlockStore, file fs.File, content []byte) {
+	strong := file.Info().Strong
+	size := int64(len(content))
+	assert.Equalf(t, size, file.Info().Size, "Size of %s", fs.RelPath(file))
+	assert.Equalf(t, fs.StrongChecksum(content), strong, "Strong checksum of %s", fs.RelPath(file))
+
+	// Whole file, and ranges within it, including across block boundaries.
+	ranges := [][2]int64{{0, size}, {0, 1}, {int64(fs.BLOCKSIZE) - 1, 2}, {size / 2, size / 4}, {size - 1, 1}}
+	for _, r := range ranges {
+		from, length := r[0], r[1]
+		if from < 0 || from+length > size {
+			continue
+		}
+
+		buf := &bytes.Buffer{}
+		n, err := store.ReadInto(strong, from, length, buf)
+		assert.Tf(t, err == nil, "ReadInto %s [%d:+%d]: %v", fs.RelPath(file), from, length, err)
+		assert.Equalf(t, length, n, "ReadInto %s [%d:+%d]", fs.RelPath(file), from, length)
+		assert.Tf(t, bytes.Equal(content[from:from+length], buf.Bytes()),
+			"ReadInto %s [%d:+%d] content differs", fs.RelPath(file), from, length)
+	}
+
+	// Reading past the end is short, and fails.
+	buf := &bytes.Buffer{}
+	n, err := store.ReadInto(strong, 0, size+1, buf)
+	assert.Tf(t, err != nil, "ReadInto %s past its end did not fail", fs.RelPath(file))
+	assert.Equalf(t, size, n, "ReadInto %s past its end", fs.RelPath(file))
+
+	for _, block := range file.Blocks() {
+		offset := block.Info().Offset()
+		end := offset + int64(fs.BLOCKSIZE)
+		if end > size {
+			end = size
+		}
+
+		data, err := store.ReadBlock(block.Info().Strong)
+		assert.Tf(t, err == nil, "ReadBlock %s@%d: %v", fs.RelPath(file), offset, err)
+		assert.Tf(t, bytes.Equal(content[offset:end], data),
+			"ReadBlock %s@%d content differs", fs.RelPath(file), offset)
+		assert.Equal(t, block.Info().Strong, fs.StrongChecksum(data))
+	}
+}
+
+func checkMissing(t *testing.T, store fs.BlockStore) {
+	missing := fs.StrongChecksum([]byte("not in the store"))
+
+	_, err := store.ReadBlock(missing)
+	assert.T(t, err != nil)
+
+	_, err = store.ReadInto(missing, 0, 1, &bytes.Buffer{})
+	assert.T(t, err != nil)
+}
+
+func checkResolve(t *testing.T, store fs.LocalStore) {
+	fs.Walk(store.Repo().Root(), func(node fs.Node) bool {
+		fsNode, isFsNode := node.(fs.FsNode)
+		if !isFsNode {
+			return false
+		}
+
+		relpath := fs.RelPath(fsNode)
+		resolved := store.Resolve(relpath)
+		_, err := os.Stat(resolved)
+		assert.Tf(t, err == nil, "Resolve(%q) = %s: %v", relpath, resolved, err)
+		assert.Equalf(t, relpath, store.RelPath(resolved), "RelPath(Resolve(%q))", relpath)
+
+		_, isDir := node.(fs.Dir)
+		return isDir
+	})
+}
+
+func checkRelocate(t *testing.T, store fs.LocalStore, path string) {
+	var file fs.File
+	for _, f := range files(store) {
+		if f.Info().Size > 0 {
+			file = f
+			break
+		}
+	}
+
+	relpath := fs.RelPath(file)
+	origPath := store.Resolve(relpath)
+	content, err := ioutil.ReadFile(origPath)
+	assert.T(t, err == nil)
+
+	relocPath, err := store.Relocate(origPath)
+	assert.Tf(t, err == nil, "Relocate %s: %v", origPath, err)
+
+	// The move is whole: nothing is left behind, and all of it arrives.
+	_, err = os.Stat(origPath)
+	assert.Tf(t, err != nil, "%s still present after Relocate", origPath)
+	relocated, err := ioutil.ReadFile(relocPath)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, bytes.Equal(content, relocated))
+
+	// The planner resolves the original path to the relocated file.
+	assert.Equal(t, relocPath, store.Resolve(relpath))
+	checkFile(t, store, file, content)
+}
@@ -0,0 +1,165 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// An operation which timed out. Timeouts are worth retrying, as the
+// store, or the mount or peer behind it, may recover.
+type ErrTimeout struct {
+	// The operation, and the checksum or path it was made on.
+	Op   string
+	Name string
+
+	// The limit exceeded, in nanoseconds.
+	Limit int64
+}
+
+func (err *ErrTimeout) String() string {
+	return fmt.Sprintf("Timed out after %dms in %s of %s", err.Limit/1e6, err.Op, err.Name)
+}
+
+func (err *ErrTimeout) Timeout() bool { return true }
+
+func (err *ErrTimeout) Temporary() bool { return true }
+
+// Test whether an error is a timeout: an ErrTimeout, or any other error
+// which says it is, as those of network connections do.
+func IsTimeout(err os.Error) bool {
+	timeout, is := err.(interface {
+		Timeout() bool
+	})
+	return is && timeout.Timeout()
+}
+
+// Limits on how long reads from a store may take. Times are in
+// nanoseconds; zero is no limit.
+type Timeouts struct {
+	// Limit on a read making no progress, so that a read stalled on a
+	// hung mount or a dead peer is noticed, however long the read as
+	// a whole.
+	Stall int64
+
+	// Time, in nanoseconds since the epoch, after which reads fail, so
+	// that a sync as a whole finishes or fails by then.
+	Deadline int64
+}
+
+// A block store whose reads fail with an ErrTimeout once they exceed
+// its limits. A read which times out writes nothing more, though what
+// it wrote before it timed out is left written. The read itself cannot
+// be interrupted, and is left to finish, or not, on its own.
+type TimeoutStore struct {
+	store    BlockStore
+	timeouts *Timeouts
+}
+
+// Wrap a block store in timeouts on its reads.
+func NewTimeoutStore(store BlockStore, timeouts *Timeouts) *TimeoutStore {
+	return &TimeoutStore{store: store, timeouts: timeouts}
+}
+
+func (ts *TimeoutStore) Repo() NodeRepo { return ts.store.Repo() }
+
+func (ts *TimeoutStore) ReadBlock(strong string) ([]byte, os.Error) {
+	buf := &bytes.Buffer{}
+	if _, err := ts.ReadBlockInto(strong, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (ts *TimeoutStore) ReadBlockInto(strong string, writer io.Writer) (int64, os.Error) {
+	return ts.run("ReadBlock", strong, writer, func(guard io.Writer) (int64, os.Error) {
+		return ts.store.ReadBlockInto(strong, guard)
+	})
+}
+
+func (ts *TimeoutStore) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	return ts.run("ReadInto", strong, writer, func(guard io.Writer) (int64, os.Error) {
+		return ts.store.ReadInto(strong, from, length, guard)
+	})
+}
+
+// Make a read, writing through a guard which reports its progress, and
+// which is shut once it times out.
+func (ts *TimeoutStore) run(op string, name string, writer io.Writer,
+	read func(guard io.Writer) (int64, os.Error)) (int64, os.Error) {
+	type result struct {
+		n   int64
+		err os.Error
+	}
+
+	guard := &guardWriter{writer: writer, progress: make(chan bool, 1)}
+	done := make(chan result, 1)
+	go func() {
+		n, err := read(guard)
+		done <- result{n: n, err: err}
+	}()
+
+	var deadline <-chan int64
+	allowed := ts.timeouts.Deadline - time.Nanoseconds()
+	if ts.timeouts.Deadline > 0 {
+		deadline = time.After(allowed)
+	}
+
+	for {
+		var stall <-chan int64
+		if ts.timeouts.Stall > 0 {
+			stall = time.After(ts.timeouts.Stall)
+		}
+
+		select {
+		case r := <-done:
+			return r.n, r.err
+		case <-guard.progress:
+			continue
+		case <-stall:
+			return guard.shut(&ErrTimeout{Op: op, Name: name, Limit: ts.timeouts.Stall})
+		case <-deadline:
+			return guard.shut(&ErrTimeout{Op: op, Name: name, Limit: allowed})
+		}
+	}
+
+	panic("Impossible")
+}
+
+// Passes writes on until it is shut, noting each.
+type guardWriter struct {
+	mutex    sync.Mutex
+	writer   io.Writer
+	written  int64
+	err      os.Error
+	progress chan bool
+}
+
+func (guard *guardWriter) Write(buf []byte) (int, os.Error) {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+
+	if guard.err != nil {
+		return 0, guard.err
+	}
+	n, err := guard.writer.Write(buf)
+	guard.written += int64(n)
+
+	select {
+	case guard.progress <- true:
+	default:
+	}
+	return n, err
+}
+
+// Refuse any more writes, failing them with err. Gets what was written.
+func (guard *guardWriter) shut(err os.Error) (int64, os.Error) {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+
+	guard.err = err
+	return guard.written, err
+}
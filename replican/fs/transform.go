@@ -0,0 +1,112 @@
+package fs
+
+import (
+	"io"
+	"os"
+)
+
+// Transform file content on its way from a source to a destination,
+// such as converting line endings or decompressing.
+//
+// A transformed tree is indexed through its transform, so its strong
+// checksums, block matches and any verification are of the transformed
+// content, never of the content on disk. Transforms must therefore be
+// deterministic: the same name and content must always transform to the
+// same bytes.
+type ContentTransform interface {
+	// Wrap the content of the named file, which is slash-separated and
+	// relative to the root of the tree. Returning r leaves it unchanged.
+	Transform(name string, r io.Reader) (io.Reader, os.Error)
+}
+
+// Adapt an ordinary function to a ContentTransform.
+type TransformFunc func(name string, r io.Reader) (io.Reader, os.Error)
+
+func (fn TransformFunc) Transform(name string, r io.Reader) (io.Reader, os.Error) {
+	return fn(name, r)
+}
+
+type transformFS struct {
+	vfs       VirtualFS
+	transform ContentTransform
+}
+
+// Get a VirtualFS whose files read as transformed.
+// Transformed files cannot seek, so a range is read by transforming all the
+// content before it. File sizes reported by Stat and Readdir are those of
+// the underlying files; NewVirtualStore counts the transformed bytes instead.
+func TransformFS(vfs VirtualFS, transform ContentTransform) VirtualFS {
+	return &transformFS{vfs: vfs, transform: transform}
+}
+
+type transformedFile struct {
+	VirtualFile
+	r io.Reader
+}
+
+func (f *transformedFile) Read(buf []byte) (int, os.Error) { return f.r.Read(buf) }
+
+func (tfs *transformFS) Open(name string) (VirtualFile, os.Error) {
+	f, err := tfs.vfs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	} else if fi.IsDirectory() {
+		return f, nil
+	}
+
+	r, err := tfs.transform.Transform(name, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &transformedFile{VirtualFile: f, r: r}, nil
+}
+
+// Convert Unix line endings to DOS line endings. Content which already has
+// DOS line endings is left as it is.
+var ToCRLF ContentTransform = TransformFunc(func(_ string, r io.Reader) (io.Reader, os.Error) {
+	return &crlfReader{r: r}, nil
+})
+
+type crlfReader struct {
+	r       io.Reader
+	lastCR  bool
+	pending bool // A LF is yet to be returned after an inserted CR
+}
+
+func (cr *crlfReader) Read(buf []byte) (n int, err os.Error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	if cr.pending {
+		buf[0] = '\n'
+		cr.pending = false
+		return 1, nil
+	}
+
+	// Leave room to expand every byte read into two.
+	in := make([]byte, (len(buf)+1)/2)
+	rd, err := cr.r.Read(in)
+	for _, b := range in[:rd] {
+		if b == '\n' && !cr.lastCR {
+			buf[n] = '\r'
+			n++
+			if n == len(buf) {
+				cr.pending = true
+				cr.lastCR = false
+				continue
+			}
+		}
+		buf[n] = b
+		n++
+		cr.lastCR = b == '\r'
+	}
+	return n, err
+}
@@ -0,0 +1,148 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Move a file or directory into the user's trash, from where the desktop
+// can restore it, rather than deleting it.
+func Trash(path string) os.Error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	return moveToTrash(path)
+}
+
+// Test whether an error from os.Rename was due to crossing file systems.
+func isCrossDevice(err os.Error) bool {
+	linkErr, isLinkErr := err.(*os.LinkError)
+	if !isLinkErr {
+		return false
+	}
+	errno, isErrno := linkErr.Error.(os.Errno)
+	return isErrno && errno == syscall.EXDEV
+}
+
+// Find the top directory of the file system a path is on.
+func mountTop(path string) (string, os.Error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+
+	top := path
+	for dir := filepath.Dir(path); dir != top; dir = filepath.Dir(dir) {
+		dirInfo, err := os.Stat(dir)
+		if err != nil {
+			return "", err
+		}
+		if dirInfo.Dev != fi.Dev {
+			break
+		}
+		top = dir
+	}
+	return top, nil
+}
+
+// Move a path into a trash directory under an unused name, trying
+// name, then name with a numeric suffix.
+func moveUnique(path string, trashDir string, suffix func(name string, n int) string) (string, os.Error) {
+	_, name := filepath.Split(path)
+	for n := 1; ; n++ {
+		trashName := name
+		if n > 1 {
+			trashName = suffix(name, n)
+		}
+
+		trashPath := filepath.Join(trashDir, trashName)
+		if _, err := os.Lstat(trashPath); err == nil {
+			continue
+		}
+		return trashName, os.Rename(path, trashPath)
+	}
+	panic("Impossible")
+}
+
+// Move a path into a trash as specified by freedesktop.org: the home trash
+// under $XDG_DATA_HOME, or $topdir/.Trash-$uid for other file systems.
+func xdgTrash(path string) os.Error {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		dataHome = filepath.Join(os.Getenv("HOME"), ".local", "share")
+	}
+
+	trashDir := filepath.Join(dataHome, "Trash")
+	err := xdgTrashInto(path, trashDir, path)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+
+	top, err := mountTop(path)
+	if err != nil {
+		return err
+	}
+	relpath, _ := filepath.Rel(top, path)
+	trashDir = filepath.Join(top, fmt.Sprintf(".Trash-%d", os.Getuid()))
+	return xdgTrashInto(path, trashDir, relpath)
+}
+
+func xdgTrashInto(path string, trashDir string, infoPath string) os.Error {
+	filesDir := filepath.Join(trashDir, "files")
+	infoDir := filepath.Join(trashDir, "info")
+	for _, dir := range []string{filesDir, infoDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	// The info file is created exclusively to claim the name.
+	_, name := filepath.Split(path)
+	for n := 1; ; n++ {
+		trashName := name
+		if n > 1 {
+			trashName = fmt.Sprintf("%s.%d", name, n)
+		}
+
+		infoF, err := os.OpenFile(filepath.Join(infoDir, trashName+".trashinfo"),
+			os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			if _, statErr := os.Stat(filepath.Join(infoDir, trashName+".trashinfo")); statErr == nil {
+				continue
+			}
+			return err
+		}
+
+		fmt.Fprintf(infoF, "[Trash Info]\nPath=%s\nDeletionDate=%s\n",
+			escapeTrashPath(infoPath), time.LocalTime().Format("2006-01-02T15:04:05"))
+		infoF.Close()
+
+		err = os.Rename(path, filepath.Join(filesDir, trashName))
+		if err != nil {
+			os.Remove(infoF.Name())
+		}
+		return err
+	}
+	panic("Impossible")
+}
+
+// Escape a path as a URL path, as trash info files require.
+func escapeTrashPath(path string) string {
+	const unreserved = "-_.~/"
+	escaped := []byte{}
+	for _, b := range []byte(filepath.ToSlash(path)) {
+		switch {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9',
+			strings.IndexRune(unreserved, int(b)) >= 0:
+			escaped = append(escaped, b)
+		default:
+			escaped = append(escaped, []byte(fmt.Sprintf("%%%02X", b))...)
+		}
+	}
+	return string(escaped)
+}
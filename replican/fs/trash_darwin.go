@@ -0,0 +1,32 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Move a path into ~/.Trash, or the .Trashes directory of the volume it is
+// on, naming it as the Finder does when the name is taken.
+func moveToTrash(path string) os.Error {
+	suffix := func(name string, n int) string {
+		ext := filepath.Ext(name)
+		return fmt.Sprintf("%s %d%s", name[:len(name)-len(ext)], n, ext)
+	}
+
+	_, err := moveUnique(path, filepath.Join(os.Getenv("HOME"), ".Trash"), suffix)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+
+	top, err := mountTop(path)
+	if err != nil {
+		return err
+	}
+	trashDir := filepath.Join(top, ".Trashes", fmt.Sprint(os.Getuid()))
+	if err = os.MkdirAll(trashDir, 0700); err != nil {
+		return err
+	}
+	_, err = moveUnique(path, trashDir, suffix)
+	return err
+}
@@ -0,0 +1,10 @@
+package fs
+
+import (
+	"os"
+)
+
+// Move a path into the freedesktop.org trash.
+func moveToTrash(path string) os.Error {
+	return xdgTrash(path)
+}
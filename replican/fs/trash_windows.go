@@ -0,0 +1,56 @@
+package fs
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	FO_DELETE          = 3
+	FOF_SILENT         = 0x0004
+	FOF_NOCONFIRMATION = 0x0010
+	FOF_ALLOWUNDO      = 0x0040
+	FOF_NOERRORUI      = 0x0400
+)
+
+// SHFILEOPSTRUCTW, as taken by SHFileOperationW.
+type shFileOpStruct struct {
+	hwnd                  uintptr
+	wFunc                 uint32
+	pFrom                 *uint16
+	pTo                   *uint16
+	fFlags                uint16
+	fAnyOperationsAborted int32
+	hNameMappings         uintptr
+	lpszProgressTitle     *uint16
+}
+
+// Move a path into the Recycle Bin of its drive, by way of the shell.
+func moveToTrash(path string) os.Error {
+	shell32, errno := syscall.LoadLibrary("shell32.dll")
+	if errno != 0 {
+		return os.NewSyscallError("LoadLibrary", errno)
+	}
+	defer syscall.FreeLibrary(shell32)
+
+	shFileOperation, errno := syscall.GetProcAddress(shell32, "SHFileOperationW")
+	if errno != 0 {
+		return os.NewSyscallError("GetProcAddress", errno)
+	}
+
+	// The list of paths is terminated by an empty path.
+	from := append(syscall.StringToUTF16(StripLongPath(path)), 0)
+	op := &shFileOpStruct{
+		wFunc:  FO_DELETE,
+		pFrom:  &from[0],
+		fFlags: FOF_ALLOWUNDO | FOF_NOCONFIRMATION | FOF_NOERRORUI | FOF_SILENT}
+
+	r1, _, _ := syscall.Syscall(uintptr(shFileOperation), 1, uintptr(unsafe.Pointer(op)), 0, 0)
+	if r1 != 0 {
+		return &os.PathError{Op: "trash", Path: path, Error: os.Errno(r1)}
+	} else if op.fAnyOperationsAborted != 0 {
+		return &os.PathError{Op: "trash", Path: path, Error: os.NewError("aborted")}
+	}
+	return nil
+}
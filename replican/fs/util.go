@@ -1,6 +1,7 @@
 package fs
 
 import (
+	"fmt"
 	"io"
 	//	"log"
 	"os"
@@ -10,6 +11,25 @@ import (
 	"syscall"
 )
 
+// Marks a Windows path which may exceed MAX_PATH. See LongPath.
+const LONG_PATH_PREFIX = `\\?\`
+
+// Remove the long path prefix given by LongPath, if any.
+func StripLongPath(path string) string {
+	switch {
+	case strings.HasPrefix(path, LONG_PATH_PREFIX+`UNC\`):
+		return `\\` + path[len(LONG_PATH_PREFIX)+4:]
+	case strings.HasPrefix(path, LONG_PATH_PREFIX):
+		return path[len(LONG_PATH_PREFIX):]
+	}
+	return path
+}
+
+// Test whether a node's mode marks it as a symbolic link.
+func IsSymlinkMode(mode uint32) bool {
+	return mode&syscall.S_IFMT == syscall.S_IFLNK
+}
+
 func SplitNames(path string) []string {
 	if path == "" {
 		return []string{}
@@ -136,3 +156,34 @@ func PostOrderWalk(path string, visitor filepath.Visitor, errors chan<- os.Error
 		}
 	}
 }
+
+// Check that a name received from elsewhere, such as a remote manifest,
+// names a single entry within its directory on this platform.
+func CheckName(name string) os.Error {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return os.NewError(fmt.Sprintf("Invalid name: %q", name))
+	case strings.IndexAny(name, "/\\\x00") >= 0:
+		return os.NewError(fmt.Sprintf("Invalid name %q: contains a path separator or NUL", name))
+	case IsReservedName(name):
+		return os.NewError(fmt.Sprintf("Invalid name %q: reserved on this platform", name))
+	}
+	return nil
+}
+
+// Check that a relative path received from elsewhere stays within the
+// directory it is resolved against. The empty path refers to that directory.
+func CheckRelPath(relpath string) os.Error {
+	if relpath == "" {
+		return nil
+	}
+	if filepath.IsAbs(relpath) || strings.HasPrefix(relpath, "/") || strings.HasPrefix(relpath, "\\") {
+		return os.NewError(fmt.Sprintf("Invalid path %q: not relative", relpath))
+	}
+	for _, name := range SplitNames(relpath) {
+		if err := CheckName(name); err != nil {
+			return os.NewError(fmt.Sprintf("Invalid path %q: %v", relpath, err))
+		}
+	}
+	return nil
+}
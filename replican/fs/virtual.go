@@ -0,0 +1,190 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// A read-only file system, such as content embedded in a program, a zip
+// file or a virtual tree. It is modelled on the io/fs package of later Go
+// releases: names are slash-separated, relative to the root ".", and
+// never contain "." or ".." elements.
+type VirtualFS interface {
+	Open(name string) (VirtualFile, os.Error)
+}
+
+// A file or directory opened from a VirtualFS. *os.File is one.
+type VirtualFile interface {
+	io.Reader
+	io.Closer
+
+	Stat() (*os.FileInfo, os.Error)
+
+	// List the entries of a directory, as os.File.Readdir does.
+	Readdir(count int) ([]os.FileInfo, os.Error)
+}
+
+type dirFS string
+
+// Get a VirtualFS for the tree rooted at a local directory.
+func DirFS(dir string) VirtualFS { return dirFS(dir) }
+
+func (dir dirFS) Open(name string) (VirtualFile, os.Error) {
+	if err := CheckRelPath(name); name != "." && err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(string(dir), filepath.FromSlash(name)))
+	if f == nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// A read-only BlockStore over the content of a VirtualFS.
+// The tree is indexed when the store is created; content is read from the
+// file system again whenever blocks are requested.
+type VirtualStore struct {
+	vfs  VirtualFS
+	repo NodeRepo
+	root Dir
+}
+
+// Index a VirtualFS into repo, providing its content as a BlockStore.
+func NewVirtualStore(vfs VirtualFS, repo NodeRepo) (*VirtualStore, os.Error) {
+	store := &VirtualStore{vfs: vfs, repo: repo}
+
+	f, err := vfs.Open(".")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	store.root = repo.AddDir(nil, &DirInfo{Mode: fi.Mode})
+	if err = store.indexDir(store.root, ".", f); err != nil {
+		return nil, err
+	}
+	store.root.UpdateStrong()
+
+	return store, nil
+}
+
+func (store *VirtualStore) indexDir(dir Dir, name string, f VirtualFile) os.Error {
+	entries, err := f.Readdir(-1)
+	if err != nil {
+		return err
+	}
+
+	for i := range entries {
+		entry := &entries[i]
+		entryName := path.Join(name, entry.Name)
+		if !store.repo.IndexFilter()(entryName, entry) {
+			continue
+		}
+
+		if err := store.indexEntry(dir, entryName, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *VirtualStore) indexEntry(dir Dir, name string, entry *os.FileInfo) os.Error {
+	if !entry.IsDirectory() && !entry.IsRegular() {
+		return nil
+	}
+
+	f, err := store.vfs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if entry.IsDirectory() {
+		subdir := store.repo.AddDir(dir, &DirInfo{
+			Name:   entry.Name,
+			Mode:   entry.Mode,
+			Parent: dir.Info().Strong})
+		return store.indexDir(subdir, name, f)
+	}
+
+	fileInfo := &FileInfo{
+		Name:   entry.Name,
+		Mode:   entry.Mode,
+		Parent: dir.Info().Strong}
+	blocksInfo, err := indexContent(f, fileInfo, BLOCKSIZE)
+	if err != nil {
+		return err
+	}
+	store.repo.AddFile(dir, fileInfo, blocksInfo)
+	return nil
+}
+
+func (store *VirtualStore) Repo() NodeRepo { return store.repo }
+
+func (store *VirtualStore) Root() Dir { return store.root }
+
+func (store *VirtualStore) ReadBlock(strong string) ([]byte, os.Error) {
+	return readBlock(store, strong)
+}
+
+func (store *VirtualStore) ReadBlockInto(strong string, writer io.Writer) (int64, os.Error) {
+	block, has := store.repo.Block(strong)
+	if !has {
+		return 0, os.NewError(
+			fmt.Sprintf("Block with strong checksum %s not found", strong))
+	}
+
+	file, has := block.Parent()
+	if !has {
+		return 0, os.NewError(
+			fmt.Sprintf("Block with strong checksum %s has no file", strong))
+	}
+
+	// The last block in a file may be short
+	n, err := store.readInto(file, block.Info().Offset(), block.Info().Size(), writer)
+	if err == os.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (store *VirtualStore) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	file, has := store.repo.File(strong)
+	if !has {
+		return 0,
+			os.NewError(fmt.Sprintf("File with strong checksum %s not found", strong))
+	}
+
+	return store.readInto(file, from, length, writer)
+}
+
+// Read a range of a file. Virtual files need not seek, so the content
+// before the range is read and discarded.
+func (store *VirtualStore) readInto(file FsNode, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	f, err := store.vfs.Open(filepath.ToSlash(RelPath(file)))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if seeker, is := f.(io.Seeker); is {
+		_, err = seeker.Seek(from, 0)
+	} else {
+		_, err = io.Copyn(ioutil.Discard, f, from)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return io.Copyn(writer, f, length)
+}
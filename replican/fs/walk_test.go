@@ -4,6 +4,7 @@ import (
 	//	"log"
 	"os"
 	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/cmars/replican-sync/replican/treegen"
@@ -96,3 +97,65 @@ func TestPostOrder3(t *testing.T) {
 			"%v did not have expected suffix %s", visitor.order[i], expect[i])
 	}
 }
+
+// Test that a directory's checksum does not depend on the order its
+// contents were added in, and that names are ordered bytewise.
+func TestDirStrongOrder(t *testing.T) {
+	// Precomposed and decomposed forms of the same name are distinct.
+	names := []string{"a", "Z", "\u00e9", "z", "e\u0301"}
+
+	build := func(names []string) Dir {
+		repo := NewMemRepo()
+		root := repo.AddDir(nil, &DirInfo{Mode: 0755})
+		for _, name := range names {
+			content := []byte(name)
+			repo.AddFile(root, &FileInfo{
+				Name:   name,
+				Mode:   0644,
+				Size:   int64(len(content)),
+				Strong: StrongChecksum(content)}, []*BlockInfo{IndexBlock(content)})
+			repo.AddDir(root, &DirInfo{Name: "d" + name, Mode: 0755})
+		}
+		root.UpdateStrong()
+		return root
+	}
+
+	reversed := make([]string, len(names))
+	for i, name := range names {
+		reversed[len(names)-1-i] = name
+	}
+
+	forward := build(names)
+	backward := build(reversed)
+	assert.Equal(t, forward.Info().Strong, backward.Info().Strong)
+
+	order := []string{}
+	for _, line := range strings.Split(string(reprDir(forward, STRONG_CONTENT)), "\n") {
+		if fields := strings.Split(line, "\t"); len(fields) == 3 {
+			order = append(order, fields[2])
+		}
+	}
+	assert.Equal(t, []string{"dZ", "da", "de\u0301", "dz", "d\u00e9", "Z", "a", "e\u0301", "z", "\u00e9"}, order)
+}
+
+// Test that a link stored as a file differs, in its directory's checksum,
+// from a file holding its target.
+func TestDirStrongSymlink(t *testing.T) {
+	build := func(mode uint32) Dir {
+		repo := NewMemRepo()
+		root := repo.AddDir(nil, &DirInfo{Mode: 0755})
+		content := []byte("bar")
+		repo.AddFile(root, &FileInfo{
+			Name:   "link",
+			Mode:   mode,
+			Size:   int64(len(content)),
+			Strong: StrongChecksum(content)}, []*BlockInfo{IndexBlock(content)})
+		root.UpdateStrong()
+		return root
+	}
+
+	file := build(0644)
+	link := build(syscall.S_IFLNK | 0777)
+	assert.T(t, file.Info().Strong != link.Info().Strong)
+	assert.T(t, CalcStrongMode(file, STRONG_META) != CalcStrongMode(link, STRONG_META))
+}
@@ -0,0 +1,56 @@
+package fs
+
+import (
+	"os"
+	"strings"
+)
+
+// Namespaces of the extended attributes which are indexed and synced.
+// Others are left alone: trusted.* can only be read with privileges,
+// and system.* holds attributes such as ACLs, which are not plain data.
+var XATTR_NAMESPACES []string = []string{"user.", "security."}
+
+// Test whether an extended attribute is in one of XATTR_NAMESPACES.
+func IsSyncedXattr(name string) bool {
+	for _, namespace := range XATTR_NAMESPACES {
+		if strings.HasPrefix(name, namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// Read the synced extended attributes of path, without following links.
+// Nil if there are none, or the platform or file system has none to read.
+func ReadXattrs(path string) (map[string][]byte, os.Error) {
+	names, err := listXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var xattrs map[string][]byte
+	for _, name := range names {
+		if !IsSyncedXattr(name) {
+			continue
+		}
+		value, err := getXattr(path, name)
+		if err != nil {
+			return nil, err
+		}
+		if xattrs == nil {
+			xattrs = make(map[string][]byte)
+		}
+		xattrs[name] = value
+	}
+	return xattrs, nil
+}
+
+// Set an extended attribute of path, without following links.
+func SetXattr(path string, name string, value []byte) os.Error {
+	return setXattr(path, name, value)
+}
+
+// Remove an extended attribute of path, without following links.
+func RemoveXattr(path string, name string) os.Error {
+	return removeXattr(path, name)
+}
@@ -0,0 +1,22 @@
+package fs
+
+import (
+	"os"
+)
+
+// Extended attributes are not available on this platform, so there are none to list.
+func listXattrs(path string) ([]string, os.Error) {
+	return nil, nil
+}
+
+func getXattr(path string, name string) ([]byte, os.Error) {
+	return nil, os.NewError("Extended attributes are not available on this platform")
+}
+
+func setXattr(path string, name string, value []byte) os.Error {
+	return os.NewError("Extended attributes are not available on this platform")
+}
+
+func removeXattr(path string, name string) os.Error {
+	return os.NewError("Extended attributes are not available on this platform")
+}
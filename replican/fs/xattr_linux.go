@@ -0,0 +1,98 @@
+package fs
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+func bufPtr(buf []byte) uintptr {
+	if len(buf) == 0 {
+		return 0
+	}
+	return uintptr(unsafe.Pointer(&buf[0]))
+}
+
+func strPtr(s string) uintptr {
+	return uintptr(unsafe.Pointer(syscall.StringBytePtr(s)))
+}
+
+func xattrError(op string, path string, errno uintptr) os.Error {
+	return &os.PathError{Op: op, Path: path, Error: os.Errno(errno)}
+}
+
+// List the names of the extended attributes of path, by way of llistxattr.
+// A file system without extended attributes has none to list.
+func listXattrs(path string) ([]string, os.Error) {
+	for {
+		size, _, errno := syscall.Syscall(syscall.SYS_LLISTXATTR, strPtr(path), 0, 0)
+		switch {
+		case int(errno) == syscall.EOPNOTSUPP:
+			return nil, nil
+		case errno != 0:
+			return nil, xattrError("llistxattr", path, errno)
+		case size == 0:
+			return nil, nil
+		}
+
+		buf := make([]byte, size)
+		size, _, errno = syscall.Syscall(syscall.SYS_LLISTXATTR, strPtr(path), bufPtr(buf), uintptr(len(buf)))
+		switch {
+		case int(errno) == syscall.ERANGE:
+			// Attributes were added since the size was taken
+			continue
+		case errno != 0:
+			return nil, xattrError("llistxattr", path, errno)
+		}
+
+		names := []string{}
+		for _, name := range strings.Split(string(buf[:size]), "\x00") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+
+	panic("Impossible")
+}
+
+func getXattr(path string, name string) ([]byte, os.Error) {
+	for {
+		size, _, errno := syscall.Syscall6(syscall.SYS_LGETXATTR, strPtr(path), strPtr(name), 0, 0, 0, 0)
+		if errno != 0 {
+			return nil, xattrError("lgetxattr", path, errno)
+		}
+
+		buf := make([]byte, size)
+		size, _, errno = syscall.Syscall6(syscall.SYS_LGETXATTR,
+			strPtr(path), strPtr(name), bufPtr(buf), uintptr(len(buf)), 0, 0)
+		switch {
+		case int(errno) == syscall.ERANGE:
+			continue
+		case errno != 0:
+			return nil, xattrError("lgetxattr", path, errno)
+		}
+		return buf[:size], nil
+	}
+
+	panic("Impossible")
+}
+
+func setXattr(path string, name string, value []byte) os.Error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR,
+		strPtr(path), strPtr(name), bufPtr(value), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return xattrError("lsetxattr", path, errno)
+	}
+	return nil
+}
+
+func removeXattr(path string, name string) os.Error {
+	_, _, errno := syscall.Syscall(syscall.SYS_LREMOVEXATTR, strPtr(path), strPtr(name), 0)
+	if errno != 0 {
+		return xattrError("lremovexattr", path, errno)
+	}
+	return nil
+}
@@ -2,7 +2,10 @@ package fstest
 
 import (
 	"os"
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/fs/repotest"
 	"github.com/cmars/replican-sync/replican/fs/sqlite3"
+	"github.com/cmars/replican-sync/replican/fs/storetest"
 	"io/ioutil"
 	"testing"
 
@@ -64,3 +67,48 @@ func TestDbParentRefs(t *testing.T) {
 	defer os.RemoveAll(dbpath)
 	DoTestParentRefs(t, dbrepo)
 }
+
+func TestDbConflictDir(t *testing.T) {
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.RemoveAll(dbpath)
+	DoTestConflictDir(t, dbrepo)
+}
+
+func TestDbReadBlock(t *testing.T) {
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.RemoveAll(dbpath)
+	DoTestReadBlock(t, dbrepo)
+}
+
+func TestDbBlockIndex(t *testing.T) {
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.RemoveAll(dbpath)
+	DoTestBlockIndex(t, dbrepo)
+}
+
+func TestDbStrongMeta(t *testing.T) {
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.RemoveAll(dbpath)
+	DoTestStrongMeta(t, dbrepo)
+}
+
+func TestDbStoreConformance(t *testing.T) {
+	dbpaths := []string{}
+	storetest.TestLocalStore(t, func(path string) (fs.LocalStore, os.Error) {
+		dbrepo, dbpath := createDbRepo(t)
+		dbpaths = append(dbpaths, dbpath)
+		return fs.NewLocalStore(path, dbrepo)
+	})
+
+	for _, dbpath := range dbpaths {
+		os.RemoveAll(dbpath)
+	}
+}
+
+func TestDbRepoConformance(t *testing.T) {
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.RemoveAll(dbpath)
+	repotest.TestNodeRepo(t, func() (fs.NodeRepo, os.Error) {
+		return dbrepo, nil
+	})
+}
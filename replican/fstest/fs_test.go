@@ -1,9 +1,17 @@
 package fstest
 
 import (
+	"bytes"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/fs/repotest"
+	"github.com/cmars/replican-sync/replican/fs/storetest"
+	"github.com/cmars/replican-sync/replican/treegen"
 	"testing"
+	"time"
 
 	"github.com/bmizerany/assert"
 )
@@ -53,3 +61,436 @@ func TestFsDirDescent(t *testing.T) {
 func TestFsParentRefs(t *testing.T) {
 	DoTestParentRefs(t, fs.NewMemRepo())
 }
+
+func TestFsConflictDir(t *testing.T) {
+	DoTestConflictDir(t, fs.NewMemRepo())
+}
+
+func TestFsReadBlock(t *testing.T) {
+	DoTestReadBlock(t, fs.NewMemRepo())
+}
+
+func TestFsBlockMapCache(t *testing.T) {
+	tg := treegen.New()
+	path := treegen.TestTree(t, tg.D("foo", tg.F("disk.img", tg.B(42, 65537))))
+	defer os.RemoveAll(path)
+	imgPath := filepath.Join(path, "foo", "disk.img")
+
+	cacheDir, err := ioutil.TempDir("", "blockmap")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(cacheDir)
+
+	cache := fs.NewBlockMapCache(cacheDir)
+
+	info, blocks, err := cache.IndexFile(imgPath)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, 9, len(blocks))
+	assert.Equal(t, 9, cache.Rehashed)
+
+	_, indexBlocks, err := fs.IndexFile(imgPath)
+	assert.T(t, err == nil)
+	for i, block := range blocks {
+		assert.Equal(t, indexBlocks[i].Strong, block.Strong)
+	}
+
+	// Unchanged files are not read again
+	cachedInfo, cachedBlocks, err := cache.IndexFile(imgPath)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, 0, cache.Rehashed)
+	assert.Equal(t, info.Strong, cachedInfo.Strong)
+	assert.Equal(t, len(blocks), len(cachedBlocks))
+
+	f, err := os.OpenFile(imgPath, os.O_WRONLY|os.O_APPEND, 0)
+	assert.T(t, err == nil)
+	f.Write([]byte("more"))
+	f.Close()
+
+	changedInfo, changedBlocks, err := cache.IndexFile(imgPath)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, 9, cache.Rehashed)
+	assert.T(t, info.Strong != changedInfo.Strong)
+	assert.Equal(t, blocks[0].Strong, changedBlocks[0].Strong)
+}
+
+func TestFsIndexCache(t *testing.T) {
+	tg := treegen.New()
+	path := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.F("baz", tg.B(43, 65537))))
+	defer os.RemoveAll(path)
+	barPath := filepath.Join(path, "foo", "bar")
+	bazPath := filepath.Join(path, "foo", "baz")
+
+	// Files modified just before they are hashed are hashed again
+	backdate := func(path string) {
+		mtime := time.Nanoseconds() - 60e9
+		assert.T(t, os.Chtimes(path, mtime, mtime) == nil)
+	}
+	backdate(barPath)
+	backdate(bazPath)
+
+	cache := fs.NewIndexCache()
+	index := func() fs.Dir {
+		indexer := &fs.Indexer{Path: path, Repo: fs.NewMemRepo(), Cache: cache}
+		return indexer.Index()
+	}
+
+	root := index()
+	assert.Equal(t, 2, cache.Rehashed)
+	cache.Sweep()
+
+	// Unchanged files are not read again
+	cachedRoot := index()
+	assert.Equal(t, 0, cache.Rehashed)
+	assert.Equal(t, 2, cache.Reused)
+	assert.Equal(t, root.Info().Strong, cachedRoot.Info().Strong)
+	cache.Sweep()
+
+	f, err := os.OpenFile(barPath, os.O_WRONLY|os.O_APPEND, 0)
+	assert.T(t, err == nil)
+	f.Write([]byte("more"))
+	f.Close()
+	backdate(barPath)
+	assert.T(t, os.Chmod(bazPath, 0600) == nil)
+
+	changedRoot := index()
+	assert.Equal(t, 1, cache.Rehashed)
+	assert.Equal(t, 1, cache.Reused)
+	assert.T(t, root.Info().Strong != changedRoot.Info().Strong)
+
+	bar, _, err := fs.IndexFile(barPath)
+	assert.T(t, err == nil)
+	changedBar, has := fs.Lookup(changedRoot, filepath.Join("foo", "bar"))
+	assert.T(t, has)
+	assert.Equal(t, bar.Strong, changedBar.(fs.File).Info().Strong)
+
+	// Metadata is taken from the file, though its checksums are reused
+	baz, has := fs.Lookup(changedRoot, filepath.Join("foo", "baz"))
+	assert.T(t, has)
+	assert.Equal(t, uint32(0600), baz.(fs.File).Info().Mode&0777)
+	cache.Sweep()
+
+	// Forgotten files are read again, however their stat looks
+	cache.Forget([]string{barPath})
+	index()
+	assert.Equal(t, 1, cache.Rehashed)
+	assert.Equal(t, 1, cache.Reused)
+	cache.Sweep()
+
+	cache.Forget([]string{filepath.Join(path, "foo")})
+	index()
+	assert.Equal(t, 2, cache.Rehashed)
+}
+
+func TestFsCachedStore(t *testing.T) {
+	tg := treegen.New()
+	path := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.F("baz", tg.B(43, 65537))))
+	defer os.RemoveAll(path)
+	barPath := filepath.Join(path, "foo", "bar")
+	bazPath := filepath.Join(path, "foo", "baz")
+	mtime := time.Nanoseconds() - 60e9
+	assert.T(t, os.Chtimes(barPath, mtime, mtime) == nil)
+	assert.T(t, os.Chtimes(bazPath, mtime, mtime) == nil)
+
+	cacheDir, err := ioutil.TempDir("", "indexcache")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(cacheDir)
+	cachePath := filepath.Join(cacheDir, "cache")
+
+	store, err := fs.NewCachedStore(path, fs.NewMemRepo(), cachePath)
+	assert.Tf(t, err == nil, "%v", err)
+	strong := store.Repo().Root().Info().Strong
+	assert.T(t, store.Close() == nil)
+
+	cache, err := fs.LoadIndexCache(cachePath)
+	assert.Tf(t, err == nil, "%v", err)
+	cachedBar, cachedBlocks, has := cache.Lookup(barPath, fs.BLOCKSIZE, fs.CHUNK_FIXED)
+	assert.T(t, has)
+	bar, blocks, err := fs.IndexFile(barPath)
+	assert.T(t, err == nil)
+	assert.Equal(t, bar.Strong, cachedBar.Strong)
+	assert.Equal(t, len(blocks), len(cachedBlocks))
+
+	// Files changed while the store was closed are read again
+	f, err := os.OpenFile(bazPath, os.O_WRONLY|os.O_APPEND, 0)
+	assert.T(t, err == nil)
+	f.Write([]byte("more"))
+	f.Close()
+
+	store, err = fs.NewCachedStore(path, fs.NewMemRepo(), cachePath)
+	assert.Tf(t, err == nil, "%v", err)
+	root, errors := fs.IndexDir(path, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.T(t, strong != store.Repo().Root().Info().Strong)
+	assert.Equal(t, root.Info().Strong, store.Repo().Root().Info().Strong)
+}
+
+func TestFsChangeJournal(t *testing.T) {
+	tg := treegen.New()
+	path := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 100))))
+	defer os.RemoveAll(path)
+
+	journal, err := fs.NewChangeJournal(path)
+	if err != nil {
+		t.Logf("Skipping, no change journal: %v", err)
+		return
+	}
+	defer journal.Close()
+
+	paths, lost := journal.Changes()
+	assert.T(t, !lost)
+	assert.Equal(t, 0, len(paths))
+
+	err = ioutil.WriteFile(filepath.Join(path, "foo", "bar"), []byte("changed"), 0644)
+	assert.T(t, err == nil)
+	err = os.MkdirAll(filepath.Join(path, "foo", "baz"), 0755)
+	assert.T(t, err == nil)
+	err = ioutil.WriteFile(filepath.Join(path, "foo", "baz", "qux"), []byte("new"), 0644)
+	assert.T(t, err == nil)
+
+	changed := make(map[string]bool)
+	for i := 0; i < 50 && !changed[filepath.Join("foo", "baz", "qux")]; i++ {
+		time.Sleep(1e7)
+		paths, _ = journal.Changes()
+		for _, path := range paths {
+			changed[path] = true
+		}
+	}
+
+	assert.Tf(t, changed[filepath.Join("foo", "bar")], "%v", changed)
+	assert.Tf(t, changed[filepath.Join("foo", "baz")], "%v", changed)
+	assert.Tf(t, changed[filepath.Join("foo", "baz", "qux")], "%v", changed)
+}
+
+func TestFsBlockIndex(t *testing.T) {
+	DoTestBlockIndex(t, fs.NewMemRepo())
+}
+
+func TestFsStrongMeta(t *testing.T) {
+	DoTestStrongMeta(t, fs.NewMemRepo())
+}
+
+func TestInRoot(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "foo")
+	assert.T(t, fs.InRoot(root, root))
+	assert.T(t, fs.InRoot(root, filepath.Join(root, "bar")))
+	assert.T(t, fs.InRoot(root, filepath.Join(root, "bar", "..", "baz")))
+	assert.T(t, !fs.InRoot(root, filepath.Join(root, "..", "bar")))
+	assert.T(t, !fs.InRoot(root, root+"bar"))
+	assert.T(t, !fs.InRoot(root, os.TempDir()))
+}
+
+func TestLongPath(t *testing.T) {
+	assert.Equal(t, `C:\foo`, fs.StripLongPath(`\\?\C:\foo`))
+	assert.Equal(t, `\\server\share\foo`, fs.StripLongPath(`\\?\UNC\server\share\foo`))
+	assert.Equal(t, "/foo", fs.StripLongPath("/foo"))
+
+	assert.Equal(t, "CON_.txt", fs.WindowsSafeName("CON.txt"))
+	assert.Equal(t, "a_b_c_", fs.WindowsSafeName("a:b?c."))
+	assert.Equal(t, "ok", fs.WindowsSafeName("ok"))
+	assert.T(t, !fs.IsWindowsReserved(fs.WindowsSafeName("lpt1 ")))
+}
+
+func indexSymlinks(t *testing.T, path string, policy fs.SymlinkPolicy) (fs.Dir, []os.Error) {
+	errors := []os.Error{}
+	dirChan := make(chan fs.Dir, 1)
+	errorChan := make(chan os.Error, 1)
+	indexer := &fs.Indexer{Path: path, Repo: fs.NewMemRepo(), Errors: errorChan,
+		Symlinks: policy}
+	go func() {
+		dirChan <- indexer.Index()
+		close(errorChan)
+	}()
+	for err := range errorChan {
+		errors = append(errors, err)
+	}
+	return <-dirChan, errors
+}
+
+func TestFsSymlinks(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.D("baz", tg.F("blop", tg.B(43, 65537))))
+	path := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(path)
+
+	foo := filepath.Join(path, "foo")
+	assert.T(t, os.Symlink("bar", filepath.Join(foo, "flink")) == nil)
+	assert.T(t, os.Symlink("baz", filepath.Join(foo, "dlink")) == nil)
+	assert.T(t, os.Symlink("..", filepath.Join(foo, "baz", "loop")) == nil)
+
+	// Links to files are followed, links to directories are errors
+	root, errors := indexSymlinks(t, foo, fs.SYMLINKS_FILES)
+	assert.Equal(t, 2, len(errors))
+	node, has := fs.Lookup(root, "flink")
+	assert.T(t, has)
+	assert.Equal(t, int64(65537), node.(fs.File).Info().Size)
+
+	root, errors = indexSymlinks(t, foo, fs.SYMLINKS_SKIP)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	_, has = fs.Lookup(root, "flink")
+	assert.T(t, !has)
+	_, has = fs.Lookup(root, "dlink")
+	assert.T(t, !has)
+
+	root, errors = indexSymlinks(t, foo, fs.SYMLINKS_STORE)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	node, has = fs.Lookup(root, "dlink")
+	assert.T(t, has)
+	assert.T(t, fs.IsSymlinkMode(node.(fs.File).Mode()))
+	assert.Equal(t, fs.StrongChecksum([]byte("baz")), node.(fs.File).Info().Strong)
+
+	// The loop back to foo is refused, both where it is and through dlink
+	root, errors = indexSymlinks(t, foo, fs.SYMLINKS_FOLLOW)
+	assert.Equalf(t, 2, len(errors), "%v", errors)
+	node, has = fs.Lookup(root, filepath.Join("dlink", "blop"))
+	assert.T(t, has)
+	assert.Equal(t, int64(65537), node.(fs.File).Info().Size)
+	_, has = fs.Lookup(root, filepath.Join("baz", "loop"))
+	assert.T(t, !has)
+}
+
+func TestFsOneFileSystem(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.D("baz", tg.F("blop", tg.B(43, 65537))))
+	path := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(path)
+
+	all, errors := fs.IndexDir(path, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	// A tree on one device is indexed the same either way
+	indexer := &fs.Indexer{Path: path, Repo: fs.NewMemRepo(), OneFileSystem: true}
+	one := indexer.Index()
+	assert.Equal(t, all.Info().Strong, one.Info().Strong)
+}
+
+func TestFsVcs(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.D("repo",
+			tg.D(".git", tg.F("HEAD", tg.B(43, 100))),
+			tg.F("work", tg.B(44, 100))),
+		tg.D("module",
+			tg.F(".git", tg.B(45, 100)),
+			tg.F("work", tg.B(46, 100))))
+	path := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(path)
+
+	foo := filepath.Join(path, "foo")
+	store, err := fs.NewLocalStore(foo, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	root := store.Repo().Root().(fs.Dir)
+	_, has := fs.Lookup(root, filepath.Join("repo", ".git", "HEAD"))
+	assert.T(t, has)
+
+	assert.T(t, store.SetVcs(fs.VCS_WORKTREE) == nil)
+	root = store.Repo().Root().(fs.Dir)
+	for _, relpath := range []string{
+		filepath.Join("repo", ".git"), filepath.Join("module", ".git")} {
+		_, has = fs.Lookup(root, relpath)
+		assert.Tf(t, !has, "%s indexed", relpath)
+	}
+	for _, relpath := range []string{
+		"bar", filepath.Join("repo", "work"), filepath.Join("module", "work")} {
+		_, has = fs.Lookup(root, relpath)
+		assert.Tf(t, has, "%s not indexed", relpath)
+	}
+
+	assert.T(t, store.SetVcs(fs.VCS_EXCLUDE) == nil)
+	root = store.Repo().Root().(fs.Dir)
+	for _, relpath := range []string{"repo", "module"} {
+		_, has = fs.Lookup(root, relpath)
+		assert.Tf(t, !has, "%s indexed", relpath)
+	}
+	_, has = fs.Lookup(root, "bar")
+	assert.T(t, has)
+}
+
+func TestFsStoreConformance(t *testing.T) {
+	storetest.TestLocalStore(t, func(path string) (fs.LocalStore, os.Error) {
+		return fs.NewLocalStore(path, fs.NewMemRepo())
+	})
+}
+
+func TestFsVirtualStoreConformance(t *testing.T) {
+	storetest.TestBlockStore(t, func(path string) (fs.BlockStore, os.Error) {
+		return fs.NewVirtualStore(fs.DirFS(path), fs.NewMemRepo())
+	})
+}
+
+func TestMemRepoConformance(t *testing.T) {
+	repotest.TestNodeRepo(t, func() (fs.NodeRepo, os.Error) {
+		return fs.NewMemRepo(), nil
+	})
+}
+
+// A store whose reads of content write their first byte and then hang,
+// as on a hung mount, until released.
+type hungStore struct {
+	fs.BlockStore
+	release chan bool
+}
+
+func (hung *hungStore) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	buf := &bytes.Buffer{}
+	if _, err := hung.BlockStore.ReadInto(strong, from, length, buf); err != nil {
+		return 0, err
+	}
+	n, err := writer.Write(buf.Bytes()[:1])
+	if err != nil {
+		return int64(n), err
+	}
+	<-hung.release
+	m, err := writer.Write(buf.Bytes()[1:])
+	return int64(n + m), err
+}
+
+func TestFsTimeoutStore(t *testing.T) {
+	tg := treegen.New()
+	path := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(path)
+
+	store, err := fs.NewLocalStore(path, fs.NewMemRepo())
+	assert.Tf(t, err == nil, "%v", err)
+	node, has := fs.Lookup(store.Repo().Root().(fs.Dir), filepath.Join("foo", "bar"))
+	assert.T(t, has)
+	file := node.(fs.File)
+
+	// Reads which keep up are passed through
+	ts := fs.NewTimeoutStore(store, &fs.Timeouts{Stall: 5e9})
+	buf := &bytes.Buffer{}
+	n, err := ts.ReadInto(file.Info().Strong, 0, file.Info().Size, buf)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, file.Info().Size, n)
+	block, err := ts.ReadBlock(file.Blocks()[0].Info().Strong)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, fs.BLOCKSIZE, len(block))
+
+	// Stalled reads time out, and write nothing more
+	hung := &hungStore{BlockStore: store, release: make(chan bool)}
+	ts = fs.NewTimeoutStore(hung, &fs.Timeouts{Stall: 50e6})
+	buf = &bytes.Buffer{}
+	n, err = ts.ReadInto(file.Info().Strong, 0, file.Info().Size, buf)
+	timeout, is := err.(*fs.ErrTimeout)
+	assert.Tf(t, is, "%v", err)
+	assert.Equal(t, "ReadInto", timeout.Op)
+	assert.T(t, fs.IsTimeout(err))
+	assert.Equal(t, int64(1), n)
+	close(hung.release)
+	assert.Equal(t, 1, buf.Len())
+
+	// As do reads past the deadline
+	hung.release = make(chan bool)
+	defer close(hung.release)
+	ts = fs.NewTimeoutStore(hung, &fs.Timeouts{Deadline: time.Nanoseconds() + 50e6})
+	_, err = ts.ReadInto(file.Info().Strong, 0, file.Info().Size, &bytes.Buffer{})
+	assert.Tf(t, fs.IsTimeout(err), "%v", err)
+	assert.T(t, !fs.IsTimeout(os.NewError("not a timeout")))
+}
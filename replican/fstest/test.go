@@ -1,6 +1,7 @@
 package fstest
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -275,3 +276,159 @@ func DoTestParentRefs(t *testing.T, repo fs.NodeRepo) {
 
 	assert.Equal(t, 1, rootCount)
 }
+
+func DoTestConflictDir(t *testing.T, repo fs.NodeRepo) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo", tg.F("bar", tg.B(42, 65537)))
+
+	path := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(path)
+
+	store, err := fs.NewLocalStore(path, repo)
+	assert.T(t, err == nil)
+
+	assert.T(t, store.SetConflictDir("conflicts") == nil)
+	assert.Equal(t, "conflicts", store.ConflictDir())
+
+	// Nothing outside the root will do
+	assert.T(t, store.SetConflictDir(filepath.Join("..", "conflicts")) != nil)
+	assert.T(t, store.SetConflictDir(filepath.Join(path, "conflicts")) != nil)
+	assert.Equal(t, "conflicts", store.ConflictDir())
+
+	// Relocated bar keeps its relative path under the conflict dir
+	barPath := filepath.Join(path, "foo", "bar")
+	newBar, err := store.Relocate(barPath)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, filepath.Join(path, "conflicts", "foo", "bar"), newBar)
+
+	_, err = os.Stat(barPath)
+	assert.T(t, err != nil)
+	_, err = os.Stat(newBar)
+	assert.T(t, err == nil)
+
+	// A second conflict at the same path does not clobber the first
+	err = treegen.Fab(filepath.Join(path, "foo"), tg.F("bar", tg.B(43, 100)))
+	assert.Tf(t, err == nil, "%v", err)
+
+	newBar2, err := store.Relocate(barPath)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, filepath.Join(path, "conflicts", "foo", "bar.1"), newBar2)
+}
+
+func DoTestReadBlock(t *testing.T, repo fs.NodeRepo) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo", tg.F("bar", tg.B(42, 65537)))
+
+	path := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(path)
+
+	store, err := fs.NewLocalStore(path, repo)
+	assert.T(t, err == nil)
+
+	var provider fs.BlockProvider = store
+
+	node, has := fs.Lookup(store.Repo().Root().(fs.Dir), filepath.Join("foo", "bar"))
+	assert.T(t, has)
+	blocks := node.(fs.File).Blocks()
+	assert.Equal(t, 9, len(blocks))
+
+	for _, block := range blocks {
+		buf, err := provider.ReadBlock(block.Info().Strong)
+		assert.Tf(t, err == nil, "%v", err)
+		assert.Equal(t, block.Info().Strong, fs.StrongChecksum(buf))
+	}
+
+	// The last block is short
+	buf, err := provider.ReadBlock(blocks[8].Info().Strong)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, 65537-8*fs.BLOCKSIZE, len(buf))
+}
+
+func DoTestBlockIndex(t *testing.T, repo fs.NodeRepo) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.D("baz", tg.F("qux", tg.B(7, 100))))
+
+	path := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(path)
+
+	store, err := fs.NewLocalStore(path, repo)
+	assert.T(t, err == nil)
+
+	indexF, err := ioutil.TempFile("", "blockindex")
+	assert.T(t, err == nil)
+	defer os.Remove(indexF.Name())
+
+	err = fs.WriteBlockIndex(indexF, store.Repo().Root())
+	indexF.Close()
+	assert.Tf(t, err == nil, "%v", err)
+
+	index, err := fs.OpenBlockIndex(indexF.Name())
+	assert.Tf(t, err == nil, "%v", err)
+	defer index.Close()
+	assert.Equal(t, 10, index.Len())
+
+	node, has := fs.Lookup(store.Repo().Root().(fs.Dir), filepath.Join("foo", "bar"))
+	assert.T(t, has)
+	file := node.(fs.File)
+
+	for _, block := range file.Blocks() {
+		indexed, has := index.Block(block.Info().Strong)
+		assert.T(t, has)
+		assert.Equal(t, block.Info().Position, indexed.Position)
+		assert.Equal(t, block.Info().Weak, indexed.Weak)
+		assert.Equal(t, filepath.Join("foo", "bar"), indexed.Path)
+		assert.Equal(t, file.Info().Strong, indexed.FileStrong)
+		assert.Equal(t, file.Info().Size, indexed.FileSize)
+
+		weakBlocks := index.WeakBlocks(block.Info().Weak)
+		assert.T(t, len(weakBlocks) > 0)
+		assert.Equal(t, block.Info().Weak, weakBlocks[0].Weak)
+	}
+
+	_, has = index.Block(fs.StrongChecksum([]byte("nosuchblock")))
+	assert.T(t, !has)
+}
+
+func DoTestStrongMeta(t *testing.T, repo fs.NodeRepo) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.D("baz", tg.F("qux", tg.B(7, 100))))
+
+	path := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(path)
+
+	modeRepo, is := repo.(fs.StrongModeRepo)
+	assert.T(t, is)
+	assert.Equal(t, fs.STRONG_CONTENT, modeRepo.StrongMode())
+	modeRepo.SetStrongMode(fs.STRONG_META)
+
+	content, errors := fs.IndexDir(path, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	meta, errors := fs.IndexDir(path, repo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	// File checksums are the same in either mode; directory checksums are not.
+	assert.T(t, content.Info().Strong != meta.Info().Strong)
+	node, has := fs.Lookup(meta, filepath.Join("foo", "bar"))
+	assert.T(t, has)
+	_, has = repo.File(node.(fs.File).Info().Strong)
+	assert.T(t, has)
+	assert.Equal(t, fs.CalcStrongMode(meta, fs.STRONG_META), meta.Info().Strong)
+
+	// A change of permissions only changes directory checksums in meta mode.
+	os.Chmod(filepath.Join(path, "foo", "baz", "qux"), 0600)
+
+	contentRepo := fs.NewMemRepo()
+	chmodContent, errors := fs.IndexDir(path, contentRepo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, content.Info().Strong, chmodContent.Info().Strong)
+
+	metaRepo := fs.NewMemRepo()
+	metaRepo.SetStrongMode(fs.STRONG_META)
+	chmodMeta, errors := fs.IndexDir(path, metaRepo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.T(t, meta.Info().Strong != chmodMeta.Info().Strong)
+}
@@ -0,0 +1,188 @@
+// Package netsim simulates network conditions for testing and
+// benchmarking: it wraps block providers and stores with latency,
+// bandwidth limits and random failures.
+//
+// Failures are drawn from a seeded source, and delays may be taken on a
+// virtual clock rather than slept, so that runs are deterministic.
+package netsim
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"rand"
+	gosync "sync"
+	"time"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// Network conditions to simulate.
+type Conditions struct {
+	// Delay before each call, in nanoseconds.
+	Latency int64
+
+	// Bytes per second transferred by each call. Zero is unlimited.
+	Bandwidth int64
+
+	// Probability, from 0 to 1, that a call fails.
+	FailureRate float64
+
+	// Seed for drawing failures.
+	Seed int64
+}
+
+// Passes simulated time.
+type Clock interface {
+	Sleep(ns int64)
+}
+
+type realClock struct{}
+
+func (clock realClock) Sleep(ns int64) { time.Sleep(ns) }
+
+// The clock which actually sleeps.
+var RealClock Clock = realClock{}
+
+// A clock which only adds up the time slept.
+type VirtualClock struct {
+	mutex   gosync.Mutex
+	elapsed int64
+}
+
+func (clock *VirtualClock) Sleep(ns int64) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.elapsed += ns
+}
+
+// Get the total time slept, in nanoseconds.
+func (clock *VirtualClock) Elapsed() int64 {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.elapsed
+}
+
+// A failure injected by a simulated network.
+type ErrInjected struct {
+	Call int
+}
+
+func (err *ErrInjected) String() string {
+	return fmt.Sprintf("Simulated network failure on call %d", err.Call)
+}
+
+// A block provider reached over a simulated network.
+type Provider struct {
+	provider   fs.BlockProvider
+	conditions Conditions
+	clock      Clock
+
+	mutex    gosync.Mutex
+	rand     *rand.Rand
+	calls    int
+	failures int
+	bytes    int64
+}
+
+// Wrap a block provider in simulated network conditions, passing time
+// on clock, or the real clock if nil.
+func NewProvider(provider fs.BlockProvider, conditions *Conditions, clock Clock) *Provider {
+	if clock == nil {
+		clock = RealClock
+	}
+	return &Provider{
+		provider:   provider,
+		conditions: *conditions,
+		clock:      clock,
+		rand:       rand.New(rand.NewSource(conditions.Seed))}
+}
+
+// Get the number of calls made, the number failed,
+// and the number of bytes transferred.
+func (sim *Provider) Stats() (calls int, failures int, bytes int64) {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	return sim.calls, sim.failures, sim.bytes
+}
+
+// Start a call, waiting out the latency, and failing it if drawn.
+func (sim *Provider) call() os.Error {
+	sim.mutex.Lock()
+	sim.calls++
+	call := sim.calls
+	failed := sim.rand.Float64() < sim.conditions.FailureRate
+	if failed {
+		sim.failures++
+	}
+	sim.mutex.Unlock()
+
+	sim.clock.Sleep(sim.conditions.Latency)
+	if failed {
+		return &ErrInjected{Call: call}
+	}
+	return nil
+}
+
+// Pass the data of a call through the simulated link.
+func (sim *Provider) transfer(buf *bytes.Buffer, writer io.Writer) (int64, os.Error) {
+	n := int64(buf.Len())
+	if sim.conditions.Bandwidth > 0 {
+		sim.clock.Sleep(n * 1e9 / sim.conditions.Bandwidth)
+	}
+
+	sim.mutex.Lock()
+	sim.bytes += n
+	sim.mutex.Unlock()
+
+	return io.Copy(writer, buf)
+}
+
+func (sim *Provider) ReadBlock(strong string) ([]byte, os.Error) {
+	buf := &bytes.Buffer{}
+	if _, err := sim.ReadBlockInto(strong, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (sim *Provider) ReadBlockInto(strong string, writer io.Writer) (int64, os.Error) {
+	if err := sim.call(); err != nil {
+		return 0, err
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := sim.provider.ReadBlockInto(strong, buf); err != nil {
+		return 0, err
+	}
+	return sim.transfer(buf, writer)
+}
+
+func (sim *Provider) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	if err := sim.call(); err != nil {
+		return 0, err
+	}
+
+	buf := &bytes.Buffer{}
+	_, err := sim.provider.ReadInto(strong, from, length, buf)
+	n, copyErr := sim.transfer(buf, writer)
+	if err == nil {
+		err = copyErr
+	}
+	return n, err
+}
+
+// A block store reached over a simulated network. Its tree model is
+// taken to be known already, so only reads of content are simulated.
+type Store struct {
+	*Provider
+	store fs.BlockStore
+}
+
+// Wrap a block store in simulated network conditions. See NewProvider.
+func NewStore(store fs.BlockStore, conditions *Conditions, clock Clock) *Store {
+	return &Store{Provider: NewProvider(store, conditions, clock), store: store}
+}
+
+func (sim *Store) Repo() fs.NodeRepo { return sim.store.Repo() }
@@ -0,0 +1,79 @@
+package netsim
+
+import (
+	"os"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/sync"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func mkStores(t *testing.T) (string, string, fs.LocalStore, fs.LocalStore) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.F("baz", tg.B(43, 100))))
+	dstpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(44, 65537))))
+
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	return srcpath, dstpath, srcStore, dstStore
+}
+
+func TestLatencyBandwidth(t *testing.T) {
+	srcpath, dstpath, srcStore, dstStore := mkStores(t)
+	defer os.RemoveAll(srcpath)
+	defer os.RemoveAll(dstpath)
+
+	clock := &VirtualClock{}
+	sim := NewStore(srcStore, &Conditions{Latency: 1e6, Bandwidth: 1e6}, clock)
+
+	failedCmd, err := sync.NewPatchPlan(sim, dstStore).Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	calls, failures, bytes := sim.Stats()
+	assert.T(t, calls > 0)
+	assert.Equal(t, 0, failures)
+	assert.Equal(t, int64(calls)*1e6+bytes*1e3, clock.Elapsed())
+
+	dstDir, errors := fs.IndexDir(dstpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, srcStore.Repo().Root().(fs.Dir).Info().Strong, dstDir.Info().Strong)
+}
+
+func TestFailures(t *testing.T) {
+	srcpath, dstpath, srcStore, _ := mkStores(t)
+	defer os.RemoveAll(srcpath)
+	defer os.RemoveAll(dstpath)
+
+	// Failures are the same for the same seed.
+	outcomes := func(seed int64) []bool {
+		sim := NewStore(srcStore, &Conditions{FailureRate: 0.5, Seed: seed}, &VirtualClock{})
+		strong := srcStore.Repo().Root().(fs.Dir).SubDirs()[0].Files()[0].Info().Strong
+		result := []bool{}
+		for i := 0; i < 20; i++ {
+			_, err := sim.ReadInto(strong, 0, 100, &nullWriter{})
+			if err != nil {
+				_, is := err.(*ErrInjected)
+				assert.Tf(t, is, "%v", err)
+			}
+			result = append(result, err == nil)
+		}
+		return result
+	}
+	assert.Equal(t, outcomes(7), outcomes(7))
+
+	sim := NewStore(srcStore, &Conditions{FailureRate: 1}, &VirtualClock{})
+	_, err := sim.ReadBlock(srcStore.Repo().Root().(fs.Dir).SubDirs()[0].Files()[0].Blocks()[0].Info().Strong)
+	_, is := err.(*ErrInjected)
+	assert.Tf(t, is, "%v", err)
+}
+
+type nullWriter struct{}
+
+func (w *nullWriter) Write(buf []byte) (int, os.Error) { return len(buf), nil }
@@ -0,0 +1,119 @@
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// A BlockProvider which keeps a local copy of each block fetched
+// from an origin provider, and serves repeat requests from that copy.
+//
+// Serving a CachingProvider lets one host on a LAN fetch content from
+// a distant origin once, on behalf of many local clients.
+type CachingProvider struct {
+	Origin fs.BlockProvider
+
+	// Directory in which cached blocks are kept, named by strong checksum.
+	Dir string
+}
+
+func NewCachingProvider(origin fs.BlockProvider, dir string) (*CachingProvider, os.Error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &CachingProvider{Origin: origin, Dir: dir}, nil
+}
+
+// Create an HTTP handler which proxies the server at originUrl, caching blocks in dir.
+func NewProxy(originUrl string, dir string) (*Server, os.Error) {
+	cache, err := NewCachingProvider(NewClient(originUrl), dir)
+	if err != nil {
+		return nil, err
+	}
+	return NewServer(cache), nil
+}
+
+func (cache *CachingProvider) blockPath(strong string) string {
+	return blockPath(cache.Dir, strong)
+}
+
+// Get the path of a block kept in dir, fanned out by the first two
+// characters of its strong checksum.
+func blockPath(dir string, strong string) string {
+	if len(strong) < 2 {
+		return filepath.Join(dir, strong)
+	}
+	return filepath.Join(dir, strong[:2], strong)
+}
+
+func (cache *CachingProvider) ReadBlock(strong string) ([]byte, os.Error) {
+	buf := &bytes.Buffer{}
+	if _, err := cache.ReadBlockInto(strong, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Strong checksums come from requests, so any which is not hex, and so
+// could name a file outside the cache, is refused.
+func (cache *CachingProvider) ReadBlockInto(strong string, writer io.Writer) (int64, os.Error) {
+	if !isStrong(strong) {
+		return 0, os.NewError(fmt.Sprintf("Invalid strong checksum %q", strong))
+	}
+	path := cache.blockPath(strong)
+
+	if f, err := os.Open(path); err == nil {
+		defer f.Close()
+		return io.Copy(writer, f)
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := cache.Origin.ReadBlockInto(strong, buf); err != nil {
+		return 0, err
+	}
+
+	// Don't let a bad origin poison the cache
+	if fs.StrongChecksum(buf.Bytes()) != strong {
+		return 0, os.NewError(fmt.Sprintf("Block %s from origin failed verification", strong))
+	}
+
+	if err := storeBlock(path, buf.Bytes()); err != nil {
+		return 0, err
+	}
+
+	return io.Copy(writer, buf)
+}
+
+// Store a block at path. The block is written under a temporary name
+// and renamed into place, so that readers never see a partial block.
+func storeBlock(path string, data []byte) os.Error {
+	dir, _ := filepath.Split(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tempF, err := ioutil.TempFile(dir, "block")
+	if err != nil {
+		return err
+	}
+
+	_, err = tempF.Write(data)
+	tempF.Close()
+	if err != nil {
+		os.Remove(tempF.Name())
+		return err
+	}
+
+	return os.Rename(tempF.Name(), path)
+}
+
+// Ranges of files are not content-addressed, so they are passed through to the origin.
+func (cache *CachingProvider) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	return cache.Origin.ReadInto(strong, from, length, writer)
+}
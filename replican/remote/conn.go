@@ -0,0 +1,170 @@
+package remote
+
+import (
+	"fmt"
+	"http"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// How a Client connects to its server, and recovers when a connection
+// fails. Times are in nanoseconds; zero is no limit.
+type ConnOptions struct {
+	// Limit on establishing a connection.
+	ConnectTimeout int64
+
+	// Limits on each read and write on a connection, so that a stalled
+	// connection is noticed, however long the transfer as a whole.
+	ReadTimeout  int64
+	WriteTimeout int64
+
+	// Have the operating system probe idle connections, so that a
+	// server which has gone away is noticed.
+	KeepAlive bool
+
+	// Times a request failed by the network is made again, on a new
+	// connection, and the delay before each. The agreement made by Hello
+	// is kept, and a range of a file is resumed from where it failed.
+	Retries    int
+	RetryDelay int64
+
+	// Carry all requests to a server as streams over one connection,
+	// rather than a connection each, so that concurrent block reads
+	// neither open many sockets nor wait on each other. The server must
+	// be serving with a MuxListener. The timeouts and keep-alive apply
+	// to the shared connection.
+	Multiplex bool
+}
+
+// An HTTP error status from the server. These are never retried.
+type ErrStatus struct {
+	URL    string
+	Status string
+}
+
+func (err *ErrStatus) String() string {
+	return fmt.Sprintf("%s: %s", err.URL, err.Status)
+}
+
+// A connection which could not be established in time.
+type ErrConnectTimeout struct {
+	Addr string
+}
+
+func (err *ErrConnectTimeout) String() string {
+	return fmt.Sprintf("Timed out connecting to %s", err.Addr)
+}
+
+// Tells fs.IsTimeout that the error is a timeout.
+func (err *ErrConnectTimeout) Timeout() bool { return true }
+
+// Make an HTTP client whose connections are made with the options.
+func (opts *ConnOptions) httpClient() *http.Client {
+	dial := opts.dial
+	if opts.Multiplex {
+		dial = (&muxDialer{opts: opts, sessions: make(map[string]*MuxSession)}).dial
+	}
+	return &http.Client{Transport: &http.Transport{Dial: dial}}
+}
+
+// Opens streams over a session per server address, dialing the session
+// again once it has failed.
+type muxDialer struct {
+	opts     *ConnOptions
+	mutex    sync.Mutex
+	sessions map[string]*MuxSession
+}
+
+func (md *muxDialer) dial(network string, addr string) (net.Conn, os.Error) {
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+
+	key := network + " " + addr
+	session, has := md.sessions[key]
+	if !has || session.Err() != nil {
+		conn, err := md.opts.dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		session = NewMuxSession(conn, true)
+		md.sessions[key] = session
+	}
+
+	stream, err := session.Open()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (opts *ConnOptions) dial(network string, addr string) (net.Conn, os.Error) {
+	type dialed struct {
+		conn net.Conn
+		err  os.Error
+	}
+
+	result := make(chan dialed, 1)
+	go func() {
+		conn, err := net.Dial(network, addr)
+		result <- dialed{conn: conn, err: err}
+	}()
+
+	var timeout <-chan int64
+	if opts.ConnectTimeout > 0 {
+		timeout = time.After(opts.ConnectTimeout)
+	}
+
+	select {
+	case d := <-result:
+		if d.err != nil {
+			return nil, d.err
+		}
+		return opts.setup(d.conn)
+	case <-timeout:
+		// Close the connection if it is made after all.
+		go func() {
+			if d := <-result; d.conn != nil {
+				d.conn.Close()
+			}
+		}()
+	}
+	return nil, &ErrConnectTimeout{Addr: addr}
+}
+
+func (opts *ConnOptions) setup(conn net.Conn) (net.Conn, os.Error) {
+	if tcpConn, is := conn.(*net.TCPConn); is && opts.KeepAlive {
+		if err := tcpConn.SetKeepAlive(true); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if err := conn.SetReadTimeout(opts.ReadTimeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.SetWriteTimeout(opts.WriteTimeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Test whether a request which failed with err, on the given attempt
+// counting from zero, is to be made again. Waits out the retry delay if so.
+func (client *Client) retry(attempt int, err os.Error) bool {
+	if client.Conn == nil || attempt >= client.Conn.Retries {
+		return false
+	}
+
+	switch err.(type) {
+	case *ErrStatus, *ErrIncompatible:
+		return false
+	}
+
+	if client.Conn.RetryDelay > 0 {
+		time.Sleep(client.Conn.RetryDelay)
+	}
+	return true
+}
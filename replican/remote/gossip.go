@@ -0,0 +1,186 @@
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"http"
+	"json"
+	"os"
+	"rand"
+	"sync"
+	"time"
+)
+
+// A peer's statement of the state of its store.
+type Announcement struct {
+	// URL at which the peer's gossip can be reached.
+	Peer string
+
+	// Strong checksum of the peer's root directory.
+	Root string
+
+	// Time the peer last indexed its store, in nanoseconds.
+	Checkpoint int64
+}
+
+// Lightweight gossip of root checksums among a set of peers.
+//
+// Each round, a peer exchanges announcements with one other peer chosen at
+// random, and learns of the state of every peer it has heard about.
+// Whenever an announcement is received with a different root than our own,
+// OnDiverge is called, which may schedule a sync or raise an alert.
+//
+// Gossip is an http.Handler, to be served at the URL given in Self.
+type Gossip struct {
+	Self  string
+	Peers []string
+
+	// Called when a peer's root differs from our own.
+	OnDiverge func(ann *Announcement)
+
+	mutex sync.Mutex
+	self  *Announcement
+	known map[string]*Announcement
+}
+
+func NewGossip(self string, peers []string) *Gossip {
+	return &Gossip{
+		Self:  self,
+		Peers: peers,
+		self:  &Announcement{Peer: self},
+		known: make(map[string]*Announcement)}
+}
+
+// Update the state we announce, after indexing the local store.
+func (gossip *Gossip) SetRoot(root string) {
+	gossip.mutex.Lock()
+	defer gossip.mutex.Unlock()
+
+	gossip.self = &Announcement{
+		Peer:       gossip.Self,
+		Root:       root,
+		Checkpoint: time.Nanoseconds()}
+}
+
+// Get the most recent announcement heard from each peer.
+func (gossip *Gossip) Known() []*Announcement {
+	gossip.mutex.Lock()
+	defer gossip.mutex.Unlock()
+
+	result := make([]*Announcement, 0, len(gossip.known))
+	for _, ann := range gossip.known {
+		result = append(result, ann)
+	}
+	return result
+}
+
+func (gossip *Gossip) announcements() []*Announcement {
+	gossip.mutex.Lock()
+	defer gossip.mutex.Unlock()
+
+	result := []*Announcement{gossip.self}
+	for _, ann := range gossip.known {
+		result = append(result, ann)
+	}
+	return result
+}
+
+// Record announcements, keeping only the latest from each peer.
+func (gossip *Gossip) hear(anns []*Announcement) {
+	diverged := []*Announcement{}
+
+	gossip.mutex.Lock()
+	for _, ann := range anns {
+		if ann.Peer == gossip.Self {
+			continue
+		}
+
+		if prev, has := gossip.known[ann.Peer]; has && prev.Checkpoint >= ann.Checkpoint {
+			continue
+		}
+
+		gossip.known[ann.Peer] = ann
+		if ann.Root != gossip.self.Root {
+			diverged = append(diverged, ann)
+		}
+	}
+	gossip.mutex.Unlock()
+
+	if gossip.OnDiverge != nil {
+		for _, ann := range diverged {
+			gossip.OnDiverge(ann)
+		}
+	}
+}
+
+// Exchange announcements with a randomly chosen peer.
+func (gossip *Gossip) Round() os.Error {
+	if len(gossip.Peers) == 0 {
+		return nil
+	}
+	return gossip.Exchange(gossip.Peers[rand.Intn(len(gossip.Peers))])
+}
+
+// Exchange announcements with the given peer.
+func (gossip *Gossip) Exchange(peer string) os.Error {
+	body, err := json.Marshal(gossip.announcements())
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(peer, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return os.NewError(fmt.Sprintf("%s: %s", peer, resp.Status))
+	}
+
+	var anns []*Announcement
+	if err = json.NewDecoder(resp.Body).Decode(&anns); err != nil {
+		return err
+	}
+
+	gossip.hear(anns)
+	return nil
+}
+
+// Run a round of gossip every interval nanoseconds, until stopped.
+// Errors are sent to the errors channel if not nil.
+func (gossip *Gossip) Run(interval int64, stop <-chan bool, errors chan<- os.Error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := gossip.Round(); err != nil && errors != nil {
+				errors <- err
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (gossip *Gossip) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(gossip.announcements())
+	if err != nil {
+		http.Error(w, err.String(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == "POST" {
+		var anns []*Announcement
+		if err := json.NewDecoder(r.Body).Decode(&anns); err != nil {
+			http.Error(w, err.String(), http.StatusBadRequest)
+			return
+		}
+		gossip.hear(anns)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
@@ -0,0 +1,47 @@
+package remote
+
+import (
+	"http/httptest"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestGossipDiverge(t *testing.T) {
+	alice := NewGossip("", nil)
+	aliceServer := httptest.NewServer(alice)
+	defer aliceServer.Close()
+	alice.Self = aliceServer.URL
+	alice.SetRoot("aaaa")
+
+	bob := NewGossip("", nil)
+	bobServer := httptest.NewServer(bob)
+	defer bobServer.Close()
+	bob.Self = bobServer.URL
+	bob.SetRoot("bbbb")
+
+	alice.Peers = []string{bob.Self}
+
+	aliceHeard := []*Announcement{}
+	alice.OnDiverge = func(ann *Announcement) { aliceHeard = append(aliceHeard, ann) }
+	bobHeard := []*Announcement{}
+	bob.OnDiverge = func(ann *Announcement) { bobHeard = append(bobHeard, ann) }
+
+	err := alice.Round()
+	assert.Tf(t, err == nil, "%v", err)
+
+	assert.Equal(t, 1, len(aliceHeard))
+	assert.Equal(t, "bbbb", aliceHeard[0].Root)
+	assert.Equal(t, bob.Self, aliceHeard[0].Peer)
+
+	assert.Equal(t, 1, len(bobHeard))
+	assert.Equal(t, "aaaa", bobHeard[0].Root)
+
+	// Once in agreement, no divergence is reported
+	bob.SetRoot("aaaa")
+	aliceHeard = []*Announcement{}
+	err = alice.Round()
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, 0, len(aliceHeard))
+	assert.Equal(t, 1, len(alice.Known()))
+}
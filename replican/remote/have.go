@@ -0,0 +1,131 @@
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"http"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// A client asks which of a batch of blocks a server already has by posting
+// their strong checksums, one per line, to /have. The server answers with
+// those it has, one per line, so that pushes send only missing blocks, as
+// pulls reuse content already in the destination. Servers whose provider
+// cannot tell answer 404 Not Found.
+const HAVE_PATH string = "/have"
+
+// Providers which can tell whether they hold a block without reading it.
+type BlockHaver interface {
+	HaveBlock(strong string) bool
+}
+
+// Test whether a provider holds a block, if it can tell.
+func haveBlock(provider fs.BlockProvider, strong string) (has bool, known bool) {
+	switch p := provider.(type) {
+	case BlockHaver:
+		return p.HaveBlock(strong), true
+	case fs.BlockStore:
+		_, has = p.Repo().Block(strong)
+		return has, true
+	}
+	return false, false
+}
+
+// Answer a /have query from a provider.
+func serveHave(w http.ResponseWriter, r *http.Request, provider fs.BlockProvider) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, known := haveBlock(provider, ""); !known {
+		http.NotFound(w, r)
+		return
+	}
+
+	strongs, err := readLines(r.Body)
+	if err != nil {
+		http.Error(w, err.String(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	for _, strong := range strongs {
+		if has, _ := haveBlock(provider, strong); has {
+			fmt.Fprintf(w, "%s\n", strong)
+		}
+	}
+}
+
+func (server *Server) serveHave(w http.ResponseWriter, r *http.Request) {
+	serveHave(w, r, server.Provider)
+}
+
+// Ask the server which of the given blocks it has.
+func (client *Client) HaveBlocks(strongs []string) (map[string]bool, os.Error) {
+	body := &bytes.Buffer{}
+	for _, strong := range strongs {
+		fmt.Fprintf(body, "%s\n", strong)
+	}
+
+	for attempt := 0; ; attempt++ {
+		had, err := client.haveBlocks(body.Bytes())
+		if err == nil || !client.retry(attempt, err) {
+			return had, err
+		}
+	}
+
+	panic("Impossible")
+}
+
+func (client *Client) haveBlocks(body []byte) (map[string]bool, os.Error) {
+	req, err := http.NewRequest("POST", client.URL+HAVE_PATH, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.ContentLength = int64(len(body))
+
+	resp, err := client.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &ErrStatus{URL: client.URL + HAVE_PATH, Status: resp.Status}
+	}
+
+	lines, err := readLines(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	had := make(map[string]bool)
+	for _, strong := range lines {
+		had[strong] = true
+	}
+	return had, nil
+}
+
+func readLines(r io.Reader) ([]string, os.Error) {
+	lines := []string{}
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+		if err == os.EOF {
+			return lines, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	panic("Impossible")
+}
@@ -0,0 +1,229 @@
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"http"
+	"io/ioutil"
+	"json"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// Version of the protocol spoken by this release, and the oldest version
+// it can still speak.
+const (
+	PROTOCOL_VERSION     = 1
+	MIN_PROTOCOL_VERSION = 1
+)
+
+// Before reading from a Server, a Client posts the Capabilities it supports
+// as JSON to /hello. The server answers with the Capabilities both will use,
+// or with 409 Conflict and the reason there are none.
+const HELLO_PATH string = "/hello"
+
+// Strong checksum algorithms.
+const HASH_SHA1 = "sha1"
+
+// Codecs block data can be sent in. Requests name the codec they want the
+// response in with CODEC_HEADER; without it, data is sent as it is.
+const (
+	CODEC_IDENTITY = "identity"
+	CODEC_GZIP     = "gzip"
+)
+
+const CODEC_HEADER = "X-Replican-Codec"
+
+// What one end of a connection supports, or once negotiated, what both
+// ends have agreed to use. Lists are in order of preference.
+type Capabilities struct {
+	// Newest and oldest protocol versions spoken.
+	Version    int
+	MinVersion int
+
+	Hashes    []string
+	BlockSize int
+	Codecs    []string
+}
+
+// Get the capabilities of this release.
+func LocalCapabilities() *Capabilities {
+	return &Capabilities{
+		Version:    PROTOCOL_VERSION,
+		MinVersion: MIN_PROTOCOL_VERSION,
+		Hashes:     []string{HASH_SHA1},
+		BlockSize:  fs.BLOCKSIZE,
+		Codecs:     []string{CODEC_IDENTITY, CODEC_GZIP}}
+}
+
+// Peers which cannot agree on how to exchange blocks.
+type ErrIncompatible struct {
+	Reason string
+}
+
+func (err *ErrIncompatible) String() string {
+	return fmt.Sprintf("Incompatible peer: %s", err.Reason)
+}
+
+// Agree on the capabilities to use between those offered by one end and
+// those supported by the other: the newest version both speak, and the
+// first hash and codec in the offer which are supported. Block sizes must
+// be the same, as checksums calculated over different blocks never match.
+func Negotiate(offer *Capabilities, supported *Capabilities) (*Capabilities, os.Error) {
+	version := offer.Version
+	if supported.Version < version {
+		version = supported.Version
+	}
+	if version < offer.MinVersion || version < supported.MinVersion {
+		return nil, &ErrIncompatible{Reason: fmt.Sprintf(
+			"no common protocol version: offered %d to %d, supported %d to %d",
+			offer.MinVersion, offer.Version, supported.MinVersion, supported.Version)}
+	}
+
+	if offer.BlockSize != supported.BlockSize {
+		return nil, &ErrIncompatible{Reason: fmt.Sprintf(
+			"block size %d offered, %d supported", offer.BlockSize, supported.BlockSize)}
+	}
+
+	hash, has := firstCommon(offer.Hashes, supported.Hashes)
+	if !has {
+		return nil, &ErrIncompatible{Reason: fmt.Sprintf(
+			"no common hash: offered %v, supported %v", offer.Hashes, supported.Hashes)}
+	}
+
+	codec, has := firstCommon(offer.Codecs, supported.Codecs)
+	if !has {
+		return nil, &ErrIncompatible{Reason: fmt.Sprintf(
+			"no common codec: offered %v, supported %v", offer.Codecs, supported.Codecs)}
+	}
+
+	return &Capabilities{
+		Version:    version,
+		MinVersion: version,
+		Hashes:     []string{hash},
+		BlockSize:  offer.BlockSize,
+		Codecs:     []string{codec}}, nil
+}
+
+func firstCommon(offered []string, supported []string) (string, bool) {
+	for _, o := range offered {
+		for _, s := range supported {
+			if o == s {
+				return o, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (server *Server) capabilities() *Capabilities {
+	if server.Capabilities != nil {
+		return server.Capabilities
+	}
+	capabilities := LocalCapabilities()
+	if store, is := server.Provider.(fs.LocalStore); is {
+		capabilities.BlockSize = store.BlockSize()
+	} else if store, is := server.Provider.(fs.BlockStore); is {
+		if sizeRepo, is := store.Repo().(fs.BlockSizeRepo); is && sizeRepo.BlockSize() > 0 {
+			capabilities.BlockSize = sizeRepo.BlockSize()
+		}
+	}
+	return capabilities
+}
+
+func (server *Server) serveHello(w http.ResponseWriter, r *http.Request) {
+	offer := &Capabilities{}
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, offer)
+	}
+	if err != nil {
+		http.Error(w, "invalid capabilities", http.StatusBadRequest)
+		return
+	}
+
+	session, err := Negotiate(offer, server.capabilities())
+	if err != nil {
+		http.Error(w, err.(*ErrIncompatible).Reason, http.StatusConflict)
+		return
+	}
+
+	buf, err := json.Marshal(session)
+	if err != nil {
+		http.Error(w, err.String(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	w.Write(buf)
+}
+
+// Agree with the server on the capabilities to use, if not already agreed.
+// Block data is only read once the server has agreed; a server which
+// answers with no capabilities, or ones this client does not support,
+// is refused with an ErrIncompatible.
+func (client *Client) Hello() (*Capabilities, os.Error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.session != nil {
+		return client.session, nil
+	} else if client.Session != nil {
+		client.session = client.Session
+		return client.session, nil
+	}
+
+	offer := client.Capabilities
+	if offer == nil {
+		offer = LocalCapabilities()
+	}
+	offerBytes, err := json.Marshal(offer)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *http.Response
+	var body []byte
+	for attempt := 0; ; attempt++ {
+		start := time.Nanoseconds()
+		resp, err = client.httpClient().Post(client.URL+HELLO_PATH, "application/json", bytes.NewBuffer(offerBytes))
+		if err == nil {
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		client.record(start, int64(len(offerBytes)), int64(len(body)),
+			err != nil || resp.StatusCode != http.StatusOK)
+		if err == nil || !client.retry(attempt, err) {
+			break
+		}
+	}
+
+	switch {
+	case err != nil:
+		return nil, err
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, &ErrIncompatible{Reason: "server does not negotiate a protocol version"}
+	case resp.StatusCode == http.StatusConflict:
+		return nil, &ErrIncompatible{Reason: string(bytes.TrimSpace(body))}
+	case resp.StatusCode != http.StatusOK:
+		return nil, &ErrStatus{URL: client.URL + HELLO_PATH, Status: resp.Status}
+	}
+
+	answer := &Capabilities{}
+	if err = json.Unmarshal(body, answer); err != nil {
+		return nil, err
+	}
+
+	// The server may only choose from what was offered.
+	session, err := Negotiate(answer, offer)
+	if err != nil {
+		return nil, err
+	}
+
+	client.session = session
+	return session, nil
+}
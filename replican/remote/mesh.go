@@ -0,0 +1,154 @@
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// A BlockProvider which looks up blocks across a mesh of peers.
+//
+// Each block is assigned an order of peers by rendezvous hashing of
+// the peer URL with the block's strong checksum. Peers are asked for the
+// block in that order, falling back to the origin if none have it.
+// When peers serve through a CachingProvider, the peers at the front of
+// a block's order come to hold it, so that a lookup usually succeeds
+// on the first request without any central index.
+type Mesh struct {
+	Peers []*Client
+
+	// Provider of last resort, may be nil.
+	Origin fs.BlockProvider
+
+	// Index of the source, such as the repo of a store opened on the
+	// origin, by which ranges of files are divided into blocks which can
+	// be verified. May be nil, in which case ranges are only read from
+	// the origin.
+	Repo fs.NodeRepo
+}
+
+func NewMesh(peerUrls []string, origin fs.BlockProvider) *Mesh {
+	mesh := &Mesh{Origin: origin}
+	for _, url := range peerUrls {
+		mesh.Peers = append(mesh.Peers, NewClient(url))
+	}
+	return mesh
+}
+
+type rankedPeers struct {
+	peers []*Client
+	ranks []string
+}
+
+func (rp *rankedPeers) Len() int { return len(rp.peers) }
+
+func (rp *rankedPeers) Less(i, j int) bool { return rp.ranks[i] > rp.ranks[j] }
+
+func (rp *rankedPeers) Swap(i, j int) {
+	rp.peers[i], rp.peers[j] = rp.peers[j], rp.peers[i]
+	rp.ranks[i], rp.ranks[j] = rp.ranks[j], rp.ranks[i]
+}
+
+// Get the peers to ask for a block, in the order they should be asked.
+func (mesh *Mesh) Lookup(strong string) []*Client {
+	rp := &rankedPeers{
+		peers: append([]*Client{}, mesh.Peers...),
+		ranks: make([]string, len(mesh.Peers))}
+	for i, peer := range rp.peers {
+		rp.ranks[i] = fs.StrongChecksum([]byte(peer.URL + "\t" + strong))
+	}
+	sort.Sort(rp)
+	return rp.peers
+}
+
+func (mesh *Mesh) ReadBlock(strong string) ([]byte, os.Error) {
+	buf := &bytes.Buffer{}
+	if _, err := mesh.ReadBlockInto(strong, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (mesh *Mesh) ReadBlockInto(strong string, writer io.Writer) (int64, os.Error) {
+	for _, peer := range mesh.Lookup(strong) {
+		buf := &bytes.Buffer{}
+		if _, err := peer.ReadBlockInto(strong, buf); err != nil {
+			continue
+		}
+
+		// Peers are not trusted to serve what was asked for
+		if fs.StrongChecksum(buf.Bytes()) == strong {
+			return io.Copy(writer, buf)
+		}
+		peer.recordCorrupt()
+	}
+
+	if mesh.Origin != nil {
+		return mesh.Origin.ReadBlockInto(strong, writer)
+	}
+
+	return 0, os.NewError(fmt.Sprintf("Block with strong checksum %s not found in mesh", strong))
+}
+
+// Peers are not trusted to serve ranges of files either, and a range
+// cannot be checked whole, so it is assembled from the blocks of the file
+// which it covers, each verified as ReadBlockInto verifies it. Files which
+// Repo does not index are read from the origin alone.
+func (mesh *Mesh) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	if mesh.Repo != nil {
+		if file, has := mesh.Repo.File(strong); has {
+			return readBlocksInto(mesh, file, from, length, writer)
+		}
+	}
+
+	if mesh.Origin != nil {
+		return mesh.Origin.ReadInto(strong, from, length, writer)
+	}
+
+	return 0, os.NewError(fmt.Sprintf("File with strong checksum %s not found in mesh", strong))
+}
+
+// Read a range of a file from the blocks which cover it, each read from
+// a provider which verifies it.
+func readBlocksInto(provider fs.BlockProvider, file fs.File, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	end := from + length
+	var written int64
+	for _, block := range file.Blocks() {
+		info := block.Info()
+		offset := info.Offset()
+		if offset+info.Size() <= from || offset >= end {
+			continue
+		}
+
+		buf, err := provider.ReadBlock(info.Strong)
+		if err != nil {
+			return written, err
+		}
+		lo, hi := from-offset, end-offset
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > int64(len(buf)) {
+			hi = int64(len(buf))
+		}
+		if lo >= hi {
+			continue
+		}
+
+		n, err := writer.Write(buf[lo:hi])
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	if written < length {
+		return written, os.NewError(fmt.Sprintf("%d bytes at offset %d past the end of %s",
+			length, from, file.Info().Strong))
+	}
+	return written, nil
+}
@@ -0,0 +1,76 @@
+package remote
+
+import (
+	"bytes"
+	"http/httptest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestMeshLookup(t *testing.T) {
+	path, store, file := mkOrigin(t)
+	defer os.RemoveAll(path)
+
+	tg := treegen.New()
+	otherPath := treegen.TestTree(t, tg.D("foo", tg.F("baz", tg.B(99, 100))))
+	defer os.RemoveAll(otherPath)
+	otherStore, err := fs.NewLocalStore(otherPath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	hasServer := httptest.NewServer(NewServer(store))
+	defer hasServer.Close()
+	otherServer := httptest.NewServer(NewServer(otherStore))
+	defer otherServer.Close()
+
+	mesh := NewMesh([]string{otherServer.URL, hasServer.URL}, nil)
+
+	// Lookup order is stable for a block
+	strong := file.Blocks()[0].Info().Strong
+	order := mesh.Lookup(strong)
+	assert.Equal(t, 2, len(order))
+	assert.Equal(t, order[0].URL, mesh.Lookup(strong)[0].URL)
+
+	for _, block := range file.Blocks() {
+		buf, err := mesh.ReadBlock(block.Info().Strong)
+		assert.Tf(t, err == nil, "%v", err)
+		assert.Equal(t, block.Info().Strong, fs.StrongChecksum(buf))
+	}
+
+	_, err = mesh.ReadBlock("nosuchblock")
+	assert.T(t, err != nil)
+}
+
+func TestMeshReadInto(t *testing.T) {
+	path, store, file := mkOrigin(t)
+	defer os.RemoveAll(path)
+
+	server := httptest.NewServer(NewServer(store))
+	defer server.Close()
+
+	// Without an index to verify it against, a peer's range is refused
+	strong := file.Info().Strong
+	mesh := NewMesh([]string{server.URL}, nil)
+	_, err := mesh.ReadInto(strong, 0, 10, &bytes.Buffer{})
+	assert.T(t, err != nil)
+
+	// With one, the range is assembled from verified blocks
+	mesh.Repo = store.Repo()
+	content, err := ioutil.ReadFile(filepath.Join(path, "foo", "bar"))
+	assert.T(t, err == nil)
+	from, length := int64(fs.BLOCKSIZE-10), int64(fs.BLOCKSIZE+20)
+	buf := &bytes.Buffer{}
+	n, err := mesh.ReadInto(strong, from, length, buf)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, length, n)
+	assert.Equal(t, content[from:from+length], buf.Bytes())
+
+	_, err = mesh.ReadInto(strong, int64(len(content))-10, 20, &bytes.Buffer{})
+	assert.T(t, err != nil)
+}
@@ -0,0 +1,529 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Many streams can be carried over one connection, as yamux does, so that
+// concurrent requests to a server neither open a socket each nor wait on
+// each other. Each stream is a net.Conn, so HTTP is carried over streams
+// as it would be over connections: serve with a MuxListener, and connect
+// with ConnOptions.Multiplex.
+//
+// On the connection, streams are carried in frames:
+//
+//	type uint8, stream uint32, length uint32, payload [length]byte
+//
+// All integers are big-endian. A stream is opened by its first frame.
+// DATA frames carry payload; WINDOW frames have none, and their length
+// grants the peer that many more bytes of DATA on the stream; FIN ends
+// writes on a stream. Streams opened by the dialing end have odd numbers,
+// those opened by the accepting end even ones, and each stream opened by
+// an end is numbered above the last. An end which sends more DATA than it
+// has been granted, sends DATA after FIN, or opens a stream out of turn
+// has broken the protocol, and the session is ended.
+const (
+	MUX_DATA byte = iota
+	MUX_WINDOW
+	MUX_FIN
+)
+
+const (
+	muxHeaderSize = 9
+
+	// Largest payload in one frame, so that streams take turns on the connection.
+	MUX_MAX_FRAME = 16384
+
+	// Bytes a stream may be sent before its reader has read any,
+	// so that a slow reader holds up only its own stream.
+	MUX_WINDOW_SIZE = 262144
+)
+
+// A connection carrying many streams.
+type MuxSession struct {
+	conn net.Conn
+
+	writeMutex sync.Mutex
+
+	mutex    sync.Mutex
+	streams  map[uint32]*MuxStream
+	client   bool
+	nextId   uint32
+	peerId   uint32
+	accepted chan *MuxStream
+	closed   chan bool
+	err      os.Error
+}
+
+// Carry streams over conn. The dialing end of the connection is the
+// client; the accepting end is not.
+func NewMuxSession(conn net.Conn, client bool) *MuxSession {
+	session := &MuxSession{
+		conn:     conn,
+		streams:  make(map[uint32]*MuxStream),
+		client:   client,
+		nextId:   2,
+		accepted: make(chan *MuxStream, 16),
+		closed:   make(chan bool)}
+	if client {
+		session.nextId = 1
+	}
+	go session.readFrames()
+	return session
+}
+
+// Open a new stream to the other end.
+func (session *MuxSession) Open() (*MuxStream, os.Error) {
+	session.mutex.Lock()
+	if session.err != nil {
+		session.mutex.Unlock()
+		return nil, session.err
+	}
+	stream := session.newStream(session.nextId)
+	session.nextId += 2
+	session.mutex.Unlock()
+
+	// An empty frame announces the stream.
+	if err := session.writeFrame(MUX_DATA, stream.id, nil); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Wait for a stream opened by the other end.
+func (session *MuxSession) Accept() (*MuxStream, os.Error) {
+	select {
+	case stream := <-session.accepted:
+		return stream, nil
+	case <-session.closed:
+	}
+	return nil, session.Err()
+}
+
+// Get the error which ended the session, if it has ended.
+func (session *MuxSession) Err() os.Error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.err
+}
+
+// Close the session, and every stream on it.
+func (session *MuxSession) Close() os.Error {
+	err := session.conn.Close()
+	session.fail(os.NewError("Multiplexed session closed"))
+	return err
+}
+
+// Create a stream. Must hold the session mutex.
+func (session *MuxSession) newStream(id uint32) *MuxStream {
+	stream := &MuxStream{session: session, id: id,
+		sendWindow: MUX_WINDOW_SIZE, recvWindow: MUX_WINDOW_SIZE}
+	stream.cond = sync.NewCond(&stream.mutex)
+	session.streams[id] = stream
+	return stream
+}
+
+func (session *MuxSession) writeFrame(frameType byte, id uint32, payload []byte) os.Error {
+	return session.writeHeader(frameType, id, uint32(len(payload)), payload)
+}
+
+func (session *MuxSession) writeHeader(frameType byte, id uint32, length uint32, payload []byte) os.Error {
+	buf := bytes.NewBuffer(make([]byte, 0, muxHeaderSize+len(payload)))
+	buf.WriteByte(frameType)
+	binary.Write(buf, binary.BigEndian, id)
+	binary.Write(buf, binary.BigEndian, length)
+	buf.Write(payload)
+
+	session.writeMutex.Lock()
+	defer session.writeMutex.Unlock()
+	if _, err := buf.WriteTo(session.conn); err != nil {
+		session.fail(err)
+		return err
+	}
+	return nil
+}
+
+func (session *MuxSession) readFrames() {
+	header := make([]byte, muxHeaderSize)
+	for {
+		if _, err := io.ReadFull(session.conn, header); err != nil {
+			session.fail(err)
+			return
+		}
+
+		frameType := header[0]
+		id := binary.BigEndian.Uint32(header[1:5])
+		length := binary.BigEndian.Uint32(header[5:9])
+
+		var payload []byte
+		if frameType == MUX_DATA {
+			if length > MUX_MAX_FRAME {
+				session.fail(os.NewError(fmt.Sprintf("Multiplexed frame too large: %d bytes", length)))
+				return
+			}
+			payload = make([]byte, length)
+			if _, err := io.ReadFull(session.conn, payload); err != nil {
+				session.fail(err)
+				return
+			}
+		}
+
+		session.mutex.Lock()
+		stream, has := session.streams[id]
+		switch {
+		case has:
+			session.mutex.Unlock()
+		case frameType == MUX_DATA:
+			if err := session.opened(id); err != nil {
+				session.mutex.Unlock()
+				session.fail(err)
+				return
+			}
+			stream = session.newStream(id)
+			session.mutex.Unlock()
+			select {
+			case session.accepted <- stream:
+			case <-session.closed:
+				return
+			}
+		default:
+			// Late frames for a stream both ends have closed.
+			session.mutex.Unlock()
+			continue
+		}
+
+		var err os.Error
+		switch frameType {
+		case MUX_DATA:
+			err = stream.received(payload)
+		case MUX_WINDOW:
+			err = stream.granted(length)
+		case MUX_FIN:
+			stream.finished()
+		default:
+			err = os.NewError(fmt.Sprintf("Unknown multiplexed frame type %d", frameType))
+		}
+		if err != nil {
+			session.fail(err)
+			return
+		}
+	}
+}
+
+// Check that the other end may open stream id: that it has the other
+// end's parity, and is numbered above the last stream it opened. Must
+// hold the session mutex.
+func (session *MuxSession) opened(id uint32) os.Error {
+	peerOdd := !session.client
+	if id == 0 || (id%2 == 1) != peerOdd || id <= session.peerId {
+		return os.NewError(fmt.Sprintf("Multiplexed stream %d opened out of turn", id))
+	}
+	session.peerId = id
+	return nil
+}
+
+// End the session with err, waking every stream waiting on it.
+func (session *MuxSession) fail(err os.Error) {
+	session.mutex.Lock()
+	if session.err != nil {
+		session.mutex.Unlock()
+		return
+	}
+	session.err = err
+	streams := session.streams
+	session.streams = make(map[uint32]*MuxStream)
+	close(session.closed)
+	session.mutex.Unlock()
+
+	for _, stream := range streams {
+		stream.mutex.Lock()
+		stream.cond.Broadcast()
+		stream.mutex.Unlock()
+	}
+}
+
+func (session *MuxSession) remove(id uint32) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.streams[id] = nil, false
+}
+
+// A stream within a MuxSession.
+type MuxStream struct {
+	session *MuxSession
+	id      uint32
+
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	readBuf    bytes.Buffer
+	sendWindow uint32
+	recvWindow uint32
+	remoteFin  bool
+	localFin   bool
+
+	// Limits on each Read and Write, in nanoseconds; zero is no limit.
+	readTimeout  int64
+	writeTimeout int64
+}
+
+// A Read or Write on a stream which timed out.
+type ErrStreamTimeout struct {
+	Op string
+	Id uint32
+}
+
+func (err *ErrStreamTimeout) String() string {
+	return fmt.Sprintf("Timed out in %s on multiplexed stream %d", err.Op, err.Id)
+}
+
+// Tells fs.IsTimeout that the error is a timeout.
+func (err *ErrStreamTimeout) Timeout() bool { return true }
+
+func (err *ErrStreamTimeout) Temporary() bool { return true }
+
+func (stream *MuxStream) received(payload []byte) os.Error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.remoteFin {
+		return os.NewError(fmt.Sprintf(
+			"Multiplexed stream %d sent data after ending", stream.id))
+	}
+	if uint32(len(payload)) > stream.recvWindow {
+		return os.NewError(fmt.Sprintf(
+			"Multiplexed stream %d sent %d bytes with a window of %d",
+			stream.id, len(payload), stream.recvWindow))
+	}
+	stream.recvWindow -= uint32(len(payload))
+	stream.readBuf.Write(payload)
+	stream.cond.Broadcast()
+	return nil
+}
+
+func (stream *MuxStream) granted(length uint32) os.Error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.sendWindow+length < stream.sendWindow {
+		return os.NewError(fmt.Sprintf(
+			"Multiplexed stream %d granted a window beyond %d bytes", stream.id, ^uint32(0)))
+	}
+	stream.sendWindow += length
+	stream.cond.Broadcast()
+	return nil
+}
+
+func (stream *MuxStream) finished() {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.remoteFin = true
+	if stream.localFin {
+		stream.session.remove(stream.id)
+	}
+	stream.cond.Broadcast()
+}
+
+// Get the time by which an operation limited to timeout must finish,
+// or zero if it is not limited.
+func deadline(timeout int64) int64 {
+	if timeout <= 0 {
+		return 0
+	}
+	return time.Nanoseconds() + timeout
+}
+
+// Wait to be woken, or for the deadline to pass. Must hold the stream
+// mutex. Returns false if the deadline has already passed.
+func (stream *MuxStream) wait(deadline int64) bool {
+	if deadline == 0 {
+		stream.cond.Wait()
+		return true
+	}
+	remaining := deadline - time.Nanoseconds()
+	if remaining <= 0 {
+		return false
+	}
+	timer := time.AfterFunc(remaining, func() {
+		stream.mutex.Lock()
+		stream.cond.Broadcast()
+		stream.mutex.Unlock()
+	})
+	stream.cond.Wait()
+	timer.Stop()
+	return true
+}
+
+func (stream *MuxStream) Read(buf []byte) (int, os.Error) {
+	stream.mutex.Lock()
+	until := deadline(stream.readTimeout)
+	for stream.readBuf.Len() == 0 && !stream.remoteFin {
+		if err := stream.session.Err(); err != nil {
+			stream.mutex.Unlock()
+			return 0, err
+		}
+		if !stream.wait(until) {
+			stream.mutex.Unlock()
+			return 0, &ErrStreamTimeout{Op: "read", Id: stream.id}
+		}
+	}
+
+	if stream.readBuf.Len() == 0 {
+		stream.mutex.Unlock()
+		return 0, os.EOF
+	}
+	n, _ := stream.readBuf.Read(buf)
+	stream.recvWindow += uint32(n)
+	stream.mutex.Unlock()
+
+	// Let the other end send as much again.
+	if err := stream.session.writeHeader(MUX_WINDOW, stream.id, uint32(n), nil); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func (stream *MuxStream) Write(buf []byte) (int, os.Error) {
+	written := 0
+	stream.mutex.Lock()
+	until := deadline(stream.writeTimeout)
+	stream.mutex.Unlock()
+	for written < len(buf) {
+		stream.mutex.Lock()
+		for stream.sendWindow == 0 && !stream.localFin {
+			if err := stream.session.Err(); err != nil {
+				stream.mutex.Unlock()
+				return written, err
+			}
+			if !stream.wait(until) {
+				stream.mutex.Unlock()
+				return written, &ErrStreamTimeout{Op: "write", Id: stream.id}
+			}
+		}
+		if stream.localFin {
+			stream.mutex.Unlock()
+			return written, os.EINVAL
+		}
+
+		n := len(buf) - written
+		if n > MUX_MAX_FRAME {
+			n = MUX_MAX_FRAME
+		}
+		if uint32(n) > stream.sendWindow {
+			n = int(stream.sendWindow)
+		}
+		stream.sendWindow -= uint32(n)
+		stream.mutex.Unlock()
+
+		if err := stream.session.writeFrame(MUX_DATA, stream.id, buf[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// End writes to the stream. The stream is gone once both ends have closed it.
+func (stream *MuxStream) Close() os.Error {
+	stream.mutex.Lock()
+	if stream.localFin {
+		stream.mutex.Unlock()
+		return nil
+	}
+	stream.localFin = true
+	if stream.remoteFin {
+		stream.session.remove(stream.id)
+	}
+	stream.cond.Broadcast()
+	stream.mutex.Unlock()
+
+	return stream.session.writeFrame(MUX_FIN, stream.id, nil)
+}
+
+func (stream *MuxStream) LocalAddr() net.Addr { return stream.session.conn.LocalAddr() }
+
+func (stream *MuxStream) RemoteAddr() net.Addr { return stream.session.conn.RemoteAddr() }
+
+// Limit how long each Read and Write on the stream may wait, for data or
+// for window to send it in. Zero is no limit. Writes of frames to the
+// session's connection are not limited, as they are shared by every stream.
+func (stream *MuxStream) SetTimeout(nsec int64) os.Error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.readTimeout = nsec
+	stream.writeTimeout = nsec
+	return nil
+}
+
+func (stream *MuxStream) SetReadTimeout(nsec int64) os.Error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.readTimeout = nsec
+	return nil
+}
+
+func (stream *MuxStream) SetWriteTimeout(nsec int64) os.Error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.writeTimeout = nsec
+	return nil
+}
+
+// A net.Listener accepting the streams of every connection accepted
+// by another listener.
+type MuxListener struct {
+	listener net.Listener
+	streams  chan *MuxStream
+	errs     chan os.Error
+}
+
+// Accept multiplexed connections on listener, as streams.
+func NewMuxListener(listener net.Listener) *MuxListener {
+	ml := &MuxListener{
+		listener: listener,
+		streams:  make(chan *MuxStream),
+		errs:     make(chan os.Error, 1)}
+	go ml.acceptConns()
+	return ml
+}
+
+func (ml *MuxListener) acceptConns() {
+	for {
+		conn, err := ml.listener.Accept()
+		if err != nil {
+			ml.errs <- err
+			return
+		}
+
+		go func() {
+			session := NewMuxSession(conn, false)
+			for {
+				stream, err := session.Accept()
+				if err != nil {
+					conn.Close()
+					return
+				}
+				ml.streams <- stream
+			}
+		}()
+	}
+}
+
+func (ml *MuxListener) Accept() (net.Conn, os.Error) {
+	select {
+	case stream := <-ml.streams:
+		return stream, nil
+	case err := <-ml.errs:
+		ml.errs <- err
+		return nil, err
+	}
+	panic("Impossible")
+}
+
+func (ml *MuxListener) Close() os.Error { return ml.listener.Close() }
+
+func (ml *MuxListener) Addr() net.Addr { return ml.listener.Addr() }
@@ -0,0 +1,423 @@
+package remote
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"http"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pairing codes have the form replican://<host:port>/<secret>.
+const PAIR_SCHEME string = "replican://"
+
+// Characters used in pairing secrets; easily read aloud, without 0/o or 1/l.
+const secretAlphabet string = "23456789abcdefghjkmnpqrstuvwxyz"
+
+const secretLength int = 20
+
+// Iterations of HMAC-SHA1 deriving each key from the secret, as PBKDF2,
+// so that every guess at a secret costs as much.
+const pairKdfIterations int = 20000
+
+// Nanoseconds a paired request is accepted for after it is made, either
+// way, allowing for the clocks of the peers to differ.
+const PAIR_WINDOW int64 = 300e9
+
+// Most bytes of a response in one authenticated frame.
+const PAIR_FRAME_SIZE int = 1 << 16
+
+// Connect two peers with a short pairing code, in place of configuring
+// keys and transport security by hand.
+//
+// The secret in the code is the only key material: both sides derive an
+// encryption key and an authentication key from it, by PBKDF2 with
+// HMAC-SHA1. The secret has about 99 bits of entropy.
+//
+// Every request is authenticated with an HMAC of the request, its time
+// and a random nonce, so only holders of the code may read the tree. The
+// serving side refuses requests made more than PAIR_WINDOW from its own
+// time, and nonces it has seen within the window, so requests cannot be
+// replayed.
+//
+// Every response is encrypted with AES in CTR mode under a fresh IV, and
+// sent as frames of at most PAIR_FRAME_SIZE bytes, so that it is streamed
+// rather than held whole. Each frame is authenticated with an HMAC of the
+// request's nonce, the IV, the status, the frame's number and whether it
+// is the last, and its ciphertext; a response which is altered, reordered,
+// cut short or given another status fails authentication.
+type Pairing struct {
+	Addr   string
+	Secret string
+
+	encKey []byte
+	macKey []byte
+}
+
+// Pair with a new random secret, for serving on addr.
+func NewPairing(addr string) (*Pairing, os.Error) {
+	secret := make([]byte, secretLength)
+	buf := make([]byte, 1)
+	for i := 0; i < secretLength; {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		// Reject values which would bias the choice of character.
+		if int(buf[0]) < 256-256%len(secretAlphabet) {
+			secret[i] = secretAlphabet[int(buf[0])%len(secretAlphabet)]
+			i++
+		}
+	}
+
+	return newPairing(addr, string(secret)), nil
+}
+
+func newPairing(addr string, secret string) *Pairing {
+	pairing := &Pairing{Addr: addr, Secret: secret}
+	pairing.encKey = pairing.derive("encrypt")[:16]
+	pairing.macKey = pairing.derive("authenticate")
+	return pairing
+}
+
+// Derive a key from the secret for a purpose, as the first block of
+// PBKDF2 with the purpose as salt.
+func (pairing *Pairing) derive(purpose string) []byte {
+	mac := hmac.NewSHA1([]byte(pairing.Secret))
+	mac.Write([]byte("replican pairing " + purpose))
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum()
+
+	key := append([]byte{}, u...)
+	for i := 1; i < pairKdfIterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum()
+		xorInto(key, u)
+	}
+	return key
+}
+
+func xorInto(dst []byte, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
+
+// Parse a pairing code given by the serving side.
+func ParsePairingCode(code string) (*Pairing, os.Error) {
+	if !strings.HasPrefix(code, PAIR_SCHEME) {
+		return nil, os.NewError(fmt.Sprintf("Not a pairing code: %s", code))
+	}
+
+	rest := code[len(PAIR_SCHEME):]
+	slash := strings.LastIndex(rest, "/")
+	if slash < 1 || slash == len(rest)-1 {
+		return nil, os.NewError(fmt.Sprintf("Not a pairing code: %s", code))
+	}
+
+	return newPairing(rest[:slash], rest[slash+1:]), nil
+}
+
+// Get the pairing code to be given to the connecting side.
+func (pairing *Pairing) Code() string {
+	return fmt.Sprintf("%s%s/%s", PAIR_SCHEME, pairing.Addr, pairing.Secret)
+}
+
+func (pairing *Pairing) sign(method string, path string, query string, stamp int64, nonce string) string {
+	mac := hmac.NewSHA1(pairing.macKey)
+	fmt.Fprintf(mac, "%s %s?%s %d %s", method, path, query, stamp, nonce)
+	return hex.EncodeToString(mac.Sum())
+}
+
+// Authenticate a frame of an encrypted response.
+func (pairing *Pairing) seal(nonce string, iv []byte, status int, seq int64, final bool, ciphertext []byte) []byte {
+	mac := hmac.NewSHA1(pairing.macKey)
+	fmt.Fprintf(mac, "%s %x %d %d %v %d ", nonce, iv, status, seq, final, len(ciphertext))
+	mac.Write(ciphertext)
+	return mac.Sum()
+}
+
+func (pairing *Pairing) stream(iv []byte) (cipher.Stream, os.Error) {
+	block, err := aes.NewCipher(pairing.encKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, iv), nil
+}
+
+// Serve a handler to paired clients only, encrypting its responses.
+func (pairing *Pairing) Handler(handler http.Handler) http.Handler {
+	return &pairedHandler{pairing: pairing, handler: handler, seen: make(map[string]int64)}
+}
+
+// Get a client for the paired server.
+func (pairing *Pairing) Client() *Client {
+	client := NewClient("http://" + pairing.Addr)
+	client.HTTP = &http.Client{Transport: &pairedTransport{pairing: pairing}}
+	return client
+}
+
+type pairedHandler struct {
+	pairing *Pairing
+	handler http.Handler
+
+	// Nonces of requests accepted within the window, and their times.
+	mutex  sync.Mutex
+	seen   map[string]int64
+	pruned int64
+}
+
+// Test that a request is within the window and its nonce is new,
+// remembering the nonce.
+func (ph *pairedHandler) fresh(stamp int64, nonce string) bool {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	now := time.Nanoseconds()
+	if stamp < now-PAIR_WINDOW || stamp > now+PAIR_WINDOW {
+		return false
+	}
+
+	if now-ph.pruned > PAIR_WINDOW/10 {
+		for seenNonce, seenStamp := range ph.seen {
+			if seenStamp < now-PAIR_WINDOW {
+				ph.seen[seenNonce] = 0, false
+			}
+		}
+		ph.pruned = now
+	}
+
+	if _, has := ph.seen[nonce]; has {
+		return false
+	}
+	ph.seen[nonce] = stamp
+	return true
+}
+
+func (ph *pairedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	nonce := r.Header.Get("X-Replican-Nonce")
+	stamp, err := strconv.Atoi64(r.Header.Get("X-Replican-Time"))
+	if err != nil || nonce == "" ||
+		subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Replican-Auth")),
+			[]byte(ph.pairing.sign(r.Method, r.URL.Path, r.URL.RawQuery, stamp, nonce))) != 1 ||
+		!ph.fresh(stamp, nonce) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		http.Error(w, err.String(), http.StatusInternalServerError)
+		return
+	}
+	stream, err := ph.pairing.stream(iv)
+	if err != nil {
+		http.Error(w, err.String(), http.StatusInternalServerError)
+		return
+	}
+
+	pw := &pairedWriter{pairing: ph.pairing, w: w, nonce: nonce, iv: iv, stream: stream,
+		status: http.StatusOK}
+	ph.handler.ServeHTTP(pw, r)
+	pw.flush(true)
+}
+
+// Encrypt and authenticate a response as it is written, in frames.
+type pairedWriter struct {
+	pairing *Pairing
+	w       http.ResponseWriter
+	nonce   string
+	iv      []byte
+	stream  cipher.Stream
+
+	status  int
+	started bool
+	seq     int64
+	pending []byte
+	err     os.Error
+}
+
+func (pw *pairedWriter) Header() http.Header { return pw.w.Header() }
+
+func (pw *pairedWriter) WriteHeader(status int) {
+	if !pw.started {
+		pw.status = status
+	}
+}
+
+func (pw *pairedWriter) Write(buf []byte) (int, os.Error) {
+	written := 0
+	for len(buf) > 0 {
+		n := PAIR_FRAME_SIZE - len(pw.pending)
+		if n > len(buf) {
+			n = len(buf)
+		}
+		pw.pending = append(pw.pending, buf[:n]...)
+		buf = buf[n:]
+		written += n
+
+		if len(pw.pending) == PAIR_FRAME_SIZE {
+			if err := pw.flush(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Write the pending bytes as a frame. Each frame is a flags byte, 1 if
+// it is the last, the length of its ciphertext as a uint32, the
+// ciphertext, and its MAC.
+func (pw *pairedWriter) flush(final bool) os.Error {
+	if pw.err != nil {
+		return pw.err
+	}
+	if !pw.started {
+		pw.started = true
+		pw.w.Header().Del("Content-Length")
+		pw.w.Header().Set("X-Replican-IV", hex.EncodeToString(pw.iv))
+		pw.w.WriteHeader(pw.status)
+	}
+
+	header := make([]byte, 5)
+	if final {
+		header[0] = 1
+	}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(pw.pending)))
+	pw.stream.XORKeyStream(pw.pending, pw.pending)
+	sum := pw.pairing.seal(pw.nonce, pw.iv, pw.status, pw.seq, final, pw.pending)
+
+	for _, part := range [][]byte{header, pw.pending, sum} {
+		if _, pw.err = pw.w.Write(part); pw.err != nil {
+			return pw.err
+		}
+	}
+	pw.seq++
+	pw.pending = pw.pending[:0]
+	return nil
+}
+
+type pairedTransport struct {
+	pairing *Pairing
+}
+
+func (pt *pairedTransport) RoundTrip(req *http.Request) (*http.Response, os.Error) {
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return nil, err
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	stamp := time.Nanoseconds()
+	req.Header.Set("X-Replican-Nonce", nonce)
+	req.Header.Set("X-Replican-Time", strconv.Itoa64(stamp))
+	req.Header.Set("X-Replican-Auth", pt.pairing.sign(req.Method, req.URL.Path, req.URL.RawQuery, stamp, nonce))
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil || resp.StatusCode == http.StatusUnauthorized {
+		return resp, err
+	}
+
+	iv, err := hex.DecodeString(resp.Header.Get("X-Replican-IV"))
+	if err != nil || len(iv) != aes.BlockSize {
+		resp.Body.Close()
+		return nil, os.NewError("Paired response has no valid IV")
+	}
+	stream, err := pt.pairing.stream(iv)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	// The first frame is read now, so that the status is authenticated
+	// before the response is returned.
+	body := &pairedBody{pairing: pt.pairing, body: resp.Body, nonce: nonce, iv: iv,
+		status: resp.StatusCode, stream: stream}
+	if err = body.next(); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	resp.Body = body
+	resp.ContentLength = -1
+	return resp, nil
+}
+
+// Decrypt and authenticate a paired response as it is read.
+type pairedBody struct {
+	pairing *Pairing
+	body    io.ReadCloser
+	nonce   string
+	iv      []byte
+	status  int
+	stream  cipher.Stream
+
+	seq   int64
+	buf   []byte
+	final bool
+}
+
+func (pb *pairedBody) Read(p []byte) (int, os.Error) {
+	for len(pb.buf) == 0 {
+		if pb.final {
+			return 0, os.EOF
+		}
+		if err := pb.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, pb.buf)
+	pb.buf = pb.buf[n:]
+	return n, nil
+}
+
+// Read, authenticate and decrypt the next frame.
+func (pb *pairedBody) next() os.Error {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(pb.body, header); err != nil {
+		return pairedReadErr(err)
+	}
+	final := header[0] == 1
+	length := binary.BigEndian.Uint32(header[1:])
+	if header[0] > 1 || length > uint32(PAIR_FRAME_SIZE) {
+		return os.NewError("Paired response has an invalid frame")
+	}
+
+	frame := make([]byte, int(length)+sha1.Size)
+	if _, err := io.ReadFull(pb.body, frame); err != nil {
+		return pairedReadErr(err)
+	}
+	ciphertext, sum := frame[:length], frame[length:]
+	if subtle.ConstantTimeCompare(sum, pb.pairing.seal(pb.nonce, pb.iv, pb.status, pb.seq, final, ciphertext)) != 1 {
+		return os.NewError("Paired response failed authentication")
+	}
+
+	pb.stream.XORKeyStream(ciphertext, ciphertext)
+	pb.buf = ciphertext
+	pb.final = final
+	pb.seq++
+	return nil
+}
+
+// A response which ends before its last frame has been cut short.
+func pairedReadErr(err os.Error) os.Error {
+	if err == os.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (pb *pairedBody) Close() os.Error {
+	return pb.body.Close()
+}
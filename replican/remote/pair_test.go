@@ -0,0 +1,183 @@
+package remote
+
+import (
+	"bytes"
+	"http"
+	"http/httptest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/sync"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestPairedSync(t *testing.T) {
+	path, store, file := mkOrigin(t)
+	defer os.RemoveAll(path)
+
+	pairing, err := NewPairing("")
+	assert.T(t, err == nil)
+	assert.Equal(t, secretLength, len(pairing.Secret))
+
+	server := httptest.NewServer(pairing.Handler(NewServer(store)))
+	defer server.Close()
+	pairing.Addr = server.Listener.Addr().String()
+
+	peer, err := ParsePairingCode(pairing.Code())
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, pairing.Addr, peer.Addr)
+
+	srcStore, err := NewStore(peer.Client())
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t,
+		store.Repo().Root().(fs.Dir).Info().Strong,
+		srcStore.Repo().Root().(fs.Dir).Info().Strong)
+
+	buf, err := srcStore.ReadBlock(file.Blocks()[0].Info().Strong)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, file.Blocks()[0].Info().Strong, fs.StrongChecksum(buf))
+
+	tg := treegen.New()
+	dstPath := treegen.TestTree(t, tg.D("foo"))
+	defer os.RemoveAll(dstPath)
+	dstStore, err := fs.NewLocalStore(dstPath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	plan := sync.NewPatchPlan(srcStore, dstStore)
+	_, err = plan.Exec()
+	assert.Tf(t, err == nil, "%v", err)
+
+	dstFile, _, err := fs.IndexFile(filepath.Join(dstPath, "foo", "bar"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, file.Info().Strong, dstFile.Strong)
+
+	// Without the secret, nothing can be read
+	stranger, err := ParsePairingCode(PAIR_SCHEME + pairing.Addr + "/wrongsecret")
+	assert.T(t, err == nil)
+	_, err = NewStore(stranger.Client())
+	assert.T(t, err != nil)
+}
+
+func TestPairingRefusesReplay(t *testing.T) {
+	pairing, err := NewPairing("")
+	assert.T(t, err == nil)
+	server := httptest.NewServer(pairing.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})))
+	defer server.Close()
+
+	get := func(stamp int64, nonce string) int {
+		req, err := http.NewRequest("GET", server.URL+"/foo", nil)
+		assert.T(t, err == nil)
+		req.Header.Set("X-Replican-Nonce", nonce)
+		req.Header.Set("X-Replican-Time", strconv.Itoa64(stamp))
+		req.Header.Set("X-Replican-Auth", pairing.sign("GET", "/foo", "", stamp, nonce))
+		resp, err := http.DefaultClient.Do(req)
+		assert.Tf(t, err == nil, "%v", err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	now := time.Nanoseconds()
+	assert.Equal(t, http.StatusOK, get(now, "first"))
+	assert.Equal(t, http.StatusUnauthorized, get(now, "first"))
+	assert.Equal(t, http.StatusUnauthorized, get(now-2*PAIR_WINDOW, "stale"))
+	assert.Equal(t, http.StatusUnauthorized, get(now+2*PAIR_WINDOW, "future"))
+}
+
+// Alters a paired response on its way to the client.
+type tamperingWriter struct {
+	http.ResponseWriter
+	written int
+	tamper  func(offset int, buf []byte) []byte
+}
+
+func (tw *tamperingWriter) Write(buf []byte) (int, os.Error) {
+	n := len(buf)
+	buf = tw.tamper(tw.written, append([]byte{}, buf...))
+	tw.written += n
+	if _, err := tw.ResponseWriter.Write(buf); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (tw *tamperingWriter) WriteHeader(status int) {
+	if status == http.StatusNotFound {
+		status = http.StatusOK
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func TestPairedResponses(t *testing.T) {
+	pairing, err := NewPairing("")
+	assert.T(t, err == nil)
+
+	content := make([]byte, 3*PAIR_FRAME_SIZE+17)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	handler := pairing.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	}))
+
+	var tamper func(offset int, buf []byte) []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tamper == nil {
+			handler.ServeHTTP(w, r)
+		} else {
+			handler.ServeHTTP(&tamperingWriter{ResponseWriter: w, tamper: tamper}, r)
+		}
+	}))
+	defer server.Close()
+	pairing.Addr = server.Listener.Addr().String()
+	client := pairing.Client().HTTP
+
+	read := func(path string) ([]byte, os.Error) {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		return ioutil.ReadAll(resp.Body)
+	}
+
+	// Responses larger than a frame are streamed through whole.
+	buf, err := read("/content")
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, bytes.Equal(content, buf))
+
+	// Altered, truncated and restatused responses are refused.
+	tamper = func(offset int, buf []byte) []byte {
+		if offset <= 2*PAIR_FRAME_SIZE && 2*PAIR_FRAME_SIZE < offset+len(buf) {
+			buf[2*PAIR_FRAME_SIZE-offset]++
+		}
+		return buf
+	}
+	_, err = read("/content")
+	assert.T(t, err != nil)
+
+	tamper = func(offset int, buf []byte) []byte {
+		if offset >= 2*PAIR_FRAME_SIZE {
+			return nil
+		}
+		return buf
+	}
+	_, err = read("/content")
+	assert.T(t, err != nil)
+
+	tamper = func(offset int, buf []byte) []byte { return buf }
+	_, err = read("/missing")
+	assert.T(t, err != nil)
+}
@@ -0,0 +1,154 @@
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"json"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/cmars/replican-sync/replican/archive"
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// A tree is published as a directory of static files laid out like the
+// URLs of a Server, so that any web server or CDN can serve it:
+//
+//	tree              manifest of the tree, as served at TREE_PATH
+//	block/<strong>    each block, named by its strong checksum
+//
+// Blocks are content-addressed, so they can be cached indefinitely, and
+// publishing a new version of a tree to the same directory only adds the
+// blocks it does not already hold. Ranges of files are read as the blocks
+// covering them, so only plain GETs are made.
+const PUBLISHED_TREE = "tree"
+const PUBLISHED_BLOCKS = "block"
+
+// Publish the store's tree to dir, for upload to a static host. Blocks
+// already published are not written again, and the manifest is replaced
+// last, so that the published tree is never missing a block its manifest
+// lists. Returns the number of blocks written.
+func Publish(store fs.BlockStore, dir string) (int, os.Error) {
+	manifest := archive.NewManifest(store.Repo().Root())
+	written := 0
+	for _, entry := range manifest {
+		for _, blockInfo := range entry.Blocks {
+			path := filepath.Join(dir, PUBLISHED_BLOCKS, blockInfo.Strong)
+			if _, err := os.Stat(path); err == nil {
+				continue
+			}
+
+			buf := &bytes.Buffer{}
+			if _, err := store.ReadBlockInto(blockInfo.Strong, buf); err != nil {
+				return written, err
+			}
+			if err := storeBlock(path, buf.Bytes()); err != nil {
+				return written, err
+			}
+			written++
+		}
+	}
+
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return written, err
+	}
+	return written, storeBlock(filepath.Join(dir, PUBLISHED_TREE), buf)
+}
+
+// A tree published with Publish, read from a static host.
+// Blocks are verified against their strong checksums as they are read,
+// as a CDN may serve stale or damaged copies.
+type StaticStore struct {
+	*Client
+
+	repo *fs.MemRepo
+}
+
+// Open the tree published at url. There are no capabilities to agree with
+// a static host; data is read uncompressed, as it was published.
+func NewStaticStore(url string) (*StaticStore, os.Error) {
+	client := NewClient(url)
+	client.Session = LocalCapabilities()
+	client.Session.Codecs = []string{CODEC_IDENTITY}
+
+	manifest, err := client.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := archive.NewRepo(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StaticStore{Client: client, repo: repo}, nil
+}
+
+func (store *StaticStore) Repo() fs.NodeRepo { return store.repo }
+
+func (store *StaticStore) ReadBlock(strong string) ([]byte, os.Error) {
+	buf := &bytes.Buffer{}
+	if _, err := store.Client.ReadBlockInto(strong, buf); err != nil {
+		return nil, err
+	}
+	if fs.StrongChecksum(buf.Bytes()) != strong {
+		return nil, os.NewError(fmt.Sprintf("Block %s from %s failed verification", strong, store.URL))
+	}
+	return buf.Bytes(), nil
+}
+
+func (store *StaticStore) ReadBlockInto(strong string, writer io.Writer) (int64, os.Error) {
+	block, err := store.ReadBlock(strong)
+	if err != nil {
+		return 0, err
+	}
+	n, err := writer.Write(block)
+	return int64(n), err
+}
+
+// Read a range of a file from the blocks covering it.
+func (store *StaticStore) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	file, has := store.repo.File(strong)
+	if !has {
+		return 0, os.NewError(fmt.Sprintf("File with strong checksum %s not found", strong))
+	}
+
+	blocks := &fs.Blocks{Contents: append([]fs.Block{}, file.Blocks()...)}
+	sort.Sort(blocks)
+
+	var written int64
+	to := from + length
+	for _, block := range blocks.Contents {
+		blockFrom := block.Info().Offset()
+		blockTo := blockFrom + block.Info().Size()
+		if blockTo <= from || blockFrom >= to {
+			continue
+		}
+
+		data, err := store.ReadBlock(block.Info().Strong)
+		if err != nil {
+			return written, err
+		}
+
+		start, end := int64(0), int64(len(data))
+		if from > blockFrom {
+			start = from - blockFrom
+		}
+		if to < blockFrom+end {
+			end = to - blockFrom
+		}
+		if start >= end {
+			continue
+		}
+
+		n, err := writer.Write(data[start:end])
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
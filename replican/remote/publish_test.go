@@ -0,0 +1,71 @@
+package remote
+
+import (
+	"http"
+	"http/httptest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/sync"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestPublish(t *testing.T) {
+	path, store, file := mkOrigin(t)
+	defer os.RemoveAll(path)
+
+	dir, err := ioutil.TempDir("", "publish")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(dir)
+
+	written, err := Publish(store, dir)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, len(file.Blocks()), written)
+
+	// Published again, nothing new is written.
+	written, err = Publish(store, dir)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, 0, written)
+
+	// Any static host will do.
+	host := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(r.URL.Path)))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(buf)
+	}))
+	defer host.Close()
+
+	srcStore, err := NewStaticStore(host.URL)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t,
+		store.Repo().Root().(fs.Dir).Info().Strong,
+		srcStore.Repo().Root().(fs.Dir).Info().Strong)
+
+	tg := treegen.New()
+	dstPath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 1000), tg.B(43, 100))))
+	defer os.RemoveAll(dstPath)
+	dstStore, err := fs.NewLocalStore(dstPath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	plan := sync.NewPatchPlan(srcStore, dstStore)
+	_, err = plan.Exec()
+	assert.Tf(t, err == nil, "%v", err)
+
+	dstFile, _, err := fs.IndexFile(filepath.Join(dstPath, "foo", "bar"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, file.Info().Strong, dstFile.Strong)
+
+	// Damaged blocks are refused.
+	blockPath := filepath.Join(dir, PUBLISHED_BLOCKS, file.Blocks()[0].Info().Strong)
+	assert.T(t, ioutil.WriteFile(blockPath, []byte("damaged"), 0644) == nil)
+	_, err = srcStore.ReadBlock(file.Blocks()[0].Info().Strong)
+	assert.T(t, err != nil)
+}
@@ -0,0 +1,426 @@
+// Package remote provides access to block data across the network.
+//
+// A Server publishes any fs.BlockProvider over HTTP, and a Client
+// reads from a Server as an fs.BlockProvider in its own right.
+// Blocks are addressed by strong checksum at /block/<strong>, and ranges of
+// files at /file/<strong>?from=<offset>&length=<length>. When the provider is
+// an fs.BlockStore, the manifest of its tree is served at /tree. The
+// manifest may be served on its own by an index server, with block data
+// served from elsewhere; see NewIndexServer and NewSplitStore. A tree may
+// also be published as static files for any web host or CDN; see Publish.
+//
+// Clients ask which of a batch of blocks a server has at /have, so that
+// content already there need not be sent to it.
+//
+// Clients and servers first agree on a protocol version, hash, block size
+// and codec at /hello, so that mismatched peers fail clearly rather than
+// exchange blocks which cannot match.
+package remote
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"http"
+	"io"
+	"json"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cmars/replican-sync/replican/archive"
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+const BLOCK_PREFIX string = "/block/"
+const FILE_PREFIX string = "/file/"
+const TREE_PATH string = "/tree"
+
+// Serve block data from a provider over HTTP.
+type Server struct {
+	Provider fs.BlockProvider
+
+	// Capabilities agreed to with clients. If nil, LocalCapabilities,
+	// with the block size of the provider if it is a local store, or of
+	// its repo.
+	Capabilities *Capabilities
+}
+
+func NewServer(provider fs.BlockProvider) *Server {
+	return &Server{Provider: provider}
+}
+
+// Serve only the manifest of the tree in repo, as a cheap metadata
+// service. Its block data must be served by another server.
+func NewIndexServer(repo fs.NodeRepo) *Server {
+	return &Server{Provider: &indexOnly{repo: repo}}
+}
+
+// A tree model without its block data.
+type indexOnly struct {
+	repo fs.NodeRepo
+}
+
+func (index *indexOnly) Repo() fs.NodeRepo { return index.repo }
+
+func (index *indexOnly) ReadBlock(strong string) ([]byte, os.Error) {
+	return nil, os.NewError(fmt.Sprintf("Block %s not served by an index server", strong))
+}
+
+func (index *indexOnly) ReadBlockInto(strong string, writer io.Writer) (int64, os.Error) {
+	return 0, os.NewError(fmt.Sprintf("Block %s not served by an index server", strong))
+}
+
+func (index *indexOnly) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	return 0, os.NewError(fmt.Sprintf("File %s not served by an index server", strong))
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == HELLO_PATH:
+		server.serveHello(w, r)
+	case strings.HasPrefix(r.URL.Path, BLOCK_PREFIX):
+		server.serveBlock(w, r, r.URL.Path[len(BLOCK_PREFIX):])
+	case strings.HasPrefix(r.URL.Path, FILE_PREFIX):
+		server.serveFile(w, r, r.URL.Path[len(FILE_PREFIX):])
+	case r.URL.Path == TREE_PATH:
+		server.serveTree(w, r)
+	case r.URL.Path == HAVE_PATH:
+		server.serveHave(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (server *Server) serveBlock(w http.ResponseWriter, r *http.Request, strong string) {
+	if !isStrong(strong) {
+		http.Error(w, "invalid strong checksum", http.StatusBadRequest)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := server.Provider.ReadBlockInto(strong, buf); err != nil {
+		http.Error(w, err.String(), http.StatusNotFound)
+		return
+	}
+
+	if out, ok := newDataWriter(w, r); ok {
+		if _, err := buf.WriteTo(out); err == nil {
+			out.Close()
+		}
+	}
+}
+
+// Ranges are streamed as they are read, so that a range of any size is
+// served without holding it in memory.
+func (server *Server) serveFile(w http.ResponseWriter, r *http.Request, strong string) {
+	if !isStrong(strong) {
+		http.Error(w, "invalid strong checksum", http.StatusBadRequest)
+		return
+	}
+
+	from, length, ok := readRange(w, r)
+	if !ok {
+		return
+	}
+	if store, is := server.Provider.(fs.BlockStore); is {
+		if file, has := store.Repo().File(strong); has && from+length > file.Info().Size {
+			http.Error(w, "range past the end of the file", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+	}
+
+	out, ok := newDataWriter(w, r)
+	if !ok {
+		return
+	}
+	if _, err := server.Provider.ReadInto(strong, from, length, out); err != nil && err != os.EOF {
+		if !out.started() {
+			http.Error(w, err.String(), http.StatusNotFound)
+		}
+		// Otherwise it is too late to fail the request. The data is left
+		// short, and any compressed stream unfinished, so that the client
+		// sees it did not arrive whole.
+		return
+	}
+	out.Close()
+}
+
+// Get the range of a file asked for by a request, failing the request
+// if it is not a valid range.
+func readRange(w http.ResponseWriter, r *http.Request) (from int64, length int64, ok bool) {
+	from, err := strconv.Atoi64(r.FormValue("from"))
+	if err != nil || from < 0 {
+		http.Error(w, "invalid from offset", http.StatusBadRequest)
+		return 0, 0, false
+	}
+
+	length, err = strconv.Atoi64(r.FormValue("length"))
+	if err != nil || length < 0 {
+		http.Error(w, "invalid length", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return from, length, true
+}
+
+// Writes block data in the codec a request asks for, straight to the
+// response. The response header is written with the first of the data,
+// so that a read which fails before writing anything can still fail the
+// request.
+type dataWriter struct {
+	w    http.ResponseWriter
+	gzip bool
+	out  io.Writer
+	gz   io.WriteCloser
+}
+
+// Get a writer of the data for a request, failing the request if its
+// codec is not supported.
+func newDataWriter(w http.ResponseWriter, r *http.Request) (*dataWriter, bool) {
+	switch codec := r.Header.Get(CODEC_HEADER); codec {
+	case "", CODEC_IDENTITY:
+		return &dataWriter{w: w}, true
+	case CODEC_GZIP:
+		return &dataWriter{w: w, gzip: true}, true
+	default:
+		http.Error(w, fmt.Sprintf("unsupported codec %q", codec), http.StatusBadRequest)
+	}
+	return nil, false
+}
+
+func (dw *dataWriter) started() bool { return dw.out != nil }
+
+func (dw *dataWriter) start() os.Error {
+	dw.w.WriteHeader(http.StatusOK)
+	dw.out = dw.w
+	if dw.gzip {
+		gz, err := gzip.NewWriter(dw.w)
+		if err != nil {
+			return err
+		}
+		dw.gz, dw.out = gz, gz
+	}
+	return nil
+}
+
+func (dw *dataWriter) Write(buf []byte) (int, os.Error) {
+	if !dw.started() {
+		if err := dw.start(); err != nil {
+			return 0, err
+		}
+	}
+	return dw.out.Write(buf)
+}
+
+// Finish the data, writing anything the codec holds back.
+func (dw *dataWriter) Close() os.Error {
+	if !dw.started() {
+		if err := dw.start(); err != nil {
+			return err
+		}
+	}
+	if dw.gz != nil {
+		return dw.gz.Close()
+	}
+	return nil
+}
+
+func (server *Server) serveTree(w http.ResponseWriter, r *http.Request) {
+	store, is := server.Provider.(fs.BlockStore)
+	if !is {
+		http.NotFound(w, r)
+		return
+	}
+
+	buf, err := json.Marshal(archive.NewManifest(store.Repo().Root()))
+	if err != nil {
+		http.Error(w, err.String(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	w.Write(buf)
+}
+
+// Read block data from a remote Server.
+type Client struct {
+	// Base URL of the server, such as http://host:port
+	URL string
+
+	// HTTP client making requests. If nil, http.DefaultClient is used.
+	HTTP *http.Client
+
+	// Capabilities offered to the server. If nil, LocalCapabilities.
+	Capabilities *Capabilities
+
+	// Capabilities to use without agreeing them with the server, for
+	// hosts which only serve data and cannot negotiate, such as a CDN.
+	// Typically those agreed by the client of the index server.
+	Session *Capabilities
+
+	// Timeouts and retries for connections to the server. Timeouts
+	// only apply to connections made by the client's own HTTP client,
+	// when HTTP is nil.
+	Conn *ConnOptions
+
+	// If not empty, presented to the server as a bearer token, as a
+	// SpoolServer requires.
+	Token string
+
+	mutex   sync.Mutex
+	session *Capabilities
+
+	connMutex sync.Mutex
+	connHTTP  *http.Client
+
+	statsMutex sync.Mutex
+	stats      PeerStats
+}
+
+func NewClient(url string) *Client {
+	return &Client{URL: strings.TrimRight(url, "/")}
+}
+
+func (client *Client) ReadBlock(strong string) ([]byte, os.Error) {
+	buf := &bytes.Buffer{}
+	if _, err := client.ReadBlockInto(strong, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Blocks are read whole before they are written, so that a block whose
+// request is retried is not written twice.
+func (client *Client) ReadBlockInto(strong string, writer io.Writer) (int64, os.Error) {
+	for attempt := 0; ; attempt++ {
+		buf := &bytes.Buffer{}
+		_, err := client.getData(client.URL+BLOCK_PREFIX+strong, buf)
+		if err == nil {
+			return buf.WriteTo(writer)
+		} else if !client.retry(attempt, err) {
+			return 0, err
+		}
+	}
+
+	panic("Impossible")
+}
+
+// A range whose request is retried is resumed from where it failed.
+// Ranges are streamed, so one cut short is only known to be by its length.
+func (client *Client) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	var total int64
+	for attempt := 0; ; attempt++ {
+		n, err := client.getData(fmt.Sprintf("%s%s%s?from=%d&length=%d",
+			client.URL, FILE_PREFIX, strong, from+total, length-total), writer)
+		total += n
+		if err == nil && total < length {
+			err = os.NewError(fmt.Sprintf("Got %d of %d bytes at offset %d of %s", total, length, from, strong))
+		}
+		if err == nil || !client.retry(attempt, err) {
+			return total, err
+		}
+	}
+
+	panic("Impossible")
+}
+
+// Get the manifest of the server's tree.
+func (client *Client) Tree() ([]*archive.Entry, os.Error) {
+	if _, err := client.Hello(); err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	for attempt := 0; ; attempt++ {
+		_, err := client.get(client.URL+TREE_PATH, buf)
+		if err == nil {
+			break
+		} else if !client.retry(attempt, err) {
+			return nil, err
+		}
+		buf.Reset()
+	}
+
+	manifest := []*archive.Entry{}
+	if err := json.Unmarshal(buf.Bytes(), &manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func (client *Client) httpClient() *http.Client {
+	switch {
+	case client.HTTP != nil:
+		return client.HTTP
+	case client.Conn != nil:
+		client.connMutex.Lock()
+		defer client.connMutex.Unlock()
+		if client.connHTTP == nil {
+			client.connHTTP = client.Conn.httpClient()
+		}
+		return client.connHTTP
+	}
+	return http.DefaultClient
+}
+
+// Make a request of the server, presenting the client's token.
+func (client *Client) do(req *http.Request) (*http.Response, os.Error) {
+	if client.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+client.Token)
+	}
+	return client.httpClient().Do(req)
+}
+
+// Get block data from the server, in the codec agreed with it.
+func (client *Client) getData(url string, writer io.Writer) (int64, os.Error) {
+	session, err := client.Hello()
+	if err != nil {
+		return 0, err
+	}
+	return client.getCodec(url, session.Codecs[0], writer)
+}
+
+func (client *Client) get(url string, writer io.Writer) (int64, os.Error) {
+	return client.getCodec(url, CODEC_IDENTITY, writer)
+}
+
+func (client *Client) getCodec(url string, codec string, writer io.Writer) (n int64, err os.Error) {
+	start := time.Nanoseconds()
+	body := &countingReader{}
+	defer func() {
+		client.record(start, 0, body.n, err != nil)
+	}()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	if codec != CODEC_IDENTITY {
+		req.Header.Set(CODEC_HEADER, codec)
+	}
+
+	resp, err := client.do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body.reader = resp.Body
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, &ErrStatus{URL: url, Status: resp.Status}
+	}
+
+	if codec != CODEC_GZIP {
+		return io.Copy(writer, body)
+	}
+
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+	return io.Copy(writer, gz)
+}
@@ -0,0 +1,454 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"http"
+	"http/httptest"
+	"io/ioutil"
+	"json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func mkOrigin(t *testing.T) (string, fs.LocalStore, fs.File) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo", tg.F("bar", tg.B(42, 65537)))
+
+	path := treegen.TestTree(t, treeSpec)
+	store, err := fs.NewLocalStore(path, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	node, has := fs.Lookup(store.Repo().Root().(fs.Dir), filepath.Join("foo", "bar"))
+	assert.T(t, has)
+
+	return path, store, node.(fs.File)
+}
+
+func TestClientServer(t *testing.T) {
+	path, store, file := mkOrigin(t)
+	defer os.RemoveAll(path)
+
+	server := httptest.NewServer(NewServer(store))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+
+	for _, block := range file.Blocks() {
+		buf, err := client.ReadBlock(block.Info().Strong)
+		assert.Tf(t, err == nil, "%v", err)
+		assert.Equal(t, block.Info().Strong, fs.StrongChecksum(buf))
+	}
+
+	buf := &bytes.Buffer{}
+	n, err := client.ReadInto(file.Info().Strong, 0, file.Info().Size, buf)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, file.Info().Size, n)
+	assert.Equal(t, file.Info().Strong, fs.StrongChecksum(buf.Bytes()))
+
+	_, err = client.ReadBlock("nosuchblock")
+	assert.T(t, err != nil)
+
+	// Ranges which are not within the file are refused
+	for query, status := range map[string]int{
+		"from=-1&length=10":  http.StatusBadRequest,
+		"from=0&length=-10":  http.StatusBadRequest,
+		"from=0&length=1e12": http.StatusBadRequest,
+		fmt.Sprintf("from=%d&length=10", file.Info().Size-5): http.StatusRequestedRangeNotSatisfiable,
+	} {
+		resp, err := http.Get(server.URL + FILE_PREFIX + file.Info().Strong + "?" + query)
+		assert.Tf(t, err == nil, "%v", err)
+		resp.Body.Close()
+		assert.Equalf(t, status, resp.StatusCode, "%s", query)
+	}
+	_, err = client.ReadInto(file.Info().Strong, file.Info().Size-5, 10, &bytes.Buffer{})
+	assert.T(t, err != nil)
+}
+
+func TestCachingProxy(t *testing.T) {
+	path, store, file := mkOrigin(t)
+	defer os.RemoveAll(path)
+
+	origin := httptest.NewServer(NewServer(store))
+
+	cacheDir, err := ioutil.TempDir("", "cache")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(cacheDir)
+
+	proxy, err := NewProxy(origin.URL, cacheDir)
+	assert.T(t, err == nil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	client := NewClient(proxyServer.URL)
+	for _, block := range file.Blocks() {
+		buf, err := client.ReadBlock(block.Info().Strong)
+		assert.Tf(t, err == nil, "%v", err)
+		assert.Equal(t, block.Info().Strong, fs.StrongChecksum(buf))
+	}
+
+	// With the origin gone, blocks are still served from the cache
+	origin.Close()
+	for _, block := range file.Blocks() {
+		buf, err := client.ReadBlock(block.Info().Strong)
+		assert.Tf(t, err == nil, "%v", err)
+		assert.Equal(t, block.Info().Strong, fs.StrongChecksum(buf))
+	}
+
+	// Paths which climb out of the cache are refused
+	secret := filepath.Join(cacheDir, "..", filepath.Base(cacheDir)+".secret")
+	assert.T(t, ioutil.WriteFile(secret, []byte("secret"), 0600) == nil)
+	defer os.Remove(secret)
+	resp, err := http.Get(proxyServer.URL + BLOCK_PREFIX + "..%2F" + filepath.Base(secret))
+	assert.Tf(t, err == nil, "%v", err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	_, err = proxy.Provider.ReadBlock(filepath.Join("..", filepath.Base(secret)))
+	assert.T(t, err != nil)
+}
+
+func TestNegotiate(t *testing.T) {
+	offer := LocalCapabilities()
+	offer.Version = PROTOCOL_VERSION + 1
+	offer.Codecs = []string{"zstd", CODEC_GZIP, CODEC_IDENTITY}
+
+	session, err := Negotiate(offer, LocalCapabilities())
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, PROTOCOL_VERSION, session.Version)
+	assert.Equal(t, []string{HASH_SHA1}, session.Hashes)
+	assert.Equal(t, []string{CODEC_GZIP}, session.Codecs)
+
+	offer.MinVersion = PROTOCOL_VERSION + 1
+	_, err = Negotiate(offer, LocalCapabilities())
+	_, is := err.(*ErrIncompatible)
+	assert.Tf(t, is, "%v", err)
+
+	offer = LocalCapabilities()
+	offer.BlockSize *= 2
+	_, err = Negotiate(offer, LocalCapabilities())
+	_, is = err.(*ErrIncompatible)
+	assert.Tf(t, is, "%v", err)
+
+	offer = LocalCapabilities()
+	offer.Hashes = []string{"sha256"}
+	_, err = Negotiate(offer, LocalCapabilities())
+	_, is = err.(*ErrIncompatible)
+	assert.Tf(t, is, "%v", err)
+}
+
+// Test that blocks are read in the codec agreed with the server,
+// and that peers which cannot agree fail before reading any.
+func TestHello(t *testing.T) {
+	path, store, file := mkOrigin(t)
+	defer os.RemoveAll(path)
+
+	server := httptest.NewServer(NewServer(store))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.Capabilities = LocalCapabilities()
+	client.Capabilities.Codecs = []string{CODEC_GZIP}
+	session, err := client.Hello()
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, []string{CODEC_GZIP}, session.Codecs)
+
+	buf := &bytes.Buffer{}
+	n, err := client.ReadInto(file.Info().Strong, 0, file.Info().Size, buf)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, file.Info().Size, n)
+	assert.Equal(t, file.Info().Strong, fs.StrongChecksum(buf.Bytes()))
+
+	// A server with another block size
+	mismatched := NewServer(store)
+	mismatched.Capabilities = LocalCapabilities()
+	mismatched.Capabilities.BlockSize *= 2
+	mismatchedServer := httptest.NewServer(mismatched)
+	defer mismatchedServer.Close()
+
+	client = NewClient(mismatchedServer.URL)
+	_, err = client.ReadBlock(file.Blocks()[0].Info().Strong)
+	_, is := err.(*ErrIncompatible)
+	assert.Tf(t, is, "%v", err)
+
+	// A server which does not negotiate at all
+	streamServer := httptest.NewServer(NewStreamServer())
+	defer streamServer.Close()
+
+	client = NewClient(streamServer.URL)
+	_, err = client.ReadBlock(file.Blocks()[0].Info().Strong)
+	_, is = err.(*ErrIncompatible)
+	assert.Tf(t, is, "%v", err)
+}
+
+// Serve a handler, but drop the connection halfway through the first
+// few successful responses with data.
+type droppingHandler struct {
+	handler http.Handler
+	drops   int
+}
+
+func (dh *droppingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	isData := strings.HasPrefix(r.URL.Path, BLOCK_PREFIX) || strings.HasPrefix(r.URL.Path, FILE_PREFIX)
+	if !isData || dh.drops == 0 {
+		dh.handler.ServeHTTP(w, r)
+		return
+	}
+
+	recorder := httptest.NewRecorder()
+	dh.handler.ServeHTTP(recorder, r)
+	body := recorder.Body.Bytes()
+	if recorder.Code != http.StatusOK {
+		w.WriteHeader(recorder.Code)
+		w.Write(body)
+		return
+	}
+	dh.drops--
+
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n", len(body))
+	conn.Write(body[:len(body)/2])
+}
+
+// Test that requests dropped by the network are retried, and that
+// ranges are resumed from where they were dropped.
+func TestRetry(t *testing.T) {
+	path, store, file := mkOrigin(t)
+	defer os.RemoveAll(path)
+
+	dropping := &droppingHandler{handler: NewServer(store), drops: 2}
+	server := httptest.NewServer(dropping)
+	defer server.Close()
+
+	// Without retries, the dropped request fails.
+	client := NewClient(server.URL)
+	_, err := client.ReadBlock(file.Blocks()[0].Info().Strong)
+	assert.T(t, err != nil)
+
+	client = NewClient(server.URL)
+	client.Conn = &ConnOptions{ReadTimeout: 5e9, WriteTimeout: 5e9, KeepAlive: true, Retries: 2}
+
+	buf := &bytes.Buffer{}
+	n, err := client.ReadInto(file.Info().Strong, 0, file.Info().Size, buf)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, file.Info().Size, n)
+	assert.Equal(t, file.Info().Strong, fs.StrongChecksum(buf.Bytes()))
+	assert.Equal(t, 0, dropping.drops)
+
+	// Errors from the server are not retried.
+	dropping.drops = 1
+	_, err = client.ReadBlock("nosuchblock")
+	_, is := err.(*ErrStatus)
+	assert.Tf(t, is, "%v", err)
+	assert.Equal(t, 1, dropping.drops)
+}
+
+// Counts the connections accepted by a listener.
+type countingListener struct {
+	net.Listener
+	accepted int
+}
+
+func (cl *countingListener) Accept() (net.Conn, os.Error) {
+	conn, err := cl.Listener.Accept()
+	if err == nil {
+		cl.accepted++
+	}
+	return conn, err
+}
+
+// Test that concurrent reads by a multiplexing client share one connection.
+func TestMultiplex(t *testing.T) {
+	path, store, file := mkOrigin(t)
+	defer os.RemoveAll(path)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Tf(t, err == nil, "%v", err)
+	counting := &countingListener{Listener: listener}
+	muxListener := NewMuxListener(counting)
+	defer muxListener.Close()
+	go http.Serve(muxListener, NewServer(store))
+
+	client := NewClient("http://" + listener.Addr().String())
+	client.Conn = &ConnOptions{Multiplex: true}
+
+	errs := make(chan os.Error)
+	for _, block := range file.Blocks() {
+		go func(strong string) {
+			buf, err := client.ReadBlock(strong)
+			if err == nil && fs.StrongChecksum(buf) != strong {
+				err = os.NewError(fmt.Sprintf("Block %s read corrupt", strong))
+			}
+			errs <- err
+		}(block.Info().Strong)
+	}
+	for _ = range file.Blocks() {
+		err := <-errs
+		assert.Tf(t, err == nil, "%v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	n, err := client.ReadInto(file.Info().Strong, 0, file.Info().Size, buf)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, file.Info().Size, n)
+	assert.Equal(t, file.Info().Strong, fs.StrongChecksum(buf.Bytes()))
+
+	assert.Equal(t, 1, counting.accepted)
+}
+
+// Encode a multiplexed frame, as the other end of a session would send it.
+func muxFrame(frameType byte, id uint32, payload []byte) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(frameType)
+	binary.Write(buf, binary.BigEndian, id)
+	binary.Write(buf, binary.BigEndian, uint32(len(payload)))
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// Wait for a session to end, failing if it does not.
+func assertMuxFailed(t *testing.T, session *MuxSession) {
+	select {
+	case <-session.closed:
+	case <-time.After(5e9):
+		t.Fatal("Session did not end")
+	}
+	assert.T(t, session.Err() != nil)
+}
+
+// Test that a session ends when the other end opens a stream out of turn.
+func TestMuxRefusesStreamId(t *testing.T) {
+	for _, id := range []uint32{0, 1, 3} {
+		local, remote := net.Pipe()
+		session := NewMuxSession(local, true)
+
+		// The accepting end opens even streams, in order.
+		_, err := remote.Write(muxFrame(MUX_DATA, 4, nil))
+		assert.Tf(t, err == nil, "%v", err)
+		remote.Write(muxFrame(MUX_DATA, id, nil))
+		assertMuxFailed(t, session)
+		session.Close()
+		remote.Close()
+	}
+
+	local, remote := net.Pipe()
+	session := NewMuxSession(local, true)
+	remote.Write(muxFrame(MUX_DATA, 4, nil))
+	remote.Write(muxFrame(MUX_DATA, 2, nil))
+	assertMuxFailed(t, session)
+	session.Close()
+	remote.Close()
+}
+
+// Test that a session ends when the other end sends more than its window.
+func TestMuxRefusesWindow(t *testing.T) {
+	local, remote := net.Pipe()
+	session := NewMuxSession(local, true)
+	defer session.Close()
+	defer remote.Close()
+
+	payload := make([]byte, MUX_MAX_FRAME)
+	for sent := 0; sent < MUX_WINDOW_SIZE; sent += MUX_MAX_FRAME {
+		_, err := remote.Write(muxFrame(MUX_DATA, 2, payload))
+		assert.Tf(t, err == nil, "%v", err)
+	}
+	assert.T(t, session.Err() == nil)
+
+	remote.Write(muxFrame(MUX_DATA, 2, []byte{0}))
+	assertMuxFailed(t, session)
+}
+
+// Test that reads and writes on a stream time out.
+func TestMuxTimeout(t *testing.T) {
+	local, remote := net.Pipe()
+	client := NewMuxSession(local, true)
+	defer client.Close()
+	server := NewMuxSession(remote, false)
+	defer server.Close()
+
+	stream, err := client.Open()
+	assert.Tf(t, err == nil, "%v", err)
+	_, err = server.Accept()
+	assert.Tf(t, err == nil, "%v", err)
+
+	stream.SetReadTimeout(1e7)
+	_, err = stream.Read(make([]byte, 1))
+	assert.Tf(t, fs.IsTimeout(err), "%v", err)
+
+	// Nothing reads on the server, so the window is soon spent.
+	stream.SetWriteTimeout(1e7)
+	n, err := stream.Write(make([]byte, MUX_WINDOW_SIZE+1))
+	assert.Tf(t, fs.IsTimeout(err), "%v", err)
+	assert.Equal(t, MUX_WINDOW_SIZE, n)
+	assert.T(t, client.Err() == nil)
+}
+
+func TestPeerStats(t *testing.T) {
+	path, store, file := mkOrigin(t)
+	defer os.RemoveAll(path)
+
+	server := httptest.NewServer(NewServer(store))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	block := file.Blocks()[0]
+	_, err := client.ReadBlock(block.Info().Strong)
+	assert.Tf(t, err == nil, "%v", err)
+	_, err = client.ReadBlock("nosuchblock")
+	assert.T(t, err != nil)
+
+	// Hello and two block reads
+	stats := client.Stats()
+	assert.Equal(t, server.URL, stats.URL)
+	assert.Equal(t, int64(3), stats.Requests)
+	assert.Equal(t, int64(1), stats.Errors)
+	assert.T(t, stats.Sent > 0)
+	assert.Tf(t, stats.Received >= int64(fs.BLOCKSIZE), "%v", stats)
+	assert.T(t, stats.Elapsed > 0)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/stats", nil)
+	(&StatsHandler{Clients: []*Client{client}}).ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	served := []*PeerStats{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &served)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, 1, len(served))
+	assert.Equal(t, stats.Received, served[0].Received)
+}
+
+func TestHaveBlocks(t *testing.T) {
+	path, store, file := mkOrigin(t)
+	defer os.RemoveAll(path)
+
+	server := httptest.NewServer(NewServer(store))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	strong := file.Blocks()[0].Info().Strong
+	had, err := client.HaveBlocks([]string{strong, fs.StrongChecksum([]byte("nosuchblock"))})
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, 1, len(had))
+	assert.T(t, had[strong])
+
+	// Providers which cannot tell refuse to answer.
+	proxy := httptest.NewServer(NewServer(client))
+	defer proxy.Close()
+	_, err = NewClient(proxy.URL).HaveBlocks([]string{strong})
+	_, is := err.(*ErrStatus)
+	assert.Tf(t, is, "%v", err)
+}
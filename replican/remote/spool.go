@@ -0,0 +1,404 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"http"
+	"io"
+	"io/ioutil"
+	"json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/cmars/replican-sync/replican/archive"
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// A push agent receives blocks from a pushing client into a Spool before
+// applying them, with a SpoolServer answering /have queries for the spool
+// and storing blocks put to /spool/block/<strong>. Once the blocks are
+// pushed, the manifest of the tree is put to /spool/tree, and the spool
+// can then be the source of a patch plan applying the tree.
+//
+// Blocks already spooled are never sent again, so a push which is
+// interrupted resumes where it left off, and a block repeated in the
+// content being pushed is sent once.
+const SPOOL_BLOCK string = "/spool/block/"
+const SPOOL_TREE string = "/spool/tree"
+
+// Name of the staged manifest in a spool directory, which cannot be
+// mistaken for the hex directories blocks are stored in.
+const SPOOL_MANIFEST string = "manifest.json"
+
+// Largest block a SpoolServer accepts.
+const MAX_SPOOL_BLOCK int64 = 1 << 24
+
+// Largest manifest a SpoolServer accepts.
+const MAX_SPOOL_MANIFEST int64 = 1 << 28
+
+// A directory of received blocks, named by strong checksum, and the
+// manifest of the tree they are pushed for.
+type Spool struct {
+	Dir string
+
+	repo  *fs.MemRepo
+	mutex sync.Mutex
+}
+
+// Open a spool directory, with any manifest already staged in it.
+func NewSpool(dir string) (*Spool, os.Error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	spool := &Spool{Dir: dir}
+	manifestPath := filepath.Join(dir, SPOOL_MANIFEST)
+	if _, err := os.Stat(manifestPath); err != nil {
+		return spool, nil
+	}
+
+	buf, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	manifest := []*archive.Entry{}
+	if err = json.Unmarshal(buf, &manifest); err != nil {
+		return nil, err
+	}
+	if spool.repo, err = archive.NewRepo(manifest); err != nil {
+		return nil, err
+	}
+	return spool, nil
+}
+
+// Stage the manifest of the tree being pushed.
+func (spool *Spool) PutManifest(manifest []*archive.Entry) os.Error {
+	repo, err := archive.NewRepo(manifest)
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filepath.Join(spool.Dir, SPOOL_MANIFEST), buf, 0644); err != nil {
+		return err
+	}
+
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+	spool.repo = repo
+	return nil
+}
+
+// Get the tree of the staged manifest, or nil if none is staged.
+func (spool *Spool) Repo() fs.NodeRepo {
+	if repo := spool.stagedRepo(); repo != nil {
+		return repo
+	}
+	return nil
+}
+
+func (spool *Spool) stagedRepo() *fs.MemRepo {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+	return spool.repo
+}
+
+// Test whether a manifest is staged and all the blocks of its files
+// have been received, so that the tree can be applied.
+func (spool *Spool) Complete() bool {
+	repo := spool.stagedRepo()
+	if repo == nil {
+		return false
+	}
+	root := repo.Root()
+	if root == nil {
+		return true
+	}
+
+	complete := true
+	fs.Walk(root, func(node fs.Node) bool {
+		if file, isFile := node.(fs.File); isFile {
+			for _, block := range file.Blocks() {
+				if !spool.HaveBlock(block.Info().Strong) {
+					complete = false
+				}
+			}
+			return false
+		}
+		return complete
+	})
+	return complete
+}
+
+// Test whether a block has been received.
+func (spool *Spool) HaveBlock(strong string) bool {
+	if !isStrong(strong) {
+		return false
+	}
+	_, err := os.Stat(blockPath(spool.Dir, strong))
+	return err == nil
+}
+
+// Get the blocks not yet received, in the order given, each only once.
+func (spool *Spool) Missing(strongs []string) []string {
+	missing := []string{}
+	seen := make(map[string]bool)
+	for _, strong := range strongs {
+		if !seen[strong] && !spool.HaveBlock(strong) {
+			missing = append(missing, strong)
+		}
+		seen[strong] = true
+	}
+	return missing
+}
+
+// Store a received block, which must match its strong checksum.
+func (spool *Spool) Put(strong string, data []byte) os.Error {
+	if !isStrong(strong) || fs.StrongChecksum(data) != strong {
+		return os.NewError(fmt.Sprintf("Block %s failed verification", strong))
+	}
+	if spool.HaveBlock(strong) {
+		return nil
+	}
+	return storeBlock(blockPath(spool.Dir, strong), data)
+}
+
+// Remove all spooled blocks and the staged manifest, once they have been
+// applied, leaving the spool empty for the next push.
+func (spool *Spool) Clear() os.Error {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+	spool.repo = nil
+
+	if err := os.RemoveAll(spool.Dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(spool.Dir, 0755)
+}
+
+func (spool *Spool) ReadBlock(strong string) ([]byte, os.Error) {
+	buf := &bytes.Buffer{}
+	if _, err := spool.ReadBlockInto(strong, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (spool *Spool) ReadBlockInto(strong string, writer io.Writer) (int64, os.Error) {
+	if !isStrong(strong) {
+		return 0, os.NewError(fmt.Sprintf("Block %s not spooled", strong))
+	}
+
+	f, err := os.Open(blockPath(spool.Dir, strong))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(writer, f)
+}
+
+// Ranges of files in the staged manifest are assembled from their
+// spooled blocks, each of which was verified when it was put.
+func (spool *Spool) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	if repo := spool.stagedRepo(); repo != nil {
+		if file, has := repo.File(strong); has {
+			return readBlocksInto(spool, file, from, length, writer)
+		}
+	}
+	return 0, os.NewError(fmt.Sprintf("File %s not in the spooled manifest", strong))
+}
+
+// Test that a strong checksum is hex, and so safe to use as a file name.
+func isStrong(strong string) bool {
+	if strong == "" {
+		return false
+	}
+	_, err := hex.DecodeString(strong)
+	return err == nil
+}
+
+// Receive pushed blocks into a spool over HTTP.
+//
+// Every request must present the token, as a client's Token does:
+//
+//	Authorization: Bearer <token>
+//
+// A server without a token refuses all requests.
+type SpoolServer struct {
+	Spool *Spool
+	Token string
+
+	// If not nil, called when a manifest is put once all its blocks are
+	// spooled, to apply the tree. Its error fails the put.
+	Apply func(spool *Spool) os.Error
+}
+
+func NewSpoolServer(spool *Spool, token string) *SpoolServer {
+	return &SpoolServer{Spool: spool, Token: token}
+}
+
+func (server *SpoolServer) authorized(r *http.Request) bool {
+	if server.Token == "" {
+		return false
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(server.Token)) == 1
+}
+
+func (server *SpoolServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !server.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.URL.Path == HAVE_PATH:
+		serveHave(w, r, server.Spool)
+	case strings.HasPrefix(r.URL.Path, SPOOL_BLOCK) && r.Method == "PUT":
+		data, ok := readBody(w, r, MAX_SPOOL_BLOCK)
+		if !ok {
+			return
+		}
+		if err := server.Spool.Put(r.URL.Path[len(SPOOL_BLOCK):], data); err != nil {
+			http.Error(w, err.String(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == SPOOL_TREE && r.Method == "PUT":
+		server.serveTree(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (server *SpoolServer) serveTree(w http.ResponseWriter, r *http.Request) {
+	buf, ok := readBody(w, r, MAX_SPOOL_MANIFEST)
+	if !ok {
+		return
+	}
+	manifest := []*archive.Entry{}
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		http.Error(w, err.String(), http.StatusBadRequest)
+		return
+	}
+	if err := server.Spool.PutManifest(manifest); err != nil {
+		http.Error(w, err.String(), http.StatusBadRequest)
+		return
+	}
+
+	if server.Apply != nil {
+		if !server.Spool.Complete() {
+			http.Error(w, "Blocks of the tree are not all spooled", http.StatusConflict)
+			return
+		}
+		if err := server.Apply(server.Spool); err != nil {
+			http.Error(w, err.String(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Read a request body of at most max bytes, answering the request if it
+// cannot be.
+func readBody(w http.ResponseWriter, r *http.Request, max int64) ([]byte, bool) {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		http.Error(w, err.String(), http.StatusBadRequest)
+		return nil, false
+	}
+	if int64(len(data)) > max {
+		http.Error(w, fmt.Sprintf("Body larger than %d bytes", max), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	return data, true
+}
+
+// Push blocks read from a provider to the server's spool, skipping those
+// it already has. Pushing again after an interruption sends only the
+// blocks which were not received.
+func (client *Client) Push(provider fs.BlockProvider, strongs []string) os.Error {
+	had, err := client.HaveBlocks(strongs)
+	if err != nil {
+		return err
+	}
+
+	for _, strong := range strongs {
+		if had[strong] {
+			continue
+		}
+		had[strong] = true
+
+		buf := &bytes.Buffer{}
+		if _, err = provider.ReadBlockInto(strong, buf); err != nil {
+			return err
+		}
+
+		for attempt := 0; ; attempt++ {
+			err = client.put(client.URL+SPOOL_BLOCK+strong, buf.Bytes())
+			if err == nil {
+				break
+			} else if !client.retry(attempt, err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Push a tree to the server's spool: the blocks of its files which the
+// spool does not have, then its manifest. A server which applies what is
+// pushed to it has done so when this returns.
+func (client *Client) PushTree(store fs.BlockStore) os.Error {
+	root := store.Repo().Root()
+	strongs := []string{}
+	if root != nil {
+		fs.Walk(root, func(node fs.Node) bool {
+			if file, isFile := node.(fs.File); isFile {
+				for _, block := range file.Blocks() {
+					strongs = append(strongs, block.Info().Strong)
+				}
+				return false
+			}
+			return true
+		})
+	}
+	if err := client.Push(store, strongs); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(archive.NewManifest(root))
+	if err != nil {
+		return err
+	}
+	return client.put(client.URL+SPOOL_TREE, buf)
+}
+
+func (client *Client) put(url string, data []byte) os.Error {
+	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(data))
+
+	resp, err := client.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return &ErrStatus{URL: url, Status: resp.Status}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package remote
+
+import (
+	"bytes"
+	"http"
+	"http/httptest"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/sync"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+// Fails block reads after a number of them, as a push interrupted part way.
+type failingProvider struct {
+	fs.BlockProvider
+	reads int
+	limit int
+}
+
+func (fp *failingProvider) ReadBlockInto(strong string, writer io.Writer) (int64, os.Error) {
+	if fp.limit >= 0 && fp.reads >= fp.limit {
+		return 0, os.NewError("interrupted")
+	}
+	fp.reads++
+	return fp.BlockProvider.ReadBlockInto(strong, writer)
+}
+
+func TestPushResume(t *testing.T) {
+	path, store, file := mkOrigin(t)
+	defer os.RemoveAll(path)
+
+	spoolDir, err := ioutil.TempDir("", "spool")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(spoolDir)
+	spool, err := NewSpool(spoolDir)
+	assert.T(t, err == nil)
+
+	server := httptest.NewServer(NewSpoolServer(spool, "secret"))
+	defer server.Close()
+	client := NewClient(server.URL)
+	client.Token = "secret"
+
+	// Repeated blocks are only sent once.
+	strongs := []string{}
+	for _, block := range file.Blocks() {
+		strongs = append(strongs, block.Info().Strong)
+	}
+	strongs = append(strongs, strongs[0])
+	unique := len(spool.Missing(strongs))
+	assert.Equal(t, len(file.Blocks()), unique)
+
+	interrupted := &failingProvider{BlockProvider: store, limit: 3}
+	assert.T(t, client.Push(interrupted, strongs) != nil)
+	assert.Equal(t, unique-3, len(spool.Missing(strongs)))
+
+	resumed := &failingProvider{BlockProvider: store, limit: -1}
+	err = client.Push(resumed, strongs)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, unique-3, resumed.reads)
+	assert.Equal(t, 0, len(spool.Missing(strongs)))
+
+	for _, block := range file.Blocks() {
+		buf, err := spool.ReadBlock(block.Info().Strong)
+		assert.Tf(t, err == nil, "%v", err)
+		assert.Equal(t, block.Info().Strong, fs.StrongChecksum(buf))
+	}
+
+	// Blocks which do not match their checksum are refused.
+	assert.T(t, spool.Put(strongs[0], []byte("corrupt")) != nil)
+	assert.T(t, spool.Put("../escape", []byte("corrupt")) != nil)
+}
+
+func TestApplyFromSpool(t *testing.T) {
+	tg := treegen.New()
+	srcPath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.D("baz", tg.F("quux", tg.B(43, 10000)), tg.F("again", tg.B(42, 65537)))))
+	defer os.RemoveAll(srcPath)
+	srcStore, err := fs.NewLocalStore(srcPath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	dstPath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(44, 1000))))
+	defer os.RemoveAll(dstPath)
+
+	spoolDir, err := ioutil.TempDir("", "spool")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(spoolDir)
+	spool, err := NewSpool(spoolDir)
+	assert.T(t, err == nil)
+
+	spoolServer := NewSpoolServer(spool, "secret")
+	spoolServer.Apply = func(spool *Spool) os.Error {
+		dstStore, err := fs.NewLocalStore(dstPath, fs.NewMemRepo())
+		if err != nil {
+			return err
+		}
+		_, err = sync.NewPatchPlan(spool, dstStore).Exec()
+		return err
+	}
+	server := httptest.NewServer(spoolServer)
+	defer server.Close()
+	client := NewClient(server.URL)
+	client.Token = "secret"
+
+	err = client.PushTree(srcStore)
+	assert.Tf(t, err == nil, "%v", err)
+
+	for _, relpath := range []string{
+		filepath.Join("foo", "bar"),
+		filepath.Join("foo", "baz", "quux"),
+		filepath.Join("foo", "baz", "again")} {
+		srcFile, _, err := fs.IndexFile(filepath.Join(srcPath, relpath))
+		assert.Tf(t, err == nil, "%v", err)
+		dstFile, _, err := fs.IndexFile(filepath.Join(dstPath, relpath))
+		assert.Tf(t, err == nil, "%v", err)
+		assert.Equalf(t, srcFile.Strong, dstFile.Strong, "%s", relpath)
+	}
+
+	// The staged manifest survives reopening the spool.
+	reopened, err := NewSpool(spoolDir)
+	assert.T(t, err == nil)
+	assert.T(t, reopened.Complete())
+
+	assert.T(t, spool.Clear() == nil)
+	assert.T(t, spool.Repo() == nil)
+	assert.T(t, !spool.Complete())
+}
+
+func TestSpoolServerRefuses(t *testing.T) {
+	spoolDir, err := ioutil.TempDir("", "spool")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(spoolDir)
+	spool, err := NewSpool(spoolDir)
+	assert.T(t, err == nil)
+
+	data := []byte("block")
+	strong := fs.StrongChecksum(data)
+	put := func(url string, token string, body []byte) int {
+		req, err := http.NewRequest("PUT", url, bytes.NewBuffer(body))
+		assert.T(t, err == nil)
+		req.ContentLength = int64(len(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Tf(t, err == nil, "%v", err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	tokenless := httptest.NewServer(NewSpoolServer(spool, ""))
+	defer tokenless.Close()
+	assert.Equal(t, http.StatusUnauthorized, put(tokenless.URL+SPOOL_BLOCK+strong, "", data))
+
+	server := httptest.NewServer(NewSpoolServer(spool, "secret"))
+	defer server.Close()
+	assert.Equal(t, http.StatusUnauthorized, put(server.URL+SPOOL_BLOCK+strong, "", data))
+	assert.Equal(t, http.StatusUnauthorized, put(server.URL+SPOOL_BLOCK+strong, "wrong", data))
+	assert.T(t, !spool.HaveBlock(strong))
+
+	huge := make([]byte, MAX_SPOOL_BLOCK+1)
+	assert.Equal(t, http.StatusRequestEntityTooLarge,
+		put(server.URL+SPOOL_BLOCK+fs.StrongChecksum(huge), "secret", huge))
+
+	assert.Equal(t, http.StatusNoContent, put(server.URL+SPOOL_BLOCK+strong, "secret", data))
+	assert.T(t, spool.HaveBlock(strong))
+}
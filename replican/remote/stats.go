@@ -0,0 +1,121 @@
+package remote
+
+import (
+	"http"
+	"io"
+	"json"
+	"os"
+	"time"
+)
+
+// Transfer statistics for a peer, as seen by a client reading from it,
+// so that slow or flaky sources can be spotted.
+type PeerStats struct {
+	URL string
+
+	// Requests made, and those failed by the network or an error status.
+	Requests int64
+	Errors   int64
+
+	// Blocks served which did not match the checksum asked for.
+	Corrupt int64
+
+	// Bytes of request and response bodies, as carried by the network.
+	Sent     int64
+	Received int64
+
+	// Time spent on requests, in nanoseconds.
+	Elapsed int64
+}
+
+// Get the fraction of requests which failed.
+func (stats *PeerStats) ErrorRate() float64 {
+	if stats.Requests == 0 {
+		return 0
+	}
+	return float64(stats.Errors) / float64(stats.Requests)
+}
+
+// Get the bytes received per second spent on requests.
+func (stats *PeerStats) Throughput() float64 {
+	if stats.Elapsed == 0 {
+		return 0
+	}
+	return float64(stats.Received) * 1e9 / float64(stats.Elapsed)
+}
+
+// Get the client's statistics so far.
+func (client *Client) Stats() *PeerStats {
+	client.statsMutex.Lock()
+	defer client.statsMutex.Unlock()
+	stats := client.stats
+	stats.URL = client.URL
+	return &stats
+}
+
+// Record a request begun at start, in nanoseconds.
+func (client *Client) record(start int64, sent int64, received int64, failed bool) {
+	client.statsMutex.Lock()
+	defer client.statsMutex.Unlock()
+	client.stats.Requests++
+	if failed {
+		client.stats.Errors++
+	}
+	client.stats.Sent += sent
+	client.stats.Received += received
+	client.stats.Elapsed += time.Nanoseconds() - start
+}
+
+func (client *Client) recordCorrupt() {
+	client.statsMutex.Lock()
+	defer client.statsMutex.Unlock()
+	client.stats.Corrupt++
+}
+
+// Get the statistics of each peer in the mesh.
+func (mesh *Mesh) Stats() []*PeerStats {
+	stats := make([]*PeerStats, len(mesh.Peers))
+	for i, peer := range mesh.Peers {
+		stats[i] = peer.Stats()
+	}
+	return stats
+}
+
+// Serves the statistics of clients as JSON, to be mounted on a
+// reporting or metrics endpoint.
+type StatsHandler struct {
+	Clients []*Client
+}
+
+func (handler *StatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := make([]*PeerStats, len(handler.Clients))
+	for i, client := range handler.Clients {
+		stats[i] = client.Stats()
+	}
+
+	buf, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, err.String(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+// Counts the bytes read through it.
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (cr *countingReader) Read(buf []byte) (int, os.Error) {
+	n, err := cr.reader.Read(buf)
+	cr.n += int64(n)
+	return n, err
+}
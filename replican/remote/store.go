@@ -0,0 +1,56 @@
+package remote
+
+import (
+	"io"
+	"os"
+
+	"github.com/cmars/replican-sync/replican/archive"
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// A remote tree, usable as the source of a patch plan.
+// The tree model is fetched from the server's manifest when the store is
+// opened; block data is read from the server as the plan is executed.
+type Store struct {
+	*Client
+
+	repo *fs.MemRepo
+	data fs.BlockProvider
+}
+
+func NewStore(client *Client) (*Store, os.Error) {
+	return NewSplitStore(client, client)
+}
+
+// Open a remote tree whose manifest is fetched from one server, the index
+// client's, and whose block data is read from another, such as a CDN in
+// front of a data server or an object store mirroring it. The two are
+// configured independently; a data client which cannot negotiate, as a
+// static host cannot, should be given its Session.
+func NewSplitStore(index *Client, data fs.BlockProvider) (*Store, os.Error) {
+	manifest, err := index.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := archive.NewRepo(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{Client: index, repo: repo, data: data}, nil
+}
+
+func (store *Store) Repo() fs.NodeRepo { return store.repo }
+
+func (store *Store) ReadBlock(strong string) ([]byte, os.Error) {
+	return store.data.ReadBlock(strong)
+}
+
+func (store *Store) ReadBlockInto(strong string, writer io.Writer) (int64, os.Error) {
+	return store.data.ReadBlockInto(strong, writer)
+}
+
+func (store *Store) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	return store.data.ReadInto(strong, from, length, writer)
+}
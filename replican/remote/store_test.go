@@ -0,0 +1,63 @@
+package remote
+
+import (
+	"http"
+	"http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/sync"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSplitStore(t *testing.T) {
+	path, store, file := mkOrigin(t)
+	defer os.RemoveAll(path)
+
+	index := httptest.NewServer(NewIndexServer(store.Repo()))
+	defer index.Close()
+
+	// Stands in for a CDN, which serves data but cannot negotiate.
+	dataServer := NewServer(store)
+	data := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == HELLO_PATH || r.URL.Path == TREE_PATH {
+			http.NotFound(w, r)
+			return
+		}
+		dataServer.ServeHTTP(w, r)
+	}))
+	defer data.Close()
+
+	indexClient := NewClient(index.URL)
+	_, err := indexClient.ReadBlock(file.Blocks()[0].Info().Strong)
+	assert.T(t, err != nil)
+
+	session, err := indexClient.Hello()
+	assert.Tf(t, err == nil, "%v", err)
+	dataClient := NewClient(data.URL)
+	dataClient.Session = session
+
+	srcStore, err := NewSplitStore(indexClient, dataClient)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t,
+		store.Repo().Root().(fs.Dir).Info().Strong,
+		srcStore.Repo().Root().(fs.Dir).Info().Strong)
+
+	tg := treegen.New()
+	dstPath := treegen.TestTree(t, tg.D("foo"))
+	defer os.RemoveAll(dstPath)
+	dstStore, err := fs.NewLocalStore(dstPath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	plan := sync.NewPatchPlan(srcStore, dstStore)
+	_, err = plan.Exec()
+	assert.Tf(t, err == nil, "%v", err)
+
+	dstFile, _, err := fs.IndexFile(filepath.Join(dstPath, "foo", "bar"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, file.Info().Strong, dstFile.Strong)
+}
@@ -0,0 +1,249 @@
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"http"
+	"io"
+	"json"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+const STREAM_PREFIX string = "/stream/"
+
+// Describe one file as the list of its blocks, for syncing single large
+// files such as disk images without indexing or exchanging a whole tree.
+//
+// On the wire, a chunk map is a line holding the file's FileInfo as JSON,
+// followed by a line per block of the form "<position> <weak> <strong>",
+// so that it can be written and read as a stream.
+type ChunkMap struct {
+	Info   *fs.FileInfo
+	Blocks []*fs.BlockInfo
+}
+
+// Index a local file into a chunk map.
+func NewChunkMap(path string) (*ChunkMap, os.Error) {
+	info, blocks, err := fs.IndexFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkMap{Info: info, Blocks: blocks}, nil
+}
+
+func (chunkMap *ChunkMap) WriteTo(w io.Writer) (int64, os.Error) {
+	cw := &countWriter{w: w}
+
+	infoBytes, err := json.Marshal(chunkMap.Info)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err = fmt.Fprintf(cw, "%s\n", infoBytes); err != nil {
+		return cw.n, err
+	}
+
+	for _, block := range chunkMap.Blocks {
+		if _, err = fmt.Fprintf(cw, "%d %d %s\n", block.Position, block.Weak, block.Strong); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, nil
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(buf []byte) (int, os.Error) {
+	n, err := cw.w.Write(buf)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Read a chunk map written by WriteTo.
+func ReadChunkMap(r io.Reader) (*ChunkMap, os.Error) {
+	br := bufio.NewReader(r)
+
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	chunkMap := &ChunkMap{Info: &fs.FileInfo{}}
+	if err = json.Unmarshal([]byte(line), chunkMap.Info); err != nil {
+		return nil, err
+	}
+
+	for {
+		line, err = br.ReadString('\n')
+		if err == os.EOF && line == "" {
+			break
+		} else if err != nil && err != os.EOF {
+			return nil, err
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, os.NewError(fmt.Sprintf("Invalid chunk map entry: %s", line))
+		}
+
+		block := &fs.BlockInfo{Strong: fields[2], Parent: chunkMap.Info.Strong}
+		if block.Position, err = strconv.Atoi(fields[0]); err != nil {
+			return nil, err
+		}
+		if block.Weak, err = strconv.Atoi(fields[1]); err != nil {
+			return nil, err
+		}
+		chunkMap.Blocks = append(chunkMap.Blocks, block)
+	}
+
+	return chunkMap, nil
+}
+
+// Serve named local files as block streams: the chunk map of a file
+// at /stream/<name>, and ranges of it at /stream/<name>?from=<offset>&length=<length>.
+// Names are used in URLs as they are, so should not need escaping.
+type StreamServer struct {
+	// Local file paths, by published name.
+	Files map[string]string
+
+	// If not nil, chunk maps are built by way of this cache, so that files
+	// unchanged since they were last served are not rehashed.
+	Cache *fs.BlockMapCache
+
+	cacheMutex sync.Mutex
+}
+
+func NewStreamServer() *StreamServer {
+	return &StreamServer{Files: make(map[string]string)}
+}
+
+func (server *StreamServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, STREAM_PREFIX) {
+		http.NotFound(w, r)
+		return
+	}
+
+	path, has := server.Files[r.URL.Path[len(STREAM_PREFIX):]]
+	if !has {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.FormValue("from") == "" {
+		chunkMap, err := server.chunkMap(path)
+		if err != nil {
+			http.Error(w, err.String(), http.StatusInternalServerError)
+			return
+		}
+		chunkMap.WriteTo(w)
+		return
+	}
+
+	from, length, ok := readRange(w, r)
+	if !ok {
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, err.String(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.String(), http.StatusInternalServerError)
+		return
+	} else if from+length > fi.Size {
+		http.Error(w, "range past the end of the file", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	// Streamed straight from the file, so that files larger than memory
+	// can be served. A response cut short falls short of its length.
+	w.Header().Set("Content-Length", strconv.Itoa64(length))
+	io.Copy(w, io.NewSectionReader(f, from, length))
+}
+
+func (server *StreamServer) chunkMap(path string) (*ChunkMap, os.Error) {
+	if server.Cache == nil {
+		return NewChunkMap(path)
+	}
+
+	server.cacheMutex.Lock()
+	defer server.cacheMutex.Unlock()
+
+	info, blocks, err := server.Cache.IndexFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkMap{Info: info, Blocks: blocks}, nil
+}
+
+// A single remote file published by a StreamServer, usable as the source
+// of a patch plan onto a single local file.
+type StreamStore struct {
+	client *Client
+	name   string
+	repo   *fs.MemRepo
+	file   fs.File
+}
+
+// Open a named stream, fetching its chunk map.
+func NewStreamStore(client *Client, name string) (*StreamStore, os.Error) {
+	buf := &bytes.Buffer{}
+	if _, err := client.get(client.URL+STREAM_PREFIX+name, buf); err != nil {
+		return nil, err
+	}
+
+	chunkMap, err := ReadChunkMap(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := fs.NewMemRepo()
+	file := repo.AddFile(nil, chunkMap.Info, chunkMap.Blocks)
+	return &StreamStore{client: client, name: name, repo: repo, file: file}, nil
+}
+
+func (store *StreamStore) Repo() fs.NodeRepo { return store.repo }
+
+func (store *StreamStore) ReadBlock(strong string) ([]byte, os.Error) {
+	buf := &bytes.Buffer{}
+	if _, err := store.ReadBlockInto(strong, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (store *StreamStore) ReadBlockInto(strong string, writer io.Writer) (int64, os.Error) {
+	block, has := store.repo.Block(strong)
+	if !has {
+		return 0, os.NewError(fmt.Sprintf("Block with strong checksum %s not found", strong))
+	}
+
+	return store.readRange(block.Info().Offset(), block.Info().Size(), writer)
+}
+
+func (store *StreamStore) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	if strong != store.file.Info().Strong {
+		return 0, os.NewError(fmt.Sprintf("File with strong checksum %s not found", strong))
+	}
+
+	return store.readRange(from, length, writer)
+}
+
+func (store *StreamStore) readRange(from int64, length int64, writer io.Writer) (int64, os.Error) {
+	return store.client.get(fmt.Sprintf("%s%s%s?from=%d&length=%d",
+		store.client.URL, STREAM_PREFIX, store.name, from, length), writer)
+}
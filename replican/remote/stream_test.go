@@ -0,0 +1,104 @@
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"http"
+	"http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/sync"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestChunkMapRoundTrip(t *testing.T) {
+	path, _, file := mkOrigin(t)
+	defer os.RemoveAll(path)
+
+	chunkMap, err := NewChunkMap(filepath.Join(path, "foo", "bar"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, file.Info().Strong, chunkMap.Info.Strong)
+
+	buf := &bytes.Buffer{}
+	_, err = chunkMap.WriteTo(buf)
+	assert.T(t, err == nil)
+
+	readMap, err := ReadChunkMap(buf)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, chunkMap.Info.Size, readMap.Info.Size)
+	assert.Equal(t, len(chunkMap.Blocks), len(readMap.Blocks))
+	for i, block := range chunkMap.Blocks {
+		assert.Equal(t, block.Position, readMap.Blocks[i].Position)
+		assert.Equal(t, block.Weak, readMap.Blocks[i].Weak)
+		assert.Equal(t, block.Strong, readMap.Blocks[i].Strong)
+	}
+}
+
+func TestStreamSync(t *testing.T) {
+	path, _, file := mkOrigin(t)
+	defer os.RemoveAll(path)
+
+	streams := NewStreamServer()
+	streams.Files["disk.img"] = filepath.Join(path, "foo", "bar")
+	server := httptest.NewServer(streams)
+	defer server.Close()
+
+	srcStore, err := NewStreamStore(NewClient(server.URL), "disk.img")
+	assert.Tf(t, err == nil, "%v", err)
+
+	tg := treegen.New()
+	dstPath := treegen.TestTree(t, tg.D("foo", tg.F("img", tg.B(42, 30000))))
+	defer os.RemoveAll(dstPath)
+	dstFilePath := filepath.Join(dstPath, "foo", "img")
+
+	dstStore, err := fs.NewLocalStore(dstFilePath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	plan := sync.NewPatchPlan(srcStore, dstStore)
+	_, err = plan.Exec()
+	assert.Tf(t, err == nil, "%v", err)
+
+	dstFile, _, err := fs.IndexFile(dstFilePath)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, file.Info().Strong, dstFile.Strong)
+
+	_, err = NewStreamStore(NewClient(server.URL), "nosuch")
+	assert.T(t, err != nil)
+}
+
+// Test that ranges are streamed whole, however large, and only within
+// the file.
+func TestStreamLargeRange(t *testing.T) {
+	tg := treegen.New()
+	path := treegen.TestTree(t, tg.F("disk.img", tg.B(42, 1<<22), tg.B(43, 1<<22)))
+	defer os.RemoveAll(path)
+
+	streams := NewStreamServer()
+	streams.Files["disk.img"] = filepath.Join(path, "disk.img")
+	server := httptest.NewServer(streams)
+	defer server.Close()
+
+	srcStore, err := NewStreamStore(NewClient(server.URL), "disk.img")
+	assert.Tf(t, err == nil, "%v", err)
+	info := srcStore.Repo().Root().(fs.File).Info()
+	assert.Equal(t, int64(2<<22), info.Size)
+
+	buf := &bytes.Buffer{}
+	n, err := srcStore.ReadInto(info.Strong, 0, info.Size, buf)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, info.Size, n)
+	assert.Equal(t, info.Strong, fs.StrongChecksum(buf.Bytes()))
+
+	for _, query := range []string{"from=-1&length=10", "from=0&length=-1",
+		fmt.Sprintf("from=%d&length=10", info.Size-5)} {
+		resp, err := http.Get(server.URL + STREAM_PREFIX + "disk.img?" + query)
+		assert.Tf(t, err == nil, "%v", err)
+		resp.Body.Close()
+		assert.Tf(t, resp.StatusCode != http.StatusOK, "%s", query)
+	}
+}
@@ -0,0 +1,74 @@
+package stats
+
+import (
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// An estimate of the cost of syncing one tree to another.
+type Estimate struct {
+	// Size of the source.
+	Files int64
+	Bytes int64
+
+	// Bytes of source content already in the destination, whole files
+	// or blocks, which a sync would reuse.
+	Reused int64
+
+	// Bytes of source content not in the destination, which a sync would
+	// transfer. Unique counts each distinct block once, as a transfer
+	// which dedups blocks repeated within the source would.
+	Transferred int64
+	Unique      int64
+}
+
+// Estimate the cost of syncing a source to a destination from their tree
+// models alone, such as manifests fetched from peers, without planning the
+// sync or reading any content. Blocks are matched by strong checksum at
+// block boundaries, so the estimate does not count content which a plan
+// would find at other offsets, and may overestimate the transfer.
+func NewEstimate(src fs.NodeRepo, dst fs.NodeRepo) *Estimate {
+	estimate := &Estimate{}
+	if src.Root() == nil {
+		return estimate
+	}
+
+	seen := make(map[string]bool)
+	fs.Walk(src.Root(), func(node fs.Node) bool {
+		file, isFile := node.(fs.File)
+		if !isFile {
+			_, isDir := node.(fs.Dir)
+			return isDir
+		}
+
+		size := file.Info().Size
+		estimate.Files++
+		estimate.Bytes += size
+
+		if _, has := dst.File(file.Info().Strong); has {
+			estimate.Reused += size
+			return false
+		}
+
+		for _, block := range file.Blocks() {
+			length := size - block.Info().Offset()
+			if length > block.Info().Size() {
+				length = block.Info().Size()
+			}
+
+			strong := block.Info().Strong
+			if _, has := dst.Block(strong); has {
+				estimate.Reused += length
+				continue
+			}
+
+			estimate.Transferred += length
+			if !seen[strong] {
+				estimate.Unique += length
+				seen[strong] = true
+			}
+		}
+		return false
+	})
+
+	return estimate
+}
@@ -0,0 +1,180 @@
+// Package stats records statistics about synced trees as a time series,
+// so that the growth and churn of a tree can be followed over time.
+//
+// Samples are stored as fixed-size records, appended in time order to
+// a local file. Queries by time range are answered by binary search
+// over the file, without reading the whole series.
+package stats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/sync"
+)
+
+// Statistics taken from one scan of a tree.
+type Sample struct {
+	// Time the sample was taken, in nanoseconds since the epoch.
+	Time int64
+
+	// Size of the tree.
+	Dirs  int64
+	Files int64
+	Bytes int64
+
+	// Number of changes needed to bring the tree up to date,
+	// and the number of bytes to be transferred from the source to do it.
+	Changes     int64
+	Transferred int64
+}
+
+const recordSize int64 = 6 * 8
+
+// Take a sample of a tree, and of the plan to update it if not nil.
+func NewSample(root fs.FsNode, plan *sync.PatchPlan) *Sample {
+	sample := &Sample{Time: time.Nanoseconds()}
+
+	if root != nil {
+		fs.Walk(root, func(node fs.Node) bool {
+			switch n := node.(type) {
+			case fs.Dir:
+				sample.Dirs++
+				return true
+			case fs.File:
+				sample.Files++
+				sample.Bytes += n.Info().Size
+			}
+			return false
+		})
+	}
+
+	if plan != nil {
+		for _, cmd := range plan.Cmds {
+			switch c := cmd.(type) {
+			case *sync.Keep:
+				continue
+			case *sync.SrcTempCopy:
+				sample.Transferred += c.Length
+			case *sync.SrcBlockCopy:
+				sample.Transferred += c.Length
+			case *sync.SrcFileDownload:
+				if !fs.IsSymlinkMode(c.SrcFile.Info().Mode) {
+					sample.Transferred += c.SrcFile.Info().Size
+				}
+			}
+			sample.Changes++
+		}
+	}
+
+	return sample
+}
+
+// A time series of samples, stored in a local file.
+type Series struct {
+	f     *os.File
+	count int64
+	last  int64
+}
+
+// Open a series file, creating it if necessary.
+func OpenSeries(path string) (*Series, os.Error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// An incomplete record left by an interrupted append is ignored,
+	// and overwritten by the next.
+	series := &Series{f: f, count: fi.Size / recordSize}
+	if series.count > 0 {
+		last, err := series.read(series.count - 1)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		series.last = last.Time
+	}
+
+	return series, nil
+}
+
+func (series *Series) read(i int64) (*Sample, os.Error) {
+	buf := make([]byte, recordSize)
+	if _, err := series.f.ReadAt(buf, i*recordSize); err != nil {
+		return nil, err
+	}
+
+	sample := &Sample{}
+	err := binary.Read(bytes.NewBuffer(buf), binary.BigEndian, sample)
+	return sample, err
+}
+
+// Append a sample to the series. Samples must be appended in time order.
+func (series *Series) Append(sample *Sample) os.Error {
+	if sample.Time < series.last {
+		return os.NewError(fmt.Sprintf(
+			"Sample at %d is earlier than the last in the series, at %d", sample.Time, series.last))
+	}
+
+	buf := &bytes.Buffer{}
+	if err := binary.Write(buf, binary.BigEndian, sample); err != nil {
+		return err
+	}
+
+	if _, err := series.f.WriteAt(buf.Bytes(), series.count*recordSize); err != nil {
+		return err
+	}
+
+	series.count++
+	series.last = sample.Time
+	return nil
+}
+
+// Get the number of samples in the series.
+func (series *Series) Len() int64 { return series.count }
+
+// Get the samples taken from time from, up to but not including time to.
+func (series *Series) Query(from int64, to int64) (samples []*Sample, err os.Error) {
+	start := series.search(from, &err)
+	end := series.search(to, &err)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := start; i < end; i++ {
+		sample, err := series.read(i)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// Find the index of the first sample taken at or after t.
+func (series *Series) search(t int64, err *os.Error) int64 {
+	return int64(sort.Search(int(series.count), func(i int) bool {
+		sample, readErr := series.read(int64(i))
+		if readErr != nil {
+			*err = readErr
+			return true
+		}
+		return sample.Time >= t
+	}))
+}
+
+func (series *Series) Close() os.Error {
+	return series.f.Close()
+}
@@ -0,0 +1,108 @@
+package stats
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/sync"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestNewSample(t *testing.T) {
+	tg := treegen.New()
+	srcPath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.D("baz", tg.F("qux", tg.B(7, 100)))))
+	defer os.RemoveAll(srcPath)
+	dstPath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(dstPath)
+
+	srcStore, err := fs.NewLocalStore(srcPath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	dstStore, err := fs.NewLocalStore(dstPath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	plan := sync.NewPatchPlan(srcStore, dstStore)
+	sample := NewSample(srcStore.Repo().Root(), plan)
+
+	assert.Equal(t, int64(3), sample.Dirs)
+	assert.Equal(t, int64(2), sample.Files)
+	assert.Equal(t, int64(65637), sample.Bytes)
+	assert.Tf(t, sample.Changes > 0, "%v", plan)
+	assert.Equal(t, int64(100), sample.Transferred)
+}
+
+func TestSeries(t *testing.T) {
+	f, err := ioutil.TempFile("", "series")
+	assert.T(t, err == nil)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	series, err := OpenSeries(f.Name())
+	assert.T(t, err == nil)
+
+	for i := int64(1); i <= 5; i++ {
+		err = series.Append(&Sample{Time: i * 10, Files: i})
+		assert.Tf(t, err == nil, "%v", err)
+	}
+
+	// Out of order
+	assert.T(t, series.Append(&Sample{Time: 15}) != nil)
+	series.Close()
+
+	series, err = OpenSeries(f.Name())
+	assert.T(t, err == nil)
+	defer series.Close()
+	assert.Equal(t, int64(5), series.Len())
+
+	samples, err := series.Query(20, 40)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, 2, len(samples))
+	assert.Equal(t, int64(20), samples[0].Time)
+	assert.Equal(t, int64(3), samples[1].Files)
+
+	samples, err = series.Query(0, 1000)
+	assert.T(t, err == nil)
+	assert.Equal(t, 5, len(samples))
+
+	samples, err = series.Query(51, 1000)
+	assert.T(t, err == nil)
+	assert.Equal(t, 0, len(samples))
+}
+
+func TestEstimate(t *testing.T) {
+	tg := treegen.New()
+	blocksize := int64(fs.BLOCKSIZE)
+	srcPath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.F("grown", tg.B(42, 65537), tg.B(44, 100)),
+		tg.F("dup", tg.B(43, blocksize), tg.B(43, blocksize)),
+		tg.D("baz", tg.F("qux", tg.B(7, 100)))))
+	defer os.RemoveAll(srcPath)
+	dstPath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(dstPath)
+
+	srcStore, err := fs.NewLocalStore(srcPath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	dstStore, err := fs.NewLocalStore(dstPath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	estimate := NewEstimate(srcStore.Repo(), dstStore.Repo())
+	assert.Equal(t, int64(4), estimate.Files)
+	assert.Equal(t, int64(65537+65637+2*blocksize+100), estimate.Bytes)
+
+	// All of bar, and the blocks of grown up to where it differs
+	assert.Equal(t, int64(65537+65536), estimate.Reused)
+
+	// The rest of grown, both blocks of dup and qux, but dup's blocks
+	// only once if unique.
+	assert.Equal(t, int64(101+2*blocksize+100), estimate.Transferred)
+	assert.Equal(t, int64(101+blocksize+100), estimate.Unique)
+	assert.Equal(t, estimate.Bytes, estimate.Reused+estimate.Transferred)
+}
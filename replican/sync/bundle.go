@@ -0,0 +1,655 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// A plan is encoded as a bundle, to be executed later or elsewhere against
+// the same destination. Integers are big-endian, strings are a length
+// uint32 followed by their bytes, and booleans are a single byte. Paths are
+// relative to the destination. The layout is:
+//
+//	header:    "RPLN", version uint8, flags uint8
+//	signature: length uint32 and bytes, only if flags has BUNDLE_SIGNED
+//	commands:  count uint32, then each command, a tag byte and its fields
+//	data:      count uint32, then each part of the source the commands read
+//
+// Each part of the source is a tag byte, 'B' for a block or 'R' for a
+// range of a file, its strong checksum, the offset of a range, and the
+// length and bytes of its content. Data is only included in bundles
+// encoded inline; otherwise the count is zero, and the commands read the
+// source given when the decoded plan is executed.
+//
+// Local temporary files are numbered in the order they are created, and
+// the commands building them refer to them by number. Files which Clean
+// would delete are encoded as Delete commands at the end of the bundle.
+//
+// Version 1 bundles carried their signature at the end; unsigned ones
+// are laid out as they are now, and are still decoded.
+const (
+	BUNDLE_MAGIC   = "RPLN"
+	BUNDLE_VERSION = 2
+)
+
+// Length of the bundle header.
+const bundleHeaderSize = len(BUNDLE_MAGIC) + 2
+
+// Largest bundle, in bytes, a decoder will accept, so that a corrupt or
+// hostile bundle cannot fill the disk its data is spooled to. Raise it
+// to apply larger bundles.
+var MaxBundleSize int64 = 1 << 34
+
+// Flags in the bundle header.
+const (
+	// The bundle carries the source data its commands read.
+	BUNDLE_INLINE byte = 1 << iota
+
+	// The header is followed by a signature over the rest of the bundle.
+	// See EncodeSignedPlan.
+	BUNDLE_SIGNED
+)
+
+const (
+	transferTag        byte = 'T'
+	dirMoveTag         byte = 'M'
+	keepTag            byte = 'K'
+	touchTag           byte = 'H'
+	setMetaTag         byte = 'S'
+	conflictTag        byte = 'C'
+	resizeTag          byte = 'Z'
+	deleteTag          byte = 'D'
+	localTempTag       byte = 'L'
+	replaceWithTempTag byte = 'P'
+	localTempCopyTag   byte = 'l'
+	srcTempCopyTag     byte = 's'
+	srcBlockCopyTag    byte = 'b'
+	srcFileDownloadTag byte = 'F'
+	createSymlinkTag   byte = 'Y'
+
+	blockDataTag byte = 'B'
+	rangeDataTag byte = 'R'
+)
+
+// Set in the encoded mode of a SetMeta which sets the mode, so that a
+// mode of zero can be set. Bundles encoded before it set only modes
+// which are not zero.
+const setMetaHasMode int64 = 1 << 32
+
+// Longest string a decoder will accept, so that a corrupt length
+// cannot exhaust memory.
+const maxEncodedString = 1 << 16
+
+// A part of the source which commands read.
+type sourcePart struct {
+	tag    byte
+	strong string
+	from   int64
+	length int64
+}
+
+func (part *sourcePart) key() string {
+	return fmt.Sprintf("%c:%s:%d:%d", part.tag, part.strong, part.from, part.length)
+}
+
+// Encode the plan as a bundle. With inline, the source data its commands
+// read is included, so that the bundle can be executed with no access to
+// the source store. Commands which cannot be carried out away from the
+// source, such as ConsistentCopy, cannot be encoded.
+func EncodePlan(w io.Writer, plan *PatchPlan, inline bool) os.Error {
+	return encodePlan(w, plan, bundleFlags(inline))
+}
+
+func bundleFlags(inline bool) byte {
+	if inline {
+		return BUNDLE_INLINE
+	}
+	return 0
+}
+
+func encodePlan(w io.Writer, plan *PatchPlan, flags byte) os.Error {
+	inline := flags&BUNDLE_INLINE != 0
+	enc := &planEncoder{w: w, temps: make(map[*LocalTemp]int)}
+	enc.pending.WriteString(BUNDLE_MAGIC)
+	enc.writeByte(BUNDLE_VERSION)
+	enc.writeByte(flags)
+
+	cmds := plan.Cmds
+	for _, dstPath := range plan.PendingDeletes() {
+		cmds = append(cmds, &Delete{
+			Path:  &LocalPath{LocalStore: plan.dstStore, RelPath: dstPath},
+			Trash: plan.opts.Trash})
+	}
+
+	enc.writeCount(len(cmds))
+	parts := []*sourcePart{}
+	seen := make(map[string]bool)
+	for _, cmd := range cmds {
+		part, err := enc.writeCmd(cmd)
+		if err != nil {
+			return err
+		}
+		if inline && part != nil && !seen[part.key()] {
+			seen[part.key()] = true
+			parts = append(parts, part)
+		}
+	}
+
+	enc.writeCount(len(parts))
+	for _, part := range parts {
+		if err := enc.writePart(plan.srcStore, part); err != nil {
+			return err
+		}
+	}
+	return enc.flush()
+}
+
+// Encodes a bundle, building each record in pending
+// before writing it out.
+type planEncoder struct {
+	w       io.Writer
+	pending bytes.Buffer
+	temps   map[*LocalTemp]int
+}
+
+func (enc *planEncoder) flush() os.Error {
+	_, err := enc.pending.WriteTo(enc.w)
+	return err
+}
+
+func (enc *planEncoder) writeByte(b byte) {
+	enc.pending.WriteByte(b)
+}
+
+func (enc *planEncoder) writeBool(b bool) {
+	if b {
+		enc.writeByte(1)
+	} else {
+		enc.writeByte(0)
+	}
+}
+
+func (enc *planEncoder) writeInt(i int64) {
+	binary.Write(&enc.pending, binary.BigEndian, i)
+}
+
+func (enc *planEncoder) writeCount(count int) {
+	binary.Write(&enc.pending, binary.BigEndian, uint32(count))
+}
+
+func (enc *planEncoder) writeString(s string) {
+	enc.writeCount(len(s))
+	enc.pending.WriteString(s)
+}
+
+func (enc *planEncoder) writePath(path PathRef) os.Error {
+	localPath, is := path.(*LocalPath)
+	if !is {
+		return os.NewError(fmt.Sprintf("Cannot encode %v, not relative to the destination", path))
+	}
+	enc.writeString(localPath.RelPath)
+	return nil
+}
+
+func (enc *planEncoder) writeTemp(temp *LocalTemp) os.Error {
+	id, has := enc.temps[temp]
+	if !has {
+		return os.NewError(fmt.Sprintf("Cannot encode temporary file for %v before it is created", temp.Path))
+	}
+	enc.writeInt(int64(id))
+	return nil
+}
+
+// Encode a command, getting the part of the source it reads, if any.
+func (enc *planEncoder) writeCmd(cmd PatchCmd) (part *sourcePart, err os.Error) {
+	switch c := cmd.(type) {
+	case *Transfer:
+		enc.writeByte(transferTag)
+		if err = enc.writePath(c.From); err == nil {
+			err = enc.writePath(c.To)
+		}
+		enc.writeBool(c.Move)
+	case *DirMove:
+		enc.writeByte(dirMoveTag)
+		if err = enc.writePath(c.From); err == nil {
+			err = enc.writePath(c.To)
+		}
+	case *Keep:
+		enc.writeByte(keepTag)
+		err = enc.writePath(c.Path)
+	case *Touch:
+		enc.writeByte(touchTag)
+		err = enc.writePath(c.Path)
+		enc.writeBool(c.Empty)
+		enc.writeInt(c.Mtime)
+	case *SetMeta:
+		enc.writeByte(setMetaTag)
+		err = enc.writePath(c.Path)
+		mode := int64(c.Mode)
+		if c.HasMode {
+			mode |= setMetaHasMode
+		}
+		enc.writeInt(mode)
+		enc.writeInt(c.Mtime)
+		enc.writeInt(int64(c.Uid))
+		enc.writeInt(int64(c.Gid))
+	case *Conflict:
+		enc.writeByte(conflictTag)
+		err = enc.writePath(c.Path)
+	case *Resize:
+		enc.writeByte(resizeTag)
+		err = enc.writePath(c.Path)
+		enc.writeInt(c.Size)
+	case *Delete:
+		enc.writeByte(deleteTag)
+		err = enc.writePath(c.Path)
+		enc.writeBool(c.Trash)
+	case *LocalTemp:
+		enc.writeByte(localTempTag)
+		err = enc.writePath(c.Path)
+		enc.writeInt(c.Size)
+		enc.temps[c] = len(enc.temps)
+	case *ReplaceWithTemp:
+		enc.writeByte(replaceWithTempTag)
+		err = enc.writeTemp(c.Temp)
+	case *LocalTempCopy:
+		enc.writeByte(localTempCopyTag)
+		err = enc.writeTemp(c.Temp)
+		enc.writeInt(c.LocalOffset)
+		enc.writeInt(c.TempOffset)
+		enc.writeInt(c.Length)
+	case *SrcTempCopy:
+		enc.writeByte(srcTempCopyTag)
+		err = enc.writeTemp(c.Temp)
+		enc.writeString(c.SrcStrong)
+		enc.writeInt(c.SrcOffset)
+		enc.writeInt(c.TempOffset)
+		enc.writeInt(c.Length)
+		part = &sourcePart{tag: rangeDataTag, strong: c.SrcStrong, from: c.SrcOffset, length: c.Length}
+	case *SrcBlockCopy:
+		enc.writeByte(srcBlockCopyTag)
+		err = enc.writeTemp(c.Temp)
+		enc.writeString(c.SrcStrong)
+		enc.writeInt(c.TempOffset)
+		enc.writeInt(c.Length)
+		part = &sourcePart{tag: blockDataTag, strong: c.SrcStrong, length: c.Length}
+	case *SrcFileDownload:
+		enc.writeByte(srcFileDownloadTag)
+		if err = fs.EncodeFileInfo(&enc.pending, c.SrcFile.Info()); err == nil {
+			err = enc.writePath(c.Path)
+		}
+		enc.writeInt(c.Length)
+		enc.writeBool(c.Compress)
+		part = &sourcePart{tag: rangeDataTag, strong: c.SrcFile.Info().Strong, length: c.SrcFile.Info().Size}
+	case *CreateSymlink:
+		enc.writeByte(createSymlinkTag)
+		if err = fs.EncodeFileInfo(&enc.pending, c.SrcFile.Info()); err == nil {
+			err = enc.writePath(c.Path)
+		}
+		part = &sourcePart{tag: rangeDataTag, strong: c.SrcFile.Info().Strong, length: c.SrcFile.Info().Size}
+	default:
+		err = os.NewError(fmt.Sprintf("Cannot encode %v", cmd))
+	}
+
+	// Keep memory bounded by the largest command, not the whole plan
+	if err == nil {
+		err = enc.flush()
+	}
+	return part, err
+}
+
+// Encode a part of the source, read from src, straight to the writer.
+func (enc *planEncoder) writePart(src fs.BlockProvider, part *sourcePart) os.Error {
+	enc.writeByte(part.tag)
+	enc.writeString(part.strong)
+	if part.tag == rangeDataTag {
+		enc.writeInt(part.from)
+	}
+	enc.writeInt(part.length)
+	if err := enc.flush(); err != nil {
+		return err
+	}
+
+	var n int64
+	var err os.Error
+	if part.tag == blockDataTag {
+		n, err = src.ReadBlockInto(part.strong, enc.w)
+	} else {
+		n, err = src.ReadInto(part.strong, part.from, part.length, enc.w)
+	}
+	if err == nil && n != part.length {
+		err = os.NewError(fmt.Sprintf("Read %d bytes of %s from the source, expected %d", n, part.strong, part.length))
+	}
+	return err
+}
+
+// Source data carried inline in a bundle, which serves the reads
+// of the commands encoded with it. The data is spooled to a temporary
+// file as the bundle is decoded, rather than held in memory, so that
+// bundles larger than memory can be applied. Close removes the file.
+type BundleData struct {
+	spool  *os.File
+	blocks map[string]*bundleRange
+	ranges map[string][]*bundleRange
+}
+
+// Where a part of the source is in the spool.
+type bundleRange struct {
+	// Offset of a range in its file.
+	from int64
+
+	offset int64
+	length int64
+}
+
+func newBundleData() (*BundleData, os.Error) {
+	spool, err := ioutil.TempFile("", "bundle")
+	if err != nil {
+		return nil, err
+	}
+	return &BundleData{
+		spool:  spool,
+		blocks: make(map[string]*bundleRange),
+		ranges: make(map[string][]*bundleRange)}, nil
+}
+
+// Remove the spooled data, once the plan has been executed.
+func (data *BundleData) Close() os.Error {
+	err := data.spool.Close()
+	if removeErr := os.Remove(data.spool.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+func (data *BundleData) ReadBlock(strong string) ([]byte, os.Error) {
+	buf := &bytes.Buffer{}
+	if _, err := data.ReadBlockInto(strong, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (data *BundleData) ReadBlockInto(strong string, writer io.Writer) (int64, os.Error) {
+	block, has := data.blocks[strong]
+	if !has {
+		return 0, os.NewError(fmt.Sprintf("Block %s not in bundle", strong))
+	}
+	return io.Copy(writer, io.NewSectionReader(data.spool, block.offset, block.length))
+}
+
+func (data *BundleData) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	for _, r := range data.ranges[strong] {
+		if r.from <= from && from+length <= r.from+r.length {
+			return io.Copy(writer, io.NewSectionReader(data.spool, r.offset+from-r.from, length))
+		}
+	}
+	return 0, os.NewError(fmt.Sprintf("%d bytes at offset %d of %s not in bundle", length, from, strong))
+}
+
+// Decode a plan from a bundle written by EncodePlan, to be executed
+// against dstStore. If the bundle was encoded inline, data is the
+// source to execute it with, to be closed once it has been; otherwise
+// data is nil, and the plan must be executed with ExecWith, given a
+// source holding the same content.
+//
+// The decoded plan leaves empty directories in place when cleaning,
+// as there is no source to tell which belong.
+//
+// A signature on the bundle is not verified; use DecodeSignedPlan
+// where the origin of the bundle must be trusted.
+func DecodePlan(r io.Reader, dstStore fs.LocalStore) (plan *PatchPlan, data *BundleData, err os.Error) {
+	_, flags, err := readBundleHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if flags&BUNDLE_SIGNED != 0 {
+		if _, err = readSignature(r); err != nil {
+			return nil, nil, err
+		}
+	}
+	return decodePlan(r, dstStore, flags)
+}
+
+// Read the header of a bundle, getting it and its flags.
+func readBundleHeader(r io.Reader) (header []byte, flags byte, err os.Error) {
+	header = make([]byte, bundleHeaderSize)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	} else if string(header[:len(BUNDLE_MAGIC)]) != BUNDLE_MAGIC {
+		return nil, 0, os.NewError("Not a plan bundle")
+	}
+
+	version, flags := header[len(BUNDLE_MAGIC)], header[len(BUNDLE_MAGIC)+1]
+	if version != BUNDLE_VERSION && (version != 1 || flags&BUNDLE_SIGNED != 0) {
+		return nil, 0, os.NewError(fmt.Sprintf("Unsupported plan bundle version %d", version))
+	}
+	return header, flags, nil
+}
+
+// Decode the commands and data following the header and any signature.
+func decodePlan(r io.Reader, dstStore fs.LocalStore, flags byte) (plan *PatchPlan, data *BundleData, err os.Error) {
+	dec := &planDecoder{r: r, dstStore: dstStore}
+	inline := flags&BUNDLE_INLINE != 0
+
+	plan = dec.readPlan()
+	if inline && dec.err == nil {
+		if data, err = newBundleData(); err != nil {
+			return nil, nil, err
+		}
+	}
+	count := dec.readCount()
+	for i := uint32(0); i < count && dec.err == nil; i++ {
+		dec.readPart(data)
+	}
+
+	if dec.err != nil {
+		if data != nil {
+			data.Close()
+		}
+		return nil, nil, dec.err
+	}
+	return plan, data, nil
+}
+
+// Decodes a bundle, keeping the first error, after which
+// everything read is zero.
+type planDecoder struct {
+	r        io.Reader
+	err      os.Error
+	dstStore fs.LocalStore
+	temps    []*LocalTemp
+
+	// Bytes of inline data spooled so far.
+	spooled int64
+}
+
+// Decode the commands of a plan, leaving the data which follows them.
+func (dec *planDecoder) readPlan() *PatchPlan {
+	plan := &PatchPlan{
+		dstStore: dec.dstStore,
+		opts:     &PlanOptions{KeepEmptyDirs: true}}
+	count := dec.readCount()
+	for i := uint32(0); i < count && dec.err == nil; i++ {
+		if cmd := dec.readCmd(); dec.err == nil {
+			plan.Cmds = append(plan.Cmds, cmd)
+		}
+	}
+	return plan
+}
+
+func (dec *planDecoder) read(value interface{}) {
+	if dec.err == nil {
+		dec.err = binary.Read(dec.r, binary.BigEndian, value)
+	}
+}
+
+func (dec *planDecoder) readByte() (b byte) {
+	dec.read(&b)
+	return b
+}
+
+func (dec *planDecoder) readBool() bool {
+	return dec.readByte() != 0
+}
+
+func (dec *planDecoder) readInt() (i int64) {
+	dec.read(&i)
+	return i
+}
+
+func (dec *planDecoder) readCount() (count uint32) {
+	dec.read(&count)
+	return count
+}
+
+func (dec *planDecoder) readString() string {
+	length := dec.readCount()
+	if dec.err != nil {
+		return ""
+	} else if length > maxEncodedString {
+		dec.err = os.NewError(fmt.Sprintf("Encoded string of %d bytes is too long", length))
+		return ""
+	}
+
+	buf := make([]byte, length)
+	if _, dec.err = io.ReadFull(dec.r, buf); dec.err != nil {
+		return ""
+	}
+	return string(buf)
+}
+
+func (dec *planDecoder) readPath() *LocalPath {
+	return &LocalPath{LocalStore: dec.dstStore, RelPath: dec.readString()}
+}
+
+func (dec *planDecoder) readTemp() *LocalTemp {
+	id := dec.readInt()
+	if dec.err == nil && (id < 0 || id >= int64(len(dec.temps))) {
+		dec.err = os.NewError(fmt.Sprintf("Temporary file %d used before it is created", id))
+	}
+	if dec.err != nil {
+		return nil
+	}
+	return dec.temps[id]
+}
+
+func (dec *planDecoder) readSrcFile() fs.File {
+	if dec.err != nil {
+		return nil
+	}
+	var info *fs.FileInfo
+	if info, dec.err = fs.DecodeFileInfo(dec.r); dec.err != nil {
+		return nil
+	}
+	return fs.NewMemRepo().AddFile(nil, info, nil)
+}
+
+func (dec *planDecoder) readCmd() PatchCmd {
+	switch tag := dec.readByte(); tag {
+	case transferTag:
+		return &Transfer{From: dec.readPath(), To: dec.readPath(), Move: dec.readBool()}
+	case dirMoveTag:
+		return &DirMove{From: dec.readPath(), To: dec.readPath()}
+	case keepTag:
+		return &Keep{Path: dec.readPath()}
+	case touchTag:
+		return &Touch{Path: dec.readPath(), Empty: dec.readBool(), Mtime: dec.readInt()}
+	case setMetaTag:
+		path := dec.readPath()
+		mode := dec.readInt()
+		return &SetMeta{
+			Path:    path,
+			Mode:    uint32(mode),
+			HasMode: mode&setMetaHasMode != 0 || uint32(mode) != 0,
+			Mtime:   dec.readInt(),
+			Uid:     int(dec.readInt()),
+			Gid:     int(dec.readInt())}
+	case conflictTag:
+		return &Conflict{Path: dec.readPath()}
+	case resizeTag:
+		return &Resize{Path: dec.readPath(), Size: dec.readInt()}
+	case deleteTag:
+		return &Delete{Path: dec.readPath(), Trash: dec.readBool()}
+	case localTempTag:
+		temp := &LocalTemp{Path: dec.readPath(), Size: dec.readInt()}
+		dec.temps = append(dec.temps, temp)
+		return temp
+	case replaceWithTempTag:
+		return &ReplaceWithTemp{Temp: dec.readTemp()}
+	case localTempCopyTag:
+		return &LocalTempCopy{
+			Temp:        dec.readTemp(),
+			LocalOffset: dec.readInt(),
+			TempOffset:  dec.readInt(),
+			Length:      dec.readInt()}
+	case srcTempCopyTag:
+		return &SrcTempCopy{
+			Temp:       dec.readTemp(),
+			SrcStrong:  dec.readString(),
+			SrcOffset:  dec.readInt(),
+			TempOffset: dec.readInt(),
+			Length:     dec.readInt()}
+	case srcBlockCopyTag:
+		return &SrcBlockCopy{
+			Temp:       dec.readTemp(),
+			SrcStrong:  dec.readString(),
+			TempOffset: dec.readInt(),
+			Length:     dec.readInt()}
+	case srcFileDownloadTag:
+		return &SrcFileDownload{
+			SrcFile:  dec.readSrcFile(),
+			Path:     dec.readPath(),
+			Length:   dec.readInt(),
+			Compress: dec.readBool()}
+	case createSymlinkTag:
+		return &CreateSymlink{SrcFile: dec.readSrcFile(), Path: dec.readPath()}
+	default:
+		if dec.err == nil {
+			dec.err = os.NewError(fmt.Sprintf("Unknown command tag %q in plan bundle", tag))
+		}
+	}
+	return nil
+}
+
+// Decode a part of the source into data, if the bundle is inline.
+func (dec *planDecoder) readPart(data *BundleData) {
+	tag := dec.readByte()
+	if dec.err == nil && (data == nil || tag != blockDataTag && tag != rangeDataTag) {
+		dec.err = os.NewError("Unexpected data in plan bundle")
+	}
+	strong := dec.readString()
+	var from int64
+	if tag == rangeDataTag {
+		from = dec.readInt()
+	}
+	length := dec.readInt()
+	if dec.err == nil && length < 0 {
+		dec.err = os.NewError(fmt.Sprintf("Negative length %d of %s in plan bundle", length, strong))
+	} else if dec.err == nil && dec.spooled+length > MaxBundleSize {
+		dec.err = os.NewError(fmt.Sprintf("Plan bundle data larger than %d bytes", MaxBundleSize))
+	}
+	if dec.err != nil {
+		return
+	}
+
+	// Copied to the spool as it arrives, so that no part is held in
+	// memory whole.
+	part := &bundleRange{from: from, offset: dec.spooled, length: length}
+	if _, dec.err = io.Copyn(data.spool, dec.r, length); dec.err != nil {
+		return
+	}
+	dec.spooled += length
+
+	if tag == blockDataTag {
+		data.blocks[strong] = part
+	} else {
+		data.ranges[strong] = append(data.ranges[strong], part)
+	}
+}
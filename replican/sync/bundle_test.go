@@ -0,0 +1,208 @@
+package sync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestBundleInline(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("same", tg.B(42, 65537)),
+		tg.F("changed", tg.B(43, 65537), tg.B(44, 65537)),
+		tg.D("new", tg.F("baz", tg.B(45, 65537)))))
+	defer os.RemoveAll(srcpath)
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	srcStrong := srcStore.Repo().Root().Info().Strong
+
+	tg = treegen.New()
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("same", tg.B(42, 65537)),
+		tg.F("changed", tg.B(43, 65537), tg.B(46, 65537)),
+		tg.F("stale", tg.B(47, 65537))))
+	defer os.RemoveAll(dstpath)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	buf := &bytes.Buffer{}
+	err = EncodePlan(buf, NewPatchPlan(srcStore, dstStore), true)
+	assert.Tf(t, err == nil, "%v", err)
+
+	// The bundle needs nothing from the source.
+	assert.T(t, os.RemoveAll(srcpath) == nil)
+
+	plan, data, err := DecodePlan(buf, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, data != nil)
+	failedCmd, err := plan.ExecWith(&ExecContext{Src: data, Dst: dstStore})
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	// The data is spooled to disk, and removed once closed.
+	spoolPath := data.spool.Name()
+	_, err = os.Stat(spoolPath)
+	assert.T(t, err == nil)
+	assert.T(t, data.Close() == nil)
+	_, err = os.Stat(spoolPath)
+	assert.T(t, err != nil)
+
+	dstRoot, errors := fs.IndexDir(dstpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, srcStrong, dstRoot.Info().Strong)
+}
+
+func TestBundleReference(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537), tg.B(43, 65537))))
+	defer os.RemoveAll(srcpath)
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	tg = treegen.New()
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537), tg.B(44, 65537))))
+	defer os.RemoveAll(dstpath)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	plan := NewPatchPlan(srcStore, dstStore)
+	inlineBuf := &bytes.Buffer{}
+	assert.T(t, EncodePlan(inlineBuf, plan, true) == nil)
+	buf := &bytes.Buffer{}
+	assert.T(t, EncodePlan(buf, plan, false) == nil)
+	assert.T(t, buf.Len() < inlineBuf.Len())
+
+	decoded, data, err := DecodePlan(buf, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, data == nil)
+	assert.Equal(t, plan.String(), decoded.String())
+	failedCmd, err := decoded.ExecWith(&ExecContext{Src: srcStore, Dst: dstStore})
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	dstRoot, errors := fs.IndexDir(dstpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, srcStore.Repo().Root().Info().Strong, dstRoot.Info().Strong)
+
+	// Anything else is refused.
+	_, _, err = DecodePlan(bytes.NewBufferString("not a bundle"), dstStore)
+	assert.T(t, err != nil)
+}
+
+// Test that a SetMeta keeps whether it sets the mode, so that a mode of
+// zero is set, and a missing one is not.
+func TestBundleSetMeta(t *testing.T) {
+	tg := treegen.New()
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.F("baz", tg.B(43, 65537))))
+	defer os.RemoveAll(dstpath)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	plan := NewPatchPlan(dstStore, dstStore)
+	plan.Cmds = []PatchCmd{
+		&SetMeta{Path: &LocalPath{LocalStore: dstStore, RelPath: filepath.Join("foo", "bar")},
+			Mode: 0, HasMode: true, Uid: -1, Gid: -1},
+		&SetMeta{Path: &LocalPath{LocalStore: dstStore, RelPath: filepath.Join("foo", "baz")},
+			Mtime: 1e18, Uid: -1, Gid: -1}}
+	buf := &bytes.Buffer{}
+	assert.T(t, EncodePlan(buf, plan, false) == nil)
+
+	decoded, _, err := DecodePlan(buf, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, 2, len(decoded.Cmds))
+	assert.T(t, decoded.Cmds[0].(*SetMeta).HasMode)
+	assert.T(t, !decoded.Cmds[1].(*SetMeta).HasMode)
+
+	failedCmd, err := decoded.ExecWith(&ExecContext{Dst: dstStore})
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	fi, err := os.Stat(filepath.Join(dstpath, "foo", "bar"))
+	assert.T(t, err == nil)
+	assert.Equal(t, uint32(0), fi.Mode&07777)
+	fi, err = os.Stat(filepath.Join(dstpath, "foo", "baz"))
+	assert.T(t, err == nil)
+	assert.T(t, fi.Mode&07777 != 0)
+	assert.Equal(t, int64(1e18), fi.Mtime_ns)
+}
+
+func TestBundleSigned(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("changed", tg.B(43, 65537), tg.B(44, 65537)),
+		tg.D("new", tg.F("baz", tg.B(45, 65537)))))
+	defer os.RemoveAll(srcpath)
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	srcStrong := srcStore.Repo().Root().Info().Strong
+
+	tg = treegen.New()
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("changed", tg.B(43, 65537), tg.B(46, 65537))))
+	defer os.RemoveAll(dstpath)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.T(t, err == nil)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.T(t, err == nil)
+
+	buf := &bytes.Buffer{}
+	err = EncodeSignedPlan(buf, NewPatchPlan(srcStore, dstStore), true, key)
+	assert.Tf(t, err == nil, "%v", err)
+	bundle := buf.Bytes()
+
+	// Refused by any other key.
+	_, _, err = DecodeSignedPlan(bytes.NewBuffer(bundle), dstStore, &otherKey.PublicKey)
+	_, isBad := err.(*ErrBadSignature)
+	assert.Tf(t, isBad, "%v", err)
+
+	// Refused if altered, here in the inline data.
+	tampered := append([]byte{}, bundle...)
+	tampered[len(tampered)-len(bundle)/4]++
+	_, _, err = DecodeSignedPlan(bytes.NewBuffer(tampered), dstStore, &key.PublicKey)
+	assert.T(t, err != nil)
+
+	// Refused if unsigned.
+	unsigned := &bytes.Buffer{}
+	err = EncodePlan(unsigned, NewPatchPlan(srcStore, dstStore), true)
+	assert.T(t, err == nil)
+	_, _, err = DecodeSignedPlan(unsigned, dstStore, &key.PublicKey)
+	_, isBad = err.(*ErrBadSignature)
+	assert.Tf(t, isBad, "%v", err)
+
+	// Refused if larger than allowed, signed or not.
+	defer func(max int64) { MaxBundleSize = max }(MaxBundleSize)
+	MaxBundleSize = 65536
+	_, _, err = DecodeSignedPlan(bytes.NewBuffer(bundle), dstStore, &key.PublicKey)
+	assert.T(t, err != nil)
+	_, _, err = DecodePlan(bytes.NewBuffer(bundle), dstStore)
+	assert.T(t, err != nil)
+	MaxBundleSize = int64(len(bundle))
+
+	// Nothing refused was applied.
+	dstRoot, errors := fs.IndexDir(dstpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.T(t, srcStrong != dstRoot.Info().Strong)
+
+	plan, data, err := DecodeSignedPlan(bytes.NewBuffer(bundle), dstStore, &key.PublicKey)
+	assert.Tf(t, err == nil, "%v", err)
+	defer data.Close()
+	failedCmd, err := plan.ExecWith(&ExecContext{Src: data, Dst: dstStore})
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	dstRoot, errors = fs.IndexDir(dstpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, srcStrong, dstRoot.Info().Strong)
+}
@@ -0,0 +1,120 @@
+package sync
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/cmars/replican-sync/replican/archive"
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// The differences between a destination and the manifest it should match.
+// Paths are relative to the destination. A missing or extra directory is
+// listed without its contents.
+type CheckResult struct {
+	// Paths in the manifest which are not in the destination.
+	Missing []string
+
+	// Paths in both whose content or mode differ, or which are a file
+	// in one and a directory in the other.
+	Modified []string
+
+	// Paths in the destination which are not in the manifest. The
+	// destination's conflict directory is not counted.
+	Extra []string
+}
+
+// Test whether the destination matches the manifest.
+func (result *CheckResult) Passed() bool {
+	return len(result.Missing) == 0 && len(result.Modified) == 0 && len(result.Extra) == 0
+}
+
+func (result *CheckResult) String() string {
+	verdict := "FAIL"
+	if result.Passed() {
+		verdict = "PASS"
+	}
+	return fmt.Sprintf("%s: %d missing, %d modified, %d extra",
+		verdict, len(result.Missing), len(result.Modified), len(result.Extra))
+}
+
+// Check a destination against a manifest of the tree it should hold,
+// without changing it. Files are compared by strong checksum and mode,
+// as indexed in the destination's repo.
+func Check(manifest []*archive.Entry, dstStore fs.LocalStore) *CheckResult {
+	result := &CheckResult{}
+
+	dstNodes := make(map[string]fs.FsNode)
+	if root := dstStore.Repo().Root(); root != nil {
+		fs.Walk(root, func(node fs.Node) bool {
+			fsNode, is := node.(fs.FsNode)
+			if !is {
+				return false
+			}
+			dstNodes[fs.RelPath(fsNode)] = fsNode
+			_, isDir := node.(fs.Dir)
+			return isDir
+		})
+	}
+
+	expected := make(map[string]bool)
+	missingDirs := make(map[string]bool)
+	for _, entry := range manifest {
+		expected[entry.Path] = true
+		if missingDirs[parentPath(entry.Path)] {
+			if entry.IsDir {
+				missingDirs[entry.Path] = true
+			}
+			continue
+		}
+
+		dstNode, has := dstNodes[entry.Path]
+		switch {
+		case !has:
+			result.Missing = append(result.Missing, entry.Path)
+			if entry.IsDir {
+				missingDirs[entry.Path] = true
+			}
+		case entry.IsDir:
+			if dir, isDir := dstNode.(fs.Dir); !isDir || dir.Mode() != entry.Mode {
+				result.Modified = append(result.Modified, entry.Path)
+			}
+		default:
+			file, isFile := dstNode.(fs.File)
+			if !isFile || file.Info().Strong != entry.Strong || file.Mode() != entry.Mode {
+				result.Modified = append(result.Modified, entry.Path)
+			}
+		}
+	}
+
+	extra := make(map[string]bool)
+	for path, _ := range dstNodes {
+		if !expected[path] && !inConflictDir(dstStore, path) {
+			extra[path] = true
+		}
+	}
+	for path, _ := range extra {
+		if !extra[parentPath(path)] {
+			result.Extra = append(result.Extra, path)
+		}
+	}
+
+	result.Missing = sortedPaths(result.Missing)
+	result.Modified = sortedPaths(result.Modified)
+	result.Extra = sortedPaths(result.Extra)
+	return result
+}
+
+func parentPath(path string) string {
+	parent, _ := filepath.Split(path)
+	return strings.TrimRight(parent, "/\\")
+}
+
+func sortedPaths(paths []string) []string {
+	set := make(map[string]bool)
+	for _, path := range paths {
+		set[path] = true
+	}
+	return sortedKeys(set)
+}
@@ -0,0 +1,44 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/archive"
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestCheck(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("same", tg.B(1, 100)),
+		tg.F("changed", tg.B(2, 100)),
+		tg.D("gone", tg.F("a", tg.B(3, 100)), tg.F("b", tg.B(4, 100)))))
+	defer os.RemoveAll(srcpath)
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	manifest := archive.NewManifest(srcStore.Repo().Root())
+
+	tg = treegen.New()
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("same", tg.B(1, 100)),
+		tg.F("changed", tg.B(5, 100)),
+		tg.D("stray", tg.F("c", tg.B(6, 100)))))
+	defer os.RemoveAll(dstpath)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	result := Check(manifest, dstStore)
+	assert.T(t, !result.Passed())
+	assert.Equal(t, []string{filepath.Join("foo", "gone")}, result.Missing)
+	assert.Equal(t, []string{filepath.Join("foo", "changed")}, result.Modified)
+	assert.Equal(t, []string{filepath.Join("foo", "stray")}, result.Extra)
+
+	// The tree the manifest was made from passes.
+	result = Check(manifest, srcStore)
+	assert.Tf(t, result.Passed(), "%v", result)
+}
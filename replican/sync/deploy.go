@@ -0,0 +1,198 @@
+package sync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// A deployment keeps each release of a tree in a numbered directory under
+// RELEASES_DIR, and serves one of them through the CURRENT_LINK symbolic
+// link beside it:
+//
+//	current -> releases/3
+//	releases/1
+//	releases/2
+//	releases/3
+//
+// A new release is staged from the current one with StageTree, so only
+// changed blocks are transferred and unchanged files are hard links.
+// Flipping the link is atomic, so readers of current see one release or
+// the other, never a tree part way through a sync.
+const (
+	RELEASES_DIR = "releases"
+	CURRENT_LINK = "current"
+)
+
+// Manages the releases of a tree deployed at Path.
+type Deployment struct {
+	Path string
+}
+
+func NewDeployment(path string) (*Deployment, os.Error) {
+	deployment := &Deployment{Path: filepath.Clean(path)}
+	if err := os.MkdirAll(deployment.releasesPath(), 0755); err != nil {
+		return nil, err
+	}
+	return deployment, nil
+}
+
+func (deployment *Deployment) releasesPath() string {
+	return filepath.Join(deployment.Path, RELEASES_DIR)
+}
+
+func (deployment *Deployment) currentPath() string {
+	return filepath.Join(deployment.Path, CURRENT_LINK)
+}
+
+// Get the path of a release.
+func (deployment *Deployment) ReleasePath(release int) string {
+	return filepath.Join(deployment.releasesPath(), strconv.Itoa(release))
+}
+
+// Get the releases deployed, oldest first. Releases still being staged
+// are not listed.
+func (deployment *Deployment) Releases() ([]int, os.Error) {
+	entries, err := ioutil.ReadDir(deployment.releasesPath())
+	if err != nil {
+		return nil, err
+	}
+
+	releases := []int{}
+	for _, entry := range entries {
+		if release, err := strconv.Atoi(entry.Name); err == nil && release > 0 && entry.IsDirectory() {
+			releases = append(releases, release)
+		}
+	}
+	sort.Ints(releases)
+	return releases, nil
+}
+
+// Get the release served through the current link, or 0 if there is none.
+func (deployment *Deployment) Current() (int, os.Error) {
+	target, err := os.Readlink(deployment.currentPath())
+	if err != nil {
+		if _, statErr := os.Lstat(deployment.currentPath()); statErr != nil {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	_, name := filepath.Split(target)
+	release, err := strconv.Atoi(name)
+	if err != nil || release <= 0 {
+		return 0, os.NewError(fmt.Sprintf(
+			"%s links to %s, which is not a release", deployment.currentPath(), target))
+	}
+	return release, nil
+}
+
+// Stage the source as a new release, numbered after the latest, starting
+// from the current release, then make it current. A release which fails
+// to stage is discarded, leaving current as it was. Returns the release.
+func (deployment *Deployment) Deploy(srcStore fs.BlockStore, opts *PlanOptions) (int, os.Error) {
+	releases, err := deployment.Releases()
+	if err != nil {
+		return 0, err
+	}
+	release := 1
+	if len(releases) > 0 {
+		release = releases[len(releases)-1] + 1
+	}
+
+	current, err := deployment.Current()
+	if err != nil {
+		return 0, err
+	}
+	// With no current release, StageTree starts from an empty tree.
+	currentPath := ""
+	if current > 0 {
+		currentPath = deployment.ReleasePath(current)
+	}
+
+	releasePath := deployment.ReleasePath(release)
+	stagingPath := releasePath + STAGING_SUFFIX
+	if err = StageTree(srcStore, currentPath, stagingPath, opts); err != nil {
+		os.RemoveAll(stagingPath)
+		return 0, err
+	}
+	if err = os.Rename(stagingPath, releasePath); err != nil {
+		os.RemoveAll(stagingPath)
+		return 0, err
+	}
+
+	return release, deployment.Activate(release)
+}
+
+// Make a deployed release current, by replacing the current link with
+// one to the release in a single rename.
+func (deployment *Deployment) Activate(release int) os.Error {
+	if info, err := os.Stat(deployment.ReleasePath(release)); err != nil {
+		return err
+	} else if !info.IsDirectory() {
+		return os.NewError(fmt.Sprintf("%s is not a release", deployment.ReleasePath(release)))
+	}
+
+	linkPath := deployment.currentPath() + STAGING_SUFFIX
+	os.Remove(linkPath)
+	if err := os.Symlink(filepath.Join(RELEASES_DIR, strconv.Itoa(release)), linkPath); err != nil {
+		return err
+	}
+	if err := os.Rename(linkPath, deployment.currentPath()); err != nil {
+		os.Remove(linkPath)
+		return err
+	}
+	return nil
+}
+
+// Make the release before the current one current again.
+// Returns the release rolled back to.
+func (deployment *Deployment) Rollback() (int, os.Error) {
+	current, err := deployment.Current()
+	if err != nil {
+		return 0, err
+	}
+	releases, err := deployment.Releases()
+	if err != nil {
+		return 0, err
+	}
+
+	previous := 0
+	for _, release := range releases {
+		if release < current {
+			previous = release
+		}
+	}
+	if previous == 0 {
+		return 0, os.NewError(fmt.Sprintf("No release before %d to roll back to", current))
+	}
+	return previous, deployment.Activate(previous)
+}
+
+// Remove all but the latest keep releases. The current release is never
+// removed, nor are releases being staged.
+func (deployment *Deployment) Prune(keep int) os.Error {
+	current, err := deployment.Current()
+	if err != nil {
+		return err
+	}
+	releases, err := deployment.Releases()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(releases)-keep; i++ {
+		if releases[i] == current {
+			continue
+		}
+		if err = os.RemoveAll(deployment.ReleasePath(releases[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestDeployRollback(t *testing.T) {
+	tg := treegen.New()
+	v1path := treegen.TestTree(t, tg.D("foo",
+		tg.F("same", tg.B(42, 65537)),
+		tg.F("changed", tg.B(43, 65537))))
+	defer os.RemoveAll(v1path)
+	tg = treegen.New()
+	v2path := treegen.TestTree(t, tg.D("foo",
+		tg.F("same", tg.B(42, 65537)),
+		tg.F("changed", tg.B(44, 65537)),
+		tg.D("new", tg.F("baz", tg.B(45, 65537)))))
+	defer os.RemoveAll(v2path)
+
+	deployPath, err := ioutil.TempDir("", "deploy")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(deployPath)
+	deployment, err := NewDeployment(deployPath)
+	assert.T(t, err == nil)
+
+	current, err := deployment.Current()
+	assert.T(t, err == nil)
+	assert.Equal(t, 0, current)
+	_, err = deployment.Rollback()
+	assert.T(t, err != nil)
+
+	strongs := []string{}
+	for i, path := range []string{v1path, v2path} {
+		srcStore, err := fs.NewLocalStore(filepath.Join(path, "foo"), fs.NewMemRepo())
+		assert.T(t, err == nil)
+		strongs = append(strongs, srcStore.Repo().Root().Info().Strong)
+
+		release, err := deployment.Deploy(srcStore, &PlanOptions{})
+		assert.Tf(t, err == nil, "%v", err)
+		assert.Equal(t, i+1, release)
+		_, err = os.Lstat(deployment.ReleasePath(release) + STAGING_SUFFIX)
+		assert.T(t, err != nil)
+	}
+
+	currentStrong := func() string {
+		current, err := deployment.Current()
+		assert.T(t, err == nil)
+		target, err := os.Readlink(filepath.Join(deployPath, CURRENT_LINK))
+		assert.T(t, err == nil)
+		assert.Equal(t, filepath.Join(RELEASES_DIR, strconv.Itoa(current)), target)
+
+		root, errors := fs.IndexDir(deployment.ReleasePath(current), fs.NewMemRepo())
+		assert.Equalf(t, 0, len(errors), "%v", errors)
+		return root.Info().Strong
+	}
+	assert.Equal(t, strongs[1], currentStrong())
+
+	// Unchanged files are shared between releases.
+	same1, err := os.Stat(filepath.Join(deployment.ReleasePath(1), "same"))
+	assert.T(t, err == nil)
+	same2, err := os.Stat(filepath.Join(deployment.ReleasePath(2), "same"))
+	assert.T(t, err == nil)
+	assert.Equal(t, same1.Ino, same2.Ino)
+
+	release, err := deployment.Rollback()
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, 1, release)
+	assert.Equal(t, strongs[0], currentStrong())
+	_, err = deployment.Rollback()
+	assert.T(t, err != nil)
+
+	// The current release is kept, however old.
+	assert.T(t, deployment.Prune(0) == nil)
+	releases, err := deployment.Releases()
+	assert.T(t, err == nil)
+	assert.Equal(t, []int{1}, releases)
+}
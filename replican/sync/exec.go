@@ -0,0 +1,332 @@
+package sync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"github.com/cmars/replican-sync/replican/events"
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// The environment in which PatchCmds are executed.
+//
+// Commands read source data from Src, and resolve their local paths
+// against Dst. A command can therefore be executed against stores other
+// than the ones it was planned with, as long as they hold the same content.
+type ExecContext struct {
+	// Source of file data.
+	Src fs.BlockProvider
+
+	// Destination store. If nil, local paths are resolved against
+	// the store they were planned with.
+	Dst fs.LocalStore
+
+	// If not nil, log each command as it is executed.
+	Logger *log.Logger
+
+	// If not nil, called after each command completes successfully.
+	Progress func(cmd PatchCmd)
+
+	// Keep symbolic links within the destination from redirecting changes
+	// outside of it. Destination files are opened with fs.OpenBeneath,
+	// which on Linux 5.6 and later holds even against links swapped in
+	// while the path is resolved. The paths of every other change, such
+	// as renames, removals and metadata, are checked with fs.CheckBeneath
+	// before the command runs, which refuses links planted in the tree
+	// but not ones swapped in after the check.
+	Confine bool
+
+	// Split reads of source ranges longer than RangeSize into parts of
+	// that size, read by up to RangeWorkers at once, so that one large
+	// file is not held to the speed of one request. Only for sources which
+	// serve concurrent reads well, such as remote servers. With fewer than
+	// two workers, ranges are read whole.
+	RangeSize    int64
+	RangeWorkers int
+
+	// Before changing a destination file in place, give it content of its
+	// own if it has other hard links, so that a tree sharing files with
+	// the destination, as a tree staged by StageTree does, is left alone.
+	Unshare bool
+}
+
+// Execute a single command in this context.
+func (ctx *ExecContext) Exec(cmd PatchCmd) os.Error {
+	if ctx.Logger != nil {
+		ctx.Logger.Printf("%v", cmd)
+	}
+
+	err := ctx.checkPaths(cmd)
+	if err == nil {
+		err = cmd.Exec(ctx)
+	}
+	if err != nil {
+		if ctx.Logger != nil {
+			ctx.Logger.Printf("%v: %v", cmd, err)
+		}
+		events.Publish(&events.CmdExecuted{Cmd: cmd, Err: err})
+		return err
+	}
+
+	events.Publish(&events.CmdExecuted{Cmd: cmd})
+	if ctx.Progress != nil {
+		ctx.Progress(cmd)
+	}
+	return nil
+}
+
+// Read a range of a source file into f at offset, in parts read
+// concurrently if the context allows. Returns the bytes read.
+//
+// Blocks of zeros are not written, so f must already read as zeros
+// over the range, as new and temporary files do.
+func (ctx *ExecContext) readRange(strong string, from int64, length int64, f *os.File, offset int64) (int64, os.Error) {
+	if ctx.RangeWorkers < 2 || ctx.RangeSize <= 0 || length <= ctx.RangeSize {
+		return ctx.Src.ReadInto(strong, from, length, &fs.SparseWriter{File: f, Offset: offset})
+	}
+
+	type part struct {
+		n   int64
+		err os.Error
+	}
+
+	workers := make(chan bool, ctx.RangeWorkers)
+	parts := make(chan part)
+	count := 0
+	for partOffset := int64(0); partOffset < length; partOffset += ctx.RangeSize {
+		partLength := ctx.RangeSize
+		if partOffset+partLength > length {
+			partLength = length - partOffset
+		}
+		count++
+
+		go func(partOffset int64, partLength int64) {
+			workers <- true
+			defer func() { <-workers }()
+
+			buf := &bytes.Buffer{}
+			n, err := ctx.Src.ReadInto(strong, from+partOffset, partLength, buf)
+			if err == nil {
+				_, err = (&fs.SparseWriter{File: f, Offset: offset + partOffset}).Write(buf.Bytes())
+			}
+			parts <- part{n: n, err: err}
+		}(partOffset, partLength)
+	}
+
+	var total int64
+	var err os.Error
+	for i := 0; i < count; i++ {
+		p := <-parts
+		total += p.n
+		if err == nil && p.err != nil {
+			err = p.err
+		}
+	}
+	return total, err
+}
+
+// Get the bytes a command reads from the source, and the bytes of file
+// content it writes to the destination. Link targets are metadata rather
+// than content, and count as neither, whichever command creates the link.
+func transferredBytes(cmd PatchCmd) (literal int64, written int64) {
+	switch c := cmd.(type) {
+	case *SrcTempCopy:
+		return c.Length, c.Length
+	case *SrcBlockCopy:
+		return c.Length, c.Length
+	case *SrcFileDownload:
+		if fs.IsSymlinkMode(c.SrcFile.Info().Mode) {
+			return 0, 0
+		}
+		return c.SrcFile.Info().Size, c.SrcFile.Info().Size
+	case *LocalTempCopy:
+		return 0, c.Length
+	}
+	return 0, 0
+}
+
+// Get the destination paths a command may write to or remove.
+func modifiedPaths(cmd PatchCmd) []PathRef {
+	switch c := cmd.(type) {
+	case *Transfer:
+		// A transfer may be a move, which removes its origin
+		return []PathRef{c.From, c.To}
+	case *DirMove:
+		return []PathRef{c.From, c.To}
+	case *Touch:
+		return []PathRef{c.Path}
+	case *SetMeta:
+		return []PathRef{c.Path}
+	case *Conflict:
+		return []PathRef{c.Path}
+	case *Resize:
+		return []PathRef{c.Path}
+	case *Delete:
+		return []PathRef{c.Path}
+	case *LocalTemp:
+		return []PathRef{c.Path}
+	case *ReplaceWithTemp:
+		return []PathRef{c.Temp.Path}
+	case *SrcFileDownload:
+		return []PathRef{c.Path}
+	case *CreateSymlink:
+		return []PathRef{c.Path}
+	case *ConsistentCopy:
+		return []PathRef{c.Path}
+	}
+	return nil
+}
+
+// Get the root of the destination store a path belongs to, if known.
+func (ctx *ExecContext) rootOf(path PathRef) (string, bool) {
+	if store := ctx.storeOf(path); store != nil {
+		return store.RootPath(), true
+	}
+	return "", false
+}
+
+// Get the destination store a path is in, if known.
+func (ctx *ExecContext) storeOf(path PathRef) fs.LocalStore {
+	if localPath, is := path.(*LocalPath); is {
+		return ctx.LocalStore(localPath)
+	}
+	return ctx.Dst
+}
+
+// Refuse to run a command which would modify anything outside its
+// destination store, whatever its relative paths say.
+func (ctx *ExecContext) checkPaths(cmd PatchCmd) os.Error {
+	for _, path := range modifiedPaths(cmd) {
+		store := ctx.storeOf(path)
+		if store == nil {
+			continue
+		}
+
+		if store.ReadOnly() {
+			return &fs.ErrReadOnly{Path: ctx.Resolve(path)}
+		}
+
+		root := store.RootPath()
+		resolved := ctx.Resolve(path)
+		if !fs.InRoot(root, resolved) {
+			return os.NewError(fmt.Sprintf(
+				"Refusing to modify %s, outside of destination %s", resolved, root))
+		}
+
+		if ctx.Confine {
+			dir, relpath := confinedPath(root, resolved)
+			if err := fs.CheckBeneath(dir, relpath, followsLinks(cmd)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Test whether a command changes what a link at its path points to, rather
+// than the link itself, as changes of mode and times do.
+func followsLinks(cmd PatchCmd) bool {
+	switch cmd.(type) {
+	case *Touch, *SetMeta:
+		return true
+	}
+	return false
+}
+
+// Split a resolved destination path into the directory it is confined
+// beneath and its path relative to that. A single file store is rooted
+// at the file itself, so it is confined beneath its parent.
+func confinedPath(root string, resolved string) (string, string) {
+	resolved = fs.StripLongPath(resolved)
+	root = filepath.Clean(root)
+	if resolved == root {
+		root = filepath.Clean(filepath.Dir(root))
+	}
+	return root, strings.TrimLeft(resolved[len(root):], string(filepath.Separator))
+}
+
+// Open a destination file, confined to its store if the context requires.
+func (ctx *ExecContext) OpenFile(path PathRef, flag int, perm uint32) (*os.File, os.Error) {
+	resolved := ctx.Resolve(path)
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if err := ctx.unshare(resolved, flag&os.O_TRUNC != 0 && flag&os.O_CREATE != 0); err != nil {
+			return nil, err
+		}
+	}
+
+	root, has := ctx.rootOf(path)
+	if !ctx.Confine || !has {
+		return os.OpenFile(resolved, flag, perm)
+	}
+
+	if !fs.InRoot(root, resolved) {
+		return nil, os.NewError(fmt.Sprintf(
+			"Refusing to open %s, outside of destination %s", resolved, root))
+	}
+
+	root, relpath := confinedPath(root, resolved)
+	return fs.OpenBeneath(root, relpath, flag, perm)
+}
+
+// Get the store in which a local path should be resolved.
+func (ctx *ExecContext) LocalStore(localPath *LocalPath) fs.LocalStore {
+	if ctx.Dst != nil {
+		return ctx.Dst
+	}
+	return localPath.LocalStore
+}
+
+// Give a file with other hard links content of its own, if the context
+// unshares files. A file about to be replaced is simply unlinked.
+func (ctx *ExecContext) unshare(path string, replacing bool) os.Error {
+	if !ctx.Unshare {
+		return nil
+	}
+	info, err := os.Lstat(path)
+	if err != nil || !info.IsRegular() || info.Nlink < 2 {
+		return nil
+	}
+	if replacing {
+		return os.Remove(path)
+	}
+
+	srcF, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer srcF.Close()
+
+	dir, name := filepath.Split(path)
+	tempF, err := ioutil.TempFile(dir, name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tempF, srcF)
+	if closeErr := tempF.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempF.Name(), info.Mode&07777)
+	}
+	if err == nil {
+		err = os.Chtimes(tempF.Name(), info.Atime_ns, info.Mtime_ns)
+	}
+	if err != nil {
+		os.Remove(tempF.Name())
+		return err
+	}
+	return os.Rename(tempF.Name(), path)
+}
+
+// Resolve a path to its absolute location in this context.
+func (ctx *ExecContext) Resolve(path PathRef) string {
+	if localPath, is := path.(*LocalPath); is {
+		return ctx.LocalStore(localPath).Resolve(localPath.RelPath)
+	}
+	return path.Resolve()
+}
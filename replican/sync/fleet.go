@@ -0,0 +1,188 @@
+package sync
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cmars/replican-sync/replican/archive"
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// The outcome of applying a release to one destination of a fleet.
+type FleetResult struct {
+	Dst fs.LocalStore
+
+	// Commands planned for this destination.
+	Cmds int
+
+	// The command which failed, if any.
+	FailedCmd PatchCmd
+
+	Err os.Error
+}
+
+func (result *FleetResult) String() string {
+	switch {
+	case result.Err != nil && result.FailedCmd != nil:
+		return fmt.Sprintf("%s: failed at %v: %v", result.Dst.RootPath(), result.FailedCmd, result.Err)
+	case result.Err != nil:
+		return fmt.Sprintf("%s: failed: %v", result.Dst.RootPath(), result.Err)
+	}
+	return fmt.Sprintf("%s: ok, %d commands", result.Dst.RootPath(), result.Cmds)
+}
+
+// A signed bundle of a release, verified once, to be applied to many
+// destinations. Its data is decoded once and shared; its commands are
+// decoded again for each destination, as executing them keeps state.
+// Close removes the spooled bundle and its data.
+type FleetBundle struct {
+	Data *BundleData
+
+	spool  *os.File
+	length int64
+}
+
+// Decode a bundle written by EncodeSignedPlan with inline data, only if
+// it was signed with the private half of key, as DecodeSignedPlan.
+func DecodeFleetBundle(r io.Reader, key *rsa.PublicKey) (*FleetBundle, os.Error) {
+	spool, length, flags, err := verifyBundle(r, key)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &FleetBundle{spool: spool, length: length}
+
+	if flags&BUNDLE_INLINE == 0 {
+		bundle.Close()
+		return nil, os.NewError("Fleet bundles must carry their data inline")
+	}
+	if _, bundle.Data, err = decodePlan(bundle.reader(), nil, flags); err != nil {
+		bundle.Close()
+		return nil, err
+	}
+	return bundle, nil
+}
+
+func (bundle *FleetBundle) reader() io.Reader {
+	return io.NewSectionReader(bundle.spool, 0, bundle.length)
+}
+
+// Decode the bundle's plan, to be executed against dstStore with the
+// bundle's data.
+func (bundle *FleetBundle) Plan(dstStore fs.LocalStore) (*PatchPlan, os.Error) {
+	dec := &planDecoder{r: bundle.reader(), dstStore: dstStore}
+	plan := dec.readPlan()
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	return plan, nil
+}
+
+func (bundle *FleetBundle) Close() os.Error {
+	var err os.Error
+	if bundle.Data != nil {
+		err = bundle.Data.Close()
+	}
+	if closeErr := bundle.spool.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(bundle.spool.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// Apply a release bundle to many destinations, updating up to parallel
+// of them at once, or all of them if parallel is zero.
+//
+// A bundle only applies to the tree it was made against, the release
+// before it. If baseline is not nil, it is the manifest of that tree, and
+// each destination is checked against it from its index first; one which
+// does not match is reported and left alone, to be synced with SyncFleet
+// instead.
+//
+// Returns a result for each destination, in the order given. A failed
+// destination does not stop the others.
+func ApplyFleet(bundle *FleetBundle, dstStores []fs.LocalStore, baseline []*archive.Entry, parallel int) []*FleetResult {
+	return fleet(dstStores, parallel, func(dstStore fs.LocalStore) *FleetResult {
+		result := &FleetResult{Dst: dstStore}
+		if baseline != nil {
+			if check := Check(baseline, dstStore); !check.Passed() {
+				result.Err = os.NewError(fmt.Sprintf(
+					"Not at the release the bundle was made against: %v", check))
+				return result
+			}
+		}
+
+		plan, err := bundle.Plan(dstStore)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		return execRelease(result, plan, bundle.Data)
+	})
+}
+
+// Sync one source, the release, to many destinations, updating up to
+// parallel of them at once, or all of them if parallel is zero.
+//
+// A plan only applies to the tree it was made against, so each
+// destination is planned from its own index, and gets only the blocks
+// it is missing. The source is read by all the destinations at once;
+// a remote store serves them over one connection.
+//
+// Returns a result for each destination, in the order given. A failed
+// destination does not stop the others.
+func SyncFleet(srcStore fs.BlockStore, dstStores []fs.LocalStore, opts *PlanOptions, parallel int) []*FleetResult {
+	return fleet(dstStores, parallel, func(dstStore fs.LocalStore) *FleetResult {
+		return applyRelease(srcStore, dstStore, opts)
+	})
+}
+
+// Update each destination with apply, up to parallel at once.
+func fleet(dstStores []fs.LocalStore, parallel int, apply func(dstStore fs.LocalStore) *FleetResult) []*FleetResult {
+	if parallel <= 0 || parallel > len(dstStores) {
+		parallel = len(dstStores)
+	}
+
+	results := make([]*FleetResult, len(dstStores))
+	slots := make(chan bool, parallel)
+	done := make(chan bool)
+	for i, dstStore := range dstStores {
+		go func(i int, dstStore fs.LocalStore) {
+			slots <- true
+			results[i] = apply(dstStore)
+			<-slots
+			done <- true
+		}(i, dstStore)
+	}
+	for _ = range dstStores {
+		<-done
+	}
+	return results
+}
+
+func applyRelease(srcStore fs.BlockStore, dstStore fs.LocalStore, opts *PlanOptions) *FleetResult {
+	return execRelease(&FleetResult{Dst: dstStore}, NewPatchPlanOpts(srcStore, dstStore, opts), srcStore)
+}
+
+func execRelease(result *FleetResult, plan *PatchPlan, src fs.BlockProvider) *FleetResult {
+	result.Cmds = len(plan.Cmds)
+	result.FailedCmd, result.Err = plan.ExecWith(&ExecContext{Src: src, Dst: result.Dst})
+	if result.Err != nil {
+		return result
+	}
+
+	errors := make(chan os.Error)
+	go func() {
+		plan.Clean(errors)
+		close(errors)
+	}()
+	for err := range errors {
+		if result.Err == nil {
+			result.Err = err
+		}
+	}
+	return result
+}
@@ -0,0 +1,132 @@
+package sync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/archive"
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSyncFleet(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("same", tg.B(42, 65537)),
+		tg.F("changed", tg.B(43, 65537)),
+		tg.D("new", tg.F("baz", tg.B(45, 65537)))))
+	defer os.RemoveAll(srcpath)
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	srcStrong := srcStore.Repo().Root().Info().Strong
+
+	// Hosts at different points, each needing a different plan.
+	tg = treegen.New()
+	oldpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("same", tg.B(42, 65537)),
+		tg.F("changed", tg.B(44, 65537))))
+	defer os.RemoveAll(oldpath)
+	tg = treegen.New()
+	emptypath := treegen.TestTree(t, tg.D("foo"))
+	defer os.RemoveAll(emptypath)
+	tg = treegen.New()
+	ropath := treegen.TestTree(t, tg.D("foo", tg.F("changed", tg.B(44, 65537))))
+	defer os.RemoveAll(ropath)
+
+	oldStore, err := fs.NewLocalStore(oldpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	emptyStore, err := fs.NewLocalStore(emptypath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	roStore, err := fs.NewReadOnlyStore(ropath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	results := SyncFleet(srcStore, []fs.LocalStore{oldStore, emptyStore, roStore}, &PlanOptions{}, 2)
+	assert.Equal(t, 3, len(results))
+
+	for i, path := range []string{oldpath, emptypath} {
+		assert.Tf(t, results[i].Err == nil, "%v", results[i])
+		root, errors := fs.IndexDir(path, fs.NewMemRepo())
+		assert.Equalf(t, 0, len(errors), "%v", errors)
+		assert.Equal(t, srcStrong, root.Info().Strong)
+	}
+
+	// A failed host is reported without stopping the others.
+	_, is := results[2].Err.(*fs.ErrReadOnly)
+	assert.Tf(t, is, "%v", results[2])
+}
+
+func TestApplyFleet(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("same", tg.B(42, 65537)),
+		tg.F("changed", tg.B(43, 65537)),
+		tg.D("new", tg.F("baz", tg.B(45, 65537)))))
+	defer os.RemoveAll(srcpath)
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	srcStrong := srcStore.Repo().Root().Info().Strong
+
+	// The previous release, which the bundle is made against, and the
+	// hosts still at it.
+	mkRelease := func() string {
+		tg := treegen.New()
+		return treegen.TestTree(t, tg.D("foo",
+			tg.F("same", tg.B(42, 65537)),
+			tg.F("changed", tg.B(44, 65537), tg.B(43, 65537))))
+	}
+	basepath := mkRelease()
+	defer os.RemoveAll(basepath)
+	baseStore, err := fs.NewLocalStore(basepath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.T(t, err == nil)
+	buf := &bytes.Buffer{}
+	err = EncodeSignedPlan(buf, NewPatchPlan(srcStore, baseStore), true, key)
+	assert.Tf(t, err == nil, "%v", err)
+
+	bundle, err := DecodeFleetBundle(bytes.NewBuffer(buf.Bytes()), &key.PublicKey)
+	assert.Tf(t, err == nil, "%v", err)
+	defer bundle.Close()
+
+	hostpaths := []string{mkRelease(), mkRelease()}
+	tg = treegen.New()
+	driftpath := treegen.TestTree(t, tg.D("foo", tg.F("changed", tg.B(46, 65537))))
+	hostpaths = append(hostpaths, driftpath)
+	dstStores := []fs.LocalStore{}
+	for _, path := range hostpaths {
+		defer os.RemoveAll(path)
+		dstStore, err := fs.NewLocalStore(path, fs.NewMemRepo())
+		assert.T(t, err == nil)
+		dstStores = append(dstStores, dstStore)
+	}
+	driftStrong := dstStores[2].Repo().Root().Info().Strong
+
+	results := ApplyFleet(bundle, dstStores, archive.NewManifest(baseStore.Repo().Root()), 2)
+	assert.Equal(t, 3, len(results))
+
+	for i, path := range hostpaths[:2] {
+		assert.Tf(t, results[i].Err == nil, "%v", results[i])
+		root, errors := fs.IndexDir(path, fs.NewMemRepo())
+		assert.Equalf(t, 0, len(errors), "%v", errors)
+		assert.Equal(t, srcStrong, root.Info().Strong)
+	}
+
+	// A host which is not at the previous release is left alone.
+	assert.T(t, results[2].Err != nil)
+	root, errors := fs.IndexDir(driftpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, driftStrong, root.Info().Strong)
+
+	// Bundles signed with another key are refused.
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.T(t, err == nil)
+	_, err = DecodeFleetBundle(bytes.NewBuffer(buf.Bytes()), &otherKey.PublicKey)
+	_, isBad := err.(*ErrBadSignature)
+	assert.Tf(t, isBad, "%v", err)
+}
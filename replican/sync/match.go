@@ -3,6 +3,7 @@ package sync
 import (
 	"fmt"
 	"os"
+	"sort"
 	"github.com/cmars/replican-sync/replican/fs"
 )
 
@@ -15,6 +16,14 @@ type FileMatch struct {
 	SrcSize      int64
 	DstSize      int64
 	BlockMatches []*BlockMatch
+
+	// Block size of the source file, or for a file divided by content,
+	// the size its blocks were chosen around.
+	BlockSize int64
+
+	// Number of weak checksum hits found while scanning the destination,
+	// including those rejected by the strong checksum.
+	WeakMatches int
 }
 
 type RangePair struct {
@@ -39,7 +48,7 @@ func Match(src string, dst string) (match *FileMatch, err os.Error) {
 }
 
 func MatchFile(srcFile fs.File, dst string) (match *FileMatch, err os.Error) {
-	match = &FileMatch{SrcSize: srcFile.Info().Size}
+	match = &FileMatch{SrcSize: srcFile.Info().Size, BlockSize: fs.FileBlockSize(srcFile)}
 	var dstOffset int64
 
 	dstF, err := os.Open(dst)
@@ -56,8 +65,15 @@ func MatchFile(srcFile fs.File, dst string) (match *FileMatch, err os.Error) {
 		match.DstSize = dstInfo.Size
 	}
 
+	if fs.IsChunked(srcFile) {
+		if err = match.matchChunks(srcFile, dstF); err != nil {
+			return nil, err
+		}
+		return match, nil
+	}
+
 	dstWeak := new(fs.WeakChecksum)
-	var buf [fs.BLOCKSIZE]byte
+	buf := make([]byte, match.BlockSize)
 	var sbuf [1]byte
 	var window []byte
 
@@ -84,6 +100,7 @@ SCAN:
 			for {
 				// Check for a weak checksum match
 				if matchBlock, has := srcFile.Repo().WeakBlock(dstWeak.Get()); has {
+					match.WeakMatches++
 
 					// Double-check with the strong checksum
 					if fs.StrongChecksum(window[:blocksize]) == matchBlock.Info().Strong {
@@ -122,14 +139,70 @@ SCAN:
 	return match, nil
 }
 
-func (match *FileMatch) NotMatched() (ranges []*RangePair) {
-	start := int64(0)
+// Match a source file divided by content. The destination is divided
+// the same way, so that its blocks line up with the source's wherever
+// their content is the same, however it has moved; each is then only
+// looked up, rather than rolled over byte by byte.
+func (match *FileMatch) matchChunks(srcFile fs.File, dstF *os.File) os.Error {
+	srcBlocks := make(map[int][]fs.Block)
+	for _, srcBlock := range srcFile.Blocks() {
+		srcBlocks[srcBlock.Info().Weak] = append(srcBlocks[srcBlock.Info().Weak], srcBlock)
+	}
+	matched := make(map[int]bool)
 
+	chunker := fs.NewChunker(dstF, int(match.BlockSize))
+	dstWeak := new(fs.WeakChecksum)
+	var dstOffset int64
+	for {
+		chunk, err := chunker.Next()
+		if err == os.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		dstWeak.Reset()
+		dstWeak.Write(chunk)
+		if candidates, has := srcBlocks[dstWeak.Get()]; has {
+			match.WeakMatches++
+
+			// The same content may be at more than one place in the source
+			strong := fs.StrongChecksum(chunk)
+			for _, srcBlock := range candidates {
+				if position := srcBlock.Info().Position; !matched[position] && srcBlock.Info().Strong == strong {
+					matched[position] = true
+					match.BlockMatches = append(match.BlockMatches, &BlockMatch{
+						SrcBlock:  srcBlock,
+						DstOffset: dstOffset})
+				}
+			}
+		}
+		dstOffset += int64(len(chunk))
+	}
+	panic("Impossible")
+}
+
+// Get the ranges of the source file not covered by any block
+// matched in the destination, in source file offsets.
+func (match *FileMatch) NotMatched() (ranges []*RangePair) {
+	positions := make([]int, 0, len(match.BlockMatches))
+	blocks := make(map[int]*fs.BlockInfo)
 	for _, blockMatch := range match.BlockMatches {
-		if start < blockMatch.DstOffset {
-			ranges = append(ranges, &RangePair{From: start, To: blockMatch.DstOffset})
+		info := blockMatch.SrcBlock.Info()
+		positions = append(positions, info.Position)
+		blocks[info.Position] = info
+	}
+	sort.Ints(positions)
+
+	start := int64(0)
+	for _, position := range positions {
+		offset := blocks[position].Offset()
+		if start < offset {
+			ranges = append(ranges, &RangePair{From: start, To: offset})
+		}
+		if end := offset + blocks[position].Size(); start < end {
+			start = end
 		}
-		start = blockMatch.DstOffset + int64(fs.BLOCKSIZE)
 	}
 
 	if start < match.SrcSize {
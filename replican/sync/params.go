@@ -0,0 +1,39 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// A source and destination whose checksums are not comparable, as they
+// were calculated with different parameters, and which the destination
+// could not be reindexed to match. Planned regardless, every file would
+// be downloaded whole.
+type ErrHashMismatch struct {
+	Src *fs.HashParams
+	Dst *fs.HashParams
+
+	// Why the destination could not be reindexed.
+	Reason os.Error
+}
+
+func (err *ErrHashMismatch) String() string {
+	return fmt.Sprintf("Source hashed with %v, destination with %v, and cannot be reindexed to match: %v",
+		err.Src, err.Dst, err.Reason)
+}
+
+// Reindex the destination with the parameters of the source, if they differ.
+func (plan *PatchPlan) matchParams() os.Error {
+	srcParams := fs.StoreParams(plan.srcStore)
+	dstParams := fs.StoreParams(plan.dstStore)
+	if srcParams.Equals(dstParams) || plan.cancelled() {
+		return nil
+	}
+
+	if err := fs.AdoptParams(plan.dstStore, srcParams); err != nil {
+		return &ErrHashMismatch{Src: srcParams, Dst: dstParams, Reason: err}
+	}
+	return nil
+}
@@ -2,12 +2,17 @@ package sync
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"io/ioutil"
 	//	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"github.com/cmars/replican-sync/replican/events"
 	"github.com/cmars/replican-sync/replican/fs"
 )
 
@@ -37,11 +42,12 @@ func (localPath *LocalPath) Resolve() string {
 type PatchCmd interface {
 	String() string
 
-	Exec(srcStore fs.BlockStore) os.Error
+	// Carry out the command, using the stores given by the context.
+	Exec(ctx *ExecContext) os.Error
 }
 
-func mkParentDirs(path PathRef) os.Error {
-	dir, _ := filepath.Split(path.Resolve())
+func mkParentDirs(path string) os.Error {
+	dir, _ := filepath.Split(path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
 	}
@@ -53,55 +59,83 @@ type Transfer struct {
 	From *LocalPath
 	To   *LocalPath
 
-	relocRefs map[string]int
+	// Move the origin rather than copying it. The planner sets this on
+	// the last Transfer reading each path, when nothing else in the plan
+	// still needs the origin. See PatchPlan.RefCount.
+	Move bool
 }
 
 func (transfer *Transfer) String() string {
 	return fmt.Sprintf("Transfer %s to %s", transfer.From, transfer.To)
 }
 
-func (transfer *Transfer) Exec(srcStore fs.BlockStore) (err os.Error) {
-	transfer.relocRefs[transfer.From.RelPath]--
-	refCount := transfer.relocRefs[transfer.From.RelPath]
-
-	switch {
-	case refCount == 0:
-		return transfer.move(srcStore)
-	case refCount > 0:
-		return transfer.copy(srcStore)
+func (transfer *Transfer) Exec(ctx *ExecContext) (err os.Error) {
+	if transfer.Move {
+		return transfer.move(ctx)
 	}
-
-	return os.NewError(fmt.Sprintf(
-		"Cannot transfer %s: reference count underflow", transfer.From.RelPath))
+	return transfer.copy(ctx)
 }
 
-func (transfer *Transfer) copy(srcStore fs.BlockStore) os.Error {
-	if err := mkParentDirs(transfer.To); err != nil {
+func (transfer *Transfer) copy(ctx *ExecContext) os.Error {
+	if err := mkParentDirs(ctx.Resolve(transfer.To)); err != nil {
 		return err
 	}
 
-	srcF, err := os.Open(transfer.From.Resolve())
+	srcF, err := ctx.OpenFile(transfer.From, os.O_RDONLY, 0)
 	if err != nil {
 		return err
 	}
 	defer srcF.Close()
 
-	dstF, err := os.Create(transfer.To.Resolve())
+	dstF, err := ctx.OpenFile(transfer.To, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
 	defer dstF.Close()
 
 	_, err = io.Copy(dstF, srcF)
-	return err
+	if err != nil {
+		return err
+	}
+
+	// Carry over the origin's metadata, as a move would have.
+	srcInfo, err := srcF.Stat()
+	if srcInfo == nil {
+		return err
+	}
+
+	if err = dstF.Chmod(srcInfo.Mode); err != nil {
+		return err
+	}
+
+	dstF.Close()
+	return os.Chtimes(ctx.Resolve(transfer.To), srcInfo.Atime_ns, srcInfo.Mtime_ns)
+}
+
+func (transfer *Transfer) move(ctx *ExecContext) os.Error {
+	if err := mkParentDirs(ctx.Resolve(transfer.To)); err != nil {
+		return err
+	}
+
+	return fs.Move(ctx.Resolve(transfer.From), ctx.Resolve(transfer.To))
+}
+
+// Move a local directory and everything in it, as a single rename.
+type DirMove struct {
+	From *LocalPath
+	To   *LocalPath
 }
 
-func (transfer *Transfer) move(srcStore fs.BlockStore) os.Error {
-	if err := mkParentDirs(transfer.To); err != nil {
+func (dirMove *DirMove) String() string {
+	return fmt.Sprintf("Move directory %s to %s", dirMove.From, dirMove.To)
+}
+
+func (dirMove *DirMove) Exec(ctx *ExecContext) os.Error {
+	if err := mkParentDirs(ctx.Resolve(dirMove.To)); err != nil {
 		return err
 	}
 
-	return fs.Move(transfer.From.Resolve(), transfer.To.Resolve())
+	return os.Rename(ctx.Resolve(dirMove.From), ctx.Resolve(dirMove.To))
 }
 
 // Keep a file. Yeah, that's right. Just leave it alone.
@@ -113,7 +147,106 @@ func (keep *Keep) String() string {
 	return fmt.Sprintf("Keep %s", keep.Path.Resolve())
 }
 
-func (keep *Keep) Exec(srcStore fs.BlockStore) os.Error {
+func (keep *Keep) Exec(ctx *ExecContext) os.Error {
+	return nil
+}
+
+// Create an empty file, or update only the modification time of a
+// destination file, without transferring any data from the source.
+type Touch struct {
+	Path PathRef
+
+	// Empty the file, creating it if it does not exist.
+	Empty bool
+
+	// Modification time to set. Zero leaves it as it is, which for
+	// a file just emptied is the time it was emptied.
+	Mtime int64
+}
+
+func (touch *Touch) String() string {
+	if touch.Empty {
+		return fmt.Sprintf("Touch empty file %s", touch.Path.Resolve())
+	}
+	return fmt.Sprintf("Touch %s", touch.Path.Resolve())
+}
+
+func (touch *Touch) Exec(ctx *ExecContext) os.Error {
+	path := ctx.Resolve(touch.Path)
+	if !touch.Empty {
+		if err := ctx.unshare(path, false); err != nil {
+			return err
+		}
+	}
+
+	if touch.Empty {
+		if err := mkParentDirs(path); err != nil {
+			return err
+		}
+
+		f, err := ctx.OpenFile(touch.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			return err
+		}
+		if err = f.Close(); err != nil {
+			return err
+		}
+	}
+
+	if touch.Mtime != 0 {
+		info, err := os.Stat(path)
+		if info == nil {
+			return err
+		}
+		return os.Chtimes(path, info.Atime_ns, touch.Mtime)
+	}
+
+	return nil
+}
+
+// Update the metadata of a destination file or directory whose
+// contents already match the source. Mode is set only with HasMode,
+// so that a mode of zero can be set; a zero Mtime, or a negative Uid
+// or Gid, leaves that attribute as it is.
+type SetMeta struct {
+	Path    PathRef
+	Mode    uint32
+	HasMode bool
+	Mtime   int64
+	Uid     int
+	Gid     int
+}
+
+func (setMeta *SetMeta) String() string {
+	return fmt.Sprintf("Set metadata on %s", setMeta.Path.Resolve())
+}
+
+func (setMeta *SetMeta) Exec(ctx *ExecContext) (err os.Error) {
+	path := ctx.Resolve(setMeta.Path)
+	if err = ctx.unshare(path, false); err != nil {
+		return err
+	}
+
+	if setMeta.HasMode {
+		if err = os.Chmod(path, setMeta.Mode); err != nil {
+			return err
+		}
+	}
+
+	if setMeta.Uid >= 0 || setMeta.Gid >= 0 {
+		if err = os.Lchown(path, setMeta.Uid, setMeta.Gid); err != nil {
+			return err
+		}
+	}
+
+	if setMeta.Mtime != 0 {
+		info, err := os.Stat(path)
+		if info == nil {
+			return err
+		}
+		return os.Chtimes(path, info.Atime_ns, setMeta.Mtime)
+	}
+
 	return nil
 }
 
@@ -123,18 +256,29 @@ type Conflict struct {
 	FileInfo *os.FileInfo
 
 	relocPath string
+	store     fs.LocalStore
 }
 
 func (conflict *Conflict) String() string {
 	return fmt.Sprintf("Conflict found at %s, redirecting...", conflict.Path)
 }
 
-func (conflict *Conflict) Exec(srcStore fs.BlockStore) (err os.Error) {
-	conflict.relocPath, err = conflict.Path.LocalStore.Relocate(conflict.Path.RelPath)
+func (conflict *Conflict) Exec(ctx *ExecContext) (err os.Error) {
+	conflict.relocPath, err = ctx.LocalStore(conflict.Path).Relocate(ctx.Resolve(conflict.Path))
+	conflict.store = ctx.LocalStore(conflict.Path)
+	if err == nil {
+		events.Publish(&events.ConflictFound{
+			Path: conflict.Path.RelPath, RelocPath: conflict.store.RelPath(conflict.relocPath)})
+	}
 	return err
 }
 
+// Remove the relocated conflict, unless the store keeps
+// conflicts in a directory of their own for later triage.
 func (conflict *Conflict) Cleanup() os.Error {
+	if conflict.store.ConflictDir() != "" {
+		return nil
+	}
 	return os.RemoveAll(conflict.relocPath)
 }
 
@@ -148,8 +292,33 @@ func (resize *Resize) String() string {
 	return fmt.Sprintf("Resize %s to %d bytes", resize.Path, resize.Size)
 }
 
-func (resize *Resize) Exec(srcStore fs.BlockStore) os.Error {
-	return os.Truncate(resize.Path.Resolve(), resize.Size)
+func (resize *Resize) Exec(ctx *ExecContext) os.Error {
+	f, err := ctx.OpenFile(resize.Path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Truncate(resize.Size)
+}
+
+// Delete a destination file which nothing in the source matches.
+type Delete struct {
+	Path PathRef
+
+	// Move the file into the user's trash with fs.Trash, rather than deleting it.
+	Trash bool
+}
+
+func (del *Delete) String() string {
+	return fmt.Sprintf("Delete %s", del.Path.Resolve())
+}
+
+func (del *Delete) Exec(ctx *ExecContext) os.Error {
+	if del.Trash {
+		return fs.Trash(ctx.Resolve(del.Path))
+	}
+	return os.Remove(ctx.Resolve(del.Path))
 }
 
 // Start a temp file to recieve changes on a local destination file.
@@ -158,32 +327,57 @@ type LocalTemp struct {
 	Path PathRef
 	Size int64
 
-	localFh *os.File
-	tempFh  *os.File
+	srcPath  string
+	localFh  *os.File
+	tempFh   *os.File
+	tempName string
 }
 
 func (localTemp *LocalTemp) String() string {
 	return fmt.Sprintf("Create a temporary file for %s, size=%d bytes", localTemp.Path.Resolve(), localTemp.Size)
 }
 
-func (localTemp *LocalTemp) Exec(srcStore fs.BlockStore) (err os.Error) {
-	localTemp.localFh, err = os.Open(localTemp.Path.Resolve())
+func (localTemp *LocalTemp) Exec(ctx *ExecContext) (err os.Error) {
+	localTemp.localFh, err = ctx.OpenFile(localTemp.Path, os.O_RDONLY, 0)
 	if err != nil {
 		return err
 	}
 
-	localDir, localName := filepath.Split(localTemp.Path.Resolve())
+	localDir, localName := filepath.Split(ctx.Resolve(localTemp.Path))
 
 	localTemp.tempFh, err = ioutil.TempFile(localDir, localName)
 	if err != nil {
 		return err
 	}
+	localTemp.tempName = localTemp.tempFh.Name()
 
 	err = localTemp.tempFh.Truncate(localTemp.Size)
 
 	return err
 }
 
+// Close the local file and the temporary file, keeping the temporary
+// file to be put in place.
+func (localTemp *LocalTemp) close() {
+	if localTemp.localFh != nil {
+		localTemp.localFh.Close()
+		localTemp.localFh = nil
+	}
+	if localTemp.tempFh != nil {
+		localTemp.tempFh.Close()
+		localTemp.tempFh = nil
+	}
+}
+
+// Abandon the temporary file, leaving the local file as it was.
+func (localTemp *LocalTemp) discard() {
+	localTemp.close()
+	if localTemp.tempName != "" {
+		os.Remove(localTemp.tempName)
+		localTemp.tempName = ""
+	}
+}
+
 // Replace the local file with its temporary
 type ReplaceWithTemp struct {
 	Temp *LocalTemp
@@ -193,20 +387,16 @@ func (rwt *ReplaceWithTemp) String() string {
 	return fmt.Sprintf("Replace %s with the temporary backup", rwt.Temp.Path.Resolve())
 }
 
-func (rwt *ReplaceWithTemp) Exec(srcStore fs.BlockStore) (err os.Error) {
-	tempName := rwt.Temp.tempFh.Name()
-	rwt.Temp.localFh.Close()
-	rwt.Temp.localFh = nil
+func (rwt *ReplaceWithTemp) Exec(ctx *ExecContext) (err os.Error) {
+	tempName := rwt.Temp.tempName
+	rwt.Temp.close()
 
-	rwt.Temp.tempFh.Close()
-	rwt.Temp.tempFh = nil
-
-	err = os.Remove(rwt.Temp.Path.Resolve())
+	err = os.Remove(ctx.Resolve(rwt.Temp.Path))
 	if err != nil {
 		return err
 	}
 
-	err = fs.Move(tempName, rwt.Temp.Path.Resolve())
+	err = fs.Move(tempName, ctx.Resolve(rwt.Temp.Path))
 	if err != nil {
 		return err
 	}
@@ -214,7 +404,9 @@ func (rwt *ReplaceWithTemp) Exec(srcStore fs.BlockStore) (err os.Error) {
 	return nil
 }
 
-// Copy a range of data known to already be in the local destination file.
+// Copy a range of data known to already be in the local destination file,
+// from LocalOffset where it is found there, to TempOffset where it belongs
+// in the source file.
 type LocalTempCopy struct {
 	Temp        *LocalTemp
 	LocalOffset int64
@@ -227,18 +419,13 @@ func (ltc *LocalTempCopy) String() string {
 		ltc.Length, ltc.LocalOffset, ltc.Temp.Path.Resolve(), ltc.TempOffset)
 }
 
-func (ltc *LocalTempCopy) Exec(srcStore fs.BlockStore) (err os.Error) {
+func (ltc *LocalTempCopy) Exec(ctx *ExecContext) (err os.Error) {
 	_, err = ltc.Temp.localFh.Seek(ltc.LocalOffset, 0)
 	if err != nil {
 		return err
 	}
 
-	_, err = ltc.Temp.tempFh.Seek(ltc.TempOffset, 0)
-	if err != nil {
-		return err
-	}
-
-	_, err = io.Copyn(ltc.Temp.tempFh, ltc.Temp.localFh, ltc.Length)
+	_, err = io.Copyn(&fs.SparseWriter{File: ltc.Temp.tempFh, Offset: ltc.TempOffset}, ltc.Temp.localFh, ltc.Length)
 	return err
 }
 
@@ -256,9 +443,32 @@ func (stc *SrcTempCopy) String() string {
 		stc.Length, stc.SrcOffset, stc.SrcStrong, stc.TempOffset)
 }
 
-func (stc *SrcTempCopy) Exec(srcStore fs.BlockStore) os.Error {
-	stc.Temp.tempFh.Seek(stc.TempOffset, 0)
-	_, err := srcStore.ReadInto(stc.SrcStrong, stc.SrcOffset, stc.Length, stc.Temp.tempFh)
+func (stc *SrcTempCopy) Exec(ctx *ExecContext) os.Error {
+	_, err := ctx.readRange(stc.SrcStrong, stc.SrcOffset, stc.Length, stc.Temp.tempFh, stc.TempOffset)
+	return err
+}
+
+// Copy a block of source data, addressed by its strong checksum,
+// into a local temp file.
+type SrcBlockCopy struct {
+	Temp       *LocalTemp
+	SrcStrong  string
+	TempOffset int64
+	Length     int64
+}
+
+func (sbc *SrcBlockCopy) String() string {
+	return fmt.Sprintf("Copy %d bytes from source block %s to offset %d in temporary file",
+		sbc.Length, sbc.SrcStrong, sbc.TempOffset)
+}
+
+func (sbc *SrcBlockCopy) Exec(ctx *ExecContext) os.Error {
+	_, err := sbc.Temp.tempFh.Seek(sbc.TempOffset, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = ctx.Src.ReadBlockInto(sbc.SrcStrong, sbc.Temp.tempFh)
 	return err
 }
 
@@ -267,54 +477,434 @@ type SrcFileDownload struct {
 	SrcFile fs.File
 	Path    PathRef
 	Length  int64
+
+	// Write the file gzip-compressed, for a compressed destination.
+	Compress bool
 }
 
 func (sfd *SrcFileDownload) String() string {
+	if sfd.Compress {
+		return fmt.Sprintf("Compress entire source %s to %s", sfd.SrcFile.Info().Strong, sfd.Path.Resolve())
+	}
 	return fmt.Sprintf("Copy entire source %s to %s", sfd.SrcFile.Info().Strong, sfd.Path.Resolve())
 }
 
-func (sfd *SrcFileDownload) Exec(srcStore fs.BlockStore) os.Error {
-	if err := mkParentDirs(sfd.Path); err != nil {
+func (sfd *SrcFileDownload) Exec(ctx *ExecContext) os.Error {
+	if err := mkParentDirs(ctx.Resolve(sfd.Path)); err != nil {
 		return err
 	}
 
-	dstFh, err := os.Create(sfd.Path.Resolve())
+	if fs.IsSymlinkMode(sfd.SrcFile.Info().Mode) {
+		return (&CreateSymlink{SrcFile: sfd.SrcFile, Path: sfd.Path}).Exec(ctx)
+	}
+
+	dstFh, err := ctx.OpenFile(sfd.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if dstFh == nil {
 		return err
 	}
+	defer dstFh.Close()
 
-	_, err = srcStore.ReadInto(sfd.SrcFile.Info().Strong, 0, sfd.SrcFile.Info().Size, dstFh)
+	if !sfd.Compress {
+		if _, err = ctx.readRange(sfd.SrcFile.Info().Strong, 0, sfd.SrcFile.Info().Size, dstFh, 0); err != nil {
+			return err
+		}
+		// Zeros at the end are left as a hole, which only the size covers
+		return dstFh.Truncate(sfd.SrcFile.Info().Size)
+	}
+
+	gz, err := gzip.NewWriter(dstFh)
+	if err != nil {
+		return err
+	}
+	_, err = ctx.Src.ReadInto(sfd.SrcFile.Info().Strong, 0, sfd.SrcFile.Info().Size, gz)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
 	return err
 }
 
+// Copy a live source file whole with a ConsistentCopier.
+type ConsistentCopy struct {
+	SrcPath string
+	Path    PathRef
+	Copier  ConsistentCopier
+}
+
+func (cc *ConsistentCopy) String() string {
+	return fmt.Sprintf("Copy live source %s to %s", cc.SrcPath, cc.Path.Resolve())
+}
+
+func (cc *ConsistentCopy) Exec(ctx *ExecContext) os.Error {
+	dstPath := ctx.Resolve(cc.Path)
+	if err := mkParentDirs(dstPath); err != nil {
+		return err
+	}
+
+	// Copy to an unused name beside the destination, then move it into place.
+	dir, name := filepath.Split(dstPath)
+	tempF, err := ioutil.TempFile(dir, name)
+	if err != nil {
+		return err
+	}
+	tempPath := tempF.Name()
+	tempF.Close()
+	os.Remove(tempPath)
+
+	if err = cc.Copier.Copy(cc.SrcPath, tempPath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return fs.Move(tempPath, dstPath)
+}
+
+// Recreate a symbolic link indexed with fs.SYMLINKS_STORE, whose content
+// is its target. The target is read from the source when executed, and
+// the link is created as-is, without resolving it. With ExecContext.Confine,
+// targets which are absolute or climb out of the destination are refused.
+type CreateSymlink struct {
+	SrcFile fs.File
+	Path    PathRef
+}
+
+func (cs *CreateSymlink) String() string {
+	return fmt.Sprintf("Link %s to the target of source %s", cs.Path.Resolve(), cs.SrcFile.Info().Strong)
+}
+
+func (cs *CreateSymlink) Exec(ctx *ExecContext) os.Error {
+	dstPath := ctx.Resolve(cs.Path)
+	if err := mkParentDirs(dstPath); err != nil {
+		return err
+	}
+
+	target := &bytes.Buffer{}
+	_, err := ctx.Src.ReadInto(cs.SrcFile.Info().Strong, 0, cs.SrcFile.Info().Size, target)
+	if err != nil {
+		return err
+	}
+
+	if root, has := ctx.rootOf(cs.Path); ctx.Confine && has {
+		root, _ = confinedPath(root, dstPath)
+		if err := fs.CheckLinkBeneath(root, dstPath, target.String()); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(target.String(), dstPath)
+}
+
+// Options which control how a PatchPlan is constructed.
+type PlanOptions struct {
+	// Compare the metadata of content-identical files, and update
+	// the destination with SetMeta rather than Keep where
+	// mode, modification time or ownership differ.
+	CompareMeta bool
+
+	// Leave destination directories which are not in the source
+	// in place after Clean, even if they are left empty.
+	KeepEmptyDirs bool
+
+	// Plan only metadata updates, as with CompareMeta, for paths whose
+	// content already matches the source, as a quick fix for drifted
+	// permissions or times. Paths whose content does not match are left
+	// alone, and reported with PathErrors as ErrContentDiffers. Nothing
+	// is deleted, and Clean does nothing.
+	MetaOnly bool
+
+	// How a destination file at the same path as a source file is judged
+	// to match it. By default, only matching content will do.
+	Compare ComparePolicy
+
+	// With COMPARE_MTIME, modification times this many nanoseconds apart
+	// are still equal, for filesystems which store times coarsely, such as
+	// FAT's two seconds.
+	MtimeWindow int64
+
+	// Leave alone destination files modified more recently than their
+	// source, rather than overwriting them with its older content, and
+	// report them with PathErrors as ErrDstNewer. This protects fresh work
+	// from an old snapshot synced over it. Times are only known when the
+	// source is on local disk.
+	KeepNewer bool
+
+	// Apply the source's POSIX ACLs to the destination once the plan
+	// is executed, with ApplyACL. The source must be indexed with its
+	// ACLs, as by fs.LocalStore.SetAcls.
+	Acls bool
+
+	// Record the reason each command was planned, for Reason and Explain.
+	Explain bool
+
+	// How to plan source names which cannot be created in the destination.
+	ReservedNames ReservedNamePolicy
+
+	// How to plan destination paths longer than the destination
+	// platform allows. See PathErrors.
+	LongNames LongNamePolicy
+
+	// Apply the Windows naming rules to the destination whatever the
+	// platform, as for a Windows share mounted on another platform.
+	WindowsNames bool
+
+	// Restore source names escaped with RESERVED_ESCAPE, as when
+	// syncing back from a Windows destination.
+	UnescapeNames bool
+
+	// Move files removed by Clean into the user's trash with fs.Trash,
+	// rather than deleting them.
+	Trash bool
+
+	// When unmatched destination files are deleted, trading peak disk
+	// usage against keeping old content until new content is in place.
+	Deletes DeletePolicy
+
+	// Files to leave alone, by destination relative path: they are
+	// neither copied from the source nor deleted from the destination.
+	Skip map[string]bool
+
+	// If not nil, asked before each change to the destination as the plan
+	// is executed, with the destination relative path changed and the
+	// command changing it; a command changing several paths is asked about
+	// each. Deletions made by Clean are asked about as Delete commands.
+	// An error refuses the change: the command fails the execution with
+	// it, and Clean reports it and leaves the path in place. Unlike Skip,
+	// it can refuse changes which were planned, such as after showing
+	// PendingDeletes to a user.
+	Veto func(path string, cmd PatchCmd) os.Error
+
+	// Copiers for live files in a local source, such as databases, which
+	// a plain copy could catch mid-write. Files handled by a copier are
+	// copied whole with ConsistentCopy, rather than patched.
+	Copiers []ConsistentCopier
+
+	// Limit on planning, in nanoseconds, or zero for none. Planning reads
+	// a destination opened on demand, and the files of a lazily indexed
+	// source, so it can stall on a hung mount. A plan which times out has
+	// no commands, and fails to execute with an fs.ErrTimeout. Wrap the
+	// source in an fs.TimeoutStore to limit the reads of executing it.
+	//
+	// Planning which times out is cancelled, but a read it is stalled in
+	// cannot be interrupted, and may yet index the destination once it
+	// returns. Plan again against a freshly opened destination store.
+	Timeout int64
+}
+
+// Make consistent copies of live files, such as databases in use, whose
+// blocks could otherwise be copied from different states of the file.
+type ConsistentCopier interface {
+	// Test whether the file at path is one this copier handles.
+	Handles(path string) bool
+
+	// Copy the file at src to dst, which does not exist.
+	Copy(src string, dst string) os.Error
+}
+
+// How a plan judges whether a destination file matches the source file at
+// the same path. The heuristics are faster than comparing content on trees
+// known to change content only with size or modification time, but miss
+// any change which keeps both.
+type ComparePolicy int
+
+const (
+	// Files match if their strong checksums do.
+	COMPARE_CONTENT ComparePolicy = iota
+
+	// Files match if their sizes do.
+	COMPARE_SIZE
+
+	// Files match if their sizes do, and their modification times are
+	// within MtimeWindow of each other. Times are only known when the
+	// source is on local disk; otherwise content is compared.
+	COMPARE_MTIME
+)
+
+// When a plan deletes destination files which nothing in the source matches.
+// Whatever the policy, unmatched files which a Transfer reuses are moved by
+// it rather than deleted, and Clean is needed to remove emptied directories.
+type DeletePolicy int
+
+const (
+	// Leave them to Clean, once the plan has run.
+	DELETE_AFTER DeletePolicy = iota
+
+	// Delete them with Delete commands at the start of the plan, so that
+	// a sync replacing much of a tree never needs room for both old and
+	// new content at once.
+	DELETE_BEFORE
+
+	// Delete them with Delete commands just before the plan first writes
+	// to their directory, or at the end of the plan if it never does.
+	DELETE_DURING
+)
+
+// How a plan treats source names which cannot be created in the destination.
+type ReservedNamePolicy int
+
+const (
+	// Plan them as they are. Commands writing them will fail.
+	RESERVED_FAIL ReservedNamePolicy = iota
+
+	// Leave them, and anything beneath them, out of the plan.
+	RESERVED_SKIP
+
+	// Give them a name which can be created, by fs.WindowsSafeName.
+	RESERVED_RENAME
+
+	// Escape them with fs.EscapeWindowsName, so that syncing back with
+	// UnescapeNames restores the original names.
+	RESERVED_ESCAPE
+)
+
+// How a plan treats destination paths which are too long to be created.
+type LongNamePolicy int
+
+const (
+	// Plan them as they are, and report them with PathErrors.
+	// Commands writing them will fail.
+	LONG_FAIL LongNamePolicy = iota
+
+	// Leave them, and anything beneath them, out of the plan.
+	LONG_SKIP
+
+	// Shorten names which are too long with fs.ShortenName. Paths which
+	// are still too long are reported with PathErrors.
+	LONG_SHORTEN
+)
+
 type PatchPlan struct {
 	Cmds []PatchCmd
 
 	dstFileUnmatch map[string]fs.File
 
+	reasons map[PatchCmd]string
+
+	pathErrors []os.Error
+
+	// Why the source and destination cannot be compared, if they cannot.
+	paramsErr os.Error
+
+	// Why planning did not finish, if it did not.
+	timeoutErr os.Error
+
+	// Closed once planning is given up on, so that it stops changing the
+	// destination. Nil if planning has no timeout.
+	cancel chan bool
+
+	// Number of commands using each destination path as content.
+	relocRefs map[string]int
+
+	// Destination directories moved whole, and the moves, which are
+	// made after everything else has read from them.
+	movedDirs map[string]bool
+	dirMoves  []*DirMove
+
+	// Directories of an on-demand destination indexed so far.
+	warmDirs map[string]bool
+
+	// Replacements held back by ExecPhased until Commit.
+	staging   bool
+	staged    []*stagedCmd
+	stagedDst string
+
+	// Bytes read from the source, and bytes of file content written,
+	// by the commands executed so far.
+	literal int64
+	written int64
+
 	srcStore fs.BlockStore
 	dstStore fs.LocalStore
+
+	opts *PlanOptions
 }
 
+// Plan the commands needed to make the destination store match the source.
+// A destination indexed with other parameters than the source, such as
+// another block size, is first reindexed with the source's; if it cannot
+// be, executing the plan fails with ErrHashMismatch.
+//
+// Planning visits the source tree in the stable order of fs.Walk,
+// so identical inputs always produce identical plans.
+//
+// A destination opened with fs.NewOnDemandStore is indexed as planning
+// reaches it: only the directories holding source paths are read, so only
+// their files are matched with the source, or deleted by Clean.
 func NewPatchPlan(srcStore fs.BlockStore, dstStore fs.LocalStore) *PatchPlan {
-	plan := &PatchPlan{srcStore: srcStore, dstStore: dstStore}
+	return NewPatchPlanOpts(srcStore, dstStore, &PlanOptions{})
+}
+
+// Plan the commands needed to make the destination store match the source,
+// with options. See NewPatchPlan.
+func NewPatchPlanOpts(srcStore fs.BlockStore, dstStore fs.LocalStore, opts *PlanOptions) *PatchPlan {
+	if opts.Timeout > 0 {
+		return newPatchPlanTimeout(srcStore, dstStore, opts)
+	}
+	return newPatchPlan(srcStore, dstStore, opts, nil)
+}
+
+// Plan within opts.Timeout, or give up on the plan. Planning cannot be
+// interrupted in the middle of a read, so it is cancelled, and stops at
+// its next step: it neither reindexes nor indexes the destination any
+// further, and its plan is discarded without being announced.
+func newPatchPlanTimeout(srcStore fs.BlockStore, dstStore fs.LocalStore, opts *PlanOptions) *PatchPlan {
+	done := make(chan *PatchPlan, 1)
+	cancel := make(chan bool)
+	go func() {
+		done <- newPatchPlan(srcStore, dstStore, opts, cancel)
+	}()
+
+	select {
+	case plan := <-done:
+		return plan
+	case <-time.After(opts.Timeout):
+		close(cancel)
+	}
+
+	return &PatchPlan{
+		srcStore:       srcStore,
+		dstStore:       dstStore,
+		opts:           opts,
+		dstFileUnmatch: make(map[string]fs.File),
+		relocRefs:      make(map[string]int),
+		movedDirs:      make(map[string]bool),
+		warmDirs:       make(map[string]bool),
+		timeoutErr:     &fs.ErrTimeout{Op: "Plan", Name: dstStore.RootPath(), Limit: opts.Timeout}}
+}
+
+func newPatchPlan(srcStore fs.BlockStore, dstStore fs.LocalStore, opts *PlanOptions, cancel chan bool) *PatchPlan {
+	plan := &PatchPlan{srcStore: srcStore, dstStore: dstStore, opts: opts, cancel: cancel}
+	if opts.Explain {
+		plan.reasons = make(map[PatchCmd]string)
+	}
+
+	plan.paramsErr = plan.matchParams()
 
 	plan.dstFileUnmatch = make(map[string]fs.File)
 
 	fs.Walk(dstStore.Repo().Root(), func(dstNode fs.Node) bool {
+		if plan.cancelled() {
+			return false
+		}
+
+		dstFsNode, isDstFsNode := dstNode.(fs.FsNode)
+		if isDstFsNode && inConflictDir(dstStore, fs.RelPath(dstFsNode)) {
+			return false
+		}
 
 		dstFile, isDstFile := dstNode.(fs.File)
-		if isDstFile {
+		if isDstFile && !opts.Skip[fs.RelPath(dstFile)] {
 			plan.dstFileUnmatch[fs.RelPath(dstFile)] = dstFile
 		}
 
 		return !isDstFile
 	})
 
-	relocRefs := make(map[string]int)
+	plan.relocRefs = make(map[string]int)
+	plan.movedDirs = make(map[string]bool)
+	plan.warmDirs = make(map[string]bool)
 
 	// Find all the FsNode matches
 	fs.Walk(srcStore.Repo().Root(), func(srcNode fs.Node) bool {
+		if plan.cancelled() {
+			return false
+		}
 
 		// Ignore non-FsNodes
 		srcFsNode, isSrcFsNode := srcNode.(fs.FsNode)
@@ -325,11 +915,50 @@ func NewPatchPlan(srcStore fs.BlockStore, dstStore fs.LocalStore) *PatchPlan {
 		//		log.Printf("In src: %s", fs.RelPath(srcFsNode))
 
 		srcFile, isSrcFile := srcNode.(fs.File)
-		srcPath := fs.RelPath(srcFsNode)
+
+		// Where the source node goes in the destination: its own path,
+		// unless a name along it cannot be created there.
+		srcPath, allowed := plan.dstName(fs.RelPath(srcFsNode))
+		if !allowed {
+			return false
+		}
+
+		if err := fs.CheckPathLength(dstStore.Resolve(srcPath)); err != nil {
+			plan.pathErrors = append(plan.pathErrors, err)
+		}
+
+		plan.warmDir(parentPath(srcPath))
 
 		// Remove this srcPath from dst unmatched, if it was present
 		plan.dstFileUnmatch[srcPath] = nil, false
 
+		if isSrcFile && plan.opts.Skip[srcPath] {
+			return false
+		}
+
+		if isSrcFile && plan.opts.KeepNewer {
+			if err := plan.checkNewer(srcFile, srcPath); err != nil {
+				plan.pathErrors = append(plan.pathErrors, err)
+				return false
+			}
+		}
+
+		if plan.opts.MetaOnly {
+			return plan.appendMetaOnly(srcFsNode, srcPath)
+		}
+
+		if isSrcFile && plan.opts.Compare != COMPARE_CONTENT && plan.quickMatch(srcFile, srcPath) {
+			matched := "size"
+			if plan.opts.Compare == COMPARE_MTIME {
+				matched = "size and modification time"
+			}
+			plan.relocRefs[srcPath]++
+			plan.appendCmd(&Keep{
+				Path: &LocalPath{LocalStore: dstStore, RelPath: srcPath}},
+				"%s matched at the same path, without comparing content", matched)
+			return false
+		}
+
 		var srcStrong string
 		if isSrcFile {
 			srcStrong = srcFile.Info().Strong
@@ -351,11 +980,29 @@ func NewPatchPlan(srcStore fs.BlockStore, dstStore fs.LocalStore) *PatchPlan {
 
 		dstFilePath := dstStore.Resolve(srcPath)
 		dstFileInfo, _ := os.Stat(dstFilePath)
+		dstLinkInfo, _ := os.Lstat(dstFilePath)
+
+		// A renamed directory is moved whole, rather than file by file
+		if srcDir, isSrcDir := srcNode.(fs.Dir); isSrcDir && hasDstNode && !isDstFile &&
+			plan.canMoveDir(srcDir, srcPath, fs.RelPath(dstNode)) {
+			plan.planDirMove(dstNode.(fs.Dir), srcPath)
+			return false
+		}
 
 		// Resolve dst node that matches strong checksum with source
-		if hasDstNode && isSrcFile == isDstFile {
+		if copier, srcAbsPath := plan.copierFor(srcFsNode); copier != nil &&
+			!(hasDstNode && fs.RelPath(dstNode) == srcPath) &&
+			(dstFileInfo == nil || dstFileInfo.IsRegular()) {
+			plan.appendCmd(&ConsistentCopy{
+				SrcPath: srcAbsPath,
+				Path:    &LocalPath{LocalStore: dstStore, RelPath: srcPath},
+				Copier:  copier},
+				"live source file is copied whole by %T", copier)
+		} else if isSrcFile && srcStrong == fs.EMPTY_STRONG {
+			plan.appendEmptyFile(srcFile, srcPath, dstLinkInfo)
+		} else if hasDstNode && isSrcFile == isDstFile && (isSrcFile || fs.RelPath(dstNode) == srcPath) {
 			dstPath := fs.RelPath(dstNode)
-			relocRefs[dstPath]++ // dstPath will be used in this cmd, inc ref count
+			plan.relocRefs[dstPath]++ // dstPath will be used in this cmd, inc ref count
 
 			//			log.Printf("srcPath=%s dstPath=%s", srcPath, dstPath)
 
@@ -363,12 +1010,16 @@ func NewPatchPlan(srcStore fs.BlockStore, dstStore fs.LocalStore) *PatchPlan {
 				// Local dst file needs to be renamed or copied to src path
 				from := &LocalPath{LocalStore: dstStore, RelPath: dstPath}
 				to := &LocalPath{LocalStore: dstStore, RelPath: srcPath}
-				plan.Cmds = append(plan.Cmds,
-					&Transfer{From: from, To: to, relocRefs: relocRefs})
+				plan.appendCmd(&Transfer{From: from, To: to},
+					"strong checksum %s matched at destination path %s", srcStrong, dstPath)
+			} else if metaCmd := plan.metaUpdate(srcFsNode, srcPath); metaCmd != nil {
+				// Same content, but the metadata has drifted
+				plan.appendCmd(metaCmd, "content matched, but metadata differs")
 			} else {
 				// Same path, keep it where it is
-				plan.Cmds = append(plan.Cmds, &Keep{
-					Path: &LocalPath{LocalStore: dstStore, RelPath: srcPath}})
+				plan.appendCmd(&Keep{
+					Path: &LocalPath{LocalStore: dstStore, RelPath: srcPath}},
+					"strong checksum %s matched at the same path", srcStrong)
 			}
 
 			// If its a file, figure out what to do with it
@@ -378,16 +1029,35 @@ func NewPatchPlan(srcStore fs.BlockStore, dstStore fs.LocalStore) *PatchPlan {
 
 			// Destination is not a file, so get rid of whatever is there first
 			case dstFileInfo != nil && !dstFileInfo.IsRegular():
-				plan.Cmds = append(plan.Cmds, &Conflict{
+				plan.appendCmd(&Conflict{
 					Path:     &LocalPath{LocalStore: dstStore, RelPath: srcPath},
-					FileInfo: dstFileInfo})
+					FileInfo: dstFileInfo},
+					"source has a file where destination has a %s", describeMode(dstFileInfo))
+				fallthrough
+
+			// Links are replaced whole, rather than patched
+			case dstLinkInfo != nil && fs.IsSymlinkMode(srcFile.Info().Mode):
+				if dstFileInfo == nil || dstFileInfo.IsRegular() {
+					plan.appendCmd(&Conflict{
+						Path:     &LocalPath{LocalStore: dstStore, RelPath: srcPath},
+						FileInfo: dstLinkInfo},
+						"source has a symbolic link where destination has a %s", describeMode(dstLinkInfo))
+				}
 				fallthrough
 
 			// Destination file does not exist, so full source copy needed
 			case dstFileInfo == nil:
-				plan.Cmds = append(plan.Cmds, &SrcFileDownload{
+				if fs.IsSymlinkMode(srcFile.Info().Mode) {
+					plan.appendCmd(&CreateSymlink{
+						SrcFile: srcFile,
+						Path:    &LocalPath{LocalStore: dstStore, RelPath: srcPath}},
+						"no symbolic link to target %s at the destination path", srcStrong)
+					break
+				}
+				plan.appendCmd(&SrcFileDownload{
 					SrcFile: srcFile,
-					Path:    &LocalPath{LocalStore: dstStore, RelPath: srcPath}})
+					Path:    &LocalPath{LocalStore: dstStore, RelPath: srcPath}},
+					"no match for strong checksum %s, and no file at the destination path", srcStrong)
 				break
 
 			// Destination file exists, add block-level commands
@@ -400,116 +1070,1561 @@ func NewPatchPlan(srcStore fs.BlockStore, dstStore fs.LocalStore) *PatchPlan {
 		} else {
 
 			if dstFileInfo != nil && !dstFileInfo.IsDirectory() {
-				plan.Cmds = append(plan.Cmds, &Conflict{
-					Path:     &LocalPath{LocalStore: dstStore, RelPath: dstFilePath},
-					FileInfo: dstFileInfo})
+				plan.appendCmd(&Conflict{
+					Path:     &LocalPath{LocalStore: dstStore, RelPath: srcPath},
+					FileInfo: dstFileInfo},
+					"source has a directory where destination has a %s", describeMode(dstFileInfo))
 			}
 		}
 
 		return !isSrcFile
 	})
 
-	return plan
-}
+	if plan.cancelled() {
+		return plan
+	}
 
-func (plan *PatchPlan) appendFilePlan(srcFile fs.File, dstPath string) os.Error {
-	match, err := MatchFile(srcFile, plan.dstStore.Resolve(dstPath))
-	if match == nil {
-		return err
+	for _, dirMove := range plan.dirMoves {
+		plan.Cmds = append(plan.Cmds, dirMove)
 	}
-	match.SrcSize = srcFile.Info().Size
 
-	// Create a local temporary file in which to effect changes
-	localTemp := &LocalTemp{
-		Path: &LocalPath{
-			LocalStore: plan.dstStore,
-			RelPath:    dstPath},
-		Size: match.SrcSize}
-	plan.Cmds = append(plan.Cmds, localTemp)
+	plan.breakTransferCycles()
+	plan.keepTransferSources()
+	plan.assignMoves()
 
-	for _, blockMatch := range match.BlockMatches {
-		// TODO: math/imath
-		length := srcFile.Info().Size - blockMatch.SrcBlock.Info().Offset()
-		if length > int64(fs.BLOCKSIZE) {
-			length = int64(fs.BLOCKSIZE)
-		}
+	if opts.MetaOnly {
+		plan.dstFileUnmatch = make(map[string]fs.File)
+	}
 
-		plan.Cmds = append(plan.Cmds, &LocalTempCopy{
-			Temp:        localTemp,
-			LocalOffset: blockMatch.SrcBlock.Info().Offset(),
-			TempOffset:  blockMatch.DstOffset,
-			Length:      length})
+	if opts.Deletes != DELETE_AFTER {
+		plan.planDeletes()
 	}
 
+	events.Publish(&events.PlanReady{Dst: dstStore.RootPath(), Cmds: len(plan.Cmds)})
+	return plan
+}
+
+// Test whether planning has been given up on.
+func (plan *PatchPlan) cancelled() bool {
+	if plan.cancel == nil {
+		return false
+	}
+	select {
+	case <-plan.cancel:
+		return true
+	default:
+	}
+	return false
+}
+
+// Index the directory at relpath in an on-demand destination, adding its
+// files to those unmatched. Directories the destination does not have are
+// left alone.
+func (plan *PatchPlan) warmDir(relpath string) {
+	if !plan.dstStore.OnDemand() || plan.warmDirs[relpath] || plan.cancelled() {
+		return
+	}
+	plan.warmDirs[relpath] = true
+
+	if err := plan.dstStore.IndexEntries(relpath); err != nil {
+		return
+	}
+
+	dstRoot, isDir := plan.dstStore.Repo().Root().(fs.Dir)
+	if !isDir {
+		return
+	}
+	dstNode, has := fs.Lookup(dstRoot, relpath)
+	if !has {
+		return
+	}
+	dstDir, isDir := dstNode.(fs.Dir)
+	if !isDir {
+		return
+	}
+
+	for _, dstFile := range dstDir.Files() {
+		dstPath := fs.RelPath(dstFile)
+		if !inConflictDir(plan.dstStore, dstPath) && !plan.opts.Skip[dstPath] {
+			plan.dstFileUnmatch[dstPath] = dstFile
+		}
+	}
+}
+
+// Take destination files which Transfers read from out of those to be
+// deleted, whether or not any source path matches them. The last Transfer
+// from each moves it away, so Clean would find nothing to delete after
+// Exec, and before Exec would destroy content the plan still needs.
+func (plan *PatchPlan) keepTransferSources() {
+	for dstPath, _ := range plan.dstFileUnmatch {
+		if plan.relocRefs[dstPath] > 0 {
+			plan.dstFileUnmatch[dstPath] = nil, false
+		}
+	}
+}
+
+// Test whether the source directory at srcPath can be planned as a move
+// of the matching destination directory at dstPath, rather than file by
+// file. Only a plain rename qualifies: nothing is at srcPath in the
+// destination, nothing is at dstPath in the source, and no option treats
+// the files within it differently.
+func (plan *PatchPlan) canMoveDir(srcDir fs.Dir, srcPath string, dstPath string) bool {
+	if srcDir.Info().Strong == fs.EMPTY_STRONG || isBeneath(srcPath, dstPath) || isBeneath(dstPath, srcPath) {
+		return false
+	}
+	if plan.opts.CompareMeta || plan.opts.KeepNewer || len(plan.opts.Skip) > 0 ||
+		len(plan.opts.Copiers) > 0 || plan.opts.Veto != nil {
+		return false
+	}
+
+	if _, err := os.Lstat(plan.dstStore.Resolve(srcPath)); err == nil {
+		return false
+	}
+	if srcRoot, isDir := plan.srcStore.Repo().Root().(fs.Dir); isDir {
+		if _, has := fs.Lookup(srcRoot, dstPath); has {
+			return false
+		}
+	}
+	for movedPath, _ := range plan.movedDirs {
+		if isBeneath(dstPath, movedPath) || isBeneath(movedPath, dstPath) {
+			return false
+		}
+	}
+
+	// Names within the directory must be kept as they are
+	srcRelPath := fs.RelPath(srcDir)
+	renamed := false
+	fs.Walk(srcDir, func(node fs.Node) bool {
+		if fsNode, is := node.(fs.FsNode); is && !renamed {
+			relpath := fs.RelPath(fsNode)
+			name, allowed := plan.dstName(relpath)
+			renamed = !allowed || name != filepath.Join(srcPath, relpath[len(srcRelPath):])
+		}
+		return !renamed
+	})
+	return !renamed
+}
+
+// Plan moving the destination directory dstDir to srcPath whole.
+func (plan *PatchPlan) planDirMove(dstDir fs.Dir, srcPath string) {
+	dstPath := fs.RelPath(dstDir)
+	plan.movedDirs[dstPath] = true
+	plan.relocRefs[dstPath]++
+
+	// Files moved with the directory are still in use, so Transfers
+	// from them must copy, and Clean must leave them alone.
+	fs.Walk(dstDir, func(node fs.Node) bool {
+		if file, isFile := node.(fs.File); isFile {
+			plan.relocRefs[fs.RelPath(file)]++
+			plan.dstFileUnmatch[fs.RelPath(file)] = nil, false
+			return false
+		}
+		return true
+	})
+
+	dirMove := &DirMove{
+		From: &LocalPath{LocalStore: plan.dstStore, RelPath: dstPath},
+		To:   &LocalPath{LocalStore: plan.dstStore, RelPath: srcPath}}
+	plan.explain(dirMove, "directory strong checksum %s matched at destination path %s",
+		dstDir.Info().Strong, dstPath)
+	plan.dirMoves = append(plan.dirMoves, dirMove)
+}
+
+// Get the number of commands in the plan which use the destination file
+// at relpath as content: Keeps and metadata updates at the path itself,
+// and Transfers reading from it. A path used more than once is copied by
+// all but the last Transfer from it, which moves it; a path which is also
+// kept is only ever copied.
+func (plan *PatchPlan) RefCount(relpath string) int {
+	return plan.relocRefs[relpath]
+}
+
+// Decide which Transfers move their origin and which copy it, from the
+// final reference counts and the final order of the plan, so that
+// executing a Transfer does not depend on which others ran before it.
+func (plan *PatchPlan) assignMoves() {
+	remaining := make(map[string]int)
+	for _, cmd := range plan.Cmds {
+		if transfer, is := cmd.(*Transfer); is {
+			path := transfer.From.RelPath
+			if _, has := remaining[path]; !has {
+				remaining[path] = plan.relocRefs[path]
+			}
+			remaining[path]--
+			transfer.Move = remaining[path] == 0
+		}
+	}
+}
+
+// Plan the deletion of unmatched destination files according to the
+// plan's DeletePolicy.
+func (plan *PatchPlan) planDeletes() {
+	deletes := []*Delete{}
+	for _, dstPath := range plan.PendingDeletes() {
+		del := &Delete{
+			Path:  &LocalPath{LocalStore: plan.dstStore, RelPath: dstPath},
+			Trash: plan.opts.Trash}
+		plan.explain(del, "nothing in the source matches %s, and nothing reuses it", dstPath)
+		deletes = append(deletes, del)
+		plan.dstFileUnmatch[dstPath] = nil, false
+	}
+
+	if plan.opts.Deletes == DELETE_BEFORE {
+		cmds := []PatchCmd{}
+		for _, del := range deletes {
+			cmds = append(cmds, del)
+		}
+		plan.Cmds = append(cmds, plan.Cmds...)
+		return
+	}
+
+	byDir := make(map[string][]*Delete)
+	for _, del := range deletes {
+		dir := parentPath(del.Path.(*LocalPath).RelPath)
+		byDir[dir] = append(byDir[dir], del)
+	}
+
+	cmds := []PatchCmd{}
+	for _, cmd := range plan.Cmds {
+		for _, path := range modifiedPaths(cmd) {
+			dir := parentPath(plan.dstStore.RelPath(path.Resolve()))
+			for _, del := range byDir[dir] {
+				cmds = append(cmds, del)
+			}
+			byDir[dir] = nil, false
+		}
+		cmds = append(cmds, cmd)
+	}
+
+	// Deletes in directories the plan never writes to come last.
+	for _, del := range deletes {
+		if _, has := byDir[parentPath(del.Path.(*LocalPath).RelPath)]; has {
+			cmds = append(cmds, del)
+		}
+	}
+	plan.Cmds = cmds
+}
+
+// Find the copier for a file in a local source, with its absolute path.
+func (plan *PatchPlan) copierFor(srcNode fs.FsNode) (ConsistentCopier, string) {
+	srcLocal, isLocal := plan.srcStore.(fs.LocalStore)
+	if _, isFile := srcNode.(fs.File); !isFile || !isLocal {
+		return nil, ""
+	}
+
+	srcPath := srcLocal.Resolve(fs.RelPath(srcNode))
+	for _, copier := range plan.opts.Copiers {
+		if copier.Handles(srcPath) {
+			return copier, srcPath
+		}
+	}
+	return nil, ""
+}
+
+// Rearrange Transfers which form a cycle, such as two files whose names
+// have been swapped, so that no path is overwritten before it has been read.
+// The first path in each cycle is moved aside to a temporary name to make room.
+func (plan *PatchPlan) breakTransferCycles() {
+	hopPaths := make(map[string]bool)
+	for cycle := plan.findTransferCycle(); cycle != nil; cycle = plan.findTransferCycle() {
+		plan.breakTransferCycle(cycle, hopPaths)
+	}
+}
+
+// Find a cycle of Transfers, each of which overwrites the path read by the next.
+// Returns the transfers in cycle order, or nil if there are no cycles.
+func (plan *PatchPlan) findTransferCycle() []*Transfer {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	readers := make(map[string][]*Transfer)
+	for _, cmd := range plan.Cmds {
+		if transfer, is := cmd.(*Transfer); is {
+			readers[transfer.From.RelPath] = append(readers[transfer.From.RelPath], transfer)
+		}
+	}
+
+	state := make(map[string]int)
+	stack := []*Transfer{}
+
+	var visit func(path string) []*Transfer
+	visit = func(path string) []*Transfer {
+		state[path] = visiting
+		for _, transfer := range readers[path] {
+			next := transfer.To.RelPath
+			stack = append(stack, transfer)
+
+			switch state[next] {
+			case visiting:
+				for i, onStack := range stack {
+					if onStack.From.RelPath == next {
+						return append([]*Transfer{}, stack[i:]...)
+					}
+				}
+			case unvisited:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+
+			stack = stack[:len(stack)-1]
+		}
+		state[path] = visited
+		return nil
+	}
+
+	for _, cmd := range plan.Cmds {
+		if transfer, is := cmd.(*Transfer); is && state[transfer.From.RelPath] == unvisited {
+			if cycle := visit(transfer.From.RelPath); cycle != nil {
+				return cycle
+			}
+		}
+	}
+
+	return nil
+}
+
+// Break a cycle of transfers by moving the path read by the first one
+// to a temporary hop, then running the cycle backwards so that each transfer
+// fills the path vacated by the one before it.
+func (plan *PatchPlan) breakTransferCycle(cycle []*Transfer, hopPaths map[string]bool) {
+	fromPath := cycle[0].From.RelPath
+	hopRef := &LocalPath{LocalStore: plan.dstStore, RelPath: plan.hopPath(fromPath, hopPaths)}
+
+	// Everything reading the first path will find it at the hop instead.
+	plan.relocRefs[hopRef.RelPath] = plan.relocRefs[fromPath]
+	plan.relocRefs[fromPath] = 1
+
+	inCycle := make(map[*Transfer]bool)
+	cyclePaths := make(map[string]bool)
+	for _, transfer := range cycle {
+		inCycle[transfer] = true
+		cyclePaths[transfer.From.RelPath] = true
+	}
+
+	hop := &Transfer{From: cycle[0].From, To: hopRef}
+	plan.explain(hop, "moved aside to break a cycle of %d transfers", len(cycle))
+	block := []PatchCmd{hop}
+	rest := []PatchCmd{}
+	insertAt := -1
+
+	for _, cmd := range plan.Cmds {
+		transfer, isTransfer := cmd.(*Transfer)
+		if !isTransfer {
+			rest = append(rest, cmd)
+			continue
+		}
+
+		readsFirst := transfer.From.RelPath == fromPath
+		if readsFirst {
+			transfer.From = hopRef
+		}
+
+		if insertAt < 0 && (readsFirst || cyclePaths[transfer.From.RelPath]) {
+			insertAt = len(rest)
+		}
+
+		switch {
+		case inCycle[transfer]:
+			// Added back in reverse order below
+		case cyclePaths[transfer.From.RelPath]:
+			// Other copies of a path in the cycle must be taken before it is overwritten
+			block = append(block, transfer)
+		default:
+			rest = append(rest, transfer)
+		}
+	}
+
+	for i := len(cycle) - 1; i >= 0; i-- {
+		block = append(block, cycle[i])
+	}
+
+	cmds := make([]PatchCmd, 0, len(rest)+len(block))
+	cmds = append(cmds, rest[:insertAt]...)
+	cmds = append(cmds, block...)
+	cmds = append(cmds, rest[insertAt:]...)
+	plan.Cmds = cmds
+}
+
+// Choose an unused temporary name alongside relpath in the destination.
+func (plan *PatchPlan) hopPath(relpath string, hopPaths map[string]bool) string {
+	dir, name := filepath.Split(relpath)
+	for i := 0; ; i++ {
+		hopPath := filepath.Join(dir, fmt.Sprintf("%s%s.%d", fs.RELOC_PREFIX, name, i))
+		if hopPaths[hopPath] {
+			continue
+		}
+		if _, err := os.Lstat(plan.dstStore.Resolve(hopPath)); err != nil {
+			hopPaths[hopPath] = true
+			return hopPath
+		}
+	}
+
+	panic("Impossible")
+}
+
+// Compare the metadata of a source node with the destination at the same path.
+// Returns a Touch command if only the modification time differs, a SetMeta
+// command if anything else differs, nil if they match or metadata comparison
+// was not requested. If either cannot be read, the error is recorded with
+// PathErrors, and nil is returned.
+func (plan *PatchPlan) metaUpdate(srcFsNode fs.FsNode, srcPath string) PatchCmd {
+	if !plan.opts.CompareMeta && !plan.opts.MetaOnly {
+		return nil
+	}
+
+	dstInfo, err := os.Stat(plan.dstStore.Resolve(srcPath))
+	if dstInfo == nil {
+		plan.pathErrors = append(plan.pathErrors, err)
+		return nil
+	}
+	srcRelPath := fs.RelPath(srcFsNode)
+
+	setMeta := &SetMeta{
+		Path: &LocalPath{LocalStore: plan.dstStore, RelPath: srcPath},
+		Uid:  -1,
+		Gid:  -1}
+	changed := false
+
+	if srcFsNode.Mode()&07777 != dstInfo.Mode&07777 {
+		setMeta.Mode = srcFsNode.Mode()
+		setMeta.HasMode = true
+		changed = true
+	}
+
+	// Times and ownership are only known when the source is on local disk
+	srcLocal, isLocal := plan.srcStore.(fs.LocalStore)
+	if !isLocal {
+		if changed {
+			return setMeta
+		}
+		return nil
+	}
+
+	srcInfo, err := os.Stat(srcLocal.Resolve(srcRelPath))
+	if srcInfo == nil {
+		plan.pathErrors = append(plan.pathErrors, err)
+		return nil
+	}
+
+	// Directory times are disturbed by any change made within them.
+	if srcInfo.IsRegular() && srcInfo.Mtime_ns != dstInfo.Mtime_ns {
+		setMeta.Mtime = srcInfo.Mtime_ns
+		changed = true
+	}
+
+	// Ownership can only be given away by root.
+	if os.Getuid() == 0 && (srcInfo.Uid != dstInfo.Uid || srcInfo.Gid != dstInfo.Gid) {
+		setMeta.Uid = srcInfo.Uid
+		setMeta.Gid = srcInfo.Gid
+		changed = true
+	}
+
+	switch {
+	case !changed:
+		return nil
+	case !setMeta.HasMode && setMeta.Uid < 0 && setMeta.Gid < 0:
+		return &Touch{Path: setMeta.Path, Mtime: setMeta.Mtime}
+	}
+	return setMeta
+}
+
+// Plan an empty source file. Any empty file matches it by strong checksum,
+// but creating one in place is cheaper than moving or downloading one.
+func (plan *PatchPlan) appendEmptyFile(srcFile fs.File, dstPath string, dstLinkInfo *os.FileInfo) {
+	path := &LocalPath{LocalStore: plan.dstStore, RelPath: dstPath}
+
+	switch {
+	case dstLinkInfo != nil && dstLinkInfo.IsRegular() && dstLinkInfo.Size == 0:
+		if metaCmd := plan.metaUpdate(srcFile, dstPath); metaCmd != nil {
+			plan.appendCmd(metaCmd, "empty file already present, but metadata differs")
+		} else {
+			plan.appendCmd(&Keep{Path: path}, "empty file already present at the same path")
+		}
+		return
+
+	case dstLinkInfo != nil && !dstLinkInfo.IsRegular():
+		plan.appendCmd(&Conflict{Path: path, FileInfo: dstLinkInfo},
+			"source has an empty file where destination has a %s", describeMode(dstLinkInfo))
+	}
+
+	touch := &Touch{Path: path, Empty: true}
+	if srcLocal, isLocal := plan.srcStore.(fs.LocalStore); isLocal {
+		if srcInfo, _ := os.Stat(srcLocal.Resolve(fs.RelPath(srcFile))); srcInfo != nil {
+			touch.Mtime = srcInfo.Mtime_ns
+		}
+	}
+	plan.appendCmd(touch, "source file is empty")
+}
+
+func (plan *PatchPlan) appendFilePlan(srcFile fs.File, dstPath string) os.Error {
+	match, err := MatchFile(srcFile, plan.dstStore.Resolve(dstPath))
+	if match == nil {
+		return err
+	}
+	match.SrcSize = srcFile.Info().Size
+
+	// Create a local temporary file in which to effect changes
+	localTemp := &LocalTemp{
+		Path: &LocalPath{
+			LocalStore: plan.dstStore,
+			RelPath:    dstPath},
+		Size:    match.SrcSize,
+		srcPath: fs.RelPath(srcFile)}
+	plan.appendCmd(localTemp,
+		"no match for strong checksum %s; %d of %d blocks found in the destination file (%d weak checksum matches)",
+		srcFile.Info().Strong, len(match.BlockMatches), len(srcFile.Blocks()), match.WeakMatches)
+
+	for _, blockMatch := range match.BlockMatches {
+		// The temporary file is created sparse, so it already has the zeros
+		if blockMatch.SrcBlock.Info().IsZero() {
+			continue
+		}
+
+		// TODO: math/imath
+		length := srcFile.Info().Size - blockMatch.SrcBlock.Info().Offset()
+		if length > blockMatch.SrcBlock.Info().Size() {
+			length = blockMatch.SrcBlock.Info().Size()
+		}
+
+		plan.appendCmd(&LocalTempCopy{
+			Temp:        localTemp,
+			LocalOffset: blockMatch.DstOffset,
+			TempOffset:  blockMatch.SrcBlock.Info().Offset(),
+			Length:      length},
+			"block %d matched at destination offset %d",
+			blockMatch.SrcBlock.Info().Position, blockMatch.DstOffset)
+	}
+
+	srcBlocks := &fs.Blocks{Contents: append([]fs.Block{}, srcFile.Blocks()...)}
+	sort.Sort(srcBlocks)
+
 	for _, srcRange := range match.NotMatched() {
-		plan.Cmds = append(plan.Cmds, &SrcTempCopy{
+		plan.appendSrcRange(localTemp, srcFile, srcBlocks, srcRange)
+	}
+
+	// Replace dst file with temp
+	plan.appendCmd(&ReplaceWithTemp{Temp: localTemp}, "patched copy is complete")
+
+	return nil
+}
+
+// Fetch a range of the source file into a temp file.
+// Whole source blocks within the range are fetched by their strong checksum,
+// so that providers can serve them from any file, or a cache.
+// Anything left over is fetched as a range of the source file.
+// The source blocks are given in order of position.
+func (plan *PatchPlan) appendSrcRange(localTemp *LocalTemp, srcFile fs.File, srcBlocks *fs.Blocks, srcRange *RangePair) {
+	for offset := srcRange.From; offset < srcRange.To; {
+		// Find the block containing offset; blocks may vary in size
+		position := sort.Search(srcBlocks.Len(), func(i int) bool {
+			info := srcBlocks.Contents[i].Info()
+			return info.Offset()+info.Size() > offset
+		})
+		hasBlock := position < srcBlocks.Len()
+
+		var srcBlock fs.Block
+		blockStart, blockEnd := offset, srcRange.To
+		if hasBlock {
+			srcBlock = srcBlocks.Contents[position]
+			blockStart = srcBlock.Info().Offset()
+			blockEnd = blockStart + srcBlock.Info().Size()
+		}
+		if blockEnd > srcFile.Info().Size {
+			blockEnd = srcFile.Info().Size
+		}
+
+		if hasBlock && offset == blockStart && blockEnd <= srcRange.To && srcBlock.Info().IsZero() {
+			offset = blockEnd
+			continue
+		} else if hasBlock && offset == blockStart && blockEnd <= srcRange.To {
+			plan.appendCmd(&SrcBlockCopy{
+				Temp:       localTemp,
+				SrcStrong:  srcBlock.Info().Strong,
+				TempOffset: offset,
+				Length:     blockEnd - offset},
+				"no match for block %d in the destination file", position)
+			offset = blockEnd
+			continue
+		}
+
+		end := blockEnd
+		if end > srcRange.To {
+			end = srcRange.To
+		}
+		plan.appendCmd(&SrcTempCopy{
 			Temp:       localTemp,
 			SrcStrong:  srcFile.Info().Strong,
-			SrcOffset:  srcRange.From,
-			TempOffset: srcRange.From,
-			Length:     srcRange.To - srcRange.From})
+			SrcOffset:  offset,
+			TempOffset: offset,
+			Length:     end - offset},
+			"no match for part of block %d in the destination file", position)
+		offset = end
+	}
+}
+
+// Execute the plan's commands in order. Returns the command which failed, if any.
+func (plan *PatchPlan) Exec() (failedCmd PatchCmd, err os.Error) {
+	return plan.ExecWith(&ExecContext{Src: plan.srcStore, Dst: plan.dstStore})
+}
+
+// Execute the plan's commands in order with the given context.
+// Returns the command which failed, if any.
+//
+// If a local source file is truncated while it is being copied, the rest
+// of its commands are skipped, and the file is planned again on its own
+// once the other commands have run.
+func (plan *PatchPlan) ExecWith(ctx *ExecContext) (failedCmd PatchCmd, err os.Error) {
+	dst := plan.dstStore
+	if ctx.Dst != nil {
+		dst = ctx.Dst
+	}
+
+	if plan.Err() != nil {
+		err = plan.Err()
+	} else if dst.ReadOnly() {
+		err = &fs.ErrReadOnly{Path: dst.RootPath()}
+	} else {
+		failedCmd, err = plan.exec(ctx, true)
+	}
+	if err == nil && plan.opts.Acls {
+		err = plan.applyAcls()
 	}
+	events.Publish(&events.SyncFinished{Dst: dst.RootPath(), Err: err})
+	return failedCmd, err
+}
+
+// A command held back until the plan is committed, with the context
+// to execute it in.
+type stagedCmd struct {
+	cmd PatchCmd
+	ctx *ExecContext
+}
+
+// Execute the plan up to its consistency barrier: every command is run
+// except the ReplaceWithTemps, which leaves the new content of each
+// patched file fully staged in a temporary file beside it. Commit then
+// puts them all in place in quick succession, so that applications
+// using the destination see it inconsistent for as short a time as
+// possible. Returns the command which failed, if any, in which case
+// the staged files are discarded.
+func (plan *PatchPlan) ExecPhased() (failedCmd PatchCmd, err os.Error) {
+	return plan.ExecPhasedWith(&ExecContext{Src: plan.srcStore, Dst: plan.dstStore})
+}
+
+// Execute the plan up to its consistency barrier with the given context.
+// See ExecPhased.
+func (plan *PatchPlan) ExecPhasedWith(ctx *ExecContext) (failedCmd PatchCmd, err os.Error) {
+	dst := plan.dstStore
+	if ctx.Dst != nil {
+		dst = ctx.Dst
+	}
+	plan.stagedDst = dst.RootPath()
+
+	if plan.Err() != nil {
+		err = plan.Err()
+	} else if dst.ReadOnly() {
+		err = &fs.ErrReadOnly{Path: dst.RootPath()}
+	} else {
+		plan.staging = true
+		failedCmd, err = plan.exec(ctx, true)
+		plan.staging = false
+	}
+
+	if err != nil {
+		plan.Abort()
+		events.Publish(&events.SyncFinished{Dst: plan.stagedDst, Err: err})
+	}
+	return failedCmd, err
+}
+
+// Put the files staged by ExecPhased in place. Returns the command which
+// failed, if any; committing again retries from that command.
+func (plan *PatchPlan) Commit() (failedCmd PatchCmd, err os.Error) {
+	for len(plan.staged) > 0 {
+		staged := plan.staged[0]
+		if err = staged.ctx.Exec(staged.cmd); err != nil {
+			failedCmd = staged.cmd
+			break
+		}
+		plan.staged = plan.staged[1:]
+	}
+
+	events.Publish(&events.SyncFinished{Dst: plan.stagedDst, Err: err})
+	return failedCmd, err
+}
+
+// Discard the files staged by ExecPhased, leaving the files they
+// would have replaced as they are.
+func (plan *PatchPlan) Abort() {
+	for _, staged := range plan.staged {
+		if temp := tempOf(staged.cmd); temp != nil {
+			temp.discard()
+		}
+	}
+	plan.staged = nil
+}
+
+// Number of times a file truncated during a sync is planned again
+// before giving up on it.
+const MAX_REPLANS = 3
+
+func (plan *PatchPlan) exec(ctx *ExecContext, replan bool) (failedCmd PatchCmd, err os.Error) {
+	srcLocal, isSrcLocal := ctx.Src.(fs.LocalStore)
+	replan = replan && isSrcLocal
+
+	conflicts := []*Conflict{}
+	truncated := []PatchCmd{}
+	var skipTemp *LocalTemp
+
+	for _, cmd := range plan.Cmds {
+		if skipTemp != nil && tempOf(cmd) == skipTemp {
+			continue
+		}
+
+		if err = plan.veto(ctx, cmd); err != nil {
+			return cmd, err
+		}
+
+		if rwt, is := cmd.(*ReplaceWithTemp); is && plan.staging {
+			rwt.Temp.close()
+			plan.staged = append(plan.staged, &stagedCmd{cmd: cmd, ctx: ctx})
+			continue
+		}
+
+		err = ctx.Exec(cmd)
+		if _, is := err.(*fs.ErrSourceTruncated); is && replan {
+			truncated = append(truncated, cmd)
+			if skipTemp = tempOf(cmd); skipTemp != nil {
+				skipTemp.discard()
+			}
+			continue
+		} else if err != nil {
+			return cmd, err
+		}
+
+		literal, written := transferredBytes(cmd)
+		plan.literal += literal
+		plan.written += written
+
+		if conflict, is := cmd.(*Conflict); is {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+
+	for _, conflict := range conflicts {
+		conflict.Cleanup()
+	}
+
+	for _, cmd := range truncated {
+		if err = plan.replanFile(ctx, srcLocal, cmd); err != nil {
+			return cmd, err
+		}
+	}
+
+	return nil, nil
+}
+
+// Ask the Veto option about each destination path a command changes.
+func (plan *PatchPlan) veto(ctx *ExecContext, cmd PatchCmd) os.Error {
+	if plan.opts.Veto == nil {
+		return nil
+	}
+
+	for _, path := range modifiedPaths(cmd) {
+		store := ctx.storeOf(path)
+		if store == nil {
+			store = plan.dstStore
+		}
+		if err := plan.opts.Veto(store.RelPath(ctx.Resolve(path)), cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the temporary file a command is building, if any.
+func tempOf(cmd PatchCmd) *LocalTemp {
+	switch c := cmd.(type) {
+	case *LocalTemp:
+		return c
+	case *LocalTempCopy:
+		return c.Temp
+	case *SrcTempCopy:
+		return c.Temp
+	case *SrcBlockCopy:
+		return c.Temp
+	case *ReplaceWithTemp:
+		return c.Temp
+	}
+	return nil
+}
+
+// Get the destination path of a command which reads a source file,
+// and the relative path of that file in the source.
+func sourcedPath(cmd PatchCmd) (PathRef, string) {
+	if sfd, is := cmd.(*SrcFileDownload); is {
+		return sfd.Path, fs.RelPath(sfd.SrcFile)
+	}
+	if temp := tempOf(cmd); temp != nil {
+		return temp.Path, temp.srcPath
+	}
+	return nil, ""
+}
+
+// Plan and patch a single file again, after its source changed
+// while it was being copied.
+func (plan *PatchPlan) replanFile(ctx *ExecContext, srcLocal fs.LocalStore, cmd PatchCmd) (err os.Error) {
+	path, srcRelPath := sourcedPath(cmd)
+	localPath, is := path.(*LocalPath)
+	if !is {
+		return os.NewError(fmt.Sprintf("Cannot replan %v", cmd))
+	}
+	srcPath := srcLocal.Resolve(srcRelPath)
+	dstPath := ctx.Resolve(localPath)
+
+	// A file store needs a file to patch, even an empty one
+	if _, err = os.Lstat(dstPath); err != nil {
+		dstF, err := ctx.OpenFile(localPath, os.O_WRONLY|os.O_CREATE, 0666)
+		if err != nil {
+			return err
+		}
+		dstF.Close()
+	}
+
+	var srcStore, dstStore fs.LocalStore
+	for i := 0; i < MAX_REPLANS; i++ {
+		if srcStore, err = fs.NewLocalStore(srcPath, fs.NewMemRepo()); err != nil {
+			return err
+		}
+		if dstStore, err = fs.NewLocalStore(dstPath, fs.NewMemRepo()); err != nil {
+			return err
+		}
+
+		filePlan := NewPatchPlanOpts(srcStore, dstStore, plan.opts)
+		filePlan.staging = plan.staging
+		_, err = filePlan.exec(&ExecContext{
+			Src:     srcStore,
+			Dst:     dstStore,
+			Logger:  ctx.Logger,
+			Confine: ctx.Confine}, false)
+		plan.literal += filePlan.literal
+		plan.written += filePlan.written
+		plan.staged = append(plan.staged, filePlan.staged...)
+		if _, is := err.(*fs.ErrSourceTruncated); !is {
+			return err
+		}
+	}
+	return err
+}
+
+// Get the bytes read from the source, and the bytes of file content
+// written to the destination, by the commands executed so far. Content
+// reused from the destination is written without being transferred, so
+// the more a sync reuses, the more written exceeds literal.
+func (plan *PatchPlan) Transferred() (literal int64, written int64) {
+	return plan.literal, plan.written
+}
+
+// A permissions change made to a destination path by SetMode.
+type ModeChange struct {
+	Path string
+	From uint32
+	To   uint32
+}
+
+func (modeChange *ModeChange) String() string {
+	return fmt.Sprintf("%s: %o -> %o", modeChange.Path, modeChange.From, modeChange.To)
+}
+
+// Set the permissions of destination files and directories to match the source.
+// Only entries whose permissions actually differ are changed.
+// Returns the changes made.
+func (plan *PatchPlan) SetMode(errors chan<- os.Error) (changes []*ModeChange) {
+	fs.Walk(plan.srcStore.Repo().Root(), func(srcNode fs.Node) bool {
+		var err os.Error
+		srcFsNode, is := srcNode.(fs.FsNode)
+		if !is {
+			return false
+		}
+
+		srcPath, allowed := plan.dstName(fs.RelPath(srcFsNode))
+		if !allowed {
+			return false
+		}
+		absPath := plan.dstStore.Resolve(srcPath)
+		dstInfo, _ := os.Stat(absPath)
+		if dstInfo == nil {
+			err = os.NewError(fmt.Sprintf("Expected %s not found in destination", srcPath))
+		} else if srcMode, dstMode := srcFsNode.Mode()&07777, dstInfo.Mode&07777; srcMode != dstMode {
+			if err = os.Chmod(absPath, srcMode); err == nil {
+				changes = append(changes, &ModeChange{Path: srcPath, From: dstMode, To: srcMode})
+			}
+		}
+
+		if err != nil && errors != nil {
+			errors <- err
+		}
+
+		_, is = srcNode.(fs.Dir)
+		return is
+	})
+
+	return changes
+}
+
+// An ownership change made to a destination path by SetOwner.
+type OwnerChange struct {
+	Path string
+	From fs.Owner
+	To   fs.Owner
+}
+
+func (ownerChange *OwnerChange) String() string {
+	return fmt.Sprintf("%s: %d:%d -> %d:%d", ownerChange.Path,
+		ownerChange.From.Uid, ownerChange.From.Gid, ownerChange.To.Uid, ownerChange.To.Gid)
+}
 
-	// Replace dst file with temp
-	plan.Cmds = append(plan.Cmds, &ReplaceWithTemp{Temp: localTemp})
+// Set the owners of destination files and directories to match the source,
+// where the source index knows them, as when indexed from local disk.
+//
+// Only root can give files away. Other users change only the group, as
+// far as the system lets them: a change refused for lack of permission
+// leaves the owner as it is, and is not an error. Returns the changes made.
+func (plan *PatchPlan) SetOwner(errors chan<- os.Error) (changes []*OwnerChange) {
+	isRoot := os.Getuid() == 0
+	fs.Walk(plan.srcStore.Repo().Root(), func(srcNode fs.Node) bool {
+		var owner *fs.Owner
+		switch src := srcNode.(type) {
+		case fs.File:
+			owner = src.Info().Owner
+		case fs.Dir:
+			owner = src.Info().Owner
+		default:
+			return false
+		}
+		_, isDir := srcNode.(fs.Dir)
 
-	return nil
+		srcPath, allowed := plan.dstName(fs.RelPath(srcNode.(fs.FsNode)))
+		if !allowed {
+			return false
+		} else if owner == nil {
+			return isDir
+		}
+		absPath := plan.dstStore.Resolve(srcPath)
+
+		var err os.Error
+		dstInfo, _ := os.Lstat(absPath)
+		if dstInfo == nil {
+			err = os.NewError(fmt.Sprintf("Expected %s not found in destination", srcPath))
+		} else {
+			from := fs.Owner{Uid: dstInfo.Uid, Gid: dstInfo.Gid}
+			to := *owner
+			if !isRoot {
+				to.Uid = from.Uid
+			}
+			if to.Uid != from.Uid || to.Gid != from.Gid {
+				if err = os.Lchown(absPath, to.Uid, to.Gid); err == nil {
+					changes = append(changes, &OwnerChange{Path: srcPath, From: from, To: to})
+				} else if pathErr, is := err.(*os.PathError); is && !isRoot && pathErr.Error == os.EPERM {
+					err = nil
+				}
+			}
+		}
+
+		if err != nil && errors != nil {
+			errors <- err
+		}
+		return isDir
+	})
+
+	return changes
 }
 
-func (plan *PatchPlan) Exec() (failedCmd PatchCmd, err os.Error) {
-	conflicts := []*Conflict{}
-	for _, cmd := range plan.Cmds {
-		err = cmd.Exec(plan.srcStore)
-		if err != nil {
-			return cmd, err
+// A modification time change made to a destination path by SetTimes.
+// Times are in nanoseconds.
+type TimeChange struct {
+	Path string
+	From int64
+	To   int64
+}
+
+func (timeChange *TimeChange) String() string {
+	return fmt.Sprintf("%s: %d -> %d", timeChange.Path, timeChange.From, timeChange.To)
+}
+
+// Set the modification times of destination files and directories to
+// match the source, where the source index knows them, as when indexed
+// from local disk. Symbolic links are left alone, as setting their times
+// would set their targets'. Only entries whose times actually differ are
+// changed. Run after Exec and Clean, which disturb directory times.
+// Returns the changes made.
+func (plan *PatchPlan) SetTimes(errors chan<- os.Error) (changes []*TimeChange) {
+	fs.Walk(plan.srcStore.Repo().Root(), func(srcNode fs.Node) bool {
+		var mtime int64
+		switch src := srcNode.(type) {
+		case fs.File:
+			if fs.IsSymlinkMode(src.Info().Mode) {
+				return false
+			}
+			mtime = src.Info().Mtime
+		case fs.Dir:
+			mtime = src.Info().Mtime
+		default:
+			return false
 		}
+		_, isDir := srcNode.(fs.Dir)
 
-		if conflict, is := cmd.(*Conflict); is {
-			conflicts = append(conflicts, conflict)
+		srcPath, allowed := plan.dstName(fs.RelPath(srcNode.(fs.FsNode)))
+		if !allowed {
+			return false
+		} else if mtime == 0 {
+			return isDir
 		}
-	}
+		absPath := plan.dstStore.Resolve(srcPath)
 
-	for _, conflict := range conflicts {
-		conflict.Cleanup()
+		var err os.Error
+		dstInfo, _ := os.Lstat(absPath)
+		if dstInfo == nil {
+			err = os.NewError(fmt.Sprintf("Expected %s not found in destination", srcPath))
+		} else if dstInfo.Mtime_ns != mtime {
+			if err = os.Chtimes(absPath, dstInfo.Atime_ns, mtime); err == nil {
+				changes = append(changes, &TimeChange{Path: srcPath, From: dstInfo.Mtime_ns, To: mtime})
+			}
+		}
+
+		if err != nil && errors != nil {
+			errors <- err
+		}
+		return isDir
+	})
+
+	return changes
+}
+
+// An extended attribute change made to a destination path by SetXattr.
+type XattrChange struct {
+	Path string
+	Name string
+
+	// Value set, or nil if the attribute was removed.
+	Value []byte
+}
+
+func (xattrChange *XattrChange) String() string {
+	if xattrChange.Value == nil {
+		return fmt.Sprintf("%s: removed %s", xattrChange.Path, xattrChange.Name)
 	}
+	return fmt.Sprintf("%s: set %s", xattrChange.Path, xattrChange.Name)
+}
 
-	return nil, nil
+// Set the extended attributes of destination files and directories to
+// match the source, which must have been indexed with them, as by
+// fs.LocalStore.SetXattrs. Attributes in fs.XATTR_NAMESPACES which the
+// source lacks are removed. Returns the changes made.
+func (plan *PatchPlan) SetXattr(errors chan<- os.Error) (changes []*XattrChange) {
+	fs.Walk(plan.srcStore.Repo().Root(), func(srcNode fs.Node) bool {
+		var srcXattrs map[string][]byte
+		switch src := srcNode.(type) {
+		case fs.File:
+			srcXattrs = src.Info().Xattrs
+		case fs.Dir:
+			srcXattrs = src.Info().Xattrs
+		default:
+			return false
+		}
+
+		srcPath, allowed := plan.dstName(fs.RelPath(srcNode.(fs.FsNode)))
+		if !allowed {
+			return false
+		}
+		absPath := plan.dstStore.Resolve(srcPath)
+
+		dstXattrs, err := fs.ReadXattrs(absPath)
+		if err == nil {
+			names := []string{}
+			for name, _ := range srcXattrs {
+				names = append(names, name)
+			}
+			for name, _ := range dstXattrs {
+				if _, has := srcXattrs[name]; !has {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				value, has := srcXattrs[name]
+				dstValue, dstHas := dstXattrs[name]
+				switch {
+				case !has:
+					err = fs.RemoveXattr(absPath, name)
+				case !dstHas || !bytes.Equal(value, dstValue):
+					err = fs.SetXattr(absPath, name, value)
+				default:
+					continue
+				}
+
+				if err != nil {
+					break
+				}
+				changes = append(changes, &XattrChange{Path: srcPath, Name: name, Value: value})
+			}
+		}
+
+		if err != nil && errors != nil {
+			errors <- err
+		}
+
+		_, isDir := srcNode.(fs.Dir)
+		return isDir
+	})
+
+	return changes
+}
+
+// A POSIX ACL change made to a destination path by ApplyACL.
+type AclChange struct {
+	Path string
+
+	// ACLs set, or nil if they were removed.
+	Acls *fs.Acls
+}
+
+func (aclChange *AclChange) String() string {
+	if aclChange.Acls == nil {
+		return fmt.Sprintf("%s: ACLs removed", aclChange.Path)
+	}
+	return fmt.Sprintf("%s: ACLs set", aclChange.Path)
 }
 
-func (plan *PatchPlan) SetMode(errors chan<- os.Error) {
+// Set the POSIX ACLs of destination files and directories to match the
+// source, which must have been indexed with them, as by
+// fs.LocalStore.SetAcls. ACLs change the group bits of the mode, so this
+// pass comes after SetMode. Returns the changes made.
+func (plan *PatchPlan) ApplyACL(errors chan<- os.Error) (changes []*AclChange) {
 	fs.Walk(plan.srcStore.Repo().Root(), func(srcNode fs.Node) bool {
-		var err os.Error
-		srcFsNode, is := srcNode.(fs.FsNode)
-		if !is {
+		var srcAcls *fs.Acls
+		switch src := srcNode.(type) {
+		case fs.File:
+			srcAcls = src.Info().Acls
+		case fs.Dir:
+			srcAcls = src.Info().Acls
+		default:
 			return false
 		}
 
-		srcPath := fs.RelPath(srcFsNode)
-		if absPath := plan.dstStore.Resolve(srcPath); absPath != "" {
-			err = os.Chmod(absPath, srcFsNode.Mode())
-		} else {
-			err = os.NewError(fmt.Sprintf("Expected %s not found in destination", srcPath))
+		srcPath, allowed := plan.dstName(fs.RelPath(srcNode.(fs.FsNode)))
+		if !allowed {
+			return false
+		}
+		absPath := plan.dstStore.Resolve(srcPath)
+
+		dstAcls, err := fs.ReadAcls(absPath)
+		if err == nil && !srcAcls.Equal(dstAcls) {
+			if err = fs.WriteAcls(absPath, srcAcls); err == nil {
+				changes = append(changes, &AclChange{Path: srcPath, Acls: srcAcls})
+			}
 		}
 
 		if err != nil && errors != nil {
 			errors <- err
 		}
 
-		_, is = srcNode.(fs.Dir)
-		return is
+		_, isDir := srcNode.(fs.Dir)
+		return isDir
 	})
+
+	return changes
 }
 
-func (plan *PatchPlan) Clean(errors chan<- os.Error) {
+// Apply ACLs after executing the plan, for the Acls option.
+// Returns the first error.
+func (plan *PatchPlan) applyAcls() (err os.Error) {
+	errors := make(chan os.Error)
+	go func() {
+		plan.ApplyACL(errors)
+		close(errors)
+	}()
+	for aclErr := range errors {
+		if err == nil {
+			err = aclErr
+		}
+	}
+	return err
+}
+
+// Plan the metadata update of a source node whose content already matches
+// the destination at dstPath, for the MetaOnly option. Returns whether to
+// visit the node's children.
+func (plan *PatchPlan) appendMetaOnly(srcFsNode fs.FsNode, dstPath string) bool {
+	dstPathRef := &LocalPath{LocalStore: plan.dstStore, RelPath: dstPath}
+
+	matched := false
+	if dstRoot, isDir := plan.dstStore.Repo().Root().(fs.Dir); isDir {
+		dstNode, has := fs.Lookup(dstRoot, dstPath)
+		switch src := srcFsNode.(type) {
+		case fs.File:
+			dstFile, isFile := dstNode.(fs.File)
+			matched = has && isFile && dstFile.Info().Strong == src.Info().Strong
+		case fs.Dir:
+			// Directories are updated whatever their contents.
+			_, matched = dstNode.(fs.Dir)
+			matched = matched && has
+		}
+	}
+
+	if !matched {
+		plan.pathErrors = append(plan.pathErrors, &ErrContentDiffers{Path: dstPath})
+		return false
+	}
+
+	if metaCmd := plan.metaUpdate(srcFsNode, dstPath); metaCmd != nil {
+		plan.appendCmd(metaCmd, "content matched, but metadata differs")
+	} else {
+		plan.appendCmd(&Keep{Path: dstPathRef}, "content and metadata matched")
+	}
+
+	_, isDir := srcFsNode.(fs.Dir)
+	return isDir
+}
+
+// A path left alone with the MetaOnly option, because its content does
+// not match the source.
+type ErrContentDiffers struct {
+	Path string
+}
+
+func (err *ErrContentDiffers) String() string {
+	return fmt.Sprintf("%s: content differs from the source, metadata not updated", err.Path)
+}
+
+// Test whether the destination file at dstPath matches a source file by
+// the plan's ComparePolicy, without comparing their content.
+func (plan *PatchPlan) quickMatch(srcFile fs.File, dstPath string) bool {
+	if fs.IsSymlinkMode(srcFile.Info().Mode) {
+		return false
+	}
+
+	dstInfo, err := os.Lstat(plan.dstStore.Resolve(dstPath))
+	if dstInfo == nil || err != nil || !dstInfo.IsRegular() || dstInfo.Size != srcFile.Info().Size {
+		return false
+	}
+	if plan.opts.Compare == COMPARE_SIZE {
+		return true
+	}
+
+	srcLocal, isLocal := plan.srcStore.(fs.LocalStore)
+	if !isLocal {
+		return false
+	}
+	srcInfo, err := os.Lstat(srcLocal.Resolve(fs.RelPath(srcFile)))
+	if srcInfo == nil || err != nil {
+		return false
+	}
+
+	diff := srcInfo.Mtime_ns - dstInfo.Mtime_ns
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= plan.opts.MtimeWindow
+}
+
+// A destination file left alone with the KeepNewer option, because it
+// was modified more recently than its source.
+type ErrDstNewer struct {
+	Path string
+
+	// Modification times, in nanoseconds since the epoch.
+	SrcMtime int64
+	DstMtime int64
+}
+
+func (err *ErrDstNewer) String() string {
+	return fmt.Sprintf("%s: destination is newer than the source, not overwritten", err.Path)
+}
+
+// Check whether a source file would overwrite different, newer content
+// at its destination path.
+func (plan *PatchPlan) checkNewer(srcFile fs.File, dstPath string) os.Error {
+	srcLocal, isLocal := plan.srcStore.(fs.LocalStore)
+	if !isLocal {
+		return nil
+	}
+
+	dstInfo, err := os.Lstat(plan.dstStore.Resolve(dstPath))
+	if dstInfo == nil || err != nil {
+		return nil
+	}
+	srcInfo, err := os.Lstat(srcLocal.Resolve(fs.RelPath(srcFile)))
+	if srcInfo == nil || err != nil || dstInfo.Mtime_ns <= srcInfo.Mtime_ns {
+		return nil
+	}
+
+	if dstRoot, isDir := plan.dstStore.Repo().Root().(fs.Dir); isDir {
+		dstNode, has := fs.Lookup(dstRoot, dstPath)
+		if dstFile, isFile := dstNode.(fs.File); has && isFile &&
+			dstFile.Info().Strong == srcFile.Info().Strong {
+			return nil
+		}
+	}
+
+	return &ErrDstNewer{
+		Path:     dstPath,
+		SrcMtime: srcInfo.Mtime_ns,
+		DstMtime: dstInfo.Mtime_ns}
+}
+
+// Get the reason the source and destination could not be compared, an
+// ErrHashMismatch, or nil if they could.
+func (plan *PatchPlan) ParamsError() os.Error {
+	return plan.paramsErr
+}
+
+// Get the reason the plan cannot be executed: its ParamsError, or an
+// fs.ErrTimeout if planning timed out. Nil if it can be.
+func (plan *PatchPlan) Err() os.Error {
+	if plan.timeoutErr != nil {
+		return plan.timeoutErr
+	}
+	return plan.paramsErr
+}
+
+// Get the errors found planning destination paths, in the order they
+// were planned: paths which are too long to be created, with the
+// KeepNewer option, files newer than their source, and with CompareMeta
+// or MetaOnly, paths whose metadata could not be read, which are kept
+// as they are.
+func (plan *PatchPlan) PathErrors() []os.Error {
+	return plan.pathErrors
+}
+
+// Get the relative paths of destination files which Clean will delete,
+// because nothing in the source matches them. Files which the plan moves
+// to another path are not deleted. Paths are sorted.
+func (plan *PatchPlan) PendingDeletes() []string {
+	paths := make([]string, 0, len(plan.dstFileUnmatch))
 	for dstPath, _ := range plan.dstFileUnmatch {
+		paths = append(paths, dstPath)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Delete the destination files which do not match anything in the source,
+// or move them to the trash with the Trash option. See PendingDeletes.
+func (plan *PatchPlan) Clean(errors chan<- os.Error) {
+	if plan.opts.MetaOnly {
+		return
+	}
+
+	for _, dstPath := range plan.PendingDeletes() {
 		absPath := plan.dstStore.Resolve(dstPath)
-		err := os.Remove(absPath)
+		err := plan.checkDelete(absPath)
+		if err == nil && plan.opts.Trash {
+			err = fs.Trash(absPath)
+		} else if err == nil {
+			err = os.Remove(absPath)
+		}
+		if err != nil && errors != nil {
+			errors <- err
+		}
+	}
+
+	if !plan.opts.KeepEmptyDirs {
+		plan.pruneDirs(errors)
+	}
+}
+
+// Remove destination directories not present in the source which are empty,
+// working from the bottom up so that emptied parents are removed too.
+func (plan *PatchPlan) pruneDirs(errors chan<- os.Error) {
+	srcDirs := make(map[string]bool)
+	fs.Walk(plan.srcStore.Repo().Root(), func(srcNode fs.Node) bool {
+		srcDir, isDir := srcNode.(fs.Dir)
+		if isDir {
+			if dstPath, allowed := plan.dstName(fs.RelPath(srcDir)); allowed {
+				srcDirs[dstPath] = true
+			}
+		}
+		return isDir
+	})
+
+	dstDirs := []string{}
+	fs.Walk(plan.dstStore.Repo().Root(), func(dstNode fs.Node) bool {
+		dstDir, isDir := dstNode.(fs.Dir)
+		if isDir {
+			dstPath := fs.RelPath(dstDir)
+			if inConflictDir(plan.dstStore, dstPath) {
+				return false
+			}
+			if dstPath != "" && !srcDirs[dstPath] {
+				dstDirs = append(dstDirs, dstPath)
+			}
+		}
+		return isDir
+	})
+
+	// Subdirectories sort after their parents, so reverse order is bottom-up.
+	sort.Strings(dstDirs)
+
+	for i := len(dstDirs) - 1; i >= 0; i-- {
+		absPath := plan.dstStore.Resolve(dstDirs[i])
+		if !isEmptyDir(absPath) {
+			continue
+		}
+
+		err := plan.checkDelete(absPath)
+		if err == nil {
+			err = os.Remove(absPath)
+		}
 		if err != nil && errors != nil {
 			errors <- err
 		}
 	}
 }
 
+// Refuse to delete anything outside of the destination, or which the
+// Veto option refuses.
+func (plan *PatchPlan) checkDelete(absPath string) os.Error {
+	root := plan.dstStore.RootPath()
+	if !fs.InRoot(root, absPath) {
+		return os.NewError(fmt.Sprintf(
+			"Refusing to delete %s, outside of destination %s", absPath, root))
+	}
+
+	if plan.opts.Veto != nil {
+		relPath := plan.dstStore.RelPath(absPath)
+		return plan.opts.Veto(relPath, &Delete{
+			Path: &LocalPath{LocalStore: plan.dstStore, RelPath: relPath}, Trash: plan.opts.Trash})
+	}
+	return nil
+}
+
+// Test whether relpath is within the store's conflict directory,
+// which is left alone when cleaning up the destination.
+func inConflictDir(store fs.LocalStore, relpath string) bool {
+	conflictDir := store.ConflictDir()
+	if conflictDir == "" {
+		return false
+	}
+	return relpath == conflictDir ||
+		strings.HasPrefix(relpath, conflictDir+string(os.PathSeparator))
+}
+
+// Test whether relpath is dir, or within it.
+func isBeneath(relpath string, dir string) bool {
+	return relpath == dir || strings.HasPrefix(relpath, dir+string(os.PathSeparator))
+}
+
+func isEmptyDir(path string) bool {
+	f, err := os.Open(path)
+	if f == nil || err != nil {
+		return false
+	}
+	defer f.Close()
+
+	names, _ := f.Readdirnames(1)
+	return len(names) == 0
+}
+
+// Get the destination path for a source path under the plan's reserved
+// and long name policies. Returns false if the path is to be skipped.
+func (plan *PatchPlan) dstName(srcPath string) (string, bool) {
+	if plan.opts.ReservedNames == RESERVED_FAIL && !plan.opts.UnescapeNames && plan.opts.LongNames == LONG_FAIL {
+		return srcPath, true
+	}
+
+	names := fs.SplitNames(srcPath)
+	for i, name := range names {
+		if plan.opts.UnescapeNames {
+			name = fs.UnescapeName(name)
+			names[i] = name
+		}
+
+		if fs.IsReservedName(name) || (plan.opts.WindowsNames && fs.IsWindowsReserved(name)) {
+			switch plan.opts.ReservedNames {
+			case RESERVED_SKIP:
+				return "", false
+			case RESERVED_RENAME:
+				names[i] = fs.WindowsSafeName(name)
+			case RESERVED_ESCAPE:
+				names[i] = fs.EscapeWindowsName(name)
+			}
+		}
+
+		if fs.IsNameTooLong(names[i]) {
+			switch plan.opts.LongNames {
+			case LONG_SKIP:
+				return "", false
+			case LONG_SHORTEN:
+				names[i] = fs.ShortenName(names[i])
+			}
+		}
+	}
+
+	dstPath := filepath.Join(names...)
+	if plan.opts.LongNames == LONG_SKIP && fs.CheckPathLength(plan.dstStore.Resolve(dstPath)) != nil {
+		return "", false
+	}
+	return dstPath, true
+}
+
+// Add a command to the plan, noting the reason for it if explanations
+// were requested.
+func (plan *PatchPlan) appendCmd(cmd PatchCmd, format string, args ...interface{}) {
+	plan.Cmds = append(plan.Cmds, cmd)
+	plan.explain(cmd, format, args...)
+}
+
+func (plan *PatchPlan) explain(cmd PatchCmd, format string, args ...interface{}) {
+	if plan.reasons != nil {
+		plan.reasons[cmd] = fmt.Sprintf(format, args...)
+	}
+}
+
+// Get the reason a command was planned. Empty unless the plan
+// was made with the Explain option.
+func (plan *PatchPlan) Reason(cmd PatchCmd) string {
+	return plan.reasons[cmd]
+}
+
+// Describe the plan with the reason for each command, followed by
+// the destination files Clean will delete.
+func (plan *PatchPlan) Explain() string {
+	buf := &bytes.Buffer{}
+	for _, cmd := range plan.Cmds {
+		fmt.Fprintf(buf, "%v\n", cmd)
+		if reason := plan.Reason(cmd); reason != "" {
+			fmt.Fprintf(buf, "\t# %s\n", reason)
+		}
+	}
+	for _, path := range plan.PendingDeletes() {
+		if plan.opts.Trash {
+			fmt.Fprintf(buf, "Trash %s\n\t# not found in the source\n", path)
+		} else {
+			fmt.Fprintf(buf, "Delete %s\n\t# not found in the source\n", path)
+		}
+	}
+	return string(buf.Bytes())
+}
+
+// Describe the kind of file at a path, for explanations.
+func describeMode(fileInfo *os.FileInfo) string {
+	switch {
+	case fileInfo.IsDirectory():
+		return "directory"
+	case fileInfo.IsRegular():
+		return "file"
+	case fileInfo.IsSymlink():
+		return "symlink"
+	}
+	return "special file"
+}
+
 func (plan *PatchPlan) String() string {
 	buf := &bytes.Buffer{}
 	for _, cmd := range plan.Cmds {
@@ -531,3 +2646,72 @@ func Patch(src string, dst string) (*PatchPlan, os.Error) {
 
 	return NewPatchPlan(srcStore, dstStore), nil
 }
+
+// Plan the commands needed to make the destination match the source, with
+// each destination file stored gzip-compressed as name.gz.
+//
+// The destination is indexed by its uncompressed content, as by
+// fs.NewCompressedStore, so files which match the source are kept. Files
+// which differ are compressed from the source in full: compressed content
+// cannot be patched in place, so blocks are not reused.
+func NewCompressedPlan(srcStore fs.BlockStore, dstStore fs.LocalStore) (*PatchPlan, os.Error) {
+	logical, err := fs.NewCompressedStore(dstStore.RootPath(), fs.NewMemRepo())
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &PatchPlan{srcStore: srcStore, dstStore: dstStore, opts: &PlanOptions{}}
+	plan.dstFileUnmatch = make(map[string]fs.File)
+
+	fs.Walk(logical.Root(), func(dstNode fs.Node) bool {
+		dstFile, isDstFile := dstNode.(fs.File)
+		if isDstFile {
+			plan.dstFileUnmatch[storedPath(dstStore, fs.RelPath(dstFile))] = dstFile
+		}
+		return !isDstFile
+	})
+
+	fs.Walk(srcStore.Repo().Root(), func(srcNode fs.Node) bool {
+		srcFile, isSrcFile := srcNode.(fs.File)
+		if !isSrcFile {
+			_, isDir := srcNode.(fs.Dir)
+			return isDir
+		}
+
+		relpath := fs.RelPath(srcFile)
+		plan.dstFileUnmatch[storedPath(dstStore, relpath)] = nil, false
+		dstPath := &LocalPath{LocalStore: dstStore, RelPath: relpath + fs.GZIP_SUFFIX}
+
+		if dstFile, has := logical.Repo().File(srcFile.Info().Strong); has && fs.RelPath(dstFile) == relpath {
+			plan.appendCmd(&Keep{Path: dstPath}, "compressed content is identical")
+		} else {
+			plan.appendCmd(&SrcFileDownload{
+				SrcFile: srcFile, Path: dstPath, Length: srcFile.Info().Size, Compress: true},
+				"compressed destinations are written in full")
+		}
+		return false
+	})
+
+	return plan, nil
+}
+
+// Get the path a file is stored at in a compressed destination.
+func storedPath(dstStore fs.LocalStore, relpath string) string {
+	if _, err := os.Stat(dstStore.Resolve(relpath + fs.GZIP_SUFFIX)); err == nil {
+		return relpath + fs.GZIP_SUFFIX
+	}
+	return relpath
+}
+
+// Plan the commands needed to make the destination match the source
+// directory, with its content transformed on the way. The source is indexed
+// through the transform, so the plan, and the checksums it verifies, are
+// of the transformed content. See fs.ContentTransform.
+func NewTransformPlan(src string, dstStore fs.LocalStore, transform fs.ContentTransform, opts *PlanOptions) (*PatchPlan, os.Error) {
+	srcStore, err := fs.NewVirtualStore(fs.TransformFS(fs.DirFS(src), transform), fs.NewMemRepo())
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPatchPlanOpts(srcStore, dstStore, opts), nil
+}
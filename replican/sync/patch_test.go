@@ -1,10 +1,13 @@
 package sync
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"github.com/cmars/replican-sync/replican/events"
 	"github.com/cmars/replican-sync/replican/fs"
 	"github.com/cmars/replican-sync/replican/fs/sqlite3"
 	"github.com/cmars/replican-sync/replican/treegen"
@@ -202,15 +205,20 @@ func DoTestPatchFileAppend(t *testing.T, mkrepo repoMaker) {
 			assert.Equal(t, ltc.LocalOffset, ltc.TempOffset)
 			assert.Equal(t, int64(fs.BLOCKSIZE), ltc.Length)
 			assert.Equal(t, int64(0), ltc.LocalOffset%int64(fs.BLOCKSIZE))
-		case i == 9:
-			stc, isStc := cmd.(*SrcTempCopy)
-			assert.T(t, isStc)
-			assert.Equal(t, int64(65538), stc.Length)
-		case i == 10:
+		case i >= 9 && i <= 16:
+			sbc, isSbc := cmd.(*SrcBlockCopy)
+			assert.Tf(t, isSbc, "cmd %d", i)
+			assert.Equal(t, int64(fs.BLOCKSIZE), sbc.Length)
+			assert.Equal(t, int64(i-1)*int64(fs.BLOCKSIZE), sbc.TempOffset)
+		case i == 17:
+			sbc, isSbc := cmd.(*SrcBlockCopy)
+			assert.T(t, isSbc)
+			assert.Equal(t, int64(2), sbc.Length)
+		case i == 18:
 			_, isRwt := cmd.(*ReplaceWithTemp)
 			assert.T(t, isRwt)
 			complete = true
-		case i > 10:
+		case i > 18:
 			t.Fatalf("too many commands")
 		}
 	}
@@ -226,6 +234,86 @@ func DoTestPatchFileAppend(t *testing.T, mkrepo repoMaker) {
 	assert.Equal(t, srcRoot.Info().Strong, dstRoot.Info().Strong)
 }
 
+// Test patching a file whose blocks are found in the destination at
+// offsets which are not block-aligned, the destination having a few
+// bytes before them. Blocks are copied from where they are found in
+// the destination to where they belong in the source, and only the
+// source not matched is fetched.
+func TestPatchFileShifted(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo", tg.F("bar", tg.B(42, 65537)))
+
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	tg = treegen.New()
+	treeSpec = tg.D("foo", tg.F("bar", tg.B(7, 5), tg.B(42, 65537)))
+
+	dstpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(dstpath)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	srcFile, has := fs.Lookup(srcStore.Repo().Root().(fs.Dir), filepath.Join("foo", "bar"))
+	assert.T(t, has)
+	match, err := MatchFile(srcFile.(fs.File), filepath.Join(dstpath, "foo", "bar"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, len(match.BlockMatches) >= 8)
+	for _, srcRange := range match.NotMatched() {
+		assert.Tf(t, srcRange.From >= 8*int64(fs.BLOCKSIZE),
+			"%d-%d not matched", srcRange.From, srcRange.To)
+	}
+
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+
+	copies := 0
+	for _, cmd := range patchPlan.Cmds {
+		if ltc, isLtc := cmd.(*LocalTempCopy); isLtc {
+			assert.Equal(t, int64(5), ltc.LocalOffset-ltc.TempOffset)
+			assert.Equal(t, int64(0), ltc.TempOffset%int64(fs.BLOCKSIZE))
+			copies++
+		}
+	}
+	assert.T(t, copies >= 8)
+
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	srcRoot, errors := fs.IndexDir(srcpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	dstRoot, errors := fs.IndexDir(dstpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, srcRoot.Info().Strong, dstRoot.Info().Strong)
+}
+
+// Test that executing a plan accounts for the bytes transferred and
+// the bytes written, reused blocks counting only as written.
+func TestTransferred(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 65537), tg.B(43, 65537))))
+	defer os.RemoveAll(srcpath)
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	tg = treegen.New()
+	dstpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(dstpath)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	// The first 8 blocks are reused, the rest transferred.
+	report := NewExecReport(patchPlan, nil)
+	assert.Equal(t, int64(65538), report.Literal)
+	assert.Equal(t, int64(131074), report.Written)
+	assert.T(t, report.Speedup() > 1.9)
+}
+
 // Test the patch planner on a case where the source file is a shorter,
 // truncated version of the destination.
 // Execute the patch plan and check both resulting trees are identical.
@@ -276,9 +364,9 @@ func DoTestPatchFileTruncate(t *testing.T, mkrepo repoMaker) {
 			assert.Equal(t, int64(fs.BLOCKSIZE), ltc.Length)
 			assert.Equal(t, int64(0), ltc.LocalOffset%int64(fs.BLOCKSIZE))
 		case i == 9:
-			stc, isStc := cmd.(*SrcTempCopy)
-			assert.T(t, isStc)
-			assert.Equal(t, int64(1), stc.Length)
+			sbc, isSbc := cmd.(*SrcBlockCopy)
+			assert.T(t, isSbc)
+			assert.Equal(t, int64(1), sbc.Length)
 			complete = true
 		case i > 10:
 			t.Fatalf("too many commands")
@@ -845,6 +933,14 @@ func DoTestClean(t *testing.T, mkrepo repoMaker) {
 	assert.Tf(t, err == nil, "%v", err)
 
 	patchPlan := NewPatchPlan(srcStore, dstStore)
+
+	pendingDeletes := patchPlan.PendingDeletes()
+	assert.Equalf(t, 10, len(pendingDeletes), "%v", pendingDeletes)
+	for i := 1; i < len(pendingDeletes); i++ {
+		assert.T(t, pendingDeletes[i-1] < pendingDeletes[i])
+	}
+	assert.Equal(t, filepath.Join("foo", "bar", "beth", "B"), pendingDeletes[0])
+
 	failedCmd, err := patchPlan.Exec()
 	assert.Tf(t, failedCmd == nil, "%v", failedCmd)
 	assert.Tf(t, err == nil, "%v", err)
@@ -861,26 +957,93 @@ func DoTestClean(t *testing.T, mkrepo repoMaker) {
 	onePath = dstStore.Resolve(filepath.Join("foo", "baz", "uno", "1"))
 	_, err = os.Stat(onePath)
 	assert.Tf(t, err != nil, "%v", err)
+
+	// Directories not in the source are pruned once empty
+	for _, dirPath := range []string{
+		filepath.Join("foo", "baz", "uno"),
+		filepath.Join("foo", "baz"),
+		filepath.Join("foo", "bar", "beth")} {
+		_, err = os.Stat(dstStore.Resolve(dirPath))
+		assert.Tf(t, err != nil, "%s still exists", dirPath)
+	}
+
+	_, err = os.Stat(dstStore.Resolve(filepath.Join("foo", "bar", "aleph")))
+	assert.Tf(t, err == nil, "%v", err)
 }
 
-func TestSetModeNew(t *testing.T) {
-	DoTestSetModeNew(t, mkMemRepo)
+// Test that Clean leaves alone files which the plan moves elsewhere,
+// whether it is run after Exec or before it.
+func TestCleanRenamed(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("new", tg.B(43, 65537)),
+		tg.F("copy", tg.B(43, 65537))))
+	defer os.RemoveAll(srcpath)
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	for _, cleanFirst := range []bool{false, true} {
+		tg = treegen.New()
+		dstpath := treegen.TestTree(t, tg.D("foo",
+			tg.F("old", tg.B(43, 65537)),
+			tg.F("stale", tg.B(44, 65537))))
+		defer os.RemoveAll(dstpath)
+		dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+		assert.T(t, err == nil)
+
+		patchPlan := NewPatchPlan(srcStore, dstStore)
+		assert.Equal(t, []string{filepath.Join("foo", "stale")}, patchPlan.PendingDeletes())
+
+		clean := func() {
+			errors := make(chan os.Error)
+			go func() {
+				patchPlan.Clean(errors)
+				close(errors)
+			}()
+			for err := range errors {
+				assert.Tf(t, err == nil, "%v", err)
+			}
+		}
+
+		if cleanFirst {
+			clean()
+		}
+		failedCmd, err := patchPlan.Exec()
+		assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+		if !cleanFirst {
+			clean()
+		}
+
+		for _, name := range []string{"old", "stale"} {
+			_, err = os.Stat(filepath.Join(dstpath, "foo", name))
+			assert.Tf(t, err != nil, "%s still exists", name)
+		}
+		srcRoot, errors := fs.IndexDir(srcpath, fs.NewMemRepo())
+		assert.Equalf(t, 0, len(errors), "%v", errors)
+		dstRoot, errors := fs.IndexDir(dstpath, fs.NewMemRepo())
+		assert.Equalf(t, 0, len(errors), "%v", errors)
+		assert.Equal(t, srcRoot.Info().Strong, dstRoot.Info().Strong)
+	}
 }
 
-func TestDbSetModeNew(t *testing.T) {
-	DoTestSetModeNew(t, mkDbRepo)
+// Test that a renamed directory is moved whole, while other paths
+// reusing content within it still copy from it first.
+
+func TestPatchDirMove(t *testing.T) {
+	DoTestPatchDirMove(t, mkMemRepo)
 }
 
-func DoTestSetModeNew(t *testing.T, mkrepo repoMaker) {
+func TestDbPatchDirMove(t *testing.T) {
+	DoTestPatchDirMove(t, mkDbRepo)
+}
+
+func DoTestPatchDirMove(t *testing.T, mkrepo repoMaker) {
 	tg := treegen.New()
-	treeSpec := tg.D("foo",
-		tg.D("bar",
-			tg.D("aleph",
-				tg.F("A", tg.B(42, 65537)),
-				tg.F("a", tg.B(42, 65537)))))
-	srcpath := treegen.TestTree(t, treeSpec)
-	os.Chmod(filepath.Join(srcpath, "foo", "bar", "aleph", "A"), 0765)
-	os.Chmod(filepath.Join(srcpath, "foo", "bar"), 0711)
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.D("new",
+			tg.F("a", tg.B(42, 65537)),
+			tg.D("sub", tg.F("b", tg.B(43, 65537)))),
+		tg.F("extra", tg.B(42, 65537))))
 	defer os.RemoveAll(srcpath)
 	srcRepo := mkrepo(t)
 	defer srcRepo.Close()
@@ -888,8 +1051,11 @@ func DoTestSetModeNew(t *testing.T, mkrepo repoMaker) {
 	assert.T(t, err == nil)
 
 	tg = treegen.New()
-	treeSpec = tg.D("foo")
-	dstpath := treegen.TestTree(t, treeSpec)
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.D("old",
+			tg.F("a", tg.B(42, 65537)),
+			tg.D("sub", tg.F("b", tg.B(43, 65537)))),
+		tg.F("stale", tg.B(44, 65537))))
 	defer os.RemoveAll(dstpath)
 	dstRepo := mkrepo(t)
 	defer dstRepo.Close()
@@ -897,10 +1063,28 @@ func DoTestSetModeNew(t *testing.T, mkrepo repoMaker) {
 	assert.T(t, err == nil)
 
 	patchPlan := NewPatchPlan(srcStore, dstStore)
-	failedCmd, err := patchPlan.Exec()
-	assert.Tf(t, failedCmd == nil, "%v", failedCmd)
-	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, []string{filepath.Join("foo", "stale")}, patchPlan.PendingDeletes())
+
+	dirMoves, transfers := 0, 0
+	for _, cmd := range patchPlan.Cmds {
+		switch c := cmd.(type) {
+		case *DirMove:
+			dirMoves++
+			assert.Equal(t, filepath.Join("foo", "old"), c.From.RelPath)
+			assert.Equal(t, filepath.Join("foo", "new"), c.To.RelPath)
+		case *Transfer:
+			transfers++
+			assert.Equal(t, filepath.Join("foo", "old", "a"), c.From.RelPath)
+			assert.Equal(t, filepath.Join("foo", "extra"), c.To.RelPath)
+			assert.Tf(t, !c.Move, "%v moves from a moved directory", c)
+			assert.Equal(t, 0, dirMoves)
+		}
+	}
+	assert.Equal(t, 1, dirMoves)
+	assert.Equal(t, 1, transfers)
 
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
 	errors := make(chan os.Error)
 	go func() {
 		patchPlan.Clean(errors)
@@ -910,91 +1094,2373 @@ func DoTestSetModeNew(t *testing.T, mkrepo repoMaker) {
 		assert.Tf(t, err == nil, "%v", err)
 	}
 
-	errors = make(chan os.Error)
-	go func() {
-		patchPlan.SetMode(errors)
-		close(errors)
-	}()
-	for err := range errors {
-		assert.Tf(t, err == nil, "%v", err)
-	}
+	_, err = os.Stat(filepath.Join(dstpath, "foo", "old"))
+	assert.T(t, err != nil)
+	srcRoot, errs := fs.IndexDir(srcpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errs), "%v", errs)
+	dstRoot, errs := fs.IndexDir(dstpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errs), "%v", errs)
+	assert.Equal(t, srcRoot.Info().Strong, dstRoot.Info().Strong)
+}
 
-	fileinfo, err := os.Stat(filepath.Join(dstpath, "foo", "bar", "aleph", "A"))
-	assert.T(t, fileinfo != nil)
-	assert.Equal(t, uint32(0765), fileinfo.Permission())
+// Test that content renamed to many paths is copied to all but the last,
+// which moves it, and that a path which is also kept is only copied.
+func TestTransferFanOut(t *testing.T) {
+	const n = 4
+	for _, keep := range []bool{false, true} {
+		tg := treegen.New()
+		srcFiles := []treegen.Generated{}
+		for i := 0; i < n; i++ {
+			srcFiles = append(srcFiles, tg.F(fmt.Sprintf("copy%d", i), tg.B(42, 65537)))
+		}
+		if keep {
+			srcFiles = append(srcFiles, tg.F("orig", tg.B(42, 65537)))
+		}
+		srcpath := treegen.TestTree(t, tg.D("foo", srcFiles...))
+		defer os.RemoveAll(srcpath)
+		srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+		assert.T(t, err == nil)
+
+		tg = treegen.New()
+		dstpath := treegen.TestTree(t, tg.D("foo", tg.F("orig", tg.B(42, 65537))))
+		defer os.RemoveAll(dstpath)
+		dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+		assert.T(t, err == nil)
+
+		patchPlan := NewPatchPlan(srcStore, dstStore)
+		origPath := filepath.Join("foo", "orig")
+
+		transfers := []*Transfer{}
+		for _, cmd := range patchPlan.Cmds {
+			if transfer, is := cmd.(*Transfer); is {
+				assert.Equal(t, origPath, transfer.From.RelPath)
+				transfers = append(transfers, transfer)
+			}
+		}
+		assert.Equal(t, n, len(transfers))
+
+		if keep {
+			assert.Equal(t, n+1, patchPlan.RefCount(origPath))
+			for _, transfer := range transfers {
+				assert.Tf(t, !transfer.Move, "%v moves a kept path", transfer)
+			}
+		} else {
+			assert.Equal(t, n, patchPlan.RefCount(origPath))
+			for i, transfer := range transfers {
+				assert.Equalf(t, i == n-1, transfer.Move, "%v", transfer)
+			}
+		}
 
-	fileinfo, err = os.Stat(filepath.Join(dstpath, "foo", "bar"))
-	assert.T(t, fileinfo != nil)
-	assert.Equal(t, uint32(0711), fileinfo.Permission())
+		failedCmd, err := patchPlan.Exec()
+		assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+		// Executing the plan leaves the decisions as they were planned.
+		for i, transfer := range transfers {
+			assert.Equalf(t, !keep && i == n-1, transfer.Move, "%v", transfer)
+		}
+
+		srcRoot, errors := fs.IndexDir(srcpath, fs.NewMemRepo())
+		assert.Equalf(t, 0, len(errors), "%v", errors)
+		dstRoot, errors := fs.IndexDir(dstpath, fs.NewMemRepo())
+		assert.Equalf(t, 0, len(errors), "%v", errors)
+		assert.Equal(t, srcRoot.Info().Strong, dstRoot.Info().Strong)
+	}
 }
 
-func TestSetModeOverwrite(t *testing.T) {
-	DoTestSetModeOverwrite(t, mkMemRepo)
+// Test that unmatched files are deleted before new content is written,
+// except those which a transfer reuses.
+func TestDeleteBefore(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("moved", tg.B(43, 65537)),
+		tg.F("new", tg.B(7, 65537))))
+	defer os.RemoveAll(srcpath)
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	tg = treegen.New()
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("old", tg.B(43, 65537)),
+		tg.F("stale", tg.B(44, 65537))))
+	defer os.RemoveAll(dstpath)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlanOpts(srcStore, dstStore, &PlanOptions{Deletes: DELETE_BEFORE})
+	assert.Equalf(t, 0, len(patchPlan.PendingDeletes()), "%v", patchPlan.PendingDeletes())
+
+	del, is := patchPlan.Cmds[0].(*Delete)
+	assert.Tf(t, is, "%v", patchPlan.Cmds[0])
+	assert.Equal(t, dstStore.Resolve(filepath.Join("foo", "stale")), del.Path.Resolve())
+	for _, cmd := range patchPlan.Cmds[1:] {
+		_, is := cmd.(*Delete)
+		assert.Tf(t, !is, "%v", cmd)
+	}
+
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	for _, gone := range []string{"old", "stale"} {
+		_, err = os.Stat(dstStore.Resolve(filepath.Join("foo", gone)))
+		assert.Tf(t, err != nil, "%s still exists", gone)
+	}
+	_, err = os.Stat(dstStore.Resolve(filepath.Join("foo", "moved")))
+	assert.Tf(t, err == nil, "%v", err)
+
+	report := NewExecReport(patchPlan, nil)
+	assert.Equal(t, []string{filepath.Join("foo", "stale")}, report.Deleted)
 }
 
-func TestDbSetModeOverwrite(t *testing.T) {
-	DoTestSetModeOverwrite(t, mkDbRepo)
+// Test that unmatched files are deleted as their directory is written to,
+// or at the end of the plan if it never is.
+func TestDeleteDuring(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.D("a", tg.F("new", tg.B(7, 65537))),
+		tg.D("b", tg.F("kept", tg.B(8, 65537)))))
+	defer os.RemoveAll(srcpath)
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	tg = treegen.New()
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.D("a", tg.F("stale", tg.B(44, 65537))),
+		tg.D("b", tg.F("kept", tg.B(8, 65537)), tg.F("stale", tg.B(45, 65537)))))
+	defer os.RemoveAll(dstpath)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlanOpts(srcStore, dstStore, &PlanOptions{Deletes: DELETE_DURING})
+
+	deleted := []string{}
+	for i, cmd := range patchPlan.Cmds {
+		del, is := cmd.(*Delete)
+		if !is {
+			continue
+		}
+		deleted = append(deleted, dstStore.RelPath(del.Path.Resolve()))
+
+		switch len(deleted) {
+		case 1:
+			// Just before the download into the same directory
+			sfd, is := patchPlan.Cmds[i+1].(*SrcFileDownload)
+			assert.Tf(t, is, "%v", patchPlan.Cmds[i+1])
+			assert.Equal(t, dstStore.Resolve(filepath.Join("foo", "a", "new")), sfd.Path.Resolve())
+		case 2:
+			assert.Equal(t, len(patchPlan.Cmds)-1, i)
+		}
+	}
+	assert.Equal(t, []string{
+		filepath.Join("foo", "a", "stale"),
+		filepath.Join("foo", "b", "stale")}, deleted)
+
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+	for _, gone := range deleted {
+		_, err = os.Stat(dstStore.Resolve(gone))
+		assert.Tf(t, err != nil, "%s still exists", gone)
+	}
 }
 
-func DoTestSetModeOverwrite(t *testing.T, mkrepo repoMaker) {
+// Test that destination files newer than their source are left alone
+// with the KeepNewer option, and reported.
+func TestKeepNewer(t *testing.T) {
 	tg := treegen.New()
-	treeSpec := tg.D("foo",
-		tg.D("bar",
-			tg.D("aleph",
-				tg.F("A", tg.B(42, 65537)),
-				tg.F("a", tg.B(42, 65537)))))
-	srcpath := treegen.TestTree(t, treeSpec)
-	os.Chmod(filepath.Join(srcpath, "foo", "bar", "aleph", "A"), 0765)
-	os.Chmod(filepath.Join(srcpath, "foo", "bar"), 0711)
+	srcpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 65537))))
 	defer os.RemoveAll(srcpath)
-	srcRepo := mkrepo(t)
-	defer srcRepo.Close()
-	srcStore, err := fs.NewLocalStore(srcpath, srcRepo)
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
 	assert.T(t, err == nil)
 
 	tg = treegen.New()
-	treeSpec = tg.D("foo",
-		tg.D("bar",
-			tg.D("aleph",
-				tg.F("A", tg.B(42, 65537)),
-				tg.F("a", tg.B(42, 65537)))))
-	dstpath := treegen.TestTree(t, treeSpec)
-	os.Chmod(filepath.Join(dstpath, "foo", "bar", "aleph", "A"), 0600)
-	os.Chmod(filepath.Join(dstpath, "foo", "bar"), 0700)
+	dstpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(43, 65537))))
 	defer os.RemoveAll(dstpath)
-	dstRepo := mkrepo(t)
-	defer dstRepo.Close()
-	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
+	barPath := filepath.Join(dstpath, "foo", "bar")
+	srcInfo, err := os.Stat(filepath.Join(srcpath, "foo", "bar"))
+	assert.T(t, err == nil)
+	err = os.Chtimes(barPath, srcInfo.Atime_ns, srcInfo.Mtime_ns+60e9)
+	assert.T(t, err == nil)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
 	assert.T(t, err == nil)
 
-	patchPlan := NewPatchPlan(srcStore, dstStore)
+	patchPlan := NewPatchPlanOpts(srcStore, dstStore, &PlanOptions{KeepNewer: true})
+	for _, cmd := range patchPlan.Cmds {
+		for _, path := range modifiedPaths(cmd) {
+			assert.Tf(t, path.Resolve() != barPath, "%v", cmd)
+		}
+	}
+	assert.Equal(t, 0, len(patchPlan.PendingDeletes()))
+
+	pathErrors := patchPlan.PathErrors()
+	assert.Equal(t, 1, len(pathErrors))
+	newer, is := pathErrors[0].(*ErrDstNewer)
+	assert.Tf(t, is, "%v", pathErrors[0])
+	assert.Equal(t, filepath.Join("foo", "bar"), newer.Path)
+
+	// An older destination is overwritten.
+	err = os.Chtimes(barPath, srcInfo.Atime_ns, srcInfo.Mtime_ns-60e9)
+	assert.T(t, err == nil)
+	patchPlan = NewPatchPlanOpts(srcStore, dstStore, &PlanOptions{KeepNewer: true})
+	assert.Equal(t, 0, len(patchPlan.PathErrors()))
+
 	failedCmd, err := patchPlan.Exec()
-	assert.Tf(t, failedCmd == nil, "%v %v", failedCmd, err)
-	assert.Tf(t, err == nil, "%v", err)
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+	srcRoot, errors := fs.IndexDir(srcpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	dstRoot, errors := fs.IndexDir(dstpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, srcRoot.Info().Strong, dstRoot.Info().Strong)
+}
 
-	errors := make(chan os.Error)
-	go func() {
-		patchPlan.Clean(errors)
-		close(errors)
-	}()
-	for err := range errors {
-		assert.Tf(t, err == nil, "%v", err)
+// Test that files are matched by size, or by size and modification
+// time, without comparing content.
+func TestCompareHeuristics(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(srcpath)
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	// Same size, different content
+	tg = treegen.New()
+	dstpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(43, 65537))))
+	defer os.RemoveAll(dstpath)
+	barPath := filepath.Join(dstpath, "foo", "bar")
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	isKept := func(plan *PatchPlan) bool {
+		for _, cmd := range plan.Cmds {
+			if keep, is := cmd.(*Keep); is && keep.Path.Resolve() == barPath {
+				return true
+			}
+		}
+		return false
 	}
 
-	errors = make(chan os.Error)
-	go func() {
-		patchPlan.SetMode(errors)
-		close(errors)
-	}()
-	for err := range errors {
-		assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, !isKept(NewPatchPlan(srcStore, dstStore)))
+	assert.T(t, isKept(NewPatchPlanOpts(srcStore, dstStore, &PlanOptions{Compare: COMPARE_SIZE})))
+
+	// Times a second apart match within a two second window.
+	srcInfo, err := os.Stat(filepath.Join(srcpath, "foo", "bar"))
+	assert.T(t, err == nil)
+	err = os.Chtimes(barPath, srcInfo.Atime_ns, srcInfo.Mtime_ns+1e9)
+	assert.T(t, err == nil)
+	assert.T(t, !isKept(NewPatchPlanOpts(srcStore, dstStore, &PlanOptions{Compare: COMPARE_MTIME})))
+	assert.T(t, isKept(NewPatchPlanOpts(srcStore, dstStore,
+		&PlanOptions{Compare: COMPARE_MTIME, MtimeWindow: 2e9})))
+}
+
+// Test that a source whose metadata cannot be read is reported, and the
+// destination kept as it is.
+func TestMetaUnreadable(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(srcpath)
+	assert.T(t, os.Chmod(filepath.Join(srcpath, "foo", "bar"), 0600) == nil)
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	tg = treegen.New()
+	dstpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(dstpath)
+	assert.T(t, os.Chmod(filepath.Join(dstpath, "foo", "bar"), 0644) == nil)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	// Gone since it was indexed
+	assert.T(t, os.Remove(filepath.Join(srcpath, "foo", "bar")) == nil)
+
+	patchPlan := NewPatchPlanOpts(srcStore, dstStore, &PlanOptions{CompareMeta: true})
+	kept := false
+	for _, cmd := range patchPlan.Cmds {
+		switch c := cmd.(type) {
+		case *SetMeta, *Touch:
+			t.Errorf("unexpected %v", cmd)
+		case *Keep:
+			kept = kept || strings.HasSuffix(c.Path.Resolve(), filepath.Join("foo", "bar"))
+		}
 	}
+	assert.T(t, kept)
+	assert.Equal(t, 1, len(patchPlan.PathErrors()))
+}
 
-	fileinfo, err := os.Stat(filepath.Join(dstpath, "foo", "bar", "aleph", "A"))
-	assert.T(t, fileinfo != nil)
-	assert.Equal(t, uint32(0765), fileinfo.Permission())
+// Test that the Veto option is asked about each change, and that a change
+// it refuses is not made.
+func TestVeto(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.F("baz", tg.B(43, 65537))))
+	defer os.RemoveAll(srcpath)
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
 
-	fileinfo, err = os.Stat(filepath.Join(dstpath, "foo", "bar"))
-	assert.T(t, fileinfo != nil)
-	assert.Equal(t, uint32(0711), fileinfo.Permission())
+	tg = treegen.New()
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(44, 65537)),
+		tg.F("stale", tg.B(45, 65537))))
+	defer os.RemoveAll(dstpath)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	refused := os.NewError("refused")
+	asked := make(map[string]bool)
+	vetoed := filepath.Join("foo", "stale")
+	opts := &PlanOptions{Veto: func(path string, cmd PatchCmd) os.Error {
+		asked[path] = true
+		if path == vetoed {
+			_, isDelete := cmd.(*Delete)
+			assert.Tf(t, isDelete, "%v", cmd)
+			return refused
+		}
+		return nil
+	}}
+
+	// Deletions refused in Clean are reported, and left in place
+	patchPlan := NewPatchPlanOpts(srcStore, dstStore, opts)
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+	errors := make(chan os.Error, 10)
+	patchPlan.Clean(errors)
+	close(errors)
+	cleanErrors := []os.Error{}
+	for err := range errors {
+		cleanErrors = append(cleanErrors, err)
+	}
+	assert.Equal(t, []os.Error{refused}, cleanErrors)
+	assert.T(t, asked[filepath.Join("foo", "bar")])
+	assert.T(t, asked[filepath.Join("foo", "baz")])
+	_, err = os.Stat(filepath.Join(dstpath, "foo", "stale"))
+	assert.T(t, err == nil)
+
+	// Commands refused fail the execution before changing anything
+	assert.T(t, treegen.Fab(filepath.Join(srcpath, "foo"), tg.F("new", tg.B(46, 65537))) == nil)
+	srcStore, err = fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	dstStore, err = fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	vetoed = filepath.Join("foo", "new")
+	opts.Veto = func(path string, cmd PatchCmd) os.Error {
+		if path == vetoed {
+			return refused
+		}
+		return nil
+	}
+
+	patchPlan = NewPatchPlanOpts(srcStore, dstStore, opts)
+	failedCmd, err = patchPlan.Exec()
+	assert.T(t, failedCmd != nil)
+	assert.Equal(t, refused, err)
+	_, err = os.Stat(filepath.Join(dstpath, "foo", "new"))
+	assert.T(t, err != nil)
+}
+
+// Test that a metadata-only plan updates metadata where content matches,
+// and leaves everything else alone.
+func TestMetaOnly(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.F("baz", tg.B(1, 100))))
+	defer os.RemoveAll(srcpath)
+	err := os.Chmod(filepath.Join(srcpath, "foo", "bar"), 0600)
+	assert.T(t, err == nil)
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	tg = treegen.New()
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.F("baz", tg.B(2, 100)),
+		tg.F("extra", tg.B(3, 100))))
+	defer os.RemoveAll(dstpath)
+	err = os.Chmod(filepath.Join(dstpath, "foo", "bar"), 0644)
+	assert.T(t, err == nil)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlanOpts(srcStore, dstStore, &PlanOptions{MetaOnly: true})
+	for _, cmd := range patchPlan.Cmds {
+		switch cmd.(type) {
+		case *Keep, *SetMeta, *Touch:
+		default:
+			t.Errorf("unexpected command in metadata-only plan: %v", cmd)
+		}
+	}
+	assert.Equal(t, 0, len(patchPlan.PendingDeletes()))
+
+	pathErrors := patchPlan.PathErrors()
+	assert.Equal(t, 1, len(pathErrors))
+	differs, is := pathErrors[0].(*ErrContentDiffers)
+	assert.Tf(t, is, "%v", pathErrors[0])
+	assert.Equal(t, filepath.Join("foo", "baz"), differs.Path)
+
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+	patchPlan.Clean(nil)
+
+	info, err := os.Stat(filepath.Join(dstpath, "foo", "bar"))
+	assert.T(t, err == nil)
+	assert.Equal(t, uint32(0600), info.Mode&07777)
+	_, err = os.Stat(filepath.Join(dstpath, "foo", "extra"))
+	assert.T(t, err == nil)
+}
+
+func TestSetModeNew(t *testing.T) {
+	DoTestSetModeNew(t, mkMemRepo)
+}
+
+func TestDbSetModeNew(t *testing.T) {
+	DoTestSetModeNew(t, mkDbRepo)
+}
+
+func DoTestSetModeNew(t *testing.T, mkrepo repoMaker) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar",
+			tg.D("aleph",
+				tg.F("A", tg.B(42, 65537)),
+				tg.F("a", tg.B(42, 65537)))))
+	srcpath := treegen.TestTree(t, treeSpec)
+	os.Chmod(filepath.Join(srcpath, "foo", "bar", "aleph", "A"), 0765)
+	os.Chmod(filepath.Join(srcpath, "foo", "bar"), 0711)
+	defer os.RemoveAll(srcpath)
+	srcRepo := mkrepo(t)
+	defer srcRepo.Close()
+	srcStore, err := fs.NewLocalStore(srcpath, srcRepo)
+	assert.T(t, err == nil)
+
+	tg = treegen.New()
+	treeSpec = tg.D("foo")
+	dstpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(dstpath)
+	dstRepo := mkrepo(t)
+	defer dstRepo.Close()
+	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil, "%v", failedCmd)
+	assert.Tf(t, err == nil, "%v", err)
+
+	errors := make(chan os.Error)
+	go func() {
+		patchPlan.Clean(errors)
+		close(errors)
+	}()
+	for err := range errors {
+		assert.Tf(t, err == nil, "%v", err)
+	}
+
+	errors = make(chan os.Error)
+	go func() {
+		patchPlan.SetMode(errors)
+		close(errors)
+	}()
+	for err := range errors {
+		assert.Tf(t, err == nil, "%v", err)
+	}
+
+	fileinfo, err := os.Stat(filepath.Join(dstpath, "foo", "bar", "aleph", "A"))
+	assert.T(t, fileinfo != nil)
+	assert.Equal(t, uint32(0765), fileinfo.Permission())
+
+	fileinfo, err = os.Stat(filepath.Join(dstpath, "foo", "bar"))
+	assert.T(t, fileinfo != nil)
+	assert.Equal(t, uint32(0711), fileinfo.Permission())
+}
+
+// Test that modification times of patched files and created
+// directories are set to match the source.
+func TestSetTimes(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("same", tg.B(42, 65537)),
+		tg.F("changed", tg.B(43, 65537)),
+		tg.D("new", tg.F("baz", tg.B(44, 65537))))
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+	const mtime = int64(1234567890) * 1e9
+	for _, relpath := range []string{"foo/changed", "foo/new/baz", "foo/new"} {
+		assert.T(t, os.Chtimes(filepath.Join(srcpath, relpath), mtime, mtime) == nil)
+	}
+
+	tg = treegen.New()
+	treeSpec = tg.D("foo",
+		tg.F("same", tg.B(42, 65537)),
+		tg.F("changed", tg.B(45, 65537)))
+	dstpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(dstpath)
+
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	errors := make(chan os.Error)
+	go func() {
+		patchPlan.Clean(errors)
+		patchPlan.SetTimes(errors)
+		close(errors)
+	}()
+	for err := range errors {
+		assert.Tf(t, err == nil, "%v", err)
+	}
+
+	for _, relpath := range []string{"foo/changed", "foo/new/baz", "foo/new"} {
+		fileinfo, err := os.Stat(filepath.Join(dstpath, relpath))
+		assert.Tf(t, err == nil, "%v", err)
+		assert.Equalf(t, mtime, fileinfo.Mtime_ns, "%s", relpath)
+	}
+
+	// Nothing more to change
+	assert.Equal(t, 0, len(patchPlan.SetTimes(nil)))
+}
+
+// Test that ownership is set to match the source. Only root can
+// give files away, so the test needs root to see any change.
+func TestSetOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Logf("Not root, ownership cannot be changed")
+		return
+	}
+
+	tg := treegen.New()
+	treeSpec := tg.D("foo", tg.D("bar", tg.F("baz", tg.B(42, 65537))))
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+	assert.T(t, os.Chown(filepath.Join(srcpath, "foo", "bar", "baz"), 12345, 23456) == nil)
+	assert.T(t, os.Chown(filepath.Join(srcpath, "foo", "bar"), 0, 23456) == nil)
+	dstpath := treegen.TestTree(t, tg.D("foo"))
+	defer os.RemoveAll(dstpath)
+
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	errors := make(chan os.Error)
+	var changes []*OwnerChange
+	go func() {
+		changes = patchPlan.SetOwner(errors)
+		close(errors)
+	}()
+	for err := range errors {
+		assert.Tf(t, err == nil, "%v", err)
+	}
+	assert.Equal(t, 2, len(changes))
+
+	fileinfo, err := os.Stat(filepath.Join(dstpath, "foo", "bar", "baz"))
+	assert.T(t, fileinfo != nil)
+	assert.Equal(t, 12345, fileinfo.Uid)
+	assert.Equal(t, 23456, fileinfo.Gid)
+
+	fileinfo, err = os.Stat(filepath.Join(dstpath, "foo", "bar"))
+	assert.T(t, fileinfo != nil)
+	assert.Equal(t, 0, fileinfo.Uid)
+	assert.Equal(t, 23456, fileinfo.Gid)
+
+	// Nothing more to change
+	assert.Equal(t, 0, len(patchPlan.SetOwner(nil)))
+}
+
+// Test that extended attributes are set to match the source,
+// where the file system supports them.
+func TestSetXattr(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo", tg.F("bar", tg.B(42, 65537)))
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(dstpath)
+
+	srcBar := filepath.Join(srcpath, "foo", "bar")
+	dstBar := filepath.Join(dstpath, "foo", "bar")
+	if err := fs.SetXattr(srcBar, "user.replican", []byte("src")); err != nil {
+		t.Logf("Extended attributes not supported here: %v", err)
+		return
+	}
+	assert.T(t, fs.SetXattr(dstBar, "user.stale", []byte("dst")) == nil)
+	assert.T(t, fs.SetXattr(filepath.Join(srcpath, "foo"), "user.dir", []byte("d")) == nil)
+
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	assert.T(t, srcStore.SetXattrs(true) == nil)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	errors := make(chan os.Error)
+	var changes []*XattrChange
+	go func() {
+		changes = patchPlan.SetXattr(errors)
+		close(errors)
+	}()
+	for err := range errors {
+		assert.Tf(t, err == nil, "%v", err)
+	}
+	assert.Equalf(t, 3, len(changes), "%v", changes)
+
+	xattrs, err := fs.ReadXattrs(dstBar)
+	assert.T(t, err == nil)
+	assert.Equal(t, 1, len(xattrs))
+	assert.Equal(t, "src", string(xattrs["user.replican"]))
+	xattrs, err = fs.ReadXattrs(filepath.Join(dstpath, "foo"))
+	assert.T(t, err == nil)
+	assert.Equal(t, "d", string(xattrs["user.dir"]))
+
+	// Nothing more to change
+	changes = patchPlan.SetXattr(nil)
+	assert.Equal(t, 0, len(changes))
+}
+
+// Encode an access ACL giving uid read and write, as Linux keeps it.
+func userAcl(uid uint32) []byte {
+	const undefined = 0xffffffff
+	buf := make([]byte, 4+5*8)
+	binary.LittleEndian.PutUint32(buf, 2)
+	for i, entry := range []struct {
+		tag  uint16
+		perm uint16
+		id   uint32
+	}{{0x01, 6, undefined}, {0x02, 6, uid}, {0x04, 4, undefined}, {0x10, 6, undefined}, {0x20, 4, undefined}} {
+		binary.LittleEndian.PutUint16(buf[4+i*8:], entry.tag)
+		binary.LittleEndian.PutUint16(buf[6+i*8:], entry.perm)
+		binary.LittleEndian.PutUint32(buf[8+i*8:], entry.id)
+	}
+	return buf
+}
+
+// Test that POSIX ACLs are applied after executing a plan,
+// where the file system supports them.
+func TestApplyACL(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo", tg.F("bar", tg.B(42, 65537)))
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo", tg.F("baz", tg.B(43, 65537))))
+	defer os.RemoveAll(dstpath)
+
+	srcAcls := &fs.Acls{Access: userAcl(12345)}
+	if err := fs.WriteAcls(filepath.Join(srcpath, "foo", "bar"), srcAcls); err != nil {
+		t.Logf("POSIX ACLs not supported here: %v", err)
+		return
+	}
+
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	assert.T(t, srcStore.SetAcls(true) == nil)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlanOpts(srcStore, dstStore, &PlanOptions{Acls: true})
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	dstAcls, err := fs.ReadAcls(filepath.Join(dstpath, "foo", "bar"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, srcAcls.Equal(dstAcls))
+
+	// Nothing more to change
+	assert.Equal(t, 0, len(patchPlan.ApplyACL(nil)))
+}
+
+func TestSetModeOverwrite(t *testing.T) {
+	DoTestSetModeOverwrite(t, mkMemRepo)
+}
+
+func TestDbSetModeOverwrite(t *testing.T) {
+	DoTestSetModeOverwrite(t, mkDbRepo)
+}
+
+func DoTestSetModeOverwrite(t *testing.T, mkrepo repoMaker) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar",
+			tg.D("aleph",
+				tg.F("A", tg.B(42, 65537)),
+				tg.F("a", tg.B(42, 65537)))))
+	srcpath := treegen.TestTree(t, treeSpec)
+	os.Chmod(filepath.Join(srcpath, "foo", "bar", "aleph", "A"), 0765)
+	os.Chmod(filepath.Join(srcpath, "foo", "bar"), 0711)
+	defer os.RemoveAll(srcpath)
+	srcRepo := mkrepo(t)
+	defer srcRepo.Close()
+	srcStore, err := fs.NewLocalStore(srcpath, srcRepo)
+	assert.T(t, err == nil)
+
+	tg = treegen.New()
+	treeSpec = tg.D("foo",
+		tg.D("bar",
+			tg.D("aleph",
+				tg.F("A", tg.B(42, 65537)),
+				tg.F("a", tg.B(42, 65537)))))
+	dstpath := treegen.TestTree(t, treeSpec)
+	os.Chmod(filepath.Join(dstpath, "foo", "bar", "aleph", "A"), 0600)
+	os.Chmod(filepath.Join(dstpath, "foo", "bar"), 0700)
+	defer os.RemoveAll(dstpath)
+	dstRepo := mkrepo(t)
+	defer dstRepo.Close()
+	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil, "%v %v", failedCmd, err)
+	assert.Tf(t, err == nil, "%v", err)
+
+	errors := make(chan os.Error)
+	go func() {
+		patchPlan.Clean(errors)
+		close(errors)
+	}()
+	for err := range errors {
+		assert.Tf(t, err == nil, "%v", err)
+	}
+
+	var changes []*ModeChange
+	errors = make(chan os.Error)
+	go func() {
+		changes = patchPlan.SetMode(errors)
+		close(errors)
+	}()
+	for err := range errors {
+		assert.Tf(t, err == nil, "%v", err)
+	}
+
+	// Only the entries with different permissions are changed
+	assert.Equalf(t, 2, len(changes), "%v", changes)
+	for _, change := range changes {
+		switch change.Path {
+		case filepath.Join("foo", "bar", "aleph", "A"):
+			assert.Equal(t, uint32(0600), change.From)
+			assert.Equal(t, uint32(0765), change.To)
+		case filepath.Join("foo", "bar"):
+			assert.Equal(t, uint32(0700), change.From)
+			assert.Equal(t, uint32(0711), change.To)
+		default:
+			t.Errorf("unexpected mode change: %v", change)
+		}
+	}
+
+	fileinfo, err := os.Stat(filepath.Join(dstpath, "foo", "bar", "aleph", "A"))
+	assert.T(t, fileinfo != nil)
+	assert.Equal(t, uint32(0765), fileinfo.Permission())
+
+	fileinfo, err = os.Stat(filepath.Join(dstpath, "foo", "bar"))
+	assert.T(t, fileinfo != nil)
+	assert.Equal(t, uint32(0711), fileinfo.Permission())
+}
+
+func TestKeepCompareMeta(t *testing.T) {
+	DoTestKeepCompareMeta(t, mkMemRepo)
+}
+
+func TestDbKeepCompareMeta(t *testing.T) {
+	DoTestKeepCompareMeta(t, mkDbRepo)
+}
+
+func DoTestKeepCompareMeta(t *testing.T, mkrepo repoMaker) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.F("baz", tg.B(43, 65537)))
+	srcpath := treegen.TestTree(t, treeSpec)
+	os.Chmod(filepath.Join(srcpath, "foo", "bar"), 0765)
+	defer os.RemoveAll(srcpath)
+	srcRepo := mkrepo(t)
+	defer srcRepo.Close()
+	srcStore, err := fs.NewLocalStore(srcpath, srcRepo)
+	assert.T(t, err == nil)
+
+	dstpath := treegen.TestTree(t, treeSpec)
+	os.Chmod(filepath.Join(dstpath, "foo", "bar"), 0600)
+	defer os.RemoveAll(dstpath)
+	dstRepo := mkrepo(t)
+	defer dstRepo.Close()
+	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
+	assert.T(t, err == nil)
+
+	// Without metadata comparison, bar is left alone
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+	for _, cmd := range patchPlan.Cmds {
+		_, isSetMeta := cmd.(*SetMeta)
+		assert.Tf(t, !isSetMeta, "unexpected %v", cmd)
+	}
+
+	patchPlan = NewPatchPlanOpts(srcStore, dstStore, &PlanOptions{CompareMeta: true})
+	//	printPlan(patchPlan)
+
+	nSetMeta := 0
+	for _, cmd := range patchPlan.Cmds {
+		if setMeta, is := cmd.(*SetMeta); is {
+			if strings.HasSuffix(setMeta.Path.Resolve(), filepath.Join("foo", "bar")) {
+				assert.Equal(t, uint32(0765), setMeta.Mode&07777)
+			}
+			nSetMeta++
+		}
+	}
+	assert.T(t, nSetMeta > 0)
+
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	fileinfo, err := os.Stat(filepath.Join(dstpath, "foo", "bar"))
+	assert.T(t, fileinfo != nil)
+	assert.Equal(t, uint32(0765), fileinfo.Permission())
+
+	srcinfo, err := os.Stat(filepath.Join(srcpath, "foo", "baz"))
+	assert.T(t, srcinfo != nil)
+	fileinfo, err = os.Stat(filepath.Join(dstpath, "foo", "baz"))
+	assert.T(t, fileinfo != nil)
+	assert.Equal(t, srcinfo.Mtime_ns, fileinfo.Mtime_ns)
+}
+
+// Test that content-identical files which differ only in modification
+// time are touched, rather than having all their metadata set.
+func TestTouchCompareMeta(t *testing.T) {
+	DoTestTouchCompareMeta(t, mkMemRepo)
+}
+
+func TestDbTouchCompareMeta(t *testing.T) {
+	DoTestTouchCompareMeta(t, mkDbRepo)
+}
+
+func DoTestTouchCompareMeta(t *testing.T, mkrepo repoMaker) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo", tg.F("bar", tg.B(42, 65537)))
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+	srcRepo := mkrepo(t)
+	defer srcRepo.Close()
+	srcStore, err := fs.NewLocalStore(srcpath, srcRepo)
+	assert.T(t, err == nil)
+
+	dstpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(dstpath)
+	barPath := filepath.Join(dstpath, "foo", "bar")
+	os.Chtimes(barPath, 1000000000, 1000000000)
+	dstRepo := mkrepo(t)
+	defer dstRepo.Close()
+	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlanOpts(srcStore, dstStore, &PlanOptions{CompareMeta: true})
+	nTouch := 0
+	for _, cmd := range patchPlan.Cmds {
+		_, isSetMeta := cmd.(*SetMeta)
+		assert.Tf(t, !isSetMeta, "unexpected %v", cmd)
+		if touch, is := cmd.(*Touch); is {
+			assert.T(t, !touch.Empty)
+			assert.Equal(t, barPath, touch.Path.Resolve())
+			nTouch++
+		}
+	}
+	assert.Equal(t, 1, nTouch)
+
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	srcinfo, err := os.Stat(filepath.Join(srcpath, "foo", "bar"))
+	assert.T(t, srcinfo != nil)
+	fileinfo, err := os.Stat(barPath)
+	assert.T(t, fileinfo != nil)
+	assert.Equal(t, srcinfo.Mtime_ns, fileinfo.Mtime_ns)
+	assert.Equal(t, int64(65537), fileinfo.Size)
+}
+
+func TestTransferCopyMeta(t *testing.T) {
+	DoTestTransferCopyMeta(t, mkMemRepo)
+}
+
+func TestDbTransferCopyMeta(t *testing.T) {
+	DoTestTransferCopyMeta(t, mkDbRepo)
+}
+
+func DoTestTransferCopyMeta(t *testing.T, mkrepo repoMaker) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.F("baz", tg.B(42, 65537)))
+
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+	srcRepo := mkrepo(t)
+	defer srcRepo.Close()
+	srcStore, err := fs.NewLocalStore(srcpath, srcRepo)
+	assert.T(t, err == nil)
+
+	tg = treegen.New()
+	treeSpec = tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)))
+
+	dstpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(dstpath)
+	barPath := filepath.Join(dstpath, "foo", "bar")
+	os.Chmod(barPath, 0751)
+	os.Chtimes(barPath, 1000000000, 1000000000)
+	dstRepo := mkrepo(t)
+	defer dstRepo.Close()
+	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+	//	printPlan(patchPlan)
+
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	// Both copies carry bar's metadata
+	for _, name := range []string{"bar", "baz"} {
+		fileinfo, err := os.Stat(filepath.Join(dstpath, "foo", name))
+		assert.Tf(t, fileinfo != nil, "%v", err)
+		assert.Equal(t, uint32(0751), fileinfo.Permission())
+		assert.Equal(t, int64(1000000000), fileinfo.Mtime_ns)
+	}
+}
+
+func TestPatchSwap(t *testing.T) {
+	DoTestPatchSwap(t, mkMemRepo)
+}
+
+func TestDbPatchSwap(t *testing.T) {
+	DoTestPatchSwap(t, mkDbRepo)
+}
+
+// Test patching where files in the destination have swapped names.
+func DoTestPatchSwap(t *testing.T, mkrepo repoMaker) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("a", tg.B(42, 65537)),
+		tg.F("b", tg.B(43, 65537)))
+
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+	srcRepo := mkrepo(t)
+	defer srcRepo.Close()
+	srcStore, err := fs.NewLocalStore(srcpath, srcRepo)
+	assert.T(t, err == nil)
+
+	tg = treegen.New()
+	treeSpec = tg.D("foo",
+		tg.F("a", tg.B(43, 65537)),
+		tg.F("b", tg.B(42, 65537)))
+
+	dstpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(dstpath)
+	dstRepo := mkrepo(t)
+	defer dstRepo.Close()
+	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+	//	printPlan(patchPlan)
+
+	// One hop aside, then the two renames
+	nTransfers := 0
+	for _, cmd := range patchPlan.Cmds {
+		if _, is := cmd.(*Transfer); is {
+			nTransfers++
+		}
+	}
+	assert.Equal(t, 3, nTransfers)
+
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	assertNoRelocs(t, filepath.Join(dstpath, "foo"))
+
+	srcDir, errors := fs.IndexDir(srcpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	dstDir, errors := fs.IndexDir(dstpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, srcDir.Info().Strong, dstDir.Info().Strong)
+}
+
+func TestPatchRotate(t *testing.T) {
+	DoTestPatchRotate(t, mkMemRepo)
+}
+
+func TestDbPatchRotate(t *testing.T) {
+	DoTestPatchRotate(t, mkDbRepo)
+}
+
+// Test patching where names have been rotated through three files,
+// one of which is also copied elsewhere.
+func DoTestPatchRotate(t *testing.T, mkrepo repoMaker) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("a", tg.B(42, 65537)),
+		tg.F("b", tg.B(43, 65537)),
+		tg.F("c", tg.B(44, 65537)),
+		tg.D("bar",
+			tg.F("d", tg.B(43, 65537))))
+
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+	srcRepo := mkrepo(t)
+	defer srcRepo.Close()
+	srcStore, err := fs.NewLocalStore(srcpath, srcRepo)
+	assert.T(t, err == nil)
+
+	tg = treegen.New()
+	treeSpec = tg.D("foo",
+		tg.F("a", tg.B(43, 65537)),
+		tg.F("b", tg.B(44, 65537)),
+		tg.F("c", tg.B(42, 65537)),
+		tg.D("bar"))
+
+	dstpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(dstpath)
+	dstRepo := mkrepo(t)
+	defer dstRepo.Close()
+	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+	//	printPlan(patchPlan)
+
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	assertNoRelocs(t, filepath.Join(dstpath, "foo"))
+
+	srcDir, errors := fs.IndexDir(srcpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	dstDir, errors := fs.IndexDir(dstpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, srcDir.Info().Strong, dstDir.Info().Strong)
+}
+
+// Test that identical inputs produce identical plans,
+// regardless of the repository holding the index.
+func TestPlanDeterminism(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar",
+			tg.F("A", tg.B(42, 65537)),
+			tg.F("b", tg.B(43, 65537)),
+			tg.F("C", tg.B(44, 65537))),
+		tg.F("baz", tg.B(45, 65537)))
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+
+	tg = treegen.New()
+	treeSpec = tg.D("foo",
+		tg.D("bar",
+			tg.F("C", tg.B(42, 65537)),
+			tg.F("a", tg.B(43, 65537))),
+		tg.F("baz", tg.B(44, 65537)),
+		tg.F("blop", tg.B(46, 65537)))
+	dstpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(dstpath)
+
+	plans := []string{}
+	for _, mkrepo := range []repoMaker{mkMemRepo, mkDbRepo, mkMemRepo} {
+		srcRepo := mkrepo(t)
+		defer srcRepo.Close()
+		srcStore, err := fs.NewLocalStore(srcpath, srcRepo)
+		assert.T(t, err == nil)
+
+		dstRepo := mkrepo(t)
+		defer dstRepo.Close()
+		dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
+		assert.T(t, err == nil)
+
+		patchPlan := NewPatchPlan(srcStore, dstStore)
+		plans = append(plans, patchPlan.String())
+	}
+
+	for i := 1; i < len(plans); i++ {
+		assert.Equal(t, plans[0], plans[i])
+	}
+}
+
+func TestExecContext(t *testing.T) {
+	DoTestExecContext(t, mkMemRepo)
+}
+
+func TestDbExecContext(t *testing.T) {
+	DoTestExecContext(t, mkDbRepo)
+}
+
+// Test executing a plan against a copy of the destination it was planned with.
+func DoTestExecContext(t *testing.T, mkrepo repoMaker) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(42, 65537), tg.B(43, 65537)),
+		tg.F("baz", tg.B(44, 65537)))
+
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+	srcRepo := mkrepo(t)
+	defer srcRepo.Close()
+	srcStore, err := fs.NewLocalStore(srcpath, srcRepo)
+	assert.T(t, err == nil)
+
+	tg = treegen.New()
+	treeSpec = tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.F("blop", tg.B(44, 65537)))
+
+	dstpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(dstpath)
+	dstRepo := mkrepo(t)
+	defer dstRepo.Close()
+	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
+	assert.T(t, err == nil)
+
+	copypath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(copypath)
+	copyStore, err := fs.NewLocalStore(copypath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+
+	executed := []PatchCmd{}
+	failedCmd, err := patchPlan.ExecWith(&ExecContext{
+		Src: srcStore,
+		Dst: copyStore,
+		Progress: func(cmd PatchCmd) {
+			executed = append(executed, cmd)
+		}})
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+	assert.Equal(t, len(patchPlan.Cmds), len(executed))
+
+	srcDir, errors := fs.IndexDir(srcpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	copyDir, errors := fs.IndexDir(copypath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	for _, path := range []string{"foo/bar", "foo/baz"} {
+		srcNode, has := fs.Lookup(srcDir, path)
+		assert.T(t, has)
+		copyNode, has := fs.Lookup(copyDir, path)
+		assert.Tf(t, has, "%s not patched in copy", path)
+		assert.Equal(t,
+			srcNode.(fs.File).Info().Strong,
+			copyNode.(fs.File).Info().Strong)
+	}
+
+	// The original destination is untouched
+	_, err = os.Stat(filepath.Join(dstpath, "foo", "blop"))
+	assert.T(t, err == nil)
+}
+
+// Test that each stage of indexing, planning and patching publishes events.
+// Counts the ranges read from a provider, safely across goroutines.
+type rangeCounter struct {
+	fs.BlockProvider
+	ranges chan bool
+}
+
+func (rc *rangeCounter) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	rc.ranges <- true
+	return rc.BlockProvider.ReadInto(strong, from, length, writer)
+}
+
+// Test that a large file is downloaded in parts read concurrently.
+func TestRangeWorkers(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 100000))))
+	defer os.RemoveAll(srcpath)
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	tg = treegen.New()
+	dstpath := treegen.TestTree(t, tg.D("foo"))
+	defer os.RemoveAll(dstpath)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	counter := &rangeCounter{BlockProvider: srcStore, ranges: make(chan bool, 100)}
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+	failedCmd, err := patchPlan.ExecWith(&ExecContext{
+		Src:          counter,
+		RangeSize:    16384,
+		RangeWorkers: 4})
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+	assert.Equal(t, 7, len(counter.ranges))
+
+	srcRoot, errors := fs.IndexDir(srcpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	dstRoot, errors := fs.IndexDir(dstpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, srcRoot.Info().Strong, dstRoot.Info().Strong)
+}
+
+func TestEvents(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.F("baz", tg.B(43, 65537)))
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+
+	tg = treegen.New()
+	treeSpec = tg.D("foo",
+		tg.D("bar", tg.F("blop", tg.B(44, 65537))),
+		tg.F("baz", tg.B(44, 65537)))
+	dstpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(dstpath)
+
+	counts := make(map[string]int)
+	id := events.Subscribe(func(event events.Event) {
+		counts[fmt.Sprintf("%T", event)]++
+	})
+	defer events.Unsubscribe(id)
+
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	assert.Equal(t, 2, counts["*events.IndexStarted"])
+	assert.Equal(t, 4, counts["*events.FileHashed"])
+	assert.Equal(t, 1, counts["*events.PlanReady"])
+	assert.Equal(t, len(patchPlan.Cmds), counts["*events.CmdExecuted"])
+	assert.Equal(t, 1, counts["*events.ConflictFound"])
+	assert.Equal(t, 1, counts["*events.SyncFinished"])
+}
+
+// Test that an explained plan gives the reason for each command.
+func TestExplain(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(42, 65537), tg.B(43, 65537)),
+		tg.F("baz", tg.B(44, 65537)),
+		tg.D("blop"))
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+
+	tg = treegen.New()
+	treeSpec = tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.F("blip", tg.B(44, 65537)),
+		tg.F("blop", tg.B(45, 65537)),
+		tg.F("gone", tg.B(46, 65537)))
+	dstpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(dstpath)
+
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlanOpts(srcStore, dstStore, &PlanOptions{Explain: true})
+	for _, cmd := range patchPlan.Cmds {
+		assert.Tf(t, patchPlan.Reason(cmd) != "", "no reason for %v", cmd)
+
+		switch cmd.(type) {
+		case *Transfer:
+			assert.T(t, strings.Contains(patchPlan.Reason(cmd), "foo/blip"))
+		case *LocalTemp:
+			assert.T(t, strings.Contains(patchPlan.Reason(cmd), "blocks found in the destination file"))
+		case *Conflict:
+			assert.T(t, strings.Contains(patchPlan.Reason(cmd), "destination has a file"))
+		}
+	}
+
+	explained := patchPlan.Explain()
+	assert.T(t, strings.Contains(explained, "Delete foo/gone"))
+
+	// Reasons are only kept when asked for
+	patchPlan = NewPatchPlan(srcStore, dstStore)
+	assert.Equal(t, "", patchPlan.Reason(patchPlan.Cmds[0]))
+}
+
+// Test that commands are refused paths which resolve outside the destination.
+func TestOutsideRoot(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo", tg.F("bar", tg.B(42, 65537)))
+	dstpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(dstpath)
+
+	dstStore, err := fs.NewLocalStore(filepath.Join(dstpath, "foo"), fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	ctx := &ExecContext{Dst: dstStore}
+	for _, cmd := range []PatchCmd{
+		&Transfer{
+			From: &LocalPath{LocalStore: dstStore, RelPath: "bar"},
+			To:   &LocalPath{LocalStore: dstStore, RelPath: "../baz"}},
+		&Resize{Path: &LocalPath{LocalStore: dstStore, RelPath: "../../bar"}, Size: 0},
+		&SetMeta{Path: AbsolutePath(filepath.Join(dstpath, "bar")), Uid: -1, Gid: -1}} {
+		err = ctx.Exec(cmd)
+		assert.Tf(t, err != nil, "%v allowed", cmd)
+		assert.Tf(t, strings.Contains(err.String(), "outside of destination"), "%v", err)
+	}
+
+	// Nothing was touched
+	_, err = os.Stat(filepath.Join(dstpath, "foo", "bar"))
+	assert.T(t, err == nil)
+	_, err = os.Stat(filepath.Join(dstpath, "baz"))
+	assert.T(t, err != nil)
+
+	err = ctx.Exec(&Resize{Path: &LocalPath{LocalStore: dstStore, RelPath: "bar"}, Size: 0})
+	assert.Tf(t, err == nil, "%v", err)
+}
+
+// Test that a confined context will not follow a link out of the destination.
+func TestConfine(t *testing.T) {
+	tg := treegen.New()
+	dstpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(dstpath)
+	outside := treegen.TestTree(t, tg.F("victim", tg.B(43, 65537)))
+	defer os.RemoveAll(outside)
+
+	err := os.Symlink(outside, filepath.Join(dstpath, "foo", "link"))
+	assert.Tf(t, err == nil, "%v", err)
+
+	dstStore, err := fs.NewLocalStore(filepath.Join(dstpath, "foo"), fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	ctx := &ExecContext{Dst: dstStore, Confine: true}
+	err = ctx.Exec(&Resize{Path: &LocalPath{LocalStore: dstStore, RelPath: "link/victim"}, Size: 0})
+	assert.T(t, err != nil)
+
+	// Nor remove, rename or change the metadata of anything through it
+	err = ctx.Exec(&Delete{Path: &LocalPath{LocalStore: dstStore, RelPath: "link/victim"}})
+	assert.T(t, err != nil)
+	err = ctx.Exec(&Transfer{
+		From: &LocalPath{LocalStore: dstStore, RelPath: "link/victim"},
+		To:   &LocalPath{LocalStore: dstStore, RelPath: "moved"}})
+	assert.T(t, err != nil)
+	err = os.Symlink(filepath.Join(outside, "victim"), filepath.Join(dstpath, "foo", "filelink"))
+	assert.Tf(t, err == nil, "%v", err)
+	err = ctx.Exec(&SetMeta{Path: &LocalPath{LocalStore: dstStore, RelPath: "filelink"}, Mode: 0600, HasMode: true, Uid: -1, Gid: -1})
+	assert.T(t, err != nil)
+
+	fi, err := os.Stat(filepath.Join(outside, "victim"))
+	assert.T(t, err == nil)
+	assert.Equal(t, int64(65537), fi.Size)
+	assert.T(t, fi.Mode&0777 != 0600)
+
+	// The link itself may still be removed
+	err = ctx.Exec(&Delete{Path: &LocalPath{LocalStore: dstStore, RelPath: "filelink"}})
+	assert.Tf(t, err == nil, "%v", err)
+
+	err = ctx.Exec(&Resize{Path: &LocalPath{LocalStore: dstStore, RelPath: "bar"}, Size: 0})
+	assert.Tf(t, err == nil, "%v", err)
+}
+
+// Test that blocks of zeros are neither transferred nor written,
+// so that a sparse source file stays sparse in the destination.
+func TestPatchSparse(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo"))
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo", tg.F("image", tg.B(43, 65536))))
+	defer os.RemoveAll(dstpath)
+
+	blocksize := fs.BLOCKSIZE
+	content := make([]byte, 64*blocksize)
+	for i := 0; i < blocksize; i++ {
+		content[i] = byte(i)
+		content[len(content)-blocksize+i] = byte(i)
+	}
+	err := ioutil.WriteFile(filepath.Join(srcpath, "foo", "image"), content, 0644)
+	assert.T(t, err == nil)
+
+	srcStore, err := fs.NewLocalStore(filepath.Join(srcpath, "foo"), fs.NewMemRepo())
+	assert.T(t, err == nil)
+	dstStore, err := fs.NewLocalStore(filepath.Join(dstpath, "foo"), fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+	for _, cmd := range patchPlan.Cmds {
+		switch c := cmd.(type) {
+		case *SrcBlockCopy:
+			assert.Tf(t, c.SrcStrong != fs.ZERO_STRONG, "%v", c)
+		case *SrcTempCopy:
+			assert.Tf(t, c.TempOffset == 0 || c.TempOffset >= int64(len(content)-blocksize), "%v", c)
+		}
+	}
+
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	literal, _ := patchPlan.Transferred()
+	assert.Equal(t, int64(2*blocksize), literal)
+
+	dstContent, err := ioutil.ReadFile(filepath.Join(dstpath, "foo", "image"))
+	assert.T(t, err == nil)
+	assert.Equal(t, fs.StrongChecksum(content), fs.StrongChecksum(dstContent))
+
+	fi, err := os.Stat(filepath.Join(dstpath, "foo", "image"))
+	assert.T(t, err == nil)
+	assert.Tf(t, fi.Blocks*512 < fi.Size, "%d of %d bytes allocated", fi.Blocks*512, fi.Size)
+}
+
+// Test patching a file indexed in blocks larger than the default.
+func TestPatchBlockSize(t *testing.T) {
+	const blocksize = 1 << 16
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo", tg.F("media",
+		tg.B(42, blocksize), tg.B(43, blocksize), tg.B(44, blocksize), tg.B(45, 100))))
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo", tg.F("media",
+		tg.B(42, blocksize), tg.B(46, blocksize), tg.B(44, blocksize))))
+	defer os.RemoveAll(dstpath)
+
+	// The block size can be given to the repo before indexing,
+	// or to the store afterwards.
+	srcRepo := fs.NewMemRepo()
+	srcRepo.SetBlockSize(blocksize)
+	srcStore, err := fs.NewLocalStore(filepath.Join(srcpath, "foo"), srcRepo)
+	assert.T(t, err == nil)
+	assert.Equal(t, blocksize, srcStore.BlockSize())
+	dstStore, err := fs.NewLocalStore(filepath.Join(dstpath, "foo"), fs.NewMemRepo())
+	assert.T(t, err == nil)
+	assert.T(t, dstStore.SetBlockSize(blocksize) == nil)
+
+	srcFile := srcStore.Repo().Root().(fs.Dir).Files()[0]
+	assert.Equal(t, 4, len(srcFile.Blocks()))
+	assert.Equal(t, int64(blocksize), fs.FileBlockSize(srcFile))
+	assert.Equal(t, int64(3*blocksize), srcFile.Blocks()[3].Info().Offset())
+
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+	localCopies := 0
+	for _, cmd := range patchPlan.Cmds {
+		if ltc, is := cmd.(*LocalTempCopy); is {
+			localCopies++
+			assert.Equal(t, int64(blocksize), ltc.Length)
+		}
+	}
+	assert.Equal(t, 2, localCopies)
+
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+	literal, _ := patchPlan.Transferred()
+	assert.Equal(t, int64(blocksize+100), literal)
+
+	srcRoot, errors := fs.IndexDir(filepath.Join(srcpath, "foo"), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	dstRoot, errors := fs.IndexDir(filepath.Join(dstpath, "foo"), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, srcRoot.Info().Strong, dstRoot.Info().Strong)
+}
+
+func TestPatchChunking(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo", tg.F("data",
+		tg.B(42, 100000), tg.B(43, 7), tg.B(44, 100000))))
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo", tg.F("data",
+		tg.B(42, 100000), tg.B(44, 100000))))
+	defer os.RemoveAll(dstpath)
+
+	srcRepo := fs.NewMemRepo()
+	srcRepo.SetChunking(fs.CHUNK_CONTENT)
+	srcStore, err := fs.NewLocalStore(filepath.Join(srcpath, "foo"), srcRepo)
+	assert.T(t, err == nil)
+	assert.Equal(t, fs.CHUNK_CONTENT, srcStore.Chunking())
+	dstStore, err := fs.NewLocalStore(filepath.Join(dstpath, "foo"), fs.NewMemRepo())
+	assert.T(t, err == nil)
+	assert.T(t, dstStore.SetChunking(fs.CHUNK_CONTENT) == nil)
+
+	// Blocks vary in size, and cover the file end to end.
+	srcFile := srcStore.Repo().Root().(fs.Dir).Files()[0]
+	assert.T(t, fs.IsChunked(srcFile))
+	var offset int64
+	sizes := make(map[int64]bool)
+	for _, block := range srcFile.Blocks() {
+		assert.Equal(t, offset, block.Info().Offset())
+		offset += block.Info().Size()
+		sizes[block.Info().Size()] = true
+	}
+	assert.Equal(t, srcFile.Info().Size, offset)
+	assert.T(t, len(sizes) > 1)
+
+	// Only the blocks around the insertion are sent.
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+	literal, _ := patchPlan.Transferred()
+	assert.Tf(t, literal < srcFile.Info().Size/2, "%d bytes sent", literal)
+
+	srcRoot, errors := fs.IndexDir(filepath.Join(srcpath, "foo"), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	dstRoot, errors := fs.IndexDir(filepath.Join(dstpath, "foo"), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, srcRoot.Info().Strong, dstRoot.Info().Strong)
+}
+
+// Test that a destination hashed differently from the source is reindexed
+// to match it, or the plan refused if it cannot be.
+func TestPatchHashMismatch(t *testing.T) {
+	const blocksize = 1 << 16
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo", tg.F("media",
+		tg.B(42, blocksize), tg.B(43, blocksize), tg.B(44, 100))))
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo", tg.F("media",
+		tg.B(42, blocksize), tg.B(44, 100))))
+	defer os.RemoveAll(dstpath)
+
+	srcRepo := fs.NewMemRepo()
+	srcRepo.SetBlockSize(blocksize)
+	srcStore, err := fs.NewLocalStore(filepath.Join(srcpath, "foo"), srcRepo)
+	assert.T(t, err == nil)
+	dstStore, err := fs.NewLocalStore(filepath.Join(dstpath, "foo"), fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, patchPlan.ParamsError() == nil, "%v", patchPlan.ParamsError())
+	assert.Equal(t, blocksize, dstStore.BlockSize())
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+	literal, _ := patchPlan.Transferred()
+	assert.Tf(t, literal < 2*blocksize, "%d bytes sent", literal)
+
+	// A DbRepo cannot hold blocks divided by content
+	assert.T(t, srcStore.SetChunking(fs.CHUNK_CONTENT) == nil)
+	dbRepo, err := sqlite3.NewDbRepo(":memory:")
+	assert.T(t, err == nil)
+	defer dbRepo.Close()
+	dbStore, err := fs.NewLocalStore(filepath.Join(dstpath, "foo"), dbRepo)
+	assert.T(t, err == nil)
+
+	patchPlan = NewPatchPlan(srcStore, dbStore)
+	mismatch, is := patchPlan.ParamsError().(*ErrHashMismatch)
+	assert.Tf(t, is, "%v", patchPlan.ParamsError())
+	assert.Equal(t, fs.CHUNK_CONTENT, mismatch.Src.Chunking)
+	_, err = patchPlan.Exec()
+	assert.Equal(t, mismatch, err)
+}
+
+func TestPatchLazyBlocks(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("same", tg.B(42, 65537)),
+		tg.F("changed", tg.B(43, 65537), tg.B(44, 7))))
+	defer os.RemoveAll(srcpath)
+	tg = treegen.New()
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("same", tg.B(42, 65537)),
+		tg.F("changed", tg.B(43, 65537))))
+	defer os.RemoveAll(dstpath)
+
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	eagerStrong := srcStore.Repo().Root().Info().Strong
+	assert.T(t, srcStore.SetLazyBlocks(true) == nil)
+	assert.Equal(t, eagerStrong, srcStore.Repo().Root().Info().Strong)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	_, sameBlocks, err := fs.IndexFile(filepath.Join(srcpath, "foo", "same"))
+	assert.T(t, err == nil)
+	_, changedBlocks, err := fs.IndexFile(filepath.Join(srcpath, "foo", "changed"))
+	assert.T(t, err == nil)
+	_, has := srcStore.Repo().Block(changedBlocks[0].Strong)
+	assert.T(t, !has)
+
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+	literal, _ := patchPlan.Transferred()
+	assert.Tf(t, literal < 65537, "%d bytes sent", literal)
+
+	// Only the file which differed was hashed in blocks
+	_, has = srcStore.Repo().Block(changedBlocks[0].Strong)
+	assert.T(t, has)
+	_, has = srcStore.Repo().Block(sameBlocks[0].Strong)
+	assert.T(t, !has)
+
+	dstRoot, errors := fs.IndexDir(dstpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, eagerStrong, dstRoot.Info().Strong)
+}
+
+func TestPatchOnDemand(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("same", tg.B(42, 65537)),
+		tg.F("changed", tg.B(43, 65537), tg.B(44, 7)),
+		tg.F("new", tg.B(45, 100))))
+	defer os.RemoveAll(srcpath)
+	tg = treegen.New()
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("same", tg.B(42, 65537)),
+		tg.F("changed", tg.B(43, 65537)),
+		tg.F("extra", tg.B(46, 100))))
+	defer os.RemoveAll(dstpath)
+	assert.T(t, treegen.Fab(dstpath, tg.D("other", tg.F("big", tg.B(47, 65537)))) == nil)
+
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	dstStore, err := fs.NewOnDemandStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	assert.T(t, dstStore.OnDemand())
+
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+	literal, _ := patchPlan.Transferred()
+	assert.Tf(t, literal < 65537, "%d bytes sent", literal)
+	patchPlan.Clean(nil)
+
+	// Only the directories the source touches were read
+	dstRoot := dstStore.Repo().Root().(fs.Dir)
+	_, has := fs.Lookup(dstRoot, filepath.Join("foo", "same"))
+	assert.T(t, has)
+	_, has = fs.Lookup(dstRoot, filepath.Join("other", "big"))
+	assert.T(t, !has)
+	_, err = os.Stat(filepath.Join(dstpath, "other", "big"))
+	assert.T(t, err == nil)
+
+	srcRoot, errors := fs.IndexDir(filepath.Join(srcpath, "foo"), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	dstFoo, errors := fs.IndexDir(filepath.Join(dstpath, "foo"), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, srcRoot.Info().Strong, dstFoo.Info().Strong)
+}
+
+// Test that links indexed as links are recreated as links.
+func TestPatchSymlinks(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(srcpath)
+	assert.T(t, os.Symlink("bar", filepath.Join(srcpath, "foo", "link")) == nil)
+	assert.T(t, os.Mkdir(filepath.Join(srcpath, "foo", "sub"), 0755) == nil)
+	assert.T(t, os.Symlink("../bar", filepath.Join(srcpath, "foo", "sub", "uplink")) == nil)
+
+	dstpath := treegen.TestTree(t, tg.D("foo", tg.F("link", tg.B(43, 100))))
+	defer os.RemoveAll(dstpath)
+
+	srcStore, err := fs.NewLocalStore(filepath.Join(srcpath, "foo"), fs.NewMemRepo())
+	assert.T(t, err == nil)
+	assert.T(t, srcStore.SetSymlinks(fs.SYMLINKS_STORE) == nil)
+	dstStore, err := fs.NewLocalStore(filepath.Join(dstpath, "foo"), fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+	links := 0
+	for _, cmd := range patchPlan.Cmds {
+		if _, is := cmd.(*CreateSymlink); is {
+			links++
+		}
+	}
+	assert.Equal(t, 2, links)
+
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	// Only bar is content; the link targets are not counted
+	report := NewExecReport(patchPlan, nil)
+	assert.Equal(t, int64(65537), report.Literal)
+	assert.Equal(t, int64(65537), report.Written)
+
+	target, err := os.Readlink(filepath.Join(dstpath, "foo", "link"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, "bar", target)
+
+	target, err = os.Readlink(filepath.Join(dstpath, "foo", "sub", "uplink"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, "../bar", target)
+}
+
+// Test that links are not created pointing outside of a confined destination.
+func TestConfineSymlinks(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(srcpath)
+	assert.T(t, os.Symlink("bar", filepath.Join(srcpath, "foo", "link")) == nil)
+	assert.T(t, os.Symlink("/etc/passwd", filepath.Join(srcpath, "foo", "abslink")) == nil)
+	assert.T(t, os.Mkdir(filepath.Join(srcpath, "foo", "sub"), 0755) == nil)
+	assert.T(t, os.Symlink("../bar", filepath.Join(srcpath, "foo", "sub", "uplink")) == nil)
+	assert.T(t, os.Symlink("../../bar", filepath.Join(srcpath, "foo", "sub", "outlink")) == nil)
+
+	dstpath := treegen.TestTree(t, tg.D("foo"))
+	defer os.RemoveAll(dstpath)
+
+	srcStore, err := fs.NewLocalStore(filepath.Join(srcpath, "foo"), fs.NewMemRepo())
+	assert.T(t, err == nil)
+	assert.T(t, srcStore.SetSymlinks(fs.SYMLINKS_STORE) == nil)
+	dstStore, err := fs.NewLocalStore(filepath.Join(dstpath, "foo"), fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	ctx := &ExecContext{Src: srcStore, Dst: dstStore, Confine: true}
+	allowed := map[string]bool{"link": true, "uplink": true, "abslink": false, "outlink": false}
+	links := 0
+	for _, cmd := range NewPatchPlan(srcStore, dstStore).Cmds {
+		cs, is := cmd.(*CreateSymlink)
+		if !is {
+			continue
+		}
+		links++
+		name := filepath.Base(cs.Path.Resolve())
+		err := ctx.Exec(cs)
+		assert.Tf(t, (err == nil) == allowed[name], "%s: %v", name, err)
+		_, err = os.Lstat(ctx.Resolve(cs.Path))
+		assert.Tf(t, (err == nil) == allowed[name], "%s: %v", name, err)
+	}
+	assert.Equal(t, 4, links)
+}
+
+// Test that a source file truncated after planning is planned again,
+// rather than failing the sync.
+func TestSourceTruncated(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537), tg.B(43, 65537)),
+		tg.F("baz", tg.B(44, 65537))))
+	defer os.RemoveAll(srcpath)
+
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(dstpath)
+
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	patchPlan := NewPatchPlan(srcStore, dstStore)
+
+	srcBar := filepath.Join(srcpath, "foo", "bar")
+	assert.T(t, os.Truncate(srcBar, 100) == nil)
+
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	srcInfo, _, err := fs.IndexFile(srcBar)
+	assert.T(t, err == nil)
+	dstInfo, _, err := fs.IndexFile(filepath.Join(dstpath, "foo", "bar"))
+	assert.T(t, err == nil)
+	assert.Equal(t, int64(100), dstInfo.Size)
+	assert.Equal(t, srcInfo.Strong, dstInfo.Strong)
+
+	_, err = os.Stat(filepath.Join(dstpath, "foo", "baz"))
+	assert.T(t, err == nil)
+}
+
+// Test renaming and skipping names reserved on Windows.
+func TestReservedNames(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("con.txt", tg.B(42, 100)),
+		tg.F("a:b", tg.B(43, 100)),
+		tg.D("trail.", tg.F("bar", tg.B(44, 100))),
+		tg.F("ok", tg.B(45, 100)))
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+
+	for _, policy := range []ReservedNamePolicy{RESERVED_SKIP, RESERVED_RENAME} {
+		dstpath := treegen.TestTree(t, tg.D("foo"))
+		defer os.RemoveAll(dstpath)
+
+		srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+		assert.T(t, err == nil)
+		dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+		assert.T(t, err == nil)
+
+		patchPlan := NewPatchPlanOpts(srcStore, dstStore,
+			&PlanOptions{ReservedNames: policy, WindowsNames: true})
+		failedCmd, err := patchPlan.Exec()
+		assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+		for _, name := range []string{"con.txt", "a:b", "trail.", "ok"} {
+			_, err = os.Stat(filepath.Join(dstpath, "foo", name))
+			assert.Equalf(t, name == "ok", err == nil, "%s: %v", name, err)
+		}
+		for _, name := range []string{"con_.txt", "a_b", filepath.Join("trail_", "bar")} {
+			_, err = os.Stat(filepath.Join(dstpath, "foo", name))
+			assert.Equalf(t, policy == RESERVED_RENAME, err == nil, "%s: %v", name, err)
+		}
+	}
+}
+
+// A VirtualFS presenting the directory "sub" of a local tree
+// under a name too long to be created.
+type longNameFS struct {
+	fs.VirtualFS
+	long string
+}
+
+func (lfs *longNameFS) Open(name string) (fs.VirtualFile, os.Error) {
+	f, err := lfs.VirtualFS.Open(strings.Replace(name, lfs.long, "sub", -1))
+	if err != nil {
+		return nil, err
+	}
+	return &longNameFile{VirtualFile: f, long: lfs.long}, nil
+}
+
+type longNameFile struct {
+	fs.VirtualFile
+	long string
+}
+
+func (f *longNameFile) Readdir(count int) ([]os.FileInfo, os.Error) {
+	entries, err := f.VirtualFile.Readdir(count)
+	for i := range entries {
+		if entries[i].Name == "sub" {
+			entries[i].Name = f.long
+		}
+	}
+	return entries, err
+}
+
+// Test that paths too long for the destination are reported when
+// planned, or skipped or shortened as requested.
+func TestLongNames(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("ok", tg.B(42, 100)),
+		tg.D("sub", tg.F("bar", tg.B(43, 100)))))
+	defer os.RemoveAll(srcpath)
+	long := strings.Repeat("long", 70) + ".d"
+	srcFS := &longNameFS{VirtualFS: fs.DirFS(srcpath), long: long}
+
+	for _, policy := range []LongNamePolicy{LONG_FAIL, LONG_SKIP, LONG_SHORTEN} {
+		dstpath := treegen.TestTree(t, tg.D("foo"))
+		defer os.RemoveAll(dstpath)
+
+		srcStore, err := fs.NewVirtualStore(srcFS, fs.NewMemRepo())
+		assert.Tf(t, err == nil, "%v", err)
+		dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+		assert.T(t, err == nil)
+
+		patchPlan := NewPatchPlanOpts(srcStore, dstStore, &PlanOptions{LongNames: policy})
+		pathErrors := patchPlan.PathErrors()
+		if policy == LONG_FAIL {
+			// The directory, and the file beneath it
+			assert.Equalf(t, 2, len(pathErrors), "%v", pathErrors)
+			for _, err := range pathErrors {
+				tooLong, is := err.(*fs.ErrPathTooLong)
+				assert.Tf(t, is, "%v", err)
+				assert.Equal(t, long, tooLong.Name)
+			}
+			continue
+		}
+		assert.Equalf(t, 0, len(pathErrors), "%v", pathErrors)
+
+		failedCmd, err := patchPlan.Exec()
+		assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+		_, err = os.Stat(filepath.Join(dstpath, "foo", "ok"))
+		assert.Tf(t, err == nil, "%v", err)
+		_, err = os.Stat(filepath.Join(dstpath, "foo", fs.ShortenName(long), "bar"))
+		assert.Equalf(t, policy == LONG_SHORTEN, err == nil, "%v", err)
+	}
+}
+
+// Test that escaped names are restored by a sync back.
+func TestEscapeNames(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("aux", tg.B(42, 100)),
+		tg.D("what?", tg.F("bar.", tg.B(43, 100))))
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo"))
+	defer os.RemoveAll(dstpath)
+	backpath := treegen.TestTree(t, tg.D("foo"))
+	defer os.RemoveAll(backpath)
+
+	patch := func(src string, dst string, opts *PlanOptions) {
+		srcStore, err := fs.NewLocalStore(src, fs.NewMemRepo())
+		assert.T(t, err == nil)
+		dstStore, err := fs.NewLocalStore(dst, fs.NewMemRepo())
+		assert.T(t, err == nil)
+		failedCmd, err := NewPatchPlanOpts(srcStore, dstStore, opts).Exec()
+		assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+	}
+
+	patch(srcpath, dstpath, &PlanOptions{ReservedNames: RESERVED_ESCAPE, WindowsNames: true})
+	dstDir, errors := fs.IndexDir(dstpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	fs.Walk(dstDir, func(node fs.Node) bool {
+		if fsNode, is := node.(fs.FsNode); is {
+			assert.Tf(t, !fs.IsWindowsReserved(fsNode.Name()), "%s", fsNode.Name())
+		}
+		_, is := node.(fs.Dir)
+		return is
+	})
+
+	patch(dstpath, backpath, &PlanOptions{UnescapeNames: true})
+	for _, path := range []string{"aux", filepath.Join("what?", "bar.")} {
+		_, err := os.Stat(filepath.Join(backpath, "foo", path))
+		assert.Tf(t, err == nil, "%v", err)
+	}
+}
+
+// Test that a read-only store can be synced from, but not to.
+func TestReadOnly(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(43, 65537))))
+	defer os.RemoveAll(dstpath)
+
+	srcStore, err := fs.NewReadOnlyStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	roDstStore, err := fs.NewReadOnlyStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	assert.T(t, roDstStore.ReadOnly())
+
+	_, err = NewPatchPlan(srcStore, roDstStore).Exec()
+	_, is := err.(*fs.ErrReadOnly)
+	assert.Tf(t, is, "%v", err)
+
+	_, err = roDstStore.Relocate(filepath.Join(dstpath, "foo", "bar"))
+	_, is = err.(*fs.ErrReadOnly)
+	assert.Tf(t, is, "%v", err)
+
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	assert.T(t, !dstStore.ReadOnly())
+	failedCmd, err := NewPatchPlan(srcStore, dstStore).Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	dstStore, err = fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	assert.Equal(t, srcStore.Repo().Root().(fs.Dir).Info().Strong,
+		dstStore.Repo().Root().(fs.Dir).Info().Strong)
+}
+
+// Test syncing from a virtual file system.
+func TestVirtualSource(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.D("baz", tg.F("quux", tg.B(43, 100))))
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(44, 65537))))
+	defer os.RemoveAll(dstpath)
+
+	srcStore, err := fs.NewVirtualStore(fs.DirFS(srcpath), fs.NewMemRepo())
+	assert.Tf(t, err == nil, "%v", err)
+	srcDir, errors := fs.IndexDir(srcpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, srcDir.Info().Strong, srcStore.Root().Info().Strong)
+
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	failedCmd, err := NewPatchPlan(srcStore, dstStore).Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	dstDir, errors := fs.IndexDir(dstpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, srcDir.Info().Strong, dstDir.Info().Strong)
+}
+
+// Test transforming source content on its way to the destination.
+func TestTransform(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo", tg.D("bar")))
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo"))
+	defer os.RemoveAll(dstpath)
+
+	text := strings.Repeat("hello\nworld\r\n", 1000)
+	err := ioutil.WriteFile(filepath.Join(srcpath, "foo", "bar", "text"), []byte(text), 0644)
+	assert.T(t, err == nil)
+
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	plan, err := NewTransformPlan(srcpath, dstStore, fs.ToCRLF, &PlanOptions{})
+	assert.Tf(t, err == nil, "%v", err)
+	failedCmd, err := plan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	content, err := ioutil.ReadFile(filepath.Join(dstpath, "foo", "bar", "text"))
+	assert.T(t, err == nil)
+	assert.Equal(t, strings.Replace(text, "o\n", "o\r\n", -1), string(content))
+
+	// Syncing again matches the transformed content already there.
+	dstStore, err = fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	plan, err = NewTransformPlan(srcpath, dstStore, fs.ToCRLF, &PlanOptions{})
+	assert.T(t, err == nil)
+	for _, cmd := range plan.Cmds {
+		_, isKeep := cmd.(*Keep)
+		assert.Tf(t, isKeep, "%v", cmd)
+	}
+}
+
+// Test that line endings are normalized by pattern, and that converted
+// content already in the destination is reused.
+func TestLineEndings(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo", tg.D("bar")))
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo", tg.D("bar")))
+	defer os.RemoveAll(dstpath)
+
+	dosText := strings.Repeat("hello\r\nworld\r\n", 10000)
+	unixText := strings.Replace(dosText, "\r\n", "\n", -1)
+	for _, name := range []string{"a.txt", "b.bat", "c.bin"} {
+		err := ioutil.WriteFile(filepath.Join(srcpath, "foo", "bar", name), []byte(dosText), 0644)
+		assert.T(t, err == nil)
+	}
+
+	// The destination has an older copy of the text, already converted.
+	err := ioutil.WriteFile(filepath.Join(dstpath, "foo", "bar", "a.txt"),
+		[]byte(unixText[:len(unixText)/2]), 0644)
+	assert.T(t, err == nil)
+
+	rules, err := fs.ParseLineEndingRules("*.txt=lf,foo/bar/*.bat=crlf")
+	assert.Tf(t, err == nil, "%v", err)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	plan, err := NewTransformPlan(srcpath, dstStore, fs.LineEndings(rules...), &PlanOptions{})
+	assert.Tf(t, err == nil, "%v", err)
+
+	reused := false
+	for _, cmd := range plan.Cmds {
+		if _, is := cmd.(*LocalTempCopy); is {
+			reused = true
+		}
+	}
+	assert.T(t, reused)
+
+	failedCmd, err := plan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	for name, text := range map[string]string{"a.txt": unixText, "b.bat": dosText, "c.bin": dosText} {
+		content, err := ioutil.ReadFile(filepath.Join(dstpath, "foo", "bar", name))
+		assert.T(t, err == nil)
+		assert.Equalf(t, text, string(content), "%s", name)
+	}
+
+	_, err = fs.ParseLineEndingRules("*.txt=cr")
+	assert.T(t, err != nil)
+}
+
+// Test syncing to a destination which stores files compressed.
+func TestCompressedDst(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.D("baz", tg.F("quux", tg.B(43, 100))))
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo", tg.F("gone", tg.B(44, 100))))
+	defer os.RemoveAll(dstpath)
+
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	plan, err := NewCompressedPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
+	failedCmd, err := plan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+	plan.Clean(nil)
+
+	for _, path := range []string{"bar.gz", filepath.Join("baz", "quux.gz")} {
+		_, err = os.Stat(filepath.Join(dstpath, "foo", path))
+		assert.Tf(t, err == nil, "%v", err)
+	}
+	_, err = os.Stat(filepath.Join(dstpath, "foo", "gone"))
+	assert.T(t, err != nil)
+
+	// Read logically, the destination is the same as the source.
+	compressed, err := fs.NewCompressedStore(dstpath, fs.NewMemRepo())
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, srcStore.Repo().Root().(fs.Dir).Info().Strong,
+		compressed.Root().Info().Strong)
+
+	// So syncing again keeps everything
+	dstStore, err = fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	plan, err = NewCompressedPlan(srcStore, dstStore)
+	assert.T(t, err == nil)
+	for _, cmd := range plan.Cmds {
+		_, isKeep := cmd.(*Keep)
+		assert.Tf(t, isKeep, "%v", cmd)
+	}
+
+	// And it can be restored from.
+	restorepath := treegen.TestTree(t, tg.D("foo"))
+	defer os.RemoveAll(restorepath)
+	restoreStore, err := fs.NewLocalStore(restorepath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	failedCmd, err = NewPatchPlan(compressed, restoreStore).Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+	restoreDir, errors := fs.IndexDir(restorepath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, srcStore.Repo().Root().(fs.Dir).Info().Strong, restoreDir.Info().Strong)
+}
+
+// Test that cleaning with the Trash option moves files to the trash.
+func TestTrash(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 100))))
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 100)), tg.F("gone", tg.B(43, 100))))
+	defer os.RemoveAll(dstpath)
+
+	home, err := ioutil.TempDir("", "home")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	defer os.Setenv("XDG_DATA_HOME", os.Getenv("XDG_DATA_HOME"))
+	os.Setenv("HOME", home)
+	os.Setenv("XDG_DATA_HOME", filepath.Join(home, "data"))
+
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	plan := NewPatchPlanOpts(srcStore, dstStore, &PlanOptions{Trash: true, Explain: true})
+	assert.T(t, strings.Contains(plan.Explain(), "Trash foo/gone"))
+
+	failedCmd, err := plan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+	errors := make(chan os.Error, 10)
+	plan.Clean(errors)
+	close(errors)
+	for err := range errors {
+		t.Error(err)
+	}
+
+	_, err = os.Stat(filepath.Join(dstpath, "foo", "gone"))
+	assert.T(t, err != nil)
+
+	trashed := false
+	for _, path := range []string{
+		filepath.Join(home, "data", "Trash", "files", "gone"),
+		filepath.Join(home, ".Trash", "gone")} {
+		if _, err = os.Stat(path); err == nil {
+			trashed = true
+		}
+	}
+	assert.T(t, trashed)
+}
+
+// Test that a live database is copied consistently, rather than patched.
+func TestConsistentCopy(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo"))
+	defer os.RemoveAll(dstpath)
+
+	// A database in use in the source
+	liveRepo, err := sqlite3.NewDbRepo(filepath.Join(srcpath, "foo", "live.db"))
+	assert.Tf(t, err == nil, "%v", err)
+	defer liveRepo.Close()
+	liveDir, errors := fs.IndexDir(filepath.Join(srcpath, "foo"), liveRepo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	plan := NewPatchPlanOpts(srcStore, dstStore,
+		&PlanOptions{Copiers: []ConsistentCopier{&sqlite3.Copier{}}})
+	copies := 0
+	for _, cmd := range plan.Cmds {
+		if cc, is := cmd.(*ConsistentCopy); is {
+			assert.T(t, strings.HasSuffix(cc.SrcPath, "live.db"))
+			copies++
+		}
+	}
+	assert.Equal(t, 1, copies)
+
+	failedCmd, err := plan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	copyRepo, err := sqlite3.NewDbRepo(filepath.Join(dstpath, "foo", "live.db"))
+	assert.Tf(t, err == nil, "%v", err)
+	defer copyRepo.Close()
+	copyDir, has := copyRepo.Dir(liveDir.Info().Strong)
+	assert.T(t, has)
+	assert.Equal(t, liveDir.Info().Strong, copyDir.Info().Strong)
+}
+
+// Test that empty source files are touched into place, rather than
+// downloaded, moved from another empty file or patched.
+func TestPatchEmptyFiles(t *testing.T) {
+	DoTestPatchEmptyFiles(t, mkMemRepo)
+}
+
+func TestDbPatchEmptyFiles(t *testing.T) {
+	DoTestPatchEmptyFiles(t, mkDbRepo)
+}
+
+func DoTestPatchEmptyFiles(t *testing.T, mkrepo repoMaker) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("new"),
+		tg.F("shrunk"),
+		tg.F("same"),
+		tg.D("sub", tg.F("nested"))))
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("shrunk", tg.B(42, 65537)),
+		tg.F("same"),
+		tg.F("other")))
+	defer os.RemoveAll(dstpath)
+	assert.T(t, os.Mkdir(filepath.Join(dstpath, "foo", "new"), 0755) == nil)
+
+	fileInfo, blocksInfo, err := fs.IndexFile(filepath.Join(srcpath, "foo", "same"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, fs.EMPTY_STRONG, fileInfo.Strong)
+	assert.Equal(t, 0, len(blocksInfo))
+
+	srcStore, err := fs.NewLocalStore(srcpath, mkrepo(t))
+	assert.T(t, err == nil)
+	dstStore, err := fs.NewLocalStore(dstpath, mkrepo(t))
+	assert.T(t, err == nil)
+
+	plan := NewPatchPlan(srcStore, dstStore)
+	touched := []string{}
+	for _, cmd := range plan.Cmds {
+		switch c := cmd.(type) {
+		case *Touch:
+			assert.T(t, c.Empty)
+			touched = append(touched, c.Path.(*LocalPath).RelPath)
+		case *Keep:
+			assert.Equal(t, filepath.Join("foo", "same"), c.Path.(*LocalPath).RelPath)
+		case *Conflict:
+			assert.Equal(t, filepath.Join("foo", "new"), c.Path.RelPath)
+		default:
+			t.Errorf("Unexpected command for empty files: %v", cmd)
+		}
+	}
+	assert.Equal(t, []string{
+		filepath.Join("foo", "new"),
+		filepath.Join("foo", "shrunk"),
+		filepath.Join("foo", "sub", "nested")}, touched)
+
+	failedCmd, err := plan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	for _, relpath := range touched {
+		info, err := os.Lstat(filepath.Join(dstpath, relpath))
+		assert.Tf(t, err == nil, "%v", err)
+		assert.T(t, info.IsRegular())
+		assert.Equal(t, int64(0), info.Size)
+	}
+}
+
+// Test that a phased sync leaves patched files as they were until
+// it is committed, with their new content staged beside them.
+func TestExecPhased(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537), tg.B(43, 65537)),
+		tg.F("baz", tg.B(44, 65537))))
+	defer os.RemoveAll(srcpath)
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	for _, commit := range []bool{true, false} {
+		tg = treegen.New()
+		dstpath := treegen.TestTree(t, tg.D("foo",
+			tg.F("bar", tg.B(42, 65537), tg.B(45, 65537))))
+		defer os.RemoveAll(dstpath)
+		dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+		assert.T(t, err == nil)
+		barPath := filepath.Join(dstpath, "foo", "bar")
+		before, err := ioutil.ReadFile(barPath)
+		assert.T(t, err == nil)
+
+		patchPlan := NewPatchPlan(srcStore, dstStore)
+		failedCmd, err := patchPlan.ExecPhased()
+		assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+		staged, err := ioutil.ReadFile(barPath)
+		assert.T(t, err == nil)
+		assert.Equal(t, fs.StrongChecksum(before), fs.StrongChecksum(staged))
+		entries, err := ioutil.ReadDir(filepath.Join(dstpath, "foo"))
+		assert.T(t, err == nil)
+		assert.Equal(t, 3, len(entries))
+
+		if !commit {
+			patchPlan.Abort()
+			entries, err = ioutil.ReadDir(filepath.Join(dstpath, "foo"))
+			assert.T(t, err == nil)
+			assert.Equal(t, 2, len(entries))
+			continue
+		}
+
+		failedCmd, err = patchPlan.Commit()
+		assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+		srcRoot, errors := fs.IndexDir(srcpath, fs.NewMemRepo())
+		assert.Equalf(t, 0, len(errors), "%v", errors)
+		dstRoot, errors := fs.IndexDir(dstpath, fs.NewMemRepo())
+		assert.Equalf(t, 0, len(errors), "%v", errors)
+		assert.Equal(t, srcRoot.Info().Strong, dstRoot.Info().Strong)
+	}
+}
+
+// A store whose tree cannot be walked until released, as when it is
+// read from a hung mount.
+type hungStore struct {
+	fs.BlockStore
+	release chan bool
+}
+
+func (hung *hungStore) Repo() fs.NodeRepo { return &hungRepo{hung.BlockStore.Repo(), hung.release} }
+
+type hungRepo struct {
+	fs.NodeRepo
+	release chan bool
+}
+
+func (hung *hungRepo) Root() fs.FsNode {
+	<-hung.release
+	return hung.NodeRepo.Root()
+}
+
+func TestPatchPlanTimeout(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo"))
+	defer os.RemoveAll(dstpath)
+
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	hung := &hungStore{BlockStore: srcStore, release: make(chan bool)}
+
+	patchPlan := NewPatchPlanOpts(hung, dstStore, &PlanOptions{Timeout: 50e6})
+	timeout, is := patchPlan.Err().(*fs.ErrTimeout)
+	assert.Tf(t, is, "%v", patchPlan.Err())
+	assert.Equal(t, "Plan", timeout.Op)
+	assert.Equal(t, 0, len(patchPlan.Cmds))
+	failedCmd, err := patchPlan.Exec()
+	assert.T(t, failedCmd == nil)
+	assert.Equal(t, timeout, err)
+
+	// Planning which finishes in time is as without a timeout. The plan
+	// given up on may still be running, so the destination is opened again.
+	close(hung.release)
+	dstStore, err = fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	assert.T(t, err == nil)
+	patchPlan = NewPatchPlanOpts(hung, dstStore, &PlanOptions{Timeout: 60e9})
+	assert.Tf(t, patchPlan.Err() == nil, "%v", patchPlan.Err())
+	failedCmd, err = patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	_, err = os.Stat(filepath.Join(dstpath, "foo", "bar"))
+	assert.T(t, err == nil)
 }
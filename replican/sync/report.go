@@ -0,0 +1,167 @@
+package sync
+
+import (
+	"io/ioutil"
+	"json"
+	"os"
+	"sort"
+	"time"
+)
+
+// A record of what a sync changed in its destination, which can be saved
+// and compared with the records of other runs.
+type ExecReport struct {
+	// Time the report was made, in nanoseconds since the epoch.
+	Time int64
+
+	// Destination paths written by the plan, and those deleted by it
+	// or left to be deleted by Clean, relative to the destination.
+	Changed []string
+	Deleted []string
+
+	// Bytes read from the source, and bytes of file content written to
+	// the destination, whether read from the source or reused from it.
+	Literal int64
+	Written int64
+
+	// Error which ended the sync, if any.
+	Err string
+}
+
+// Report on the execution of a plan, which ended with err.
+func NewExecReport(plan *PatchPlan, err os.Error) *ExecReport {
+	report := &ExecReport{Time: time.Nanoseconds(), Deleted: plan.PendingDeletes()}
+	report.Literal, report.Written = plan.Transferred()
+	if err != nil {
+		report.Err = err.String()
+	}
+
+	changed, deleted := make(map[string]bool), make(map[string]bool)
+	for _, path := range report.Deleted {
+		deleted[path] = true
+	}
+	for _, cmd := range plan.Cmds {
+		if del, is := cmd.(*Delete); is {
+			deleted[plan.dstStore.RelPath(del.Path.Resolve())] = true
+			continue
+		}
+		for _, path := range modifiedPaths(cmd) {
+			changed[plan.dstStore.RelPath(path.Resolve())] = true
+		}
+	}
+	report.Changed = sortedKeys(changed)
+	report.Deleted = sortedKeys(deleted)
+	return report
+}
+
+// Get the bytes written for each byte transferred, as rsync reports its
+// speedup. Zero if nothing was transferred.
+func (report *ExecReport) Speedup() float64 {
+	if report.Literal == 0 {
+		return 0
+	}
+	return float64(report.Written) / float64(report.Literal)
+}
+
+// Get all the paths a report changed or deleted.
+func (report *ExecReport) paths() map[string]bool {
+	paths := make(map[string]bool)
+	for _, path := range report.Changed {
+		paths[path] = true
+	}
+	for _, path := range report.Deleted {
+		paths[path] = true
+	}
+	return paths
+}
+
+// The difference between the paths touched by two runs.
+type ReportDiff struct {
+	// Paths changed or deleted by the newer run only.
+	Added []string
+
+	// Paths changed or deleted by the older run only.
+	Removed []string
+
+	// Paths changed or deleted by both runs. Paths which keep appearing
+	// here usually have unstable modification times or content.
+	Repeated []string
+}
+
+// Compare the paths touched by two runs.
+func CompareReports(older *ExecReport, newer *ExecReport) *ReportDiff {
+	olderPaths, newerPaths := older.paths(), newer.paths()
+	added, removed, repeated := make(map[string]bool), make(map[string]bool), make(map[string]bool)
+
+	for path, _ := range newerPaths {
+		if olderPaths[path] {
+			repeated[path] = true
+		} else {
+			added[path] = true
+		}
+	}
+	for path, _ := range olderPaths {
+		if !newerPaths[path] {
+			removed[path] = true
+		}
+	}
+
+	return &ReportDiff{
+		Added:    sortedKeys(added),
+		Removed:  sortedKeys(removed),
+		Repeated: sortedKeys(repeated)}
+}
+
+// Get the paths touched by every one of at least two runs: files which
+// churn on each sync, rather than settling once synced.
+func Churning(reports []*ExecReport) []string {
+	if len(reports) < 2 {
+		return []string{}
+	}
+
+	churning := reports[0].paths()
+	for _, report := range reports[1:] {
+		paths := report.paths()
+		for path, _ := range churning {
+			if !paths[path] {
+				churning[path] = false, false
+			}
+		}
+	}
+	return sortedKeys(churning)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := []string{}
+	for key, _ := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Save a history of reports as JSON.
+func SaveReports(path string, reports []*ExecReport) os.Error {
+	buf, err := json.Marshal(reports)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf, 0644)
+}
+
+// Load a history of reports saved with SaveReports. A history not yet
+// saved is empty.
+func LoadReports(path string) ([]*ExecReport, os.Error) {
+	buf, err := ioutil.ReadFile(path)
+	if pathErr, is := err.(*os.PathError); is && pathErr.Error == os.ENOENT {
+		return []*ExecReport{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	reports := []*ExecReport{}
+	if err = json.Unmarshal(buf, &reports); err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
@@ -0,0 +1,182 @@
+package sync
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// Longest signature a decoder will accept.
+const maxSignature = 1 << 12
+
+// A bundle which is unsigned, or whose signature does not verify
+// with the key trusted to have signed it.
+type ErrBadSignature struct {
+	Reason string
+}
+
+func (err *ErrBadSignature) String() string {
+	return fmt.Sprintf("Plan bundle not trusted: %s", err.Reason)
+}
+
+// Encode the plan as a bundle, as EncodePlan, signed with key. The
+// signature is an RSA PKCS #1 v1.5 signature of the SHA-256 hash of
+// the bundle, and covers the header, commands and any inline data. It
+// follows the header, so that it can be verified before the rest is
+// decoded; the bundle is spooled to a temporary file until it is signed.
+func EncodeSignedPlan(w io.Writer, plan *PatchPlan, inline bool, key *rsa.PrivateKey) os.Error {
+	spool, err := ioutil.TempFile("", "bundle")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	hash := sha256.New()
+	if err = encodePlan(io.MultiWriter(spool, hash), plan, bundleFlags(inline)|BUNDLE_SIGNED); err != nil {
+		return err
+	}
+	length, err := spool.Seek(0, 1)
+	if err != nil {
+		return err
+	}
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash.Sum())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, io.NewSectionReader(spool, 0, int64(bundleHeaderSize))); err != nil {
+		return err
+	}
+	if err = binary.Write(w, binary.BigEndian, uint32(len(sig))); err != nil {
+		return err
+	}
+	if _, err = w.Write(sig); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, io.NewSectionReader(spool, int64(bundleHeaderSize), length-int64(bundleHeaderSize)))
+	return err
+}
+
+// Decode a plan from a bundle written by EncodeSignedPlan, as DecodePlan,
+// only if it was signed with the private half of key. Unsigned bundles,
+// and bundles which were altered after signing, fail with ErrBadSignature,
+// and no plan is returned for them to be executed.
+//
+// The bundle is spooled to a temporary file and verified before any of
+// it past the header is decoded. Bundles larger than MaxBundleSize are
+// refused.
+func DecodeSignedPlan(r io.Reader, dstStore fs.LocalStore, key *rsa.PublicKey) (plan *PatchPlan, data *BundleData, err os.Error) {
+	spool, length, flags, err := verifyBundle(r, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	return decodePlan(io.NewSectionReader(spool, 0, length), dstStore, flags)
+}
+
+// Spool a signed bundle to a temporary file, less its header and
+// signature, and verify it. The caller removes the file.
+func verifyBundle(r io.Reader, key *rsa.PublicKey) (spool *os.File, length int64, flags byte, err os.Error) {
+	header, flags, err := readBundleHeader(r)
+	if err != nil {
+		return nil, 0, 0, err
+	} else if flags&BUNDLE_SIGNED == 0 {
+		return nil, 0, 0, &ErrBadSignature{Reason: "bundle is not signed"}
+	}
+	sig, err := readSignature(r)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	f, err := ioutil.TempFile("", "bundle")
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	hash := sha256.New()
+	hash.Write(header)
+	length, err = io.Copyn(io.MultiWriter(f, hash), r, MaxBundleSize+1)
+	if err != nil && err != os.EOF {
+		return nil, 0, 0, err
+	} else if length > MaxBundleSize {
+		err = os.NewError(fmt.Sprintf("Plan bundle larger than %d bytes", MaxBundleSize))
+		return nil, 0, 0, err
+	}
+
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash.Sum(), sig); err != nil {
+		err = &ErrBadSignature{Reason: err.String()}
+		return nil, 0, 0, err
+	}
+	return f, length, flags, nil
+}
+
+// Read the signature following the header of a signed bundle.
+func readSignature(r io.Reader) ([]byte, os.Error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	} else if length > maxSignature {
+		return nil, &ErrBadSignature{Reason: fmt.Sprintf("signature of %d bytes is too long", length)}
+	}
+	sig := make([]byte, length)
+	if _, err := io.ReadFull(r, sig); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// Read an RSA private key for signing bundles from a PEM file.
+func ReadSigningKey(path string) (*rsa.PrivateKey, os.Error) {
+	der, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParsePKCS1PrivateKey(der)
+}
+
+// Read an RSA public key for verifying bundles from a PEM file.
+func ReadVerifyingKey(path string) (*rsa.PublicKey, os.Error) {
+	der, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	if rsaKey, is := key.(*rsa.PublicKey); is {
+		return rsaKey, nil
+	}
+	return nil, os.NewError(fmt.Sprintf("%s: not an RSA public key", path))
+}
+
+func readPEM(path string) ([]byte, os.Error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, os.NewError(fmt.Sprintf("%s: no PEM data", path))
+	}
+	return block.Bytes, nil
+}
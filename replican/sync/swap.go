@@ -0,0 +1,144 @@
+package sync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// Suffixes of the directories beside the destination in which SwapTree
+// stages the new tree, and to which it moves the old tree aside.
+const (
+	STAGING_SUFFIX = ".replican-staging"
+	SWAPPED_SUFFIX = ".replican-old"
+)
+
+// Build the source tree at stagingPath, starting from a copy of the tree
+// at currentPath made of hard links, so that unchanged files take no
+// space and no time to stage. Files are unshared before being changed in
+// place, so the current tree is left exactly as it was. Anything already
+// at stagingPath is removed first.
+func StageTree(srcStore fs.BlockStore, currentPath string, stagingPath string, opts *PlanOptions) os.Error {
+	if err := os.RemoveAll(stagingPath); err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(currentPath); err == nil {
+		if err = linkTree(currentPath, stagingPath); err != nil {
+			return err
+		}
+	} else if err = os.MkdirAll(stagingPath, 0755); err != nil {
+		return err
+	}
+
+	stagingStore, err := fs.NewLocalStore(stagingPath, fs.NewMemRepo())
+	if err != nil {
+		return err
+	}
+
+	plan := NewPatchPlanOpts(srcStore, stagingStore, opts)
+	if _, err = plan.ExecWith(&ExecContext{Src: srcStore, Dst: stagingStore, Unshare: true}); err != nil {
+		return err
+	}
+
+	errors := make(chan os.Error)
+	go func() {
+		plan.Clean(errors)
+		close(errors)
+	}()
+	for cleanErr := range errors {
+		if err == nil {
+			err = cleanErr
+		}
+	}
+	return err
+}
+
+// Make the destination directory at dstPath match the source all or
+// nothing, as a deployment needs. The new tree is staged beside it with
+// StageTree, then swapped into place. A tree which fails to stage is
+// discarded, leaving the destination as it was.
+//
+// Where fs.Exchange can, the trees are exchanged in one step. Otherwise a
+// directory cannot be renamed over another, so the old tree is moved aside
+// for the instant between two renames, and moved back if the second fails.
+// Where even that is too long, serve the tree through a symbolic link
+// which can be flipped, as a Deployment does.
+func SwapTree(srcStore fs.BlockStore, dstPath string, opts *PlanOptions) os.Error {
+	dstPath = filepath.Clean(dstPath)
+	stagingPath := dstPath + STAGING_SUFFIX
+	swappedPath := dstPath + SWAPPED_SUFFIX
+
+	if err := StageTree(srcStore, dstPath, stagingPath, opts); err != nil {
+		os.RemoveAll(stagingPath)
+		return err
+	}
+
+	if _, err := os.Lstat(dstPath); err != nil {
+		return os.Rename(stagingPath, dstPath)
+	}
+
+	exchanged, err := fs.Exchange(stagingPath, dstPath)
+	if err != nil {
+		return err
+	} else if exchanged {
+		// The old tree is where the new one was staged
+		return os.RemoveAll(stagingPath)
+	}
+
+	if err = os.RemoveAll(swappedPath); err != nil {
+		return err
+	}
+	if err = os.Rename(dstPath, swappedPath); err != nil {
+		return err
+	}
+	if err = os.Rename(stagingPath, dstPath); err != nil {
+		if restoreErr := os.Rename(swappedPath, dstPath); restoreErr != nil {
+			return os.NewError(fmt.Sprintf(
+				"%v; old tree left at %s, failed to restore it: %v", err, swappedPath, restoreErr))
+		}
+		return err
+	}
+
+	return os.RemoveAll(swappedPath)
+}
+
+// Copy the tree at path to linkPath, making hard links to its files.
+// Symbolic links are recreated, rather than followed.
+func linkTree(path string, linkPath string) os.Error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.IsDirectory():
+		if err = os.Mkdir(linkPath, info.Mode&07777); err != nil {
+			return err
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err = linkTree(filepath.Join(path, entry.Name), filepath.Join(linkPath, entry.Name)); err != nil {
+				return err
+			}
+		}
+		return os.Chtimes(linkPath, info.Atime_ns, info.Mtime_ns)
+	case info.IsSymlink():
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, linkPath)
+	case info.IsRegular():
+		return os.Link(path, linkPath)
+	}
+
+	// Devices, sockets and the like are left out, as the indexer leaves them.
+	return nil
+}
@@ -0,0 +1,70 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSwapTree(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("same", tg.B(42, 65537)),
+		tg.F("changed", tg.B(43, 65537), tg.B(44, 65537)),
+		tg.D("new", tg.F("baz", tg.B(45, 65537)))))
+	defer os.RemoveAll(srcpath)
+	srcStore, err := fs.NewLocalStore(filepath.Join(srcpath, "foo"), fs.NewMemRepo())
+	assert.T(t, err == nil)
+
+	tg = treegen.New()
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("same", tg.B(42, 65537)),
+		tg.F("changed", tg.B(43, 65537), tg.B(46, 65537)),
+		tg.F("stale", tg.B(47, 65537))))
+	defer os.RemoveAll(dstpath)
+	foo := filepath.Join(dstpath, "foo")
+	assert.T(t, os.Chmod(filepath.Join(foo, "same"), 0600) == nil)
+	sameBefore, err := os.Stat(filepath.Join(foo, "same"))
+	assert.T(t, err == nil)
+	dstBefore, errors := fs.IndexDir(foo, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	// Staging leaves the current tree alone, even where a file shared
+	// with it has its metadata changed.
+	opts := &PlanOptions{CompareMeta: true}
+	stagingPath := foo + STAGING_SUFFIX
+	err = StageTree(srcStore, foo, stagingPath, opts)
+	assert.Tf(t, err == nil, "%v", err)
+	dstStaged, errors := fs.IndexDir(foo, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, dstBefore.Info().Strong, dstStaged.Info().Strong)
+	sameStaged, err := os.Stat(filepath.Join(foo, "same"))
+	assert.T(t, err == nil)
+	assert.Equal(t, uint32(0600), sameStaged.Mode&07777)
+
+	// Unchanged files are shared with the staged tree.
+	err = StageTree(srcStore, foo, stagingPath, &PlanOptions{})
+	assert.Tf(t, err == nil, "%v", err)
+	staged, err := os.Stat(filepath.Join(stagingPath, "same"))
+	assert.T(t, err == nil)
+	assert.Equal(t, sameBefore.Ino, staged.Ino)
+	assert.T(t, os.RemoveAll(stagingPath) == nil)
+
+	err = SwapTree(srcStore, foo, &PlanOptions{})
+	assert.Tf(t, err == nil, "%v", err)
+	for _, path := range []string{stagingPath, foo + SWAPPED_SUFFIX} {
+		_, err = os.Lstat(path)
+		assert.Tf(t, err != nil, "%s left behind", path)
+	}
+
+	srcRoot, errors := fs.IndexDir(filepath.Join(srcpath, "foo"), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	dstRoot, errors := fs.IndexDir(foo, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, srcRoot.Info().Strong, dstRoot.Info().Strong)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"http"
+	"log"
+	"net"
+	"exec"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+
+	"github.com/cmars/replican-sync/replican/daemon"
+)
+
+const SERVICE_LABEL string = "com.github.cmars.replican"
+const SERVICE_NAME string = "replican"
+
+// Run the sync daemon with a JSON configuration file.
+func main() {
+	if len(os.Args) < 2 {
+		die(fmt.Sprintf("Usage: %s [install|service] <config file>", os.Args[0]), nil)
+	}
+
+	switch os.Args[1] {
+	case "install":
+		if len(os.Args) < 3 {
+			die(fmt.Sprintf("Usage: %s install <config file>", os.Args[0]), nil)
+		}
+		install(os.Args[2])
+		return
+	case "service":
+		// Started by the Windows service control manager, as install
+		// registers the daemon there.
+		if len(os.Args) < 3 {
+			die(fmt.Sprintf("Usage: %s service <config file>", os.Args[0]), nil)
+		}
+		err := daemon.ServeWindowsService(SERVICE_NAME, func(stop <-chan bool) {
+			serve(os.Args[2], stop)
+		})
+		if err != nil {
+			die("Cannot run as a service", err)
+		}
+		return
+	}
+
+	// Let syncs in progress finish before exiting.
+	stop := make(chan bool)
+	go func() {
+		for sig := range signal.Incoming {
+			if usig, is := sig.(os.UnixSignal); is && (usig == os.SIGTERM || usig == os.SIGINT) {
+				close(stop)
+				return
+			}
+		}
+	}()
+	serve(os.Args[1], stop)
+}
+
+// Run the daemon until shutdown is closed, then drain the syncs in progress.
+func serve(configPath string, shutdown <-chan bool) {
+	config, err := daemon.LoadConfig(configPath)
+	if err != nil {
+		die(fmt.Sprintf("Cannot read configuration %s", configPath), err)
+	}
+
+	d := daemon.New()
+	for _, profile := range config.Profiles {
+		if err = d.AddProfile(profile); err != nil {
+			die("Invalid configuration", err)
+		}
+	}
+
+	errors := make(chan os.Error)
+	go func() {
+		for err := range errors {
+			log.Println(err)
+		}
+	}()
+
+	stop := make(chan bool)
+	go d.Run(stop, errors)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", daemon.NewDashboard(d, config.Token))
+	mux.Handle(daemon.API_PREFIX, daemon.NewAPI(d, config.Token))
+
+	// Prefer sockets passed by the service manager to the configured address.
+	listeners, err := daemon.Listeners()
+	if err != nil {
+		die("Cannot use activated sockets", err)
+	}
+	if len(listeners) == 0 && config.Listen != "" {
+		listener, err := net.Listen("tcp", config.Listen)
+		if err != nil {
+			die(fmt.Sprintf("Cannot serve on %s", config.Listen), err)
+		}
+		listeners = append(listeners, listener)
+	}
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errors <- http.Serve(listener, mux)
+		}(listener)
+	}
+
+	daemon.Notify("READY=1")
+	go daemon.Watchdog(stop)
+
+	<-shutdown
+	daemon.Notify("STOPPING=1")
+	close(stop)
+	d.Drain()
+}
+
+// Register the daemon with the native service manager.
+func install(configPath string) {
+	exe, err := exec.LookPath(os.Args[0])
+	if err == nil {
+		exe, err = filepath.Abs(exe)
+	}
+	if err != nil {
+		die("Cannot locate the daemon executable", err)
+	}
+
+	configPath, err = filepath.Abs(configPath)
+	if err != nil {
+		die(fmt.Sprintf("Cannot locate configuration %s", configPath), err)
+	}
+
+	switch runtime.GOOS {
+	case "darwin":
+		path, err := daemon.InstallLaunchd(SERVICE_LABEL, exe, configPath)
+		if err != nil {
+			die("Cannot install launchd job", err)
+		}
+		fmt.Printf("Installed %s; start it with: launchctl load %s\n", path, path)
+	case "windows":
+		cmd := exec.Command("sc.exe", daemon.WindowsServiceArgs(SERVICE_NAME, exe, configPath)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			die("Cannot create service", err)
+		}
+		fmt.Printf("Installed service %s; start it with: sc.exe start %s\n", SERVICE_NAME, SERVICE_NAME)
+	default:
+		die(fmt.Sprintf("No service manager integration on %s; use a systemd unit", runtime.GOOS), nil)
+	}
+}
+
+func die(message string, err os.Error) {
+	if err == nil {
+		fmt.Fprintln(os.Stderr, message)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", message, err)
+	}
+	os.Exit(1)
+}
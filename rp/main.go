@@ -2,11 +2,16 @@ package main
 
 import (
 	"fmt"
+	"http"
 	"io/ioutil"
+	"net"
 	"os"
 
+	"github.com/cmars/replican-sync/replican/archive"
 	"github.com/cmars/replican-sync/replican/fs"
 	"github.com/cmars/replican-sync/replican/fs/sqlite3"
+	"github.com/cmars/replican-sync/replican/remote"
+	"github.com/cmars/replican-sync/replican/stats"
 	"github.com/cmars/replican-sync/replican/sync"
 
 	"optarg.googlecode.com/hg/optarg"
@@ -14,6 +19,7 @@ import (
 
 func main() {
 	verboseOpt := optarg.NewBoolOption("v", "verbose")
+	explainOpt := optarg.NewBoolOption("e", "explain")
 
 	files, err := optarg.Parse()
 	if err != nil {
@@ -22,8 +28,25 @@ func main() {
 		os.Exit(1)
 	}
 
+	switch {
+	case len(files) == 2 && files[0] == "serve":
+		serve(files[1])
+	case len(files) == 3 && files[0] == "sync":
+		pairSync(files[1], files[2], verboseOpt.Value, explainOpt.Value)
+	case len(files) == 3 && files[0] == "estimate":
+		estimate(files[1], files[2])
+	case len(files) == 5 && files[0] == "bundle":
+		writeBundle(files[1], files[2], files[3], files[4])
+	case len(files) >= 5 && files[0] == "fleet":
+		applyFleet(files[1], files[2], files[3], files[4:])
+	}
+
 	if len(files) < 2 {
-		die(fmt.Sprintf("Usage: %s <src> <dst>", os.Args[0]), nil)
+		die(fmt.Sprintf(
+			"Usage: %s <src> <dst>\n       %s serve <dir>\n       %s sync <code> <dst>\n       %s estimate <src> <dst>\n"+
+				"       %s bundle <src> <baseline> <bundle> <signing key>\n"+
+				"       %s fleet <bundle> <verifying key> <baseline> <dst>...\n",
+			os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0]), nil)
 	}
 
 	srcpath := files[0]
@@ -54,7 +77,7 @@ func main() {
 		die("Failed to create source index database", err)
 	}
 
-	srcStore, err := fs.NewLocalStore(srcpath, srcRepo)
+	srcStore, err := fs.NewReadOnlyStore(srcpath, srcRepo)
 	if err != nil {
 		die(fmt.Sprintf("Failed to read source %s", srcpath), err)
 	}
@@ -74,20 +97,196 @@ func main() {
 		die(fmt.Sprintf("Failed to read destination %s", srcpath), err)
 	}
 
-	patchPlan := sync.NewPatchPlan(srcStore, dstStore)
+	patchPlan := sync.NewPatchPlanOpts(srcStore, dstStore,
+		&sync.PlanOptions{Explain: explainOpt.Value})
+	printPlan(patchPlan, verboseOpt.Value, explainOpt.Value)
 
-	if verboseOpt.Value {
-		fmt.Printf("%v\n", patchPlan)
+	failedCmd, err := patchPlan.Exec()
+	if err != nil {
+		die(failedCmd.String(), err)
 	}
+	printTransferred(patchPlan)
+
+	os.Exit(0)
+}
+
+// Serve a tree to a peer, which connects with the pairing code printed.
+func serve(path string) {
+	store, err := fs.NewReadOnlyStore(path, fs.NewMemRepo())
+	if err != nil {
+		die(fmt.Sprintf("Failed to read %s", path), err)
+	}
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		die("Cannot listen for peers", err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		die("Cannot determine host name", err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	pairing, err := remote.NewPairing(net.JoinHostPort(hostname, port))
+	if err != nil {
+		die("Cannot create pairing code", err)
+	}
+
+	fmt.Printf("Serving %s. On the other machine, run:\n\n    %s sync %s <dst>\n\n",
+		path, os.Args[0], pairing.Code())
+
+	err = http.Serve(listener, pairing.Handler(remote.NewServer(store)))
+	die("Stopped serving", err)
+}
+
+// Sync a tree served by a peer with the pairing code it gave.
+func pairSync(code string, dstpath string, verbose bool, explain bool) {
+	pairing, err := remote.ParsePairingCode(code)
+	if err != nil {
+		die("Invalid pairing code", err)
+	}
+
+	srcStore, err := remote.NewStore(pairing.Client())
+	if err != nil {
+		die(fmt.Sprintf("Cannot connect to %s", pairing.Addr), err)
+	}
+
+	if err = os.MkdirAll(dstpath, 0755); err != nil {
+		die(fmt.Sprintf("Cannot create destination %s", dstpath), err)
+	}
+
+	dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+	if err != nil {
+		die(fmt.Sprintf("Failed to read destination %s", dstpath), err)
+	}
+
+	patchPlan := sync.NewPatchPlanOpts(srcStore, dstStore, &sync.PlanOptions{Explain: explain})
+	printPlan(patchPlan, verbose, explain)
 
 	failedCmd, err := patchPlan.Exec()
 	if err != nil {
 		die(failedCmd.String(), err)
 	}
+	printTransferred(patchPlan)
 
 	os.Exit(0)
 }
 
+// Estimate how much of a source would be transferred to sync it to a
+// destination, and how much reused.
+func estimate(srcpath string, dstpath string) {
+	srcStore, err := fs.NewReadOnlyStore(srcpath, fs.NewMemRepo())
+	if err != nil {
+		die(fmt.Sprintf("Failed to read source %s", srcpath), err)
+	}
+
+	dstStore, err := fs.NewReadOnlyStore(dstpath, fs.NewMemRepo())
+	if err != nil {
+		die(fmt.Sprintf("Failed to read destination %s", dstpath), err)
+	}
+
+	est := stats.NewEstimate(srcStore.Repo(), dstStore.Repo())
+	fmt.Printf("%d files, %d bytes\n", est.Files, est.Bytes)
+	fmt.Printf("%d bytes reused\n", est.Reused)
+	fmt.Printf("%d bytes transferred, %d unique\n", est.Transferred, est.Unique)
+	os.Exit(0)
+}
+
+// Write a signed bundle releasing a source to hosts at the baseline,
+// the tree of the previous release.
+func writeBundle(srcpath string, basepath string, bundlepath string, keypath string) {
+	key, err := sync.ReadSigningKey(keypath)
+	if err != nil {
+		die(fmt.Sprintf("Cannot read signing key %s", keypath), err)
+	}
+
+	srcStore, err := fs.NewReadOnlyStore(srcpath, fs.NewMemRepo())
+	if err != nil {
+		die(fmt.Sprintf("Failed to read source %s", srcpath), err)
+	}
+	baseStore, err := fs.NewReadOnlyStore(basepath, fs.NewMemRepo())
+	if err != nil {
+		die(fmt.Sprintf("Failed to read baseline %s", basepath), err)
+	}
+
+	f, err := os.Create(bundlepath)
+	if err != nil {
+		die(fmt.Sprintf("Cannot create bundle %s", bundlepath), err)
+	}
+	if err = sync.EncodeSignedPlan(f, sync.NewPatchPlan(srcStore, baseStore), true, key); err != nil {
+		f.Close()
+		os.Remove(bundlepath)
+		die("Failed to write bundle", err)
+	}
+	if err = f.Close(); err != nil {
+		die("Failed to write bundle", err)
+	}
+	os.Exit(0)
+}
+
+// Apply a signed bundle to each destination still at the baseline it
+// was made against, reporting how each went.
+func applyFleet(bundlepath string, keypath string, basepath string, dstpaths []string) {
+	key, err := sync.ReadVerifyingKey(keypath)
+	if err != nil {
+		die(fmt.Sprintf("Cannot read verifying key %s", keypath), err)
+	}
+
+	baseStore, err := fs.NewReadOnlyStore(basepath, fs.NewMemRepo())
+	if err != nil {
+		die(fmt.Sprintf("Failed to read baseline %s", basepath), err)
+	}
+
+	dstStores := []fs.LocalStore{}
+	for _, dstpath := range dstpaths {
+		dstStore, err := fs.NewLocalStore(dstpath, fs.NewMemRepo())
+		if err != nil {
+			die(fmt.Sprintf("Failed to read destination %s", dstpath), err)
+		}
+		dstStores = append(dstStores, dstStore)
+	}
+
+	f, err := os.Open(bundlepath)
+	if err != nil {
+		die(fmt.Sprintf("Cannot open bundle %s", bundlepath), err)
+	}
+	bundle, err := sync.DecodeFleetBundle(f, key)
+	f.Close()
+	if err != nil {
+		die(fmt.Sprintf("Cannot apply bundle %s", bundlepath), err)
+	}
+
+	results := sync.ApplyFleet(bundle, dstStores, archive.NewManifest(baseStore.Repo().Root()), 0)
+	bundle.Close()
+
+	failed := false
+	for _, result := range results {
+		fmt.Printf("%v\n", result)
+		failed = failed || result.Err != nil
+	}
+	if failed {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// Print the plan if asked, with the reason for each command if explaining.
+func printPlan(patchPlan *sync.PatchPlan, verbose bool, explain bool) {
+	if explain {
+		fmt.Printf("%s\n", patchPlan.Explain())
+	} else if verbose {
+		fmt.Printf("%v\n", patchPlan)
+	}
+}
+
+// Print the bytes transferred by a sync, and the bytes written with them.
+func printTransferred(patchPlan *sync.PatchPlan) {
+	report := sync.NewExecReport(patchPlan, nil)
+	fmt.Printf("%d bytes transferred, %d bytes written, speedup %.2f\n",
+		report.Literal, report.Written, report.Speedup())
+}
+
 func die(message string, err os.Error) {
 	if err == nil {
 		fmt.Fprint(os.Stderr, message)
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/cmars/replican-sync/replican/archive"
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+const usage = `Usage:
+	%s create <src> <archive> [volume size]
+	%s parity <file> <shard size> <group size>
+	%s repair <file>
+`
+
+// Create, protect and repair deduplicated backup archives.
+func main() {
+	if len(os.Args) < 3 {
+		die(fmt.Sprintf(usage, os.Args[0], os.Args[0], os.Args[0]), nil)
+	}
+
+	switch os.Args[1] {
+	case "create":
+		create(os.Args[2:])
+	case "parity":
+		parity(os.Args[2:])
+	case "repair":
+		repair(os.Args[2:])
+	default:
+		die(fmt.Sprintf(usage, os.Args[0], os.Args[0], os.Args[0]), nil)
+	}
+}
+
+func create(args []string) {
+	if len(args) < 2 {
+		die("create: missing <src> or <archive>", nil)
+	}
+
+	store, err := fs.NewReadOnlyStore(args[0], fs.NewMemRepo())
+	if err != nil {
+		die(fmt.Sprintf("Failed to read source %s", args[0]), err)
+	}
+
+	if len(args) < 3 {
+		err = archive.Create(args[1], store)
+	} else {
+		var volumes []string
+		volumes, err = archive.CreateVolumes(args[1], store, atoi64(args[2]))
+		for _, volume := range volumes {
+			fmt.Println(volume)
+		}
+	}
+	if err != nil {
+		die(fmt.Sprintf("Failed to create archive %s", args[1]), err)
+	}
+}
+
+func parity(args []string) {
+	if len(args) < 3 {
+		die("parity: missing <file>, <shard size> or <group size>", nil)
+	}
+
+	parityPath, err := archive.CreateParity(args[0], atoi64(args[1]), int(atoi64(args[2])))
+	if err != nil {
+		die(fmt.Sprintf("Failed to create parity for %s", args[0]), err)
+	}
+	fmt.Println(parityPath)
+}
+
+func repair(args []string) {
+	repaired, err := archive.Repair(args[0])
+	for _, shard := range repaired {
+		fmt.Printf("Repaired shard %d\n", shard)
+	}
+	if err != nil {
+		die(fmt.Sprintf("Failed to repair %s", args[0]), err)
+	}
+}
+
+func atoi64(s string) int64 {
+	n, err := strconv.Atoi64(s)
+	if err != nil {
+		die(fmt.Sprintf("Not a number: %s", s), err)
+	}
+	return n
+}
+
+func die(message string, err os.Error) {
+	if err == nil {
+		fmt.Fprintln(os.Stderr, message)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", message, err)
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"http"
+	"os"
+
+	"github.com/cmars/replican-sync/replican/remote"
+)
+
+// Run a caching proxy for a remote block server.
+func main() {
+	if len(os.Args) < 4 {
+		die(fmt.Sprintf("Usage: %s <listen addr> <origin url> <cache dir>", os.Args[0]), nil)
+	}
+
+	listenAddr := os.Args[1]
+	originUrl := os.Args[2]
+	cacheDir := os.Args[3]
+
+	proxy, err := remote.NewProxy(originUrl, cacheDir)
+	if err != nil {
+		die(fmt.Sprintf("Cannot use cache directory %s", cacheDir), err)
+	}
+
+	err = http.ListenAndServe(listenAddr, proxy)
+	if err != nil {
+		die(fmt.Sprintf("Cannot serve on %s", listenAddr), err)
+	}
+}
+
+func die(message string, err os.Error) {
+	if err == nil {
+		fmt.Fprintln(os.Stderr, message)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", message, err)
+	}
+	os.Exit(1)
+}